@@ -0,0 +1,100 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/audit"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
+)
+
+const auditRecordKey = "auditRecord"
+
+// auditor records the state, lock and admin requests, nil when auditing is
+// disabled
+var auditor *audit.Logger
+
+// newAuditor opens the audit log, committed through gitOps when configured
+func newAuditor(config *config.Config, gitOps *storage.GitOperations) *audit.Logger {
+	if !config.Audit.Enabled {
+		return nil
+	}
+	var committer audit.Committer
+	if gitOps != nil {
+		committer = gitOps
+	}
+	a, err := audit.New(config.Audit, config.Repo.RepoLocal.Path, committer, logger.GetZapLogger())
+	if err != nil {
+		logger.Fatalf("failed to initialize audit log: %v", err)
+	}
+	logger.Infof("audit log enabled at %s", config.Audit.Path)
+	return a
+}
+
+// auditMiddleware records the request once it is handled, the handlers add
+// the lock ID, serials and parameters they know of to auditRecord
+func auditMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if auditor == nil {
+			c.Next()
+			return
+		}
+		record := &audit.Record{
+			Time:      time.Now().UTC(),
+			Principal: principal(c),
+			ClientIP:  c.ClientIP(),
+			State:     c.Query("state"),
+			LockID:    c.Query("ID"),
+		}
+		c.Set(auditRecordKey, record)
+		c.Next()
+
+		record.RequestID = requestID(c)
+		record.Action = auditAction(c.Request.Method, c.FullPath())
+		record.Status = c.Writer.Status()
+		record.Outcome = audit.OutcomeSuccess
+		if record.Status >= http.StatusBadRequest {
+			record.Outcome = audit.OutcomeFailure
+		}
+		// only the kind, the message may quote the state
+		if err := c.Errors.Last(); err != nil {
+			record.Error = errs.KindOf(err.Err).String()
+		}
+		if err := auditor.Log(*record); err != nil {
+			logger.Errorf("failed to record audit log: %v", err)
+		}
+	}
+}
+
+// auditRecord returns the audit record of the request, nil when auditing is
+// disabled
+func auditRecord(c *gin.Context) *audit.Record {
+	record, _ := c.Get(auditRecordKey)
+	r, _ := record.(*audit.Record)
+	return r
+}
+
+func auditAction(method, route string) string {
+	switch method + " " + strings.TrimPrefix(route, "/v1") {
+	case "GET /local/state":
+		return "state.read"
+	case "POST /local/state":
+		return "state.write"
+	case "DELETE /local/state":
+		return "state.delete"
+	case "GET /local/state/changes":
+		return "state.changes"
+	case "LOCK /local/lock":
+		return "lock.acquire"
+	case "UNLOCK /local/unlock":
+		return "lock.release"
+	case "POST /admin/rekey":
+		return "admin.rekey"
+	}
+	return method + " " + route
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goccy/go-json"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/audit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAuditMiddleware(t *testing.T) {
+	config := newTestConfig(t)
+	config.Audit.Enabled = true
+	config.Audit.Path = filepath.Join(t.TempDir(), "audit.jsonl")
+	config.Server.Admin.Enabled = true
+	config.Server.Admin.Token = "secret"
+
+	a, err := audit.New(config.Audit, "", nil, zap.NewNop())
+	require.NoError(t, err)
+	auditor = a
+	t.Cleanup(func() { auditor = nil })
+
+	r := gin.New()
+	routerGroupV1Local(config, r.Group("/"), nil, newKeyring(config))
+	routerGroupV1Admin(config, r.Group("/"), nil)
+
+	for _, serial := range []string{"1", "2"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/local/state?state=env/prod.tfstate&ID=lock-1",
+			strings.NewReader(`{"version": 4, "serial": `+serial+`, "lineage": "abc", "outputs": {"password": {"value": "hunter2"}}}`))
+		req.SetBasicAuth("alice", "password")
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/local/state?state=env/missing.tfstate", nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/local/state?state=env/prod.tfstate", nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/rekey?dryRun=true", nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	require.NoError(t, auditor.Close(context.Background()))
+	data, err := os.ReadFile(config.Audit.Path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "hunter2")
+
+	var records []audit.Record
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		var record audit.Record
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.Len(t, records, 5)
+
+	assert.Equal(t, "state.write", records[0].Action)
+	assert.Equal(t, "alice", records[0].Principal)
+	assert.Equal(t, "env/prod.tfstate", records[0].State)
+	assert.Equal(t, "lock-1", records[0].LockID)
+	assert.Nil(t, records[0].SerialBefore)
+	require.NotNil(t, records[0].SerialAfter)
+	assert.Equal(t, uint64(1), *records[0].SerialAfter)
+	assert.Equal(t, audit.OutcomeSuccess, records[0].Outcome)
+	assert.NotEmpty(t, records[0].RequestID)
+
+	require.NotNil(t, records[1].SerialBefore)
+	assert.Equal(t, uint64(1), *records[1].SerialBefore)
+	assert.Equal(t, uint64(2), *records[1].SerialAfter)
+
+	assert.Equal(t, "state.read", records[2].Action)
+	assert.Equal(t, audit.OutcomeFailure, records[2].Outcome)
+	assert.Equal(t, http.StatusNotFound, records[2].Status)
+	assert.Equal(t, "not_found", records[2].Error)
+
+	assert.Equal(t, "state.delete", records[3].Action)
+	assert.Equal(t, "env/prod.tfstate", records[3].State)
+	require.NotNil(t, records[3].SerialBefore)
+	assert.Equal(t, uint64(2), *records[3].SerialBefore)
+	assert.Nil(t, records[3].SerialAfter)
+
+	assert.Equal(t, "admin.rekey", records[4].Action)
+	assert.Equal(t, http.StatusUnauthorized, records[4].Status)
+	assert.Empty(t, records[4].Principal)
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/sidecar"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/tfstate"
+)
+
+const defaultMaxBodySize int64 = 100 << 20 // 100 MiB
+
+// errValidationAborted stops the JSON validator when the body was not read to
+// the end, e.g. because the encryption failed
+var errValidationAborted = errors.New("validation aborted")
+
+// limitBody rejects request bodies larger than maxBodySize bytes with 413
+func limitBody(maxBodySize int64) gin.HandlerFunc {
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > maxBodySize {
+			abortWithError(c, errs.Errorf(errs.KindTooLarge, "app.limitBody", "request body is larger than %d bytes", maxBodySize))
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBodySize)
+		c.Next()
+	}
+}
+
+// bodyError classifies an error returned while reading the request body
+func bodyError(op string, err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errs.Errorf(errs.KindTooLarge, op, "request body is larger than %d bytes", tooLarge.Limit)
+	}
+	return errs.E(errs.KindBadRequest, op, fmt.Errorf("failed to read request body: %w", err))
+}
+
+// jsonStream passes the request body through to the encryption while a
+// decoder checks in the background that it is a single valid JSON value, so
+// the state never has to be held in memory. The body is hashed and its state
+// metadata collected on the way.
+type jsonStream struct {
+	body   io.Reader
+	pw     *io.PipeWriter
+	eof    bool
+	done   chan error
+	digest *sidecar.DigestWriter
+	// state is set by a successful Close
+	state *tfstate.State
+}
+
+func newJSONStream(body io.Reader) *jsonStream {
+	pr, pw := io.Pipe()
+	s := &jsonStream{body: body, pw: pw, done: make(chan error, 1), digest: sidecar.NewDigestWriter()}
+	go func() {
+		state, err := validateJSON(pr)
+		// unblocks the writer when the body is invalid before its end
+		pr.CloseWithError(err)
+		s.state = state
+		s.done <- err
+	}()
+	return s
+}
+
+func (s *jsonStream) Read(p []byte) (int, error) {
+	n, err := s.body.Read(p)
+	if n > 0 {
+		s.digest.Write(p[:n])
+		if _, werr := s.pw.Write(p[:n]); werr != nil {
+			return n, werr
+		}
+	}
+	if err == io.EOF {
+		s.eof = true
+	} else if err != nil {
+		err = bodyError("app.apply", err)
+	}
+	return n, err
+}
+
+// Close stops the validation and returns its result. A body that was not
+// read to the end is only reported when it already turned out invalid.
+func (s *jsonStream) Close() error {
+	if s.eof {
+		s.pw.Close()
+	} else {
+		s.pw.CloseWithError(errValidationAborted)
+	}
+	err := <-s.done
+	if errors.Is(err, errValidationAborted) {
+		return nil
+	}
+	return err
+}
+
+// validateJSON checks r is a single valid JSON value and returns its state
+// metadata
+func validateJSON(r io.Reader) (*tfstate.State, error) {
+	state, err := tfstate.Parse(r)
+	if errors.Is(err, errValidationAborted) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errs.E(errs.KindBadRequest, "app.validateJSON", fmt.Errorf("request body is not valid JSON: %w", err))
+	}
+	return state, nil
+}
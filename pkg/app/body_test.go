@@ -0,0 +1,46 @@
+package app
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONStream(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		valid bool
+	}{
+		{"object", `{"serial": 1, "resources": [{"a": null}]}`, true},
+		{"trailing whitespace", "{\"serial\": 1}\n\n", true},
+		{"large state", `{"data": "` + strings.Repeat("x", 1<<20) + `"}`, true},
+		{"empty", ``, false},
+		{"truncated", `{"serial": 1, "resources": [`, false},
+		{"missing colon", `{"serial" 1}`, false},
+		{"trailing data", `{"serial": 1} {"serial": 2}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newJSONStream(strings.NewReader(tt.body))
+			_, copyErr := io.Copy(io.Discard, s)
+			err := s.Close()
+			if tt.valid {
+				assert.NoError(t, copyErr)
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errs.Is(err, errs.KindBadRequest), "got %v", err)
+		})
+	}
+}
+
+func TestJSONStream_NotReadToTheEnd(t *testing.T) {
+	s := newJSONStream(strings.NewReader(`{"serial": 1}`))
+	// the encryption failed before reading, that is not a validation error
+	assert.NoError(t, s.Close())
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goccy/go-json"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/tfstate"
+)
+
+// changesSuffix names the plaintext sidecar keeping the resource-level
+// changes of the recent writes of a state
+const changesSuffix = ".changes.json"
+
+// defaultChangesHistory is the number of writes kept in the changes sidecar
+// when repo.local.changesHistory is not set
+const defaultChangesHistory = 100
+
+func changesPath(statePath string) string {
+	return statePath + changesSuffix
+}
+
+// stateChange is the diff of a write against the version it replaced. Like
+// the metadata sidecar it never contains attribute or output values.
+type stateChange struct {
+	Serial         uint64          `json:"serial"`
+	PreviousSerial *uint64         `json:"previous_serial,omitempty"`
+	Lineage        string          `json:"lineage"`
+	Time           time.Time       `json:"time"`
+	Changes        tfstate.Changes `json:"changes"`
+}
+
+func newStateChange(previous, state *tfstate.State, changes tfstate.Changes) stateChange {
+	change := stateChange{
+		Serial:  state.Serial,
+		Lineage: state.Lineage,
+		Time:    time.Now().UTC(),
+		Changes: changes,
+	}
+	if previous != nil {
+		change.PreviousSerial = &previous.Serial
+	}
+	return change
+}
+
+// readChanges returns the changes recorded for a state, oldest first
+func readChanges(statePath string) ([]stateChange, error) {
+	data, err := os.ReadFile(changesPath(statePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errs.E(errs.KindStorage, "app.readChanges", fmt.Errorf("failed to read changes: %w", err))
+	}
+	var changes []stateChange
+	if err := json.Unmarshal(data, &changes); err != nil {
+		return nil, errs.E(errs.KindStorage, "app.readChanges", fmt.Errorf("invalid changes file: %w", err))
+	}
+	return changes, nil
+}
+
+// appendChanges returns the recorded changes followed by change, keeping the
+// most recent repo.local.changesHistory entries
+func appendChanges(config *config.Config, statePath string, change stateChange) ([]stateChange, error) {
+	changes, err := readChanges(statePath)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, change)
+
+	history := config.Repo.RepoLocal.ChangesHistory
+	if history <= 0 {
+		history = defaultChangesHistory
+	}
+	if len(changes) > history {
+		changes = changes[len(changes)-history:]
+	}
+	return changes, nil
+}
+
+func writeChanges(w io.Writer, changes []stateChange) error {
+	data, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// changesHandler returns the changes of the write of a state version, the
+// serial given by the version parameter, or of the latest write
+func changesHandler(config *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		const op = "app.changes"
+		relativeStatePath := c.Query("state")
+		statePath, err := resolveStatePath(config, relativeStatePath)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		var serial uint64
+		version := c.Query("version")
+		if version != "" {
+			if serial, err = strconv.ParseUint(version, 10, 64); err != nil {
+				abortWithError(c, errs.Errorf(errs.KindBadRequest, op, "invalid version '%s', expected a state serial", version))
+				return
+			}
+		}
+
+		changes, err := readChanges(statePath)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		// the latest write of a serial wins, e.g. after a new lineage
+		for i := len(changes) - 1; i >= 0; i-- {
+			if version == "" || changes[i].Serial == serial {
+				c.JSON(http.StatusOK, gin.H{
+					"state":  relativeStatePath,
+					"change": changes[i],
+				})
+				return
+			}
+		}
+		if version == "" {
+			abortWithError(c, errs.Errorf(errs.KindNotFound, op, "no changes recorded for %s", relativeStatePath))
+			return
+		}
+		abortWithError(c, errs.Errorf(errs.KindNotFound, op, "no changes recorded for %s version %s", relativeStatePath, version))
+	}
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/commitmsg"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/encryptions"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/sidecar"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/tfstate"
+)
+
+// previousState returns the metadata of the state about to be replaced, nil
+// when there is none yet
+func previousState(keyring *encryptions.Keyring, statePath string) (*tfstate.State, error) {
+	if keyring == nil {
+		return nil, errs.Errorf(errs.KindEncryption, "app.previousState", "no age identities loaded, can not decrypt state")
+	}
+	plaintext, err := encryptions.OpenState(keyring.Identities(), statePath)
+	if errs.Is(err, errs.KindNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer plaintext.Close()
+
+	state, err := tfstate.Parse(plaintext)
+	if err != nil {
+		return nil, errs.E(errs.KindEncryption, "app.previousState", fmt.Errorf("failed to read state: %w", err))
+	}
+	return state, nil
+}
+
+// principal returns the user authenticated by the request. Terraform sends
+// the username and password of the http backend as basic auth.
+func principal(c *gin.Context) string {
+	username, _, _ := c.Request.BasicAuth()
+	return username
+}
+
+func newCommitData(relativeStatePath string, state *tfstate.State, changes tfstate.Changes, writer sidecar.Writer, principal string) commitmsg.Data {
+	return commitmsg.Data{
+		Path:             relativeStatePath,
+		Serial:           state.Serial,
+		Lineage:          state.Lineage,
+		TerraformVersion: state.TerraformVersion,
+		Lock: commitmsg.Lock{
+			Who:       writer.Who,
+			Operation: writer.Operation,
+			ID:        writer.LockID,
+		},
+		Principal: principal,
+		Added:     len(changes.Added),
+		Changed:   len(changes.Changed),
+		Removed:   len(changes.Removed),
+		Changes:   changes,
+	}
+}
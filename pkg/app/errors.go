@@ -0,0 +1,97 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/lock"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "requestId"
+)
+
+// requestIDMiddleware propagates the X-Request-ID header or generates one
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" {
+			id = uuid.New().String()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+func requestID(c *gin.Context) string {
+	if id := c.GetString(requestIDKey); id != "" {
+		return id
+	}
+	id := uuid.New().String()
+	c.Set(requestIDKey, id)
+	c.Header(requestIDHeader, id)
+	return id
+}
+
+// httpStatus maps an error kind to its HTTP status code
+func httpStatus(kind errs.Kind) int {
+	switch kind {
+	case errs.KindNotFound:
+		return http.StatusNotFound
+	case errs.KindConflict:
+		return http.StatusConflict
+	case errs.KindLocked:
+		return http.StatusLocked
+	case errs.KindBadRequest:
+		return http.StatusBadRequest
+	case errs.KindTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errs.KindGitSync:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// abortWithError aborts the request with the status code of the error kind
+// and a JSON error body. Locked states answer with the current lock info, the
+// body Terraform expects to report who holds the lock.
+func abortWithError(c *gin.Context, err error) {
+	kind := errs.KindOf(err)
+	status := httpStatus(kind)
+	id := requestID(c)
+
+	fields := []zap.Field{
+		zap.Error(err),
+		zap.String("kind", kind.String()),
+		zap.Int("status", status),
+		zap.String("requestId", id),
+	}
+	if status >= http.StatusInternalServerError {
+		logger.Error("request failed", fields...)
+	} else {
+		logger.Warn("request failed", fields...)
+	}
+	//nolint:errcheck
+	c.Error(err)
+
+	var locked *lock.LockedError
+	if kind == errs.KindLocked && errors.As(err, &locked) {
+		c.AbortWithStatusJSON(status, locked.Info)
+		return
+	}
+
+	c.AbortWithStatusJSON(status, gin.H{
+		"message":   http.StatusText(status),
+		"status":    kind.String(),
+		"error":     err.Error(),
+		"requestId": id,
+	})
+}
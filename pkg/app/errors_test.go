@@ -0,0 +1,85 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goccy/go-json"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/lock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAbortWithError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		kind   string
+	}{
+		{"not found", errs.Errorf(errs.KindNotFound, "test", "missing"), http.StatusNotFound, "not_found"},
+		{"bad request", errs.Errorf(errs.KindBadRequest, "test", "invalid"), http.StatusBadRequest, "bad_request"},
+		{"conflict", errs.Errorf(errs.KindConflict, "test", "conflict"), http.StatusConflict, "conflict"},
+		{"encryption", fmt.Errorf("wrapped: %w", errs.Errorf(errs.KindEncryption, "test", "no key")), http.StatusInternalServerError, "encryption_failure"},
+		{"git sync", errs.Errorf(errs.KindGitSync, "test", "push failed"), http.StatusBadGateway, "git_sync_failure"},
+		{"untyped", fmt.Errorf("boom"), http.StatusInternalServerError, "internal_error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(requestIDMiddleware())
+			r.GET("/", func(c *gin.Context) {
+				abortWithError(c, tt.err)
+			})
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.Header.Set(requestIDHeader, "req-123")
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.status, w.Code)
+			var body map[string]string
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tt.kind, body["status"])
+			assert.Equal(t, "req-123", body["requestId"])
+			assert.Equal(t, tt.err.Error(), body["error"])
+			assert.Equal(t, "req-123", w.Header().Get(requestIDHeader))
+		})
+	}
+}
+
+func TestAbortWithError_Locked(t *testing.T) {
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) {
+		abortWithError(c, errs.E(errs.KindLocked, "test", &lock.LockedError{Info: &lock.LockInfo{ID: "abc", Who: "alice@laptop"}}))
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusLocked, w.Code)
+	var info lock.LockInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, "abc", info.ID)
+	assert.Equal(t, "alice@laptop", info.Who)
+	assert.NotEmpty(t, w.Header().Get(requestIDHeader))
+}
+
+func TestGetHandler_InvalidStatePath(t *testing.T) {
+	r := gin.New()
+	routerGroupV1Local(&config.Config{}, r.Group("/"), nil, nil)
+
+	for _, path := range []string{"/local/state", "/local/state?state=../outside.tfstate"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+}
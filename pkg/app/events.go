@@ -0,0 +1,99 @@
+package app
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/events"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
+)
+
+const defaultEventsKeepAlive = 15 * time.Second
+
+// eventBroker streams the events on /v1/events, nil when the stream is
+// disabled
+var eventBroker *events.Broker
+
+// newEventBroker fans the events out through the Redis server of the locks,
+// pushes are sent as git.sync
+func newEventBroker(config *config.Config, gitOps *storage.GitOperations) *events.Broker {
+	if !config.Server.Events.Enabled {
+		return nil
+	}
+	var pool *redis.Pool
+	if Locker != nil && len(config.Redis.Addresses) > 0 {
+		pool = Locker.Pool()
+		logger.Infof("sharing events with the other replicas on redis channel %s", config.Server.Events.Channel)
+	}
+	broker := events.New(pool, config.Server.Events.Channel, logger.GetZapLogger())
+	if gitOps != nil {
+		gitOps.OnPush(func(remote string, err error) {
+			data := gin.H{"remote": remote, "success": err == nil}
+			if err != nil {
+				data["error"] = err.Error()
+			}
+			broker.Publish(events.GitSync, "", data)
+		})
+	}
+	return broker
+}
+
+// streamEvent sends the event to the stream when it is enabled
+func streamEvent(eventType, state string, data any) {
+	if eventBroker != nil {
+		eventBroker.Publish(eventType, state, data)
+	}
+}
+
+// CloseEvents ends the open event streams, which would otherwise keep the
+// server from shutting down
+func CloseEvents() {
+	if eventBroker != nil {
+		eventBroker.Close()
+	}
+}
+
+// eventsHandler streams the events of the states under the prefix query
+// parameter as server-sent events, git events are always sent
+func eventsHandler(config *config.Config) gin.HandlerFunc {
+	keepAlive := time.Duration(config.Server.Events.KeepAlive) * time.Second
+	if keepAlive <= 0 {
+		keepAlive = defaultEventsKeepAlive
+	}
+
+	return func(c *gin.Context) {
+		subscription := eventBroker.Subscribe(c.Query("prefix"))
+		defer subscription.Close()
+		ticker := time.NewTicker(keepAlive)
+		defer ticker.Stop()
+
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Header("Content-Type", "text/event-stream")
+		// the client knows it is subscribed once it gets the headers
+		c.Status(http.StatusOK)
+		c.Writer.WriteHeaderNow()
+		c.Writer.Flush()
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event, ok := <-subscription.C:
+				if !ok {
+					return false
+				}
+				c.Render(-1, sse.Event{Id: event.ID, Event: event.Type, Data: event})
+				return true
+			case <-ticker.C:
+				_, err := io.WriteString(w, ":keepalive\n\n")
+				return err == nil
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	}
+}
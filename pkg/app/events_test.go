@@ -0,0 +1,92 @@
+package app
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goccy/go-json"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestEventsHandler(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Server.Events.Enabled = true
+	eventBroker = events.New(nil, "", zap.NewNop())
+	t.Cleanup(func() {
+		CloseEvents()
+		eventBroker = nil
+	})
+
+	r := gin.New()
+	routerGroupV1Local(cfg, r.Group("/"), nil, newKeyring(cfg))
+	r.GET("/events", eventsHandler(cfg))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events?prefix=env/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// the stream is subscribed once the headers are sent
+	eventBroker.Publish(events.GitSync, "", nil)
+	for _, statePath := range []string{"other/prod.tfstate", "env/prod.tfstate"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/local/state?state="+statePath,
+			strings.NewReader(`{"version": 4, "serial": 3, "lineage": "abc"}`))
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	next := func() (string, events.Event) {
+		var name string
+		var event events.Event
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case strings.HasPrefix(line, "event:"):
+				name = line[len("event:"):]
+			case strings.HasPrefix(line, "data:"):
+				require.NoError(t, json.Unmarshal([]byte(line[len("data:"):]), &event))
+			case line == "" && name != "":
+				return name, event
+			}
+		}
+	}
+
+	name, _ := next()
+	assert.Equal(t, events.GitSync, name)
+	name, event := next()
+	assert.Equal(t, events.StateWritten, name)
+	assert.Equal(t, "env/prod.tfstate", event.State)
+	data, _ := json.Marshal(event.Data)
+	assert.Contains(t, string(data), `"serial":3`)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/local/state?state=env/prod.tfstate", nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	name, event = next()
+	assert.Equal(t, events.StateDeleted, name)
+	assert.Equal(t, "env/prod.tfstate", event.State)
+	data, _ = json.Marshal(event.Data)
+	assert.Contains(t, string(data), `"serial":3`)
+
+	// closing the broker ends the stream
+	CloseEvents()
+	_, err = reader.ReadString('\n')
+	for err == nil {
+		_, err = reader.ReadString('\n')
+	}
+}
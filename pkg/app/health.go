@@ -0,0 +1,134 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"filippo.io/age"
+	"github.com/gin-gonic/gin"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/audit"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/encryptions"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/health"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
+)
+
+const defaultRemoteCheckTimeout = 10 * time.Second
+
+// healthProbe is the plaintext of the encryption round trip, a valid state
+// for the structured format
+var healthProbe = []byte(`{"version":4,"serial":0,"lineage":"readyz"}`)
+
+// healthChecks are the dependency checks of /readyz, set up with the v1
+// routes
+var healthChecks []health.Check
+
+// newHealthChecks returns the checks of the configured dependencies
+func newHealthChecks(config *config.Config, gitOps *storage.GitOperations, keyring *encryptions.Keyring) []health.Check {
+	timeout := time.Duration(config.Server.Health.Timeout) * time.Second
+	// the probe is unauthenticated, it must not parse the identities again
+	recipients, recipientsErr := encryptions.LoadRecipients(config.Encryptions.Age)
+	checks := []health.Check{{
+		Name:    "encryption",
+		Timeout: timeout,
+		Run: func(context.Context) error {
+			if recipientsErr != nil {
+				return recipientsErr
+			}
+			return checkEncryption(config, recipients, keyring)
+		},
+	}}
+
+	if len(config.Redis.Addresses) > 0 {
+		checks = append(checks, health.Check{
+			Name:    "redis",
+			Timeout: timeout,
+			Run: func(ctx context.Context) error {
+				if Locker == nil {
+					return errors.New("lock backend is not initialized")
+				}
+				return Locker.Ping(ctx)
+			},
+		})
+	}
+
+	if config.Repo.Remote.Enabled {
+		// the audit records are committed in batches
+		var ignoredDirs []string
+		if config.Audit.Enabled && config.Audit.Commit {
+			ignoredDirs = append(ignoredDirs, audit.Dir)
+		}
+		checks = append(checks, health.Check{
+			Name:    "git",
+			Timeout: timeout,
+			Run: func(ctx context.Context) error {
+				if gitOps == nil {
+					return errors.New("git operations failed to initialize")
+				}
+				return gitOps.CheckWorktree(ctx, storage.BackupDir(config), ignoredDirs...)
+			},
+		})
+
+		if config.Server.Health.Remote {
+			remoteTimeout := time.Duration(config.Server.Health.RemoteTimeout) * time.Second
+			if remoteTimeout <= 0 {
+				remoteTimeout = defaultRemoteCheckTimeout
+			}
+			checks = append(checks, health.Check{
+				Name:    "git-remote",
+				Timeout: remoteTimeout,
+				Run: func(ctx context.Context) error {
+					if gitOps == nil {
+						return errors.New("git operations failed to initialize")
+					}
+					return gitOps.CheckRemote(ctx)
+				},
+			})
+		}
+	}
+	return checks
+}
+
+// checkEncryption checks that the identity files still exist, then encrypts
+// a probe to the recipients and decrypts it with the cached identities
+func checkEncryption(config *config.Config, recipients []age.Recipient, keyring *encryptions.Keyring) error {
+	if keyring == nil {
+		return errors.New("no age identities loaded")
+	}
+	if err := keyring.CheckFiles(); err != nil {
+		return err
+	}
+
+	var encrypted bytes.Buffer
+	opts := encryptions.EncryptOptions{
+		Format:      encryptions.FormatBinary,
+		Compression: config.Encryptions.Age.Compression,
+	}
+	if err := encryptions.AgeEncrypt(recipients, bytes.NewReader(healthProbe), &encrypted, opts); err != nil {
+		return err
+	}
+	decrypted, err := encryptions.Decrypt(keyring.Identities(), encrypted.Bytes())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(decrypted, healthProbe) {
+		return fmt.Errorf("decrypted probe does not match")
+	}
+	return nil
+}
+
+// readyzHandler answers 503 when a dependency check fails
+func readyzHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := health.Run(c.Request.Context(), healthChecks)
+		status := http.StatusOK
+		if !report.OK() {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, report)
+	}
+}
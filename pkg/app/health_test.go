@@ -0,0 +1,64 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goccy/go-json"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/health"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/lock/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadyz(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Encryptions.Age.Compression = "zstd"
+	t.Cleanup(func() {
+		healthChecks = nil
+		Locker = nil
+	})
+
+	r := gin.New()
+	r.GET("/readyz", readyzHandler())
+	get := func() (int, health.Report) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		r.ServeHTTP(w, req)
+		var report health.Report
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		return w.Code, report
+	}
+
+	healthChecks = newHealthChecks(cfg, nil, newKeyring(cfg))
+	code, report := get()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusOK, report.Status)
+	require.Len(t, report.Checks, 1)
+	assert.Equal(t, "encryption", report.Checks[0].Name)
+	assert.Equal(t, health.StatusOK, report.Checks[0].Status)
+
+	// unreachable Redis, git that failed to initialize and a missing key file
+	cfg.Redis.Addresses = []string{"127.0.0.1:1"}
+	cfg.Repo.Remote.Enabled = true
+	Locker = redis.NewRedisLock(cfg)
+	healthChecks = newHealthChecks(cfg, nil, newKeyring(cfg))
+	require.NoError(t, os.Remove(cfg.Encryptions.Age.AgePrivateKeyPath))
+
+	code, report = get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, health.StatusUnavailable, report.Status)
+	statuses := map[string]string{}
+	for _, check := range report.Checks {
+		statuses[check.Name] = check.Status
+		assert.NotEmpty(t, check.Error, check.Name)
+	}
+	assert.Equal(t, map[string]string{
+		"encryption": health.StatusFailed,
+		"redis":      health.StatusFailed,
+		"git":        health.StatusFailed,
+	}, statuses)
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/sidecar"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
+)
+
+// checksumFresh reports whether the stored sums can be trusted for the state
+// file as it is: they were stored for an encrypted state of its size, and
+// not before the state was last replaced, e.g. by a git pull or a rekey
+func checksumFresh(statePath string, stored *sidecar.Digest, state fs.FileInfo) bool {
+	if stored == nil || stored.MD5 == nil {
+		return false
+	}
+	if stored.EncryptedSize != 0 && stored.EncryptedSize != state.Size() {
+		return false
+	}
+	info, err := os.Stat(sidecar.ChecksumPath(statePath))
+	return err == nil && !info.ModTime().Before(state.ModTime())
+}
+
+// refreshChecksum updates a stale checksum with the sums measured on the
+// state file, unless the state was replaced meanwhile. A checksum whose sums
+// still match is only touched, the committed sidecar is left as it is.
+func refreshChecksum(statePath string, state fs.FileInfo, stored *sidecar.Digest, sums sidecar.Digest) error {
+	current, err := os.Stat(statePath)
+	if err != nil || !os.SameFile(current, state) {
+		return err
+	}
+	if stored != nil && stored.Matches(sums) {
+		now := time.Now()
+		return os.Chtimes(sidecar.ChecksumPath(statePath), now, now)
+	}
+	return storage.WriteFileAtomic(sidecar.ChecksumPath(statePath), 0644, func(w io.Writer) error {
+		return sidecar.WriteChecksum(w, statePath, sums)
+	})
+}
+
+// stateETag is the strong entity tag of a state, its quoted plaintext SHA-256
+func stateETag(sha256Hex string) string {
+	return `"` + sha256Hex + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches the entity tag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyContentMD5 compares the Content-MD5 request header, when sent, with
+// the MD5 of the received body
+func verifyContentMD5(header string, sum []byte) error {
+	if header == "" {
+		return nil
+	}
+	expected, err := base64.StdEncoding.DecodeString(header)
+	if err != nil || len(expected) != md5.Size {
+		return errs.Errorf(errs.KindBadRequest, "app.verifyContentMD5", "malformed Content-MD5 header %q", header)
+	}
+	if !bytes.Equal(expected, sum) {
+		return errs.Errorf(errs.KindBadRequest, "app.verifyContentMD5", "Content-MD5 mismatch: header %s, body %s",
+			header, base64.StdEncoding.EncodeToString(sum))
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/sidecar"
+)
+
+// lastWriter returns the writer of the current request. Terraform sends the
+// ID of the lock it holds as the ID query parameter, the lock tells who and
+// which operation is writing.
+func lastWriter(c *gin.Context, config *config.Config, relativeStatePath string) sidecar.Writer {
+	writer := sidecar.Writer{
+		LockID:   c.Query("ID"),
+		ClientIP: c.ClientIP(),
+		Time:     time.Now().UTC(),
+	}
+	if Locker == nil || len(config.Redis.Addresses) == 0 {
+		return writer
+	}
+
+	info, err := Locker.GetLock(c.Request.Context(), relativeStatePath)
+	if err != nil {
+		if !errs.Is(err, errs.KindNotFound) {
+			logger.Warnf("failed to get lock of %s: %v", relativeStatePath, err)
+		}
+		return writer
+	}
+	writer.Who = info.Who
+	writer.Operation = info.Operation
+	if writer.LockID == "" {
+		writer.LockID = info.ID
+	}
+	return writer
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/metrics"
+)
+
+const metricsPath = "/metrics"
+
+// metricsMiddleware records the count and latency of every request by route
+// pattern, requests matching no route share the "unmatched" route
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.ObserveRequest(route, c.Request.Method, strconv.Itoa(c.Writer.Status()), time.Since(start))
+	}
+}
+
+// StartMetricsServer serves /metrics on server.metrics.address in the
+// background, the metrics are served by the main router when no address is
+// configured
+func StartMetricsServer(config *config.Config) {
+	if !config.Server.Metrics.Enabled || config.Server.Metrics.Address == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, metrics.Handler())
+	server := &http.Server{
+		Addr:              config.Server.Metrics.Address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		logger.Infof("serving metrics on %s%s", config.Server.Metrics.Address, metricsPath)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatalf("metrics server failed: %v", err)
+		}
+	}()
+}
@@ -21,6 +21,22 @@ func TestNewAppHealthz(t *testing.T) {
 	assert.Equal(t, "{\"status\":\"ok\"}", w.Body.String())
 }
 
+func TestNewAppHealthzVerbose(t *testing.T) {
+	router := NewApp(config.NewDefaultConfig())
+
+	// liveness stays ok, the checks fail without any age key
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz?verbose", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.MatchRegex(t, w.Body.String(), `^\{"status":"unavailable","checks":\[\{"name":"encryption","status":"failed",`)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 503, w.Code)
+}
+
 func TestNewAppVersion(t *testing.T) {
 	router := NewApp(config.NewDefaultConfig())
 
@@ -31,3 +47,22 @@ func TestNewAppVersion(t *testing.T) {
 	assert.Equal(t, 200, w.Code)
 	assert.MatchRegex(t, w.Body.String(), `{"build":".*","commit":".*","version":".*"}`)
 }
+
+func TestNewAppMetrics(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	cfg.Server.Metrics.Enabled = true
+	router := NewApp(cfg)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/version", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.MatchRegex(t, w.Body.String(), `tbg_http_requests_total\{method="GET",route="/version",status="200"\} \d+`)
+	assert.MatchRegex(t, w.Body.String(), `tbg_redis_pool_active_connections \d+`)
+}
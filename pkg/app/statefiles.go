@@ -0,0 +1,100 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
+)
+
+// stateFiles tracks the files written or removed for one state (the state
+// and its sidecars) so they are committed, rolled back or kept together
+type stateFiles struct {
+	root      string
+	backupDir string
+	paths     []string
+	backups   []*storage.Backup
+}
+
+func newStateFiles(root, backupDir string) *stateFiles {
+	return &stateFiles{root: root, backupDir: backupDir}
+}
+
+// write replaces a file atomically, keeping its previous version until the
+// commit is confirmed
+func (f *stateFiles) write(path string, write func(w io.Writer) error) error {
+	relativePath, err := filepath.Rel(f.root, path)
+	if err != nil {
+		return errs.E(errs.KindStorage, "app.stateFiles.write", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return errs.E(errs.KindStorage, "app.stateFiles.write", fmt.Errorf("failed to create state directory: %w", err))
+	}
+
+	backup, err := storage.BackupFile(path, filepath.Join(f.backupDir, relativePath))
+	if err != nil {
+		return err
+	}
+	if err := storage.WriteFileAtomic(path, 0644, write); err != nil {
+		if discardErr := backup.Discard(); discardErr != nil {
+			logger.Warnf("failed to remove backup of %s: %v", relativePath, discardErr)
+		}
+		return err
+	}
+
+	f.paths = append(f.paths, filepath.ToSlash(relativePath))
+	f.backups = append(f.backups, backup)
+	return nil
+}
+
+// remove deletes a file, keeping its previous version until the commit is
+// confirmed. A file that does not exist is skipped.
+func (f *stateFiles) remove(path string) error {
+	relativePath, err := filepath.Rel(f.root, path)
+	if err != nil {
+		return errs.E(errs.KindStorage, "app.stateFiles.remove", err)
+	}
+	backup, err := storage.BackupFile(path, filepath.Join(f.backupDir, relativePath))
+	if err != nil || backup == nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if discardErr := backup.Discard(); discardErr != nil {
+			logger.Warnf("failed to remove backup of %s: %v", relativePath, discardErr)
+		}
+		return errs.E(errs.KindStorage, "app.stateFiles.remove", fmt.Errorf("failed to remove %s: %w", relativePath, err))
+	}
+
+	f.paths = append(f.paths, filepath.ToSlash(relativePath))
+	f.backups = append(f.backups, backup)
+	return nil
+}
+
+// restore rolls the written and removed files back to their previous version
+func (f *stateFiles) restore() {
+	for i, backup := range f.backups {
+		if backup == nil {
+			// the file did not exist before, it is not committed either
+			if err := os.Remove(filepath.Join(f.root, filepath.FromSlash(f.paths[i]))); err != nil {
+				logger.Errorf("failed to remove uncommitted %s: %v", f.paths[i], err)
+			}
+			continue
+		}
+		if err := backup.Restore(); err != nil {
+			logger.Errorf("failed to restore the previous version of %s: %v", f.paths[i], err)
+		}
+	}
+}
+
+// discard drops the backups once the files are committed
+func (f *stateFiles) discard() {
+	for i, backup := range f.backups {
+		if err := backup.Discard(); err != nil {
+			logger.Warnf("failed to remove backup of %s: %v", f.paths[i], err)
+		}
+	}
+}
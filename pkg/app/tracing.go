@@ -0,0 +1,190 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	stdout "go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+)
+
+const defaultServiceName = "terraform-backend-gitops"
+
+// tracerProvider exports the spans until Shutdown, nil when tracing is
+// disabled
+var tracerProvider *sdktrace.TracerProvider
+
+func initTracer(ctx context.Context, config *config.Config) (*sdktrace.TracerProvider, error) {
+	exporter, err := newExporter(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	res, err := newResource(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracing resource: %w", err)
+	}
+
+	// Set sdktrace.Sampler dynamically based on config
+	sampler := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.Tracing.SampleRate))
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	// export failures would be silent otherwise
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warnf("opentelemetry: %v", err)
+	}))
+	return tp, nil
+}
+
+func newExporter(ctx context.Context, config *config.Config) (sdktrace.SpanExporter, error) {
+	otlp := config.Tracing.OTLP
+	headers := map[string]string{}
+	for key, value := range otlp.Headers {
+		headers[key] = os.ExpandEnv(value)
+	}
+	timeout := time.Duration(otlp.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	switch config.Tracing.Provider {
+	case "stdout":
+		// local exporter to stdout logs
+		exporter, err := stdout.New(stdout.WithPrettyPrint())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout exporter: %w", err)
+		}
+		return exporter, nil
+	case "otlptracehttp":
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(otlp.Endpoint),
+			otlptracehttp.WithHeaders(headers),
+			otlptracehttp.WithTimeout(timeout),
+		}
+		if otlp.TLS.Enabled {
+			tlsConfig, err := otlpTLSConfig(otlp.TLS)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(tlsConfig))
+		} else {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create otlptracehttp exporter: %w, make sure to configure correct tracing.otlp.endpoint", err)
+		}
+		logger.Info("OTLP exporter created", zap.String("endpoint", otlp.Endpoint), zap.Bool("tls", otlp.TLS.Enabled))
+		return exporter, nil
+	case "otlptracegrpc":
+		opts := []otlptracegrpc.Option{
+			otlptracegrpc.WithEndpoint(otlp.Endpoint),
+			otlptracegrpc.WithHeaders(headers),
+			otlptracegrpc.WithTimeout(timeout),
+		}
+		if otlp.TLS.Enabled {
+			tlsConfig, err := otlpTLSConfig(otlp.TLS)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+		} else {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err := otlptracegrpc.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create otlptracegrpc exporter: %w, make sure to configure correct tracing.otlp.endpoint", err)
+		}
+		logger.Info("OTLP exporter created", zap.String("endpoint", otlp.Endpoint), zap.Bool("tls", otlp.TLS.Enabled))
+		return exporter, nil
+	default:
+		return nil, fmt.Errorf("unsupported tracing provider: %s", config.Tracing.Provider)
+	}
+}
+
+func otlpTLSConfig(cfg config.OTLPTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify, //nolint:gosec // opt-in for self-signed collectors
+	}
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(os.ExpandEnv(cfg.CAFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tracing.otlp.tls.caFile: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("tracing.otlp.tls.caFile has no PEM certificate")
+		}
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(os.ExpandEnv(cfg.CertFile), os.ExpandEnv(cfg.KeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tracing.otlp.tls client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// newResource describes the service on every span
+func newResource(config *config.Config) (*resource.Resource, error) {
+	serviceName := config.Tracing.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("service.name", serviceName),
+	}
+	if config.Build.Version != "" {
+		attrs = append(attrs, attribute.String("service.version", config.Build.Version))
+	}
+	if config.Tracing.Environment != "" {
+		attrs = append(attrs, attribute.String("deployment.environment", config.Tracing.Environment))
+	}
+	for _, attr := range config.Tracing.ResourceAttributes {
+		if attr.Key == "" {
+			return nil, errors.New("tracing.resourceAttributes entry without a key")
+		}
+		attrs = append(attrs, attribute.String(attr.Key, os.ExpandEnv(attr.Value)))
+	}
+	return resource.Merge(resource.Default(), resource.NewSchemaless(attrs...))
+}
+
+// startStateSpan starts a child span of the request for an operation on a
+// state
+func startStateSpan(c *gin.Context, name, relativeStatePath string) (context.Context, oteltrace.Span) {
+	return tracer.Start(c.Request.Context(), name, oteltrace.WithAttributes(attribute.String("state.path", relativeStatePath)))
+}
+
+// endSpan records err on the span and ends it
+func endSpan(span oteltrace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
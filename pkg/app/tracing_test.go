@@ -0,0 +1,72 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+)
+
+func TestInitTracer_ExportsSpans(t *testing.T) {
+	var exports atomic.Int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "secret", r.Header.Get("X-Api-Key"))
+		exports.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+	t.Setenv("TEST_OTLP_KEY", "secret")
+
+	cfg := config.NewDefaultConfig()
+	cfg.Tracing.Enabled = true
+	cfg.Tracing.Provider = "otlptracehttp"
+	cfg.Tracing.SampleRate = 1
+	cfg.Tracing.Environment = "test"
+	cfg.Tracing.OTLP.Endpoint = strings.TrimPrefix(collector.URL, "http://")
+	cfg.Tracing.OTLP.Headers = map[string]string{"X-Api-Key": "${TEST_OTLP_KEY}"}
+
+	previous := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(previous)
+	tp, err := initTracer(context.Background(), cfg)
+	require.NoError(t, err)
+
+	_, span := otel.Tracer("test").Start(context.Background(), "test")
+	span.End()
+	require.NoError(t, tp.Shutdown(context.Background()))
+	assert.Equal(t, int32(1), exports.Load())
+}
+
+func TestNewResource(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	cfg.Tracing.Environment = "prod"
+	cfg.Tracing.ResourceAttributes = []config.ResourceAttribute{{Key: "service.namespace", Value: "platform"}}
+
+	res, err := newResource(cfg)
+	require.NoError(t, err)
+	attrs := map[string]string{}
+	for _, kv := range res.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	assert.Equal(t, defaultServiceName, attrs["service.name"])
+	assert.Equal(t, "prod", attrs["deployment.environment"])
+	assert.Equal(t, "platform", attrs["service.namespace"])
+
+	cfg.Tracing.ResourceAttributes = []config.ResourceAttribute{{Value: "no key"}}
+	_, err = newResource(cfg)
+	assert.Error(t, err)
+}
+
+func TestInitTracer_UnsupportedProvider(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	cfg.Tracing.Provider = "zipkin"
+	_, err := initTracer(context.Background(), cfg)
+	assert.Error(t, err)
+}
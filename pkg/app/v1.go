@@ -3,6 +3,8 @@ package app
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
 )
 
 func routerGroupV1(config *config.Config, group *gin.RouterGroup) *gin.RouterGroup {
@@ -12,8 +14,57 @@ func routerGroupV1(config *config.Config, group *gin.RouterGroup) *gin.RouterGro
 			"apiVersion": "v1",
 		})
 	})
-	routerGroupV1Local(config, v1Group)
-	routerGroupV1Git(config, v1Group)
+	gitOps := newGitOperations(config)
+	recoverStates(config, gitOps)
+	auditor = newAuditor(config, gitOps)
+	webhooks = newWebhooks(config, gitOps)
+	keyring := newKeyring(config)
+	healthChecks = newHealthChecks(config, gitOps, keyring)
+	routerGroupV1Local(config, v1Group, gitOps, keyring)
+	routerGroupV1Git(config, v1Group, gitOps)
+	routerGroupV1Webhooks(v1Group)
+	// the locker is created with the local routes
+	eventBroker = newEventBroker(config, gitOps)
+	if config.Server.Events.Enabled {
+		v1Group.GET("/events", eventsHandler(config))
+	}
+	if config.Server.Admin.Enabled {
+		routerGroupV1Admin(config, v1Group, gitOps)
+	}
 
 	return v1Group
 }
+
+// newGitOperations initializes git operations once, shared by every handler
+// that commits to the repository
+func newGitOperations(config *config.Config) *storage.GitOperations {
+	if !config.Repo.Remote.Enabled {
+		return nil
+	}
+
+	gitOps, err := storage.NewGitOperations(config, logger.GetZapLogger())
+	if err != nil {
+		logger.Warnf("failed to initialize git operations: %v", err)
+		return nil
+	}
+	logger.Info("git operations initialized successfully")
+	return gitOps
+}
+
+// recoverStates cleans up after a crash while writing a state: leftover
+// temporary files are removed and states that were replaced but never
+// committed are rolled back to their backup
+func recoverStates(config *config.Config, gitOps *storage.GitOperations) {
+	if config.Repo.RepoLocal.Path == "" {
+		return
+	}
+	if err := storage.RemoveTempFiles(config.Repo.RepoLocal.Path, logger.GetZapLogger()); err != nil {
+		logger.Warnf("failed to remove temporary state files: %v", err)
+	}
+	if gitOps == nil {
+		return
+	}
+	if err := gitOps.RecoverBackups(storage.BackupDir(config)); err != nil {
+		logger.Warnf("failed to recover state backups: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"crypto/subtle"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/rekey"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
+)
+
+// adminPrincipal is the audited principal of requests authorized by the
+// admin token
+const adminPrincipal = "admin-token"
+
+func routerGroupV1Admin(config *config.Config, group *gin.RouterGroup, gitOps *storage.GitOperations) *gin.RouterGroup {
+	v1Admin := group.Group("/admin")
+	// unauthorized attempts are audited too
+	v1Admin.Use(auditMiddleware(), adminAuth(config))
+	v1Admin.POST("/rekey", rekeyHandler(config, gitOps))
+	return v1Admin
+}
+
+// adminAuth requires the configured bearer token on admin endpoints, they
+// are unavailable without a token
+func adminAuth(config *config.Config) gin.HandlerFunc {
+	token := os.ExpandEnv(config.Server.Admin.Token)
+	if token == "" {
+		logger.Error("admin endpoints enabled without server.admin.token, they answer 503")
+	}
+
+	return func(c *gin.Context) {
+		if token == "" {
+			c.AbortWithStatusJSON(503, gin.H{
+				"message":   "admin endpoints require server.admin.token",
+				"status":    "unavailable",
+				"requestId": requestID(c),
+			})
+			return
+		}
+
+		provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(401, gin.H{
+				"message":   "unauthorized",
+				"status":    "unauthorized",
+				"requestId": requestID(c),
+			})
+			return
+		}
+		if record := auditRecord(c); record != nil && record.Principal == "" {
+			record.Principal = adminPrincipal
+		}
+		c.Next()
+	}
+}
+
+func rekeyHandler(config *config.Config, gitOps *storage.GitOperations) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dryRun, _ := strconv.ParseBool(c.DefaultQuery("dryRun", "false"))
+		onLocked := c.DefaultQuery("onLocked", rekey.OnLockedAbort)
+		// migrate only converts the states not stored in the configured format and compression
+		migrate, _ := strconv.ParseBool(c.DefaultQuery("migrate", "false"))
+		if record := auditRecord(c); record != nil {
+			record.Params = map[string]string{
+				"dryRun":   strconv.FormatBool(dryRun),
+				"onLocked": onLocked,
+				"migrate":  strconv.FormatBool(migrate),
+			}
+		}
+
+		var locker rekey.Locker
+		if Locker != nil && len(config.Redis.Addresses) > 0 {
+			locker = Locker
+		}
+		var committer rekey.Committer
+		if gitOps != nil {
+			committer = gitOps
+		}
+
+		rekeyer, err := rekey.New(config, locker, committer, logger.GetZapLogger())
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		result, err := rekeyer.Run(c.Request.Context(), rekey.Options{DryRun: dryRun, OnLocked: onLocked, Migrate: migrate})
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"message": "rekeyed successfully",
+			"status":  "ok",
+			"result":  result,
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAuth(t *testing.T) {
+	config := newTestConfig(t)
+	config.Server.Admin.Enabled = true
+
+	for _, tc := range []struct {
+		name          string
+		token         string
+		authorization string
+		status        int
+	}{
+		{name: "no token configured", authorization: "Bearer ", status: http.StatusServiceUnavailable},
+		{name: "missing", token: "secret", status: http.StatusUnauthorized},
+		{name: "wrong", token: "secret", authorization: "Bearer nope", status: http.StatusUnauthorized},
+		{name: "valid", token: "secret", authorization: "Bearer secret", status: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config.Server.Admin.Token = tc.token
+			r := gin.New()
+			r.GET("/admin", adminAuth(config), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/admin", nil)
+			req.Header.Set("Authorization", tc.authorization)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tc.status, w.Code)
+		})
+	}
+}
@@ -1,11 +1,14 @@
 package app
 
 import (
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
 )
 
-func routerGroupV1Git(config *config.Config, group *gin.RouterGroup) *gin.RouterGroup {
+func routerGroupV1Git(config *config.Config, group *gin.RouterGroup, gitOps *storage.GitOperations) *gin.RouterGroup {
 	v1Git := group.Group("/git")
 	v1Git.GET("/", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -13,6 +16,20 @@ func routerGroupV1Git(config *config.Config, group *gin.RouterGroup) *gin.Router
 			"apiVersion": "v1",
 		})
 	})
-	//TODO: implement remote git handler
+	v1Git.GET("/status", statusHandler(gitOps))
 	return v1Git
 }
+
+// statusHandler returns the sync status of origin and of the mirrors
+func statusHandler(gitOps *storage.GitOperations) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if gitOps == nil {
+			c.JSON(http.StatusOK, gin.H{"enabled": false})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"enabled": true,
+			"remotes": gitOps.RemoteStatus(),
+		})
+	}
+}
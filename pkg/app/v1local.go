@@ -1,221 +1,581 @@
 package app
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/goccy/go-json"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/commitmsg"
 	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
 	"github.com/kholisrag/terraform-backend-gitops/pkg/encryptions"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/events"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/lock"
 	"github.com/kholisrag/terraform-backend-gitops/pkg/lock/redis"
 	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/metrics"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/sidecar"
 	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
-	"go.uber.org/zap"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/tfstate"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/webhook"
 )
 
 var (
 	Locker *redis.RedisLocker
 )
 
-func routerGroupV1Local(config *config.Config, group *gin.RouterGroup) *gin.RouterGroup {
-	v1Local := group.Group("/local")
+// newKeyring parses the identities once, the keyring reloads them when the
+// files change. It is nil when they fail to load.
+func newKeyring(config *config.Config) *encryptions.Keyring {
+	keyring, err := encryptions.NewKeyring(config.Encryptions.Age)
+	if err != nil {
+		logger.Warnf("failed to load age identities: %v", err)
+		return nil
+	}
+	return keyring
+}
+
+func routerGroupV1Local(config *config.Config, group *gin.RouterGroup, gitOps *storage.GitOperations, keyring *encryptions.Keyring) *gin.RouterGroup {
+	// rejected bodies are audited too
+	v1Local := group.Group("/local", auditMiddleware(), limitBody(config.Server.MaxBodySize))
 	v1Local.GET("/", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"backend":    "local",
 			"apiVersion": "v1",
 		})
 	})
-	v1Local.POST("/state", applyHandler(config))
-	v1Local.GET("/state", getHandler(config))
+	v1Local.POST("/state", applyHandler(config, gitOps, keyring))
+	v1Local.GET("/state", getHandler(config, keyring))
+	v1Local.DELETE("/state", deleteHandler(config, gitOps, keyring))
+	v1Local.GET("/state/changes", changesHandler(config))
 	v1Local.Handle("LOCK", "/lock", lockHandler(config))
-	v1Local.Handle("UNLOCK", "/unlock", unlockHandler())
+	v1Local.Handle("UNLOCK", "/unlock", unlockHandler(config))
 	return v1Local
 }
 
-func applyHandler(config *config.Config) gin.HandlerFunc {
-	// Initialize git operations once (not on every request)
-	var gitOps *storage.GitOperations
-	if config.Repo.RepoGithub.Enabled {
-		var err error
-		gitOps, err = storage.NewGitOperations(config, logger.GetZapLogger())
-		if err != nil {
-			logger.Warnf("failed to initialize git operations: %v", err)
-		} else {
-			logger.Info("git operations initialized successfully")
-		}
+func applyHandler(config *config.Config, gitOps *storage.GitOperations, keyring *encryptions.Keyring) gin.HandlerFunc {
+	// Parse the recipients once, every state is encrypted to all of them
+	recipients, err := encryptions.LoadRecipients(config.Encryptions.Age)
+	if err != nil {
+		logger.Warnf("failed to load age recipients: %v", err)
+	} else {
+		logger.Infof("loaded %d age recipients", len(recipients))
+	}
+	// The template is validated on startup, an invalid one here falls back to the default
+	commitTemplate, err := commitmsg.New(config.Repo.Remote.CommitMessage, config.Repo.Remote.CommitTrailers)
+	if err != nil {
+		logger.Warnf("using the default commit message: %v", err)
+		commitTemplate, _ = commitmsg.New(commitmsg.Default, nil)
 	}
 
 	return func(c *gin.Context) {
 		relativeStatePath := c.Query("state")
 		logger.Debugf("applyHandler relativeStatePath: %s", relativeStatePath)
-		stateData, err := io.ReadAll(c.Request.Body)
-		if err != nil {
-			logger.Error("failed to read request body", zap.Error(err))
-			//nolint:errcheck
-			c.AbortWithError(400, err)
-		}
-
-		var data interface{}
-		err = json.Unmarshal(stateData, &data)
+		statePath, err := resolveStatePath(config, relativeStatePath)
 		if err != nil {
-			logger.Error("failed to unmarshal request body", zap.Error(err))
-			//nolint:errcheck
-			c.AbortWithError(400, err)
+			abortWithError(c, err)
+			return
 		}
 
-		statePath := filepath.Join(config.Repo.RepoLocal.Path, relativeStatePath)
 		dirPath := filepath.Dir(statePath)
 		logger.Debugf("applyHandler statePath: %s", statePath)
 		logger.Debugf("applyHandler dirPath: %s", dirPath)
 
 		err = os.MkdirAll(dirPath, 0750)
 		if err != nil {
-			logger.Error("failed to create state directory", zap.Error(err))
-			//nolint:errcheck
-			c.AbortWithError(500, err)
+			abortWithError(c, errs.E(errs.KindStorage, "app.apply", fmt.Errorf("failed to create state directory: %w", err)))
+			return
 		}
-		stateFile, err := os.Create(statePath)
-		if err != nil {
-			logger.Error("failed to create state file", zap.Error(err))
-			//nolint:errcheck
-			c.AbortWithError(500, err)
+		encryptOptions := encryptions.EncryptOptions{
+			Format:        config.Encryptions.Age.Format,
+			SensitiveOnly: config.Encryptions.Age.SensitiveOnly,
+			Compression:   config.Encryptions.Age.Compression,
+		}
+		if encryptOptions.Format == encryptions.FormatStructured && keyring != nil {
+			// reuse the data key of the current state to keep unchanged values stable in git
+			encryptOptions.Previous, _ = os.ReadFile(statePath)
+			encryptOptions.Identities = keyring.Identities()
 		}
-		defer stateFile.Close()
 
-		err = encryptions.AgeEncrypt(config.Encryptions.Age.Recipient, string(stateData), stateFile)
+		// The resources and outputs of the previous version are compared to
+		// the new one
+		gitEnabled := config.Repo.Remote.Enabled && gitOps != nil
+		_, span := startStateSpan(c, "encryptions.decryptPrevious", relativeStatePath)
+		previous, err := previousState(keyring, statePath)
+		endSpan(span, err)
 		if err != nil {
-			logger.Error("failed to write encrypted state file", zap.Error(err))
-			//nolint:errcheck
-			c.AbortWithError(500, err)
+			logger.Warnf("failed to read previous state of %s, counting all resources as added: %v", relativeStatePath, err)
+		}
+
+		// The previous versions are kept until the new ones are committed
+		files := newStateFiles(config.Repo.RepoLocal.Path, storage.BackupDir(config))
+
+		// The body is validated and hashed while it is encrypted, the state is
+		// only replaced once the encrypted file is complete and synced to disk.
+		// served are the sums of the plaintext GET returns, the structured
+		// format returns it re-indented.
+		var sums, served sidecar.Digest
+		var state *tfstate.State
+		err = files.write(statePath, func(w io.Writer) error {
+			_, span := startStateSpan(c, "encryptions.encrypt", relativeStatePath)
+			body := newJSONStream(c.Request.Body)
+			var plaintext io.Reader = body
+			var document bytes.Buffer
+			if encryptOptions.Format == encryptions.FormatStructured {
+				// the structured format reads the whole document anyway
+				plaintext = io.TeeReader(body, &document)
+			}
+			start := time.Now()
+			err := encryptions.AgeEncrypt(recipients, plaintext, w, encryptOptions)
+			if validateErr := body.Close(); validateErr != nil {
+				endSpan(span, validateErr)
+				return validateErr
+			}
+			endSpan(span, err)
+			if err != nil {
+				return err
+			}
+			sums = body.digest.Digest()
+			state = body.state
+			metrics.ObserveEncrypt(time.Since(start), sums.Size)
+			if err := verifyContentMD5(c.GetHeader("Content-MD5"), sums.MD5); err != nil {
+				return err
+			}
+			served = sums
+			if encryptOptions.Format == encryptions.FormatStructured {
+				normalized, err := encryptions.NormalizePlaintext(encryptions.FormatStructured, document.Bytes())
+				if err != nil {
+					return errs.E(errs.KindEncryption, "app.apply", err)
+				}
+				served = sidecar.NewDigest(normalized)
+			}
+			return nil
+		})
+		if err == nil {
+			// the encrypted size tells a stale checksum apart
+			var info fs.FileInfo
+			if info, err = os.Stat(statePath); err != nil {
+				err = errs.E(errs.KindStorage, "app.apply", err)
+			} else {
+				served.EncryptedSize = info.Size()
+			}
+		}
+		if err == nil {
+			err = files.write(sidecar.ChecksumPath(statePath), func(w io.Writer) error {
+				return sidecar.WriteChecksum(w, statePath, served)
+			})
+		}
+		if record := auditRecord(c); record != nil && state != nil {
+			record.SerialAfter = &state.Serial
+			if previous != nil {
+				record.SerialBefore = &previous.Serial
+			}
+		}
+		var changes tfstate.Changes
+		var change stateChange
+		if err == nil {
+			changes = tfstate.Diff(previous, state)
+			change = newStateChange(previous, state, changes)
+			var history []stateChange
+			if history, err = appendChanges(config, statePath, change); err == nil {
+				err = files.write(changesPath(statePath), func(w io.Writer) error {
+					return writeChanges(w, history)
+				})
+			}
+		}
+		var writer sidecar.Writer
+		if err == nil && (gitEnabled || config.Repo.RepoLocal.Metadata) {
+			writer = lastWriter(c, config, relativeStatePath)
+		}
+		if err == nil && config.Repo.RepoLocal.Metadata {
+			metadata := sidecar.NewMetadata(relativeStatePath, state, writer)
+			err = files.write(sidecar.MetadataPath(statePath), func(w io.Writer) error {
+				return sidecar.WriteMetadata(w, metadata)
+			})
 		}
 		if err != nil {
-			logger.Error("failed to write state file", zap.Error(err))
-			//nolint:errcheck
-			c.AbortWithError(500, err)
+			files.restore()
+			abortWithError(c, err)
+			return
 		}
+		c.Header("ETag", stateETag(hex.EncodeToString(served.SHA256)))
 
 		// Git commit and push if enabled
-		if config.Repo.RepoGithub.Enabled && gitOps != nil {
-			commitMsg := fmt.Sprintf("%s: %s",
-				config.Repo.RepoGithub.CommitMessage,
-				relativeStatePath)
+		if gitEnabled {
+			commitMsg, err := commitTemplate.Render(newCommitData(relativeStatePath, state, changes, writer, principal(c)))
+			if err != nil {
+				files.restore()
+				abortWithError(c, errs.E(errs.KindInternal, "app.apply", err))
+				return
+			}
 
 			logger.Debugf("attempting git commit and push for: %s", relativeStatePath)
 
-			if err := gitOps.CommitAndPush(relativeStatePath, commitMsg); err != nil {
-				logger.Warnf("failed to sync to github: %v", err)
-				c.JSON(200, gin.H{
-					"message": "applied successfully (git sync failed)",
-					"status":  "ok_with_warning",
-					"state":   relativeStatePath,
-					"gitSync": "failed",
-					"error":   err.Error(),
-				})
+			if err := gitOps.CommitAndPushFiles(c.Request.Context(), files.paths, commitMsg); err != nil {
+				// the state is committed but a required mirror is out of sync
+				if errors.Is(err, storage.ErrRequiredMirror) {
+					files.discard()
+					abortWithError(c, err)
+					return
+				}
+				// the state is committed locally, a failed push is reported but not fatal
+				if errs.Is(err, errs.KindGitSync) {
+					files.discard()
+					publishEvent(webhook.EventStateChanged, relativeStatePath, change)
+					streamEvent(events.StateWritten, relativeStatePath, change)
+					logger.Warnf("failed to sync to remote: %v", err)
+					c.JSON(200, gin.H{
+						"message": "applied successfully (git sync failed)",
+						"status":  "ok_with_warning",
+						"state":   relativeStatePath,
+						"gitSync": "failed",
+						"error":   err.Error(),
+						"changes": changes,
+					})
+					return
+				}
+				// the commit failed, the uncommitted state is rolled back
+				files.restore()
+				abortWithError(c, err)
 				return
 			}
 
-			logger.Infof("successfully synced state to GitHub: %s", relativeStatePath)
+			files.discard()
+			publishEvent(webhook.EventStateChanged, relativeStatePath, change)
+			streamEvent(events.StateWritten, relativeStatePath, change)
+			logger.Infof("successfully synced state to remote: %s", relativeStatePath)
 			c.JSON(200, gin.H{
 				"message": "applied successfully",
 				"status":  "ok",
 				"state":   relativeStatePath,
 				"gitSync": "success",
+				"changes": changes,
 			})
 		} else {
+			files.discard()
+			publishEvent(webhook.EventStateChanged, relativeStatePath, change)
+			streamEvent(events.StateWritten, relativeStatePath, change)
 			c.JSON(200, gin.H{
 				"message": "applied successfully",
 				"status":  "ok",
 				"state":   relativeStatePath,
+				"changes": changes,
 			})
 		}
 	}
 }
 
-func getHandler(config *config.Config) gin.HandlerFunc {
+func getHandler(config *config.Config, keyring *encryptions.Keyring) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		relativeStatePath := c.Query("state")
-		body, err := io.ReadAll(c.Request.Body)
-		defer c.Request.Body.Close()
+		logger.Debugf("getHandler relativeStatePath: %s", relativeStatePath)
+		statePath, err := resolveStatePath(config, relativeStatePath)
 		if err != nil {
-			logger.Error("failed to read request body", zap.Error(err))
-			//nolint:errcheck
-			c.AbortWithError(400, err)
+			abortWithError(c, err)
+			return
 		}
-		logger.Debugf("requestbody: %s", body)
-		logger.Debugf("getHandler relativeStatePath: %s", relativeStatePath)
-
-		statePath := filepath.Join(config.Repo.RepoLocal.Path, relativeStatePath)
 		logger.Debugf("statePath: %s", statePath)
 
-		// Check if file exists or not if not return 404
-		// If file exists then decrypt and return the file
-		if _, err := os.Stat(statePath); os.IsNotExist(err) {
-			c.AbortWithStatus(404)
-		} else {
-			logger.Debugf("file exists")
-			stateFile, err := encryptions.AgeDecrypt(config.Encryptions.Age.AgePrivateKeyPath, statePath)
-			if err != nil {
-				logger.Debugf("get err: %v", err)
-				if err.Error() == "failed to open file" {
-					c.AbortWithStatusJSON(404, err)
-				} else {
-					logger.Error("failed to decrypt file", zap.Error(err))
-					//nolint:errcheck
-					c.AbortWithError(500, err)
-					return
-				}
+		if keyring == nil {
+			abortWithError(c, errs.Errorf(errs.KindEncryption, "app.get", "no age identities loaded, can not decrypt state"))
+			return
+		}
+
+		// Polling clients sending the stored checksum get 304 without the
+		// state being decrypted
+		stored, err := sidecar.ReadChecksum(statePath)
+		if err != nil {
+			logger.Warnf("ignoring checksum of %s: %v", relativeStatePath, err)
+		}
+		ifNoneMatch := c.GetHeader("If-None-Match")
+		if stored != nil && ifNoneMatch != "" && etagMatches(ifNoneMatch, stateETag(hex.EncodeToString(stored.SHA256))) {
+			if info, err := os.Stat(statePath); err == nil && checksumFresh(statePath, stored, info) {
+				c.Header("ETag", stateETag(hex.EncodeToString(stored.SHA256)))
+				c.Status(http.StatusNotModified)
+				return
+			}
+		}
+
+		// A missing state file is reported as not found
+		stateFile, err := openStateFile(statePath)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		defer stateFile.Close()
+		stateInfo, err := stateFile.Stat()
+		if err != nil {
+			abortWithError(c, errs.E(errs.KindStorage, "app.get", err))
+			return
+		}
+
+		_, span := startStateSpan(c, "encryptions.decrypt", relativeStatePath)
+		start := time.Now()
+		fresh := checksumFresh(statePath, stored, stateInfo)
+		plaintext, err := encryptions.DecryptReader(keyring.Identities(), stateFile)
+		if err == nil && (!fresh || isInMemory(plaintext)) {
+			// The headers need the sums before the body is sent. Without
+			// stored ones, when the state was replaced since they were
+			// stored, or when the state was decrypted at once anyway, they
+			// are measured on the plaintext.
+			var data []byte
+			if data, err = io.ReadAll(plaintext); err != nil {
+				err = errs.E(errs.KindEncryption, "app.get", fmt.Errorf("failed to decrypt state: %w", err))
 			} else {
+				sums := sidecar.NewDigest(data)
+				sums.EncryptedSize = stateInfo.Size()
+				if stored != nil && !bytes.Equal(stored.SHA256, sums.SHA256) {
+					logger.Warnf("state %s does not match its stored checksum %x, serving %x", relativeStatePath, stored.SHA256, sums.SHA256)
+				}
+				if stored != nil && !fresh {
+					if err := refreshChecksum(statePath, stateInfo, stored, sums); err != nil {
+						logger.Warnf("failed to refresh checksum of %s: %v", relativeStatePath, err)
+					}
+				}
+				stored, plaintext = &sums, bytes.NewReader(data)
+			}
+		}
+		endSpan(span, err)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		metrics.ObserveDecrypt(time.Since(start), stored.Size)
+
+		etag := stateETag(hex.EncodeToString(stored.SHA256))
+		if ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+			c.Header("ETag", etag)
+			c.Status(http.StatusNotModified)
+			return
+		}
+
+		// The stream is hashed while it is sent, a state not matching the
+		// headers it was served with is logged
+		served := sidecar.NewDigestWriter()
+		c.DataFromReader(http.StatusOK, stored.Size, "application/json", io.TeeReader(plaintext, served), map[string]string{
+			"Content-MD5": base64.StdEncoding.EncodeToString(stored.MD5),
+			"ETag":        etag,
+		})
+		if sums := served.Digest(); !bytes.Equal(sums.SHA256, stored.SHA256) {
+			logger.Errorf("state %s does not match its stored checksum %x, served %d bytes with sha256 %x",
+				relativeStatePath, stored.SHA256, sums.Size, sums.SHA256)
+		}
+	}
+}
 
-				c.JSON(200, stateFile)
+// isInMemory reports whether the plaintext was decrypted at once, as the
+// structured and armored formats are
+func isInMemory(plaintext io.Reader) bool {
+	_, ok := plaintext.(*bytes.Reader)
+	return ok
+}
+
+// deleteCommitMessage is the message of the commit removing a state
+const deleteCommitMessage = "chore: delete terraform state [automated]: %s"
+
+// deleteHandler removes a state and its sidecars, e.g. on terraform
+// workspace delete, and commits the removal
+func deleteHandler(config *config.Config, gitOps *storage.GitOperations, keyring *encryptions.Keyring) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		relativeStatePath := c.Query("state")
+		logger.Debugf("deleteHandler relativeStatePath: %s", relativeStatePath)
+		statePath, err := resolveStatePath(config, relativeStatePath)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		if _, err := os.Stat(statePath); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				abortWithError(c, errs.E(errs.KindNotFound, "app.delete", err))
+				return
 			}
+			abortWithError(c, errs.E(errs.KindStorage, "app.delete", fmt.Errorf("failed to stat state file: %w", err)))
+			return
 		}
+
+		previous, err := previousState(keyring, statePath)
+		if err != nil {
+			logger.Warnf("failed to read state %s before deleting it: %v", relativeStatePath, err)
+		}
+		if record := auditRecord(c); record != nil && previous != nil {
+			record.SerialBefore = &previous.Serial
+		}
+
+		// The removed files are kept until the removal is committed
+		files := newStateFiles(config.Repo.RepoLocal.Path, storage.BackupDir(config))
+		for _, path := range []string{statePath, sidecar.ChecksumPath(statePath), changesPath(statePath), sidecar.MetadataPath(statePath)} {
+			if err := files.remove(path); err != nil {
+				files.restore()
+				abortWithError(c, err)
+				return
+			}
+		}
+
+		response := gin.H{
+			"message": "deleted successfully",
+			"status":  "ok",
+			"state":   relativeStatePath,
+		}
+		if config.Repo.Remote.Enabled && gitOps != nil {
+			err := gitOps.CommitAndPushFiles(c.Request.Context(), files.paths, fmt.Sprintf(deleteCommitMessage, relativeStatePath))
+			switch {
+			case errors.Is(err, storage.ErrRequiredMirror):
+				// the removal is committed but a required mirror is out of sync
+				files.discard()
+				abortWithError(c, err)
+				return
+			case errs.Is(err, errs.KindGitSync):
+				// the removal is committed locally, a failed push is reported but not fatal
+				logger.Warnf("failed to sync to remote: %v", err)
+				response["message"] = "deleted successfully (git sync failed)"
+				response["status"] = "ok_with_warning"
+				response["gitSync"] = "failed"
+				response["error"] = err.Error()
+			case err != nil:
+				// the commit failed, the removed files are put back
+				files.restore()
+				abortWithError(c, err)
+				return
+			default:
+				response["gitSync"] = "success"
+			}
+		}
+
+		files.discard()
+		deleted := gin.H{}
+		if previous != nil {
+			deleted["serial"] = previous.Serial
+			deleted["lineage"] = previous.Lineage
+		}
+		streamEvent(events.StateDeleted, relativeStatePath, deleted)
+		logger.Infof("deleted state %s", relativeStatePath)
+		c.JSON(http.StatusOK, response)
 	}
 }
 
+func openStateFile(statePath string) (*os.File, error) {
+	f, err := os.Open(statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errs.E(errs.KindNotFound, "app.openStateFile", err)
+	}
+	if err != nil {
+		return nil, errs.E(errs.KindStorage, "app.openStateFile", fmt.Errorf("failed to open state file: %w", err))
+	}
+	return f, nil
+}
+
 func lockHandler(config *config.Config) gin.HandlerFunc {
 	Locker = redis.NewRedisLock(config)
 	return func(c *gin.Context) {
 		relativeStatePath := c.Query("state")
-
-		lock, err := Locker.GetLock(relativeStatePath)
-		if lock == "not_found" {
-			c.AbortWithStatusJSON(200, gin.H{
-				"message": "lock not found",
-				"status":  "not_found",
-				"state":   relativeStatePath,
-			})
+		logger.Debugf("lockHandler relativeStatePath: %s", relativeStatePath)
+		if _, err := resolveStatePath(config, relativeStatePath); err != nil {
+			abortWithError(c, err)
+			return
 		}
+
+		info, err := bindLockInfo(c)
 		if err != nil {
-			logger.Errorf("failed to get lock: %v", err)
-			//nolint:errcheck
-			c.AbortWithError(500, err)
-		}
-		if lock == relativeStatePath {
-			c.AbortWithStatusJSON(500, gin.H{
-				"message": "lock already exists",
-				"status":  "already_exists",
-				"state":   relativeStatePath,
-			})
+			abortWithError(c, err)
+			return
+		}
+		if info == nil {
+			abortWithError(c, errs.Errorf(errs.KindBadRequest, "app.lock", "lock info is required"))
+			return
+		}
+		if record := auditRecord(c); record != nil {
+			record.LockID = info.ID
 		}
 
 		logger.Debug("starting to lock using redsync")
+		if err := Locker.Lock(c.Request.Context(), relativeStatePath, info); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		lockAcquired(config, relativeStatePath, info)
+		streamEvent(events.LockAcquired, relativeStatePath, lockEventData(info))
 
-		logger.Debugf("lockHandler relativeStatePath: %s", relativeStatePath)
-		//nolint:errcheck
-		Locker.Lock(relativeStatePath, false)
+		c.JSON(200, info)
 	}
 }
 
-func unlockHandler() gin.HandlerFunc {
+func unlockHandler(config *config.Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		logger.Debug("processing to unlock with redsync")
 
 		relativeStatePath := c.Query("state")
 		logger.Debugf("unlockHandler relativeStatePath: %s", relativeStatePath)
-		//nolint:errcheck
-		Locker.Unlock(relativeStatePath)
+		if _, err := resolveStatePath(config, relativeStatePath); err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		// terraform force-unlock sends no lock info
+		info, err := bindLockInfo(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		if record := auditRecord(c); record != nil && info != nil {
+			record.LockID = info.ID
+		}
+
+		if err := Locker.Unlock(c.Request.Context(), relativeStatePath, info); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		lockReleased(relativeStatePath)
+		var released any
+		if info != nil {
+			released = lockEventData(info)
+		}
+		streamEvent(events.LockReleased, relativeStatePath, released)
+
+		c.JSON(200, gin.H{
+			"message": "unlocked successfully",
+			"status":  "ok",
+			"state":   relativeStatePath,
+		})
+	}
+}
+
+// bindLockInfo parses the lock info of the request body, nil when empty
+func bindLockInfo(c *gin.Context) (*lock.LockInfo, error) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, bodyError("app.bindLockInfo", err)
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return nil, nil
+	}
+
+	info := &lock.LockInfo{}
+	if err := json.Unmarshal(body, info); err != nil {
+		return nil, errs.E(errs.KindBadRequest, "app.bindLockInfo", fmt.Errorf("failed to unmarshal lock info: %w", err))
+	}
+	return info, nil
+}
+
+// resolveStatePath returns the state file path inside the local repository,
+// rejecting empty paths and paths escaping the repository
+func resolveStatePath(config *config.Config, relativeStatePath string) (string, error) {
+	if relativeStatePath == "" {
+		return "", errs.Errorf(errs.KindBadRequest, "app.resolveStatePath", "state query parameter is required")
+	}
+	cleaned := filepath.Clean(filepath.FromSlash(relativeStatePath))
+	if filepath.IsAbs(cleaned) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", errs.Errorf(errs.KindBadRequest, "app.resolveStatePath", "invalid state path %q", relativeStatePath)
 	}
+	return filepath.Join(config.Repo.RepoLocal.Path, cleaned), nil
 }
@@ -1,12 +1,32 @@
 package app
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"filippo.io/age"
 	"github.com/gin-gonic/gin"
+	"github.com/go-git/go-git/v5"
+	"github.com/goccy/go-json"
 	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/encryptions"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/sidecar"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 func TestRouterGroupV1Local(t *testing.T) {
@@ -15,7 +35,7 @@ func TestRouterGroupV1Local(t *testing.T) {
 
 	config := &config.Config{} // Initialize your config here
 
-	routerGroupV1Local(config, group)
+	routerGroupV1Local(config, group, nil, newKeyring(config))
 
 	httpRecorder := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/local/", nil)
@@ -32,3 +52,541 @@ func TestRouterGroupV1Local(t *testing.T) {
 			httpRecorder.Body.String(), expected)
 	}
 }
+
+// newTestConfig returns a config storing states in a temporary directory,
+// encrypted to a freshly generated age key
+func newTestConfig(t *testing.T) *config.Config {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "key.txt")
+	require.NoError(t, os.WriteFile(keyPath, []byte(identity.String()+"\n"), 0600))
+
+	config := &config.Config{}
+	config.Repo.RepoLocal.Path = t.TempDir()
+	config.Encryptions.Age.Recipient = identity.Recipient().String()
+	config.Encryptions.Age.AgePrivateKeyPath = keyPath
+	return config
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	config := newTestConfig(t)
+
+	r := gin.New()
+	routerGroupV1Local(config, r.Group("/"), nil, newKeyring(config))
+
+	// key order, whitespace and integers beyond float64 precision must survive
+	state := "{\n  \"version\": 4,\n  \"serial\": 9007199254740993,\n  \"lineage\": \"abc\",\n  \"outputs\": {}\n}\n"
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/local/state?state=env/prod.tfstate", strings.NewReader(state))
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/local/state?state=env/prod.tfstate", nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	sum := md5.Sum([]byte(state))
+	sha := sha256.Sum256([]byte(state))
+	assert.Equal(t, state, w.Body.String())
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, strconv.Itoa(len(state)), w.Header().Get("Content-Length"))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(sum[:]), w.Header().Get("Content-MD5"))
+	assert.Equal(t, `"`+hex.EncodeToString(sha[:])+`"`, w.Header().Get("ETag"))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/local/state?state=env/missing.tfstate", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestApplyHandler_InvalidJSON(t *testing.T) {
+	config := newTestConfig(t)
+
+	r := gin.New()
+	routerGroupV1Local(config, r.Group("/"), nil, newKeyring(config))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/local/state?state=prod.tfstate", strings.NewReader(`{"serial":`))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NoFileExists(t, filepath.Join(config.Repo.RepoLocal.Path, "prod.tfstate"))
+
+	// an invalid upload leaves the current state untouched
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/local/state?state=prod.tfstate", strings.NewReader(`{"serial": 1}`))
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/local/state?state=prod.tfstate", strings.NewReader(`{"serial": 2} trailing`))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/local/state?state=prod.tfstate", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, `{"serial": 1}`, w.Body.String())
+
+	temporary, err := filepath.Glob(filepath.Join(config.Repo.RepoLocal.Path, ".*.tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, temporary, "temporary files are removed")
+}
+
+func TestApplyHandler_BodyTooLarge(t *testing.T) {
+	config := newTestConfig(t)
+	config.Server.MaxBodySize = 16
+
+	r := gin.New()
+	routerGroupV1Local(config, r.Group("/"), nil, newKeyring(config))
+
+	body := `{"serial": 1, "lineage": "abc"}`
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/local/state?state=prod.tfstate", strings.NewReader(body))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// chunked uploads without Content-Length are cut off while streaming
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/local/state?state=prod.tfstate", io.NopCloser(strings.NewReader(body)))
+	req.ContentLength = -1
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+	assert.NoFileExists(t, filepath.Join(config.Repo.RepoLocal.Path, "prod.tfstate"))
+}
+
+func TestApplyHandler_ContentMD5(t *testing.T) {
+	config := newTestConfig(t)
+
+	r := gin.New()
+	routerGroupV1Local(config, r.Group("/"), nil, newKeyring(config))
+
+	state := `{"serial": 1}`
+	sum := md5.Sum([]byte(state))
+	wrong := md5.Sum([]byte(`{"serial": 2}`))
+
+	for _, tt := range []struct {
+		header string
+		status int
+	}{
+		{base64.StdEncoding.EncodeToString(wrong[:]), http.StatusBadRequest},
+		{"not-base64", http.StatusBadRequest},
+		{base64.StdEncoding.EncodeToString(sum[:]), http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/local/state?state=prod.tfstate", strings.NewReader(state))
+		req.Header.Set("Content-MD5", tt.header)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, tt.status, w.Code, tt.header)
+		if tt.status != http.StatusOK {
+			assert.NoFileExists(t, filepath.Join(config.Repo.RepoLocal.Path, "prod.tfstate"))
+		}
+	}
+
+	// the plaintext SHA-256 is stored next to the state in the sha256sum
+	// format, followed by the size and MD5 on a comment line
+	sha := sha256.Sum256([]byte(state))
+	data, err := os.ReadFile(filepath.Join(config.Repo.RepoLocal.Path, "prod.tfstate.sha256"))
+	require.NoError(t, err)
+	info, err := os.Stat(filepath.Join(config.Repo.RepoLocal.Path, "prod.tfstate"))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%x  prod.tfstate\n# size 13 md5 %x encrypted %d\n", sha, sum, info.Size()), string(data))
+}
+
+func TestGetHandler_IfNoneMatch(t *testing.T) {
+	config := newTestConfig(t)
+
+	r := gin.New()
+	routerGroupV1Local(config, r.Group("/"), nil, newKeyring(config))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/local/state?state=prod.tfstate", strings.NewReader(`{"serial": 1}`))
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/local/state?state=prod.tfstate", nil)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w = get(etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+	assert.Empty(t, w.Body.String())
+
+	w = get(`"other", W/` + etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = get(`"other"`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"serial": 1}`, w.Body.String())
+
+	// states written before checksums were stored are measured on the
+	// decrypted plaintext
+	require.NoError(t, os.Remove(filepath.Join(config.Repo.RepoLocal.Path, "prod.tfstate.sha256")))
+	w = get(etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	w = get(`"other"`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+	assert.Equal(t, "13", w.Header().Get("Content-Length"))
+	assert.NotEmpty(t, w.Header().Get("Content-MD5"))
+}
+
+func TestGetHandler_StaleChecksum(t *testing.T) {
+	config := newTestConfig(t)
+
+	r := gin.New()
+	routerGroupV1Local(config, r.Group("/"), nil, newKeyring(config))
+	statePath := filepath.Join(config.Repo.RepoLocal.Path, "prod.tfstate")
+
+	apply := func(state string) (string, []byte) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/local/state?state=prod.tfstate", strings.NewReader(state))
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		encrypted, err := os.ReadFile(statePath)
+		require.NoError(t, err)
+		return w.Header().Get("ETag"), encrypted
+	}
+	// replace puts an older encrypted state back without its checksum, as a
+	// git pull or a restore outside the backend does
+	replace := func(encrypted []byte) {
+		require.NoError(t, os.WriteFile(statePath+".new", encrypted, 0644))
+		require.NoError(t, os.Rename(statePath+".new", statePath))
+		past := time.Now().Add(-time.Minute)
+		require.NoError(t, os.Chtimes(sidecar.ChecksumPath(statePath), past, past))
+	}
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/local/state?state=prod.tfstate", nil)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	etag1, encrypted1 := apply(`{"serial": 1}`)
+	checksum1, err := os.ReadFile(sidecar.ChecksumPath(statePath))
+	require.NoError(t, err)
+
+	// a state of the same size is told apart by its modification time
+	etag2, _ := apply(`{"serial": 2}`)
+	replace(encrypted1)
+	w := get(etag2)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"serial": 1}`, w.Body.String())
+	assert.Equal(t, etag1, w.Header().Get("ETag"))
+	data, err := os.ReadFile(sidecar.ChecksumPath(statePath))
+	require.NoError(t, err)
+	assert.Equal(t, string(checksum1), string(data))
+	assert.Equal(t, http.StatusNotModified, get(etag1).Code)
+
+	// a state of another size is told apart by its encrypted size
+	etag3, _ := apply(`{"serial": 333}`)
+	replace(encrypted1)
+	w = get(etag3)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "13", w.Header().Get("Content-Length"))
+	assert.Equal(t, `{"serial": 1}`, w.Body.String())
+	assert.Equal(t, etag1, w.Header().Get("ETag"))
+	data, err = os.ReadFile(sidecar.ChecksumPath(statePath))
+	require.NoError(t, err)
+	assert.Equal(t, string(checksum1), string(data))
+
+	// a checksum still matching the state is only touched
+	past := time.Now().Add(-time.Minute)
+	require.NoError(t, os.Chtimes(sidecar.ChecksumPath(statePath), past, past))
+	require.NoError(t, os.Chtimes(statePath, time.Now(), time.Now()))
+	assert.Equal(t, http.StatusOK, get("").Code)
+	info, err := os.Stat(sidecar.ChecksumPath(statePath))
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().After(past))
+	data, err = os.ReadFile(sidecar.ChecksumPath(statePath))
+	require.NoError(t, err)
+	assert.Equal(t, string(checksum1), string(data))
+}
+
+func TestGetHandler_StructuredChecksum(t *testing.T) {
+	config := newTestConfig(t)
+	config.Encryptions.Age.Format = encryptions.FormatStructured
+
+	r := gin.New()
+	routerGroupV1Local(config, r.Group("/"), nil, newKeyring(config))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/local/state?state=prod.tfstate", strings.NewReader(`{"serial":1,"lineage":"abc"}`))
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	etag := w.Header().Get("ETag")
+
+	// the structured format serves the document re-indented, the stored
+	// checksum and the ETag are those of the served bytes
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/local/state?state=prod.tfstate", nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	sha := sha256.Sum256(w.Body.Bytes())
+	assert.Equal(t, `"`+hex.EncodeToString(sha[:])+`"`, etag)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	stored, err := sidecar.ReadChecksum(filepath.Join(config.Repo.RepoLocal.Path, "prod.tfstate"))
+	require.NoError(t, err)
+	assert.Equal(t, sha[:], stored.SHA256)
+	assert.Equal(t, int64(w.Body.Len()), stored.Size)
+}
+
+func TestApplyHandler_Metadata(t *testing.T) {
+	config := newTestConfig(t)
+	config.Repo.RepoLocal.Metadata = true
+
+	r := gin.New()
+	routerGroupV1Local(config, r.Group("/"), nil, newKeyring(config))
+
+	state := `{
+  "version": 4,
+  "terraform_version": "1.9.5",
+  "serial": 7,
+  "lineage": "abc",
+  "outputs": {"db_password": {"value": "hunter2", "type": "string", "sensitive": true}},
+  "resources": [
+    {"mode": "managed", "type": "aws_db_instance", "name": "main", "instances": [{"attributes": {"password": "hunter2"}}]}
+  ]
+}`
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/local/state?state=env/prod.tfstate&ID=lock-123", strings.NewReader(state))
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	data, err := os.ReadFile(filepath.Join(config.Repo.RepoLocal.Path, "env", "prod.tfstate.meta.json"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "hunter2")
+
+	var metadata sidecar.Metadata
+	require.NoError(t, json.Unmarshal(data, &metadata))
+	assert.Equal(t, "env/prod.tfstate", metadata.State)
+	assert.Equal(t, uint64(7), metadata.Serial)
+	assert.Equal(t, "abc", metadata.Lineage)
+	assert.Equal(t, "1.9.5", metadata.TerraformVersion)
+	assert.Equal(t, 1, metadata.ResourceCount)
+	assert.Equal(t, []string{"aws_db_instance.main"}, metadata.Resources)
+	assert.Equal(t, "lock-123", metadata.LastWriter.LockID)
+	assert.False(t, metadata.LastWriter.Time.IsZero())
+}
+
+func TestDeleteHandler(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Repo.RepoLocal.Metadata = true
+	repo, err := git.PlainInit(cfg.Repo.RepoLocal.Path, false)
+	require.NoError(t, err)
+	cfg.Repo.Remote = config.RepoRemote{
+		Enabled:       true,
+		RemoteURL:     "https://github.com/test/repo.git",
+		AuthMethod:    "default",
+		RetryAttempts: 1,
+	}
+	gitOps, err := storage.NewGitOperations(cfg, zap.NewNop())
+	require.NoError(t, err)
+
+	r := gin.New()
+	routerGroupV1Local(cfg, r.Group("/"), gitOps, newKeyring(cfg))
+	request := func(method string) *httptest.ResponseRecorder {
+		var body io.Reader
+		if method == "POST" {
+			body = strings.NewReader(`{"version": 4, "serial": 3, "lineage": "abc"}`)
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/local/state?state=env/prod.tfstate", body)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, request("POST").Code)
+	w := request("DELETE")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"gitSync":"success"`)
+
+	// the state and its sidecars are removed and the removal is committed
+	entries, err := os.ReadDir(filepath.Join(cfg.Repo.RepoLocal.Path, "env"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	head, err := repo.Head()
+	require.NoError(t, err)
+	commit, err := repo.CommitObject(head.Hash())
+	require.NoError(t, err)
+	assert.Equal(t, "chore: delete terraform state [automated]: env/prod.tfstate", commit.Message)
+	tree, err := commit.Tree()
+	require.NoError(t, err)
+	assert.Empty(t, tree.Entries)
+	assert.NoFileExists(t, filepath.Join(storage.BackupDir(cfg), "env", "prod.tfstate"))
+
+	assert.Equal(t, http.StatusNotFound, request("GET").Code)
+	assert.Equal(t, http.StatusNotFound, request("DELETE").Code)
+}
+
+func TestApplyHandler_CommitMessage(t *testing.T) {
+	cfg := newTestConfig(t)
+	repo, err := git.PlainInit(cfg.Repo.RepoLocal.Path, false)
+	require.NoError(t, err)
+	cfg.Repo.Remote = config.RepoRemote{
+		Enabled:       true,
+		RemoteURL:     "https://github.com/test/repo.git",
+		AuthMethod:    "default",
+		CommitMessage: "{{ .Path }} serial {{ .Serial }}: +{{ .Added }} ~{{ .Changed }} -{{ .Removed }}",
+		CommitTrailers: []config.CommitTrailer{
+			{Key: "State-Lineage", Value: "{{ .Lineage }}"},
+			{Key: "Terraform-Principal", Value: "{{ .Principal }}"},
+		},
+		RetryAttempts: 1,
+	}
+	gitOps, err := storage.NewGitOperations(cfg, zap.NewNop())
+	require.NoError(t, err)
+
+	r := gin.New()
+	routerGroupV1Local(cfg, r.Group("/"), gitOps, newKeyring(cfg))
+
+	apply := func(serial int, resources string) string {
+		state := fmt.Sprintf(`{"version": 4, "serial": %d, "lineage": "abc", "resources": [%s]}`, serial, resources)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/local/state?state=prod.tfstate", strings.NewReader(state))
+		req.SetBasicAuth("ci", "secret")
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		head, err := repo.Head()
+		require.NoError(t, err)
+		commit, err := repo.CommitObject(head.Hash())
+		require.NoError(t, err)
+		return commit.Message
+	}
+
+	resource := func(name, id string) string {
+		return fmt.Sprintf(`{"mode": "managed", "type": "null_resource", "name": %q, "instances": [{"attributes": {"id": %q}}]}`, name, id)
+	}
+
+	message := apply(1, resource("a", "1")+","+resource("b", "1"))
+	assert.Equal(t, "prod.tfstate serial 1: +2 ~0 -0\n\n"+
+		"+ null_resource.a\n+ null_resource.b\n\n"+
+		"State-Lineage: abc\nTerraform-Principal: ci", message)
+
+	message = apply(2, resource("a", "2")+","+resource("c", "1"))
+	assert.Equal(t, "prod.tfstate serial 2: +1 ~1 -1\n\n"+
+		"+ null_resource.c\n~ null_resource.a\n- null_resource.b\n\n"+
+		"State-Lineage: abc\nTerraform-Principal: ci", message)
+}
+
+func TestApplyHandler_RequiredMirror(t *testing.T) {
+	cfg := newTestConfig(t)
+	_, err := git.PlainInit(cfg.Repo.RepoLocal.Path, false)
+	require.NoError(t, err)
+	originDir := t.TempDir()
+	_, err = git.PlainInit(originDir, true)
+	require.NoError(t, err)
+	cfg.Repo.Remote = config.RepoRemote{
+		Enabled:       true,
+		RemoteURL:     originDir,
+		Branch:        "master",
+		AuthMethod:    "default",
+		AutoPush:      true,
+		RetryAttempts: 1,
+		Mirrors: []config.RemoteMirror{
+			// not a repository, every push to it fails
+			{Name: "dr", RepoRemote: config.RepoRemote{RemoteURL: t.TempDir(), AuthMethod: "default"}},
+		},
+	}
+
+	apply := func(cfg *config.Config) *httptest.ResponseRecorder {
+		gitOps, err := storage.NewGitOperations(cfg, zap.NewNop())
+		require.NoError(t, err)
+		r := gin.New()
+		routerGroupV1Local(cfg, r.Group("/"), gitOps, newKeyring(cfg))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/local/state?state=prod.tfstate", strings.NewReader(`{"version": 4, "serial": 1}`))
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := apply(cfg)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"gitSync":"success"`)
+
+	cfg.Repo.Remote.Mirrors[0].Required = true
+	w = apply(cfg)
+	assert.Equal(t, http.StatusBadGateway, w.Code, w.Body.String())
+	// the state stays committed
+	_, err = os.Stat(filepath.Join(cfg.Repo.RepoLocal.Path, "prod.tfstate"))
+	assert.NoError(t, err)
+}
+
+func TestChangesHandler(t *testing.T) {
+	config := newTestConfig(t)
+	config.Repo.RepoLocal.ChangesHistory = 2
+
+	r := gin.New()
+	routerGroupV1Local(config, r.Group("/"), nil, newKeyring(config))
+
+	apply := func(serial int, password string, resources ...string) map[string]json.RawMessage {
+		state := fmt.Sprintf(`{"version": 4, "serial": %d, "lineage": "abc", "outputs": {"db_password": {"value": %q, "sensitive": true}}, "resources": [%s]}`,
+			serial, password, strings.Join(resources, ","))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/local/state?state=env/prod.tfstate", strings.NewReader(state))
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var body map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return body
+	}
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/local/state/changes?"+query, nil)
+		r.ServeHTTP(w, req)
+		return w
+	}
+	resource := func(name, password string) string {
+		return fmt.Sprintf(`{"mode": "managed", "type": "aws_db_instance", "name": %q, "instances": [{"attributes": {"password": %q}}]}`, name, password)
+	}
+
+	body := apply(1, "hunter2", resource("a", "hunter2"))
+	assert.JSONEq(t, `{"added": ["aws_db_instance.a"], "changed": [], "removed": [], "outputs": ["db_password"]}`, string(body["changes"]))
+
+	body = apply(2, "hunter3", resource("a", "hunter3"), resource("b", "hunter3"))
+	assert.JSONEq(t, `{"added": ["aws_db_instance.b"], "changed": ["aws_db_instance.a"], "removed": [], "outputs": ["db_password"]}`, string(body["changes"]))
+
+	apply(3, "hunter3", resource("b", "hunter3"))
+
+	data, err := os.ReadFile(filepath.Join(config.Repo.RepoLocal.Path, "env", "prod.tfstate.changes.json"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "hunter")
+
+	var change struct {
+		State  string      `json:"state"`
+		Change stateChange `json:"change"`
+	}
+	w := get("state=env/prod.tfstate")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &change))
+	assert.Equal(t, "env/prod.tfstate", change.State)
+	assert.Equal(t, uint64(3), change.Change.Serial)
+	require.NotNil(t, change.Change.PreviousSerial)
+	assert.Equal(t, uint64(2), *change.Change.PreviousSerial)
+	assert.Equal(t, []string{"aws_db_instance.a"}, change.Change.Changes.Removed)
+	assert.Empty(t, change.Change.Changes.Outputs)
+
+	w = get("state=env/prod.tfstate&version=2")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &change))
+	assert.Equal(t, uint64(2), change.Change.Serial)
+	assert.Equal(t, []string{"aws_db_instance.b"}, change.Change.Changes.Added)
+
+	// only the last two writes are kept
+	assert.Equal(t, http.StatusNotFound, get("state=env/prod.tfstate&version=1").Code)
+	assert.Equal(t, http.StatusNotFound, get("state=env/dev.tfstate").Code)
+	assert.Equal(t, http.StatusBadRequest, get("state=env/prod.tfstate&version=latest").Code)
+}
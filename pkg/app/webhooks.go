@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/lock"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/webhook"
+)
+
+const defaultLockHeldThreshold = time.Hour
+
+// webhooks delivers the events to the configured targets, nil when no target
+// is configured
+var webhooks *webhook.Dispatcher
+
+// heldLocks are the timers of the acquired locks, sending lock.held_too_long
+// when a lock is still held after the threshold
+var heldLocks = struct {
+	sync.Mutex
+	timers map[string]*time.Timer
+}{timers: map[string]*time.Timer{}}
+
+// newWebhooks starts the delivery of the events, failed pushes are sent as
+// git.push_failed
+func newWebhooks(config *config.Config, gitOps *storage.GitOperations) *webhook.Dispatcher {
+	d, err := webhook.New(config.Webhooks, logger.GetZapLogger())
+	if err != nil {
+		logger.Fatalf("failed to initialize webhooks: %v", err)
+	}
+	if d == nil {
+		return nil
+	}
+	logger.Infof("webhooks enabled for %d targets", len(config.Webhooks.Targets))
+	if gitOps != nil {
+		gitOps.OnPush(func(remote string, err error) {
+			if err != nil {
+				d.Publish(webhook.EventGitPushFailed, "", gin.H{"remote": remote, "error": err.Error()})
+			}
+		})
+	}
+	return d
+}
+
+// publishEvent sends the event when webhooks are enabled
+func publishEvent(eventType, state string, data any) {
+	if webhooks != nil {
+		webhooks.Publish(eventType, state, data)
+	}
+}
+
+// lockAcquired sends lock.acquired and watches how long the lock is held
+func lockAcquired(config *config.Config, relativeStatePath string, info *lock.LockInfo) {
+	if webhooks == nil {
+		return
+	}
+	webhooks.Publish(webhook.EventLockAcquired, relativeStatePath, lockEventData(info))
+
+	threshold := time.Duration(config.Webhooks.LockHeldThreshold) * time.Second
+	if threshold <= 0 {
+		threshold = defaultLockHeldThreshold
+	}
+	id := info.ID
+	heldLocks.Lock()
+	defer heldLocks.Unlock()
+	if timer := heldLocks.timers[relativeStatePath]; timer != nil {
+		timer.Stop()
+	}
+	heldLocks.timers[relativeStatePath] = time.AfterFunc(threshold, func() {
+		heldLocks.Lock()
+		delete(heldLocks.timers, relativeStatePath)
+		heldLocks.Unlock()
+
+		// the lock may have been released by another replica
+		current, err := Locker.GetLock(context.Background(), relativeStatePath)
+		if err != nil || current.ID != id {
+			return
+		}
+		data := lockEventData(current)
+		data["heldFor"] = time.Since(current.Created).Round(time.Second).String()
+		webhooks.Publish(webhook.EventLockHeldTooLong, relativeStatePath, data)
+	})
+}
+
+// lockReleased stops watching the lock
+func lockReleased(relativeStatePath string) {
+	heldLocks.Lock()
+	defer heldLocks.Unlock()
+	if timer := heldLocks.timers[relativeStatePath]; timer != nil {
+		timer.Stop()
+		delete(heldLocks.timers, relativeStatePath)
+	}
+}
+
+func lockEventData(info *lock.LockInfo) gin.H {
+	return gin.H{
+		"id":        info.ID,
+		"who":       info.Who,
+		"operation": info.Operation,
+		"created":   info.Created,
+	}
+}
+
+func routerGroupV1Webhooks(group *gin.RouterGroup) *gin.RouterGroup {
+	v1Webhooks := group.Group("/webhooks")
+	v1Webhooks.GET("/deliveries", deliveriesHandler())
+	return v1Webhooks
+}
+
+// deliveriesHandler returns the latest deliveries, newest first, optionally
+// of a single target
+func deliveriesHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if webhooks == nil {
+			c.JSON(http.StatusOK, gin.H{"enabled": false})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"enabled":    true,
+			"pending":    webhooks.Pending(),
+			"deliveries": webhooks.Deliveries(c.Query("target")),
+		})
+	}
+}
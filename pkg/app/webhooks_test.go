@@ -0,0 +1,84 @@
+package app
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goccy/go-json"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhooks_StateChanged(t *testing.T) {
+	var mu sync.Mutex
+	var events []webhook.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, webhook.Sign("s3cret", body), r.Header.Get(webhook.HeaderSignature))
+		var event webhook.Event
+		assert.NoError(t, json.Unmarshal(body, &event))
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	cfg := newTestConfig(t)
+	cfg.Webhooks.Targets = []config.WebhookTarget{{
+		Name:   "chat",
+		URL:    server.URL,
+		Secret: "s3cret",
+		Events: []string{webhook.EventStateChanged},
+		States: []string{"env/**"},
+	}}
+	webhooks = newWebhooks(cfg, nil)
+	t.Cleanup(func() {
+		webhooks.Close(context.Background())
+		webhooks = nil
+	})
+
+	r := gin.New()
+	routerGroupV1Local(cfg, r.Group("/"), nil, newKeyring(cfg))
+	routerGroupV1Webhooks(r.Group("/"))
+
+	for _, statePath := range []string{"env/prod.tfstate", "other/prod.tfstate"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/local/state?state="+statePath,
+			strings.NewReader(`{"version": 4, "serial": 1, "lineage": "abc", "outputs": {"password": {"value": "hunter2"}}}`))
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	require.Eventually(t, func() bool { return webhooks.Pending() == 0 && len(webhooks.Deliveries("")) == 1 }, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	require.Len(t, events, 1)
+	assert.Equal(t, webhook.EventStateChanged, events[0].Type)
+	assert.Equal(t, "env/prod.tfstate", events[0].State)
+	data, _ := json.Marshal(events[0].Data)
+	assert.NotContains(t, string(data), "hunter2")
+	assert.Contains(t, string(data), `"serial":1`)
+	mu.Unlock()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/webhooks/deliveries?target=chat", nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Enabled    bool               `json:"enabled"`
+		Pending    int                `json:"pending"`
+		Deliveries []webhook.Delivery `json:"deliveries"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.True(t, body.Enabled)
+	require.Len(t, body.Deliveries, 1)
+	assert.True(t, body.Deliveries[0].Delivered)
+}
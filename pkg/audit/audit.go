@@ -0,0 +1,218 @@
+// Package audit records who read, wrote, locked and unlocked which state and
+// every admin action, as JSON lines. Records never contain state content.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+)
+
+// Dir is the directory of the state repository the records are committed to
+const Dir = "audit"
+
+// Outcomes of a record
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+const (
+	defaultPath           = "audit.jsonl"
+	defaultMaxSizeMB      = 100
+	defaultMaxBackups     = 10
+	defaultCommitInterval = 300 * time.Second
+	commitTimeout         = time.Minute
+)
+
+// Record is a single audited request
+type Record struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId,omitempty"`
+	// Action is e.g. state.write, lock.acquire or admin.rekey
+	Action    string `json:"action"`
+	Principal string `json:"principal,omitempty"`
+	ClientIP  string `json:"clientIp,omitempty"`
+	State     string `json:"state,omitempty"`
+	LockID    string `json:"lockId,omitempty"`
+	// SerialBefore and SerialAfter are the serials of a written state, nil
+	// when unknown
+	SerialBefore *uint64 `json:"serialBefore,omitempty"`
+	SerialAfter  *uint64 `json:"serialAfter,omitempty"`
+	// Params are the options of an admin action
+	Params  map[string]string `json:"params,omitempty"`
+	Outcome string            `json:"outcome"`
+	Status  int               `json:"status"`
+	// Error is the kind of the error, never its message which may quote the
+	// state
+	Error string `json:"error,omitempty"`
+}
+
+// Committer commits the audit files of the state repository
+type Committer interface {
+	CommitAndPushFiles(ctx context.Context, filePaths []string, commitMessage string) error
+}
+
+// Logger appends the records to the audit file and, when committing, to the
+// daily files of the state repository
+type Logger struct {
+	file   *rotatingFile
+	logger *zap.Logger
+
+	// repoPath is empty when the records are not committed
+	repoPath  string
+	committer Committer
+
+	mu      sync.Mutex
+	pending map[string]bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// New opens the audit file. Without a committer the records are only
+// written to the audit file.
+func New(cfg config.Audit, repoPath string, committer Committer, logger *zap.Logger) (*Logger, error) {
+	filePath := cfg.Path
+	if filePath == "" {
+		filePath = defaultPath
+	}
+	maxSizeMB := cfg.MaxSizeMB
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultMaxSizeMB
+	}
+	maxBackups := cfg.MaxBackups
+	if maxBackups <= 0 {
+		maxBackups = defaultMaxBackups
+	}
+	file, err := openRotatingFile(filePath, int64(maxSizeMB)<<20, maxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	l := &Logger{file: file, logger: logger, pending: map[string]bool{}}
+	if cfg.Commit {
+		if committer == nil || repoPath == "" {
+			logger.Warn("audit.commit requires git operations, the audit log is not committed")
+			return l, nil
+		}
+		interval := time.Duration(cfg.CommitInterval) * time.Second
+		if interval <= 0 {
+			interval = defaultCommitInterval
+		}
+		l.repoPath = repoPath
+		l.committer = committer
+		l.stop = make(chan struct{})
+		l.done = make(chan struct{})
+		go l.commitLoop(interval)
+	}
+	return l, nil
+}
+
+// Log appends the record
+func (l *Logger) Log(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(line); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	if l.repoPath == "" {
+		return nil
+	}
+
+	relativePath := path.Join(Dir, record.Time.UTC().Format(time.DateOnly)+".jsonl")
+	if err := appendFile(filepath.Join(l.repoPath, filepath.FromSlash(relativePath)), line); err != nil {
+		return fmt.Errorf("failed to write audit log to the repository: %w", err)
+	}
+	l.pending[relativePath] = true
+	return nil
+}
+
+// Close commits the pending records and closes the audit file
+func (l *Logger) Close(ctx context.Context) error {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+		l.commit(ctx)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+func (l *Logger) commitLoop(interval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), commitTimeout)
+			l.commit(ctx)
+			cancel()
+		}
+	}
+}
+
+// commit commits the audit files written since the last commit. Files of a
+// failed commit are retried with the next one, a failed push is not retried
+// as the records are committed locally.
+func (l *Logger) commit(ctx context.Context) {
+	l.mu.Lock()
+	paths := make([]string, 0, len(l.pending))
+	for p := range l.pending {
+		paths = append(paths, p)
+	}
+	l.pending = map[string]bool{}
+	l.mu.Unlock()
+	if len(paths) == 0 {
+		return
+	}
+	sort.Strings(paths)
+
+	err := l.committer.CommitAndPushFiles(ctx, paths, "chore: audit log [automated]")
+	if err == nil {
+		return
+	}
+	l.logger.Warn("failed to commit audit log", zap.Strings("files", paths), zap.Error(err))
+	if !errs.Is(err, errs.KindGitSync) {
+		l.mu.Lock()
+		for _, p := range paths {
+			l.pending[p] = true
+		}
+		l.mu.Unlock()
+	}
+}
+
+func appendFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
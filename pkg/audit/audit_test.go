@@ -0,0 +1,142 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+)
+
+type fakeCommitter struct {
+	mu      sync.Mutex
+	commits [][]string
+	err     error
+}
+
+func (f *fakeCommitter) CommitAndPushFiles(_ context.Context, filePaths []string, _ string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commits = append(f.commits, filePaths)
+	return f.err
+}
+
+func readRecords(t *testing.T, name string) []Record {
+	t.Helper()
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record Record
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestLogger_Log(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "logs", "audit.jsonl")
+	l, err := New(config.Audit{Enabled: true, Path: name}, "", nil, zap.NewNop())
+	require.NoError(t, err)
+
+	before, after := uint64(1), uint64(2)
+	require.NoError(t, l.Log(Record{
+		Time:         time.Now(),
+		Action:       "state.write",
+		Principal:    "alice",
+		State:        "env/prod.tfstate",
+		SerialBefore: &before,
+		SerialAfter:  &after,
+		Outcome:      OutcomeSuccess,
+		Status:       200,
+	}))
+	require.NoError(t, l.Log(Record{Time: time.Now(), Action: "lock.acquire", LockID: "abc", Outcome: OutcomeFailure, Status: 423, Error: "locked"}))
+	require.NoError(t, l.Close(context.Background()))
+
+	records := readRecords(t, name)
+	require.Len(t, records, 2)
+	assert.Equal(t, "alice", records[0].Principal)
+	assert.Equal(t, uint64(1), *records[0].SerialBefore)
+	assert.Equal(t, uint64(2), *records[0].SerialAfter)
+	assert.Equal(t, "abc", records[1].LockID)
+	assert.Nil(t, records[1].SerialBefore)
+	assert.Equal(t, "locked", records[1].Error)
+}
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.jsonl")
+	r, err := openRotatingFile(name, 10, 2)
+	require.NoError(t, err)
+
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		_, err := r.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	require.NoError(t, r.Close())
+
+	for file, want := range map[string]string{
+		name:        "dddddd\n",
+		name + ".1": "cccccc\n",
+		name + ".2": "bbbbbb\n",
+	} {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data), file)
+	}
+	// beyond maxBackups the oldest file is dropped
+	assert.NoFileExists(t, name+".3")
+
+	// a reopened file keeps counting its size
+	r, err = openRotatingFile(name, 10, 2)
+	require.NoError(t, err)
+	_, err = r.Write([]byte("eeeeee\n"))
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	data, err := os.ReadFile(name + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "dddddd\n", string(data))
+}
+
+func TestLogger_Commit(t *testing.T) {
+	repoPath := t.TempDir()
+	committer := &fakeCommitter{err: errs.E(errs.KindStorage, "test", errors.New("commit failed"))}
+	cfg := config.Audit{Enabled: true, Path: filepath.Join(t.TempDir(), "audit.jsonl"), Commit: true, CommitInterval: 3600}
+	l, err := New(cfg, repoPath, committer, zap.NewNop())
+	require.NoError(t, err)
+
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, l.Log(Record{Time: now, Action: "state.read", Outcome: OutcomeSuccess, Status: 200}))
+	records := readRecords(t, filepath.Join(repoPath, "audit", "2026-03-01.jsonl"))
+	require.Len(t, records, 1)
+	assert.Equal(t, "state.read", records[0].Action)
+
+	// a failed commit is retried with the next one
+	l.commit(context.Background())
+	committer.err = errs.E(errs.KindGitSync, "test", errors.New("push failed"))
+	require.NoError(t, l.Log(Record{Time: now.Add(24 * time.Hour), Action: "state.read", Outcome: OutcomeSuccess, Status: 200}))
+	l.commit(context.Background())
+	// a failed push is not, the records are committed locally
+	l.commit(context.Background())
+	committer.err = nil
+	require.NoError(t, l.Close(context.Background()))
+
+	assert.Equal(t, [][]string{
+		{"audit/2026-03-01.jsonl"},
+		{"audit/2026-03-01.jsonl", "audit/2026-03-02.jsonl"},
+	}, committer.commits)
+}
@@ -0,0 +1,63 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	commitVerifySince string
+
+	commitCmd = &cobra.Command{
+		Use:   "commit",
+		Short: "Inspect the commits of the state repository",
+	}
+
+	commitVerifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Verify every commit of the state branch is signed by the backend's key",
+		Long: `
+Check the signature of every commit of repo.remote.branch against the key
+configured in repo.remote.signing, and exit with an error when any commit is
+unsigned or signed by another key. Use --since to skip the history from before
+signing was enabled.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			gitOps, err := storage.NewGitOperations(&Konfig, logger.GetZapLogger())
+			if err != nil {
+				logger.Fatal("failed to initialize git operations", zap.Error(err))
+			}
+
+			results, err := gitOps.VerifyCommits(commitVerifySince)
+			if err != nil {
+				logger.Fatal("failed to verify commits", zap.Error(err))
+			}
+
+			failed := 0
+			for _, result := range results {
+				status := "ok"
+				if result.Err != nil {
+					status = result.Err.Error()
+					failed++
+				}
+				fmt.Printf("%s %s: %s\n", result.Hash[:12], result.Subject, status)
+			}
+			if failed > 0 {
+				logger.Errorf("%d of %d commits are not signed by the backend's key", failed, len(results))
+				os.Exit(1)
+			}
+			logger.Infof("all %d commits are signed by the backend's key", len(results))
+		},
+	}
+)
+
+func init() {
+	commitVerifyCmd.Flags().StringVar(&commitVerifySince, "since", "", "only verify the commits after this revision")
+	commitCmd.AddCommand(commitVerifyCmd)
+	rootCmd.AddCommand(commitCmd)
+}
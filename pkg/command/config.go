@@ -0,0 +1,52 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"github.com/spf13/cobra"
+)
+
+var (
+	configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+		// the subcommands load the configuration without exiting on the
+		// first problem
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+	}
+
+	configValidateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "Report every invalid or unknown key of the configuration",
+		Long: `
+Load the configuration file, the TBG_ environment variables and the --set
+flags, and report every unknown key, invalid value and failed check at once
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			unknown, problems := loadConfig()
+			logger.Init(Konfig.LogLevel)
+			for _, key := range unknown {
+				problems = append(problems, fmt.Errorf("unknown key %s", key))
+			}
+			problems = append(problems, validateConfig(&Konfig)...)
+
+			out := cmd.OutOrStdout()
+			if len(problems) == 0 {
+				fmt.Fprintf(out, "%s is valid\n", cfgPath)
+				return
+			}
+			fmt.Fprintf(out, "%s has %d problems:\n", cfgPath, len(problems))
+			for _, problem := range problems {
+				fmt.Fprintf(out, "  - %v\n", problem)
+			}
+			os.Exit(1)
+		},
+	}
+)
+
+func init() {
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,95 @@
+package command
+
+import (
+	"context"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/lock/redis"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/rekey"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	rekeyDryRun   bool
+	rekeyOnLocked string
+
+	rekeyCmd = &cobra.Command{
+		Use:   "rekey",
+		Short: "Re-encrypt every state to the configured recipients",
+		Long: `
+Decrypt every state of the repository with the configured identities,
+re-encrypt it to the configured recipients and commit all of them as one commit
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runRekey(rekey.Options{
+				DryRun:   rekeyDryRun,
+				OnLocked: rekeyOnLocked,
+			})
+		},
+	}
+
+	migrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "Convert the existing states to the configured encryption format and compression",
+		Long: `
+Re-encrypt the states that are not stored in the configured encryption format
+and compression yet, e.g. after enabling encryptions.age.compression, and commit
+all of them as one commit
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runRekey(rekey.Options{
+				DryRun:   rekeyDryRun,
+				OnLocked: rekeyOnLocked,
+				Migrate:  true,
+			})
+		},
+	}
+)
+
+func runRekey(opts rekey.Options) {
+	var locker rekey.Locker
+	if len(Konfig.Redis.Addresses) > 0 {
+		locker = redis.NewRedisLock(&Konfig)
+	} else {
+		logger.Warn("redis not configured, locked states can not be detected")
+	}
+
+	var committer rekey.Committer
+	if Konfig.Repo.Remote.Enabled {
+		gitOps, err := storage.NewGitOperations(&Konfig, logger.GetZapLogger())
+		if err != nil {
+			logger.Fatal("failed to initialize git operations", zap.Error(err))
+		}
+		committer = gitOps
+	}
+
+	rekeyer, err := rekey.New(&Konfig, locker, committer, logger.GetZapLogger())
+	if err != nil {
+		logger.Fatal("failed to initialize rekey", zap.Error(err))
+	}
+
+	result, err := rekeyer.Run(context.Background(), opts)
+	if err != nil {
+		logger.Fatal("failed to rekey states", zap.Error(err))
+	}
+
+	for _, skipped := range result.Skipped {
+		logger.Warn("state skipped", zap.String("state", skipped.State), zap.String("reason", skipped.Reason))
+	}
+	logger.Info("rekey finished",
+		zap.Bool("dryRun", result.DryRun),
+		zap.Bool("migrate", opts.Migrate),
+		zap.Strings("rekeyed", result.Rekeyed),
+		zap.Int("skipped", len(result.Skipped)),
+		zap.Bool("committed", result.Committed))
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{rekeyCmd, migrateCmd} {
+		cmd.Flags().BoolVar(&rekeyDryRun, "dry-run", false, "only verify every state can be re-encrypted, do not write or commit")
+		cmd.Flags().StringVar(&rekeyOnLocked, "on-locked", rekey.OnLockedAbort, "what to do with locked states: skip or abort")
+		rootCmd.AddCommand(cmd)
+	}
+}
@@ -1,11 +1,20 @@
 package command
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"strings"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/commitmsg"
 	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/encryptions"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/forge"
 	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/webhook"
 	"github.com/knadh/koanf/parsers/yaml"
 	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/v2"
@@ -16,6 +25,8 @@ var (
 	k       = koanf.New(".")
 	Konfig  = config.Config{}
 	cfgPath string
+	// cfgOverrides are the key=value pairs of --set
+	cfgOverrides []string
 
 	version   string
 	commit    string
@@ -27,16 +38,19 @@ var (
 		Long: `
 A Simple HTTP Server that function as Terraform Backend HTTP,
 saves and encrypts terraform state to files (GitOps style)
+
+The configuration file is overridden by the TBG_ environment variables, e.g.
+TBG_REPO__REMOTE__TOKEN for repo.remote.token, and by the --set flags.
 `,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			initConfig()
+		},
 	}
 )
 
-func init() {
-	cobra.OnInitialize(initConfig)
-}
-
 func Execute(version string, commit string, buildTime string) (err error) {
 	rootCmd.PersistentFlags().StringVar(&cfgPath, "config", "./.terraform-backend-gitops.yaml", "config file path")
+	rootCmd.PersistentFlags().StringArrayVar(&cfgOverrides, "set", nil, "override a configuration key, e.g. --set server.address=0.0.0.0:8080, can be repeated")
 
 	if err = rootCmd.Execute(); err != nil {
 		logger.Fatalf("error executing the command: %v", err)
@@ -45,87 +59,257 @@ func Execute(version string, commit string, buildTime string) (err error) {
 	return err
 }
 
+// initConfig loads the configuration and exits on any problem, all of them
+// being logged first
 func initConfig() {
-	// Load the configuration
+	unknown, problems := loadConfig()
+	logger.Init(Konfig.LogLevel)
+	for _, key := range unknown {
+		logger.Warnf("ignoring unknown configuration key %s", key)
+	}
+	// Pretty Print the configuration
+	logger.Debugf("loaded configuration: %+v", Konfig)
+
+	problems = append(problems, validateConfig(&Konfig)...)
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			logger.Errorf("invalid configuration: %v", problem)
+		}
+		logger.Fatalf("the configuration has %d problems, see `config validate`", len(problems))
+	}
+}
+
+// loadConfig loads the defaults, the configuration file, the TBG_
+// environment variables and the --set flags, each overriding the previous
+// ones, into Konfig. It returns the unknown keys and every value that could
+// not be loaded.
+func loadConfig() (unknown []string, problems []error) {
 	if err := k.Load(file.Provider(cfgPath), yaml.Parser()); err != nil {
-		logger.Warnf("error loading the configuration: %v", err)
+		if errors.Is(err, fs.ErrNotExist) {
+			logger.Warnf("error loading the configuration: %v", err)
+		} else {
+			problems = append(problems, fmt.Errorf("failed to load %s: %w", cfgPath, err))
+		}
 	}
 
-	err := k.Unmarshal("", &Konfig)
-	if err != nil {
-		logger.Fatalf("error unmarshalling the configuration: %v", err)
+	// repo.github is the former name of repo.remote
+	if k.Exists("repo.github") {
+		if k.Exists("repo.remote") {
+			logger.Warn("both repo.remote and the deprecated repo.github are configured, ignoring repo.github")
+		} else {
+			logger.Warn("repo.github is deprecated, rename it to repo.remote")
+			if err := k.MergeAt(k.Cut("repo.github"), "repo.remote"); err != nil {
+				problems = append(problems, fmt.Errorf("failed to load repo.github: %w", err))
+			}
+		}
+		k.Delete("repo.github")
 	}
 
-	logger.Init(Konfig.LogLevel)
-	// Pretty Print the configuration
-	logger.Debugf("loaded configuration: %+v", Konfig)
+	envOverrides, err := config.EnvOverrides(os.Environ())
+	problems = append(problems, splitErrors(err)...)
+	flagOverrides, err := config.FlagOverrides(cfgOverrides)
+	problems = append(problems, splitErrors(err)...)
+	for _, overrides := range []map[string]any{envOverrides, flagOverrides} {
+		for key, value := range overrides {
+			if err := k.Set(key, value); err != nil {
+				problems = append(problems, fmt.Errorf("failed to set %s: %w", key, err))
+			}
+		}
+	}
+
+	Konfig = *config.NewDefaultConfig()
+	unknown, err = config.Unmarshal(k, &Konfig)
+	problems = append(problems, splitErrors(err)...)
+	return unknown, problems
+}
 
+// splitErrors returns the errors joined in err
+func splitErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// validateConfig returns every problem of the configuration
+func validateConfig(cfg *config.Config) (problems []error) {
 	// Check if the root directory is a Git repository
-	repo, err := git.PlainOpen(Konfig.Repo.RepoLocal.Path)
+	repo, err := git.PlainOpen(cfg.Repo.RepoLocal.Path)
 	if err != nil {
-		logger.Fatalf("the current/configured directory is not a git repository: %v", err)
+		problems = append(problems, fmt.Errorf("the current/configured directory is not a git repository: %v", err))
 	} else {
 		// go-git check git repository status
 		logger.Infof("the current/configured directory is a git repository")
+
+		// Get the repository's root directory
+		repoRoot, err := repo.Worktree()
+		if err != nil {
+			problems = append(problems, fmt.Errorf("the git repository has no worktree: %v", err))
+		} else {
+			logger.Infof("repository root: %v", repoRoot.Filesystem.Root())
+			gitStatus, _ := repoRoot.Status()
+			logger.Debugf("git status: %v", gitStatus.String())
+		}
 	}
 
-	// Get the repository's root directory
-	repoRoot, err := repo.Worktree()
-	if err != nil {
-		panic(err)
+	// Validate the encryption format
+	switch cfg.Encryptions.Age.Format {
+	case "", encryptions.FormatBinary:
+		logger.Debug("using binary age encryption format")
+	case encryptions.FormatStructured:
+		logger.Infof("using structured age encryption format (sensitiveOnly=%v)", cfg.Encryptions.Age.SensitiveOnly)
+	default:
+		problems = append(problems, fmt.Errorf("unsupported encryptions.age.format '%s', use binary or structured", cfg.Encryptions.Age.Format))
+	}
+	if err := encryptions.ValidateCompression(cfg.Encryptions.Age.Compression); err != nil {
+		problems = append(problems, fmt.Errorf("invalid encryptions.age.compression: %v", err))
+	}
+	if cfg.Encryptions.Age.Format == encryptions.FormatStructured &&
+		cfg.Encryptions.Age.Compression != "" && cfg.Encryptions.Age.Compression != encryptions.CompressionNone {
+		problems = append(problems, errors.New("encryptions.age.compression is only supported by the binary format"))
+	}
+
+	if _, err := commitmsg.New(cfg.Repo.Remote.CommitMessage, cfg.Repo.Remote.CommitTrailers); err != nil {
+		problems = append(problems, fmt.Errorf("invalid repo.remote commit message: %v", err))
 	}
-	logger.Infof("repository root: %v", repoRoot.Filesystem.Root())
-	gitStatus, _ := repoRoot.Status()
-	logger.Debugf("git status: %v", gitStatus.String())
 
-	// Validate GitHub sync configuration if enabled
-	if Konfig.Repo.RepoGithub.Enabled {
-		logger.Info("GitHub sync enabled, validating configuration...")
+	if _, err := storage.NewCommitSigner(cfg.Repo.Remote.Signing); err != nil {
+		problems = append(problems, fmt.Errorf("invalid repo.remote.signing: %v", err))
+	}
+
+	// Validate git sync configuration if enabled
+	if cfg.Repo.Remote.Enabled {
+		logger.Info("git sync enabled, validating configuration...")
 
 		// Validate remote URL is configured
-		if Konfig.Repo.RepoGithub.RemoteURL == "" {
-			logger.Fatal("GitHub sync enabled but remoteUrl not configured")
+		if cfg.Repo.Remote.RemoteURL == "" {
+			problems = append(problems, errors.New("git sync enabled but remoteUrl not configured"))
+		}
+
+		// Validate the forge and its quirks
+		remoteForge := cfg.Repo.Remote.Forge
+		if err := forge.ValidateType(remoteForge); err != nil {
+			problems = append(problems, fmt.Errorf("invalid repo.remote.forge: %v", err))
+		}
+		if remoteForge == "" {
+			remoteForge = forge.TypeGitHub
+		}
+		if detected := forge.DetectType(cfg.Repo.Remote.RemoteURL); detected != "" && detected != remoteForge {
+			logger.Warnf("remoteUrl is on %s but forge is %s", detected, remoteForge)
 		}
 
 		// Check if remote exists
-		remote, err := repo.Remote("origin")
-		if err == git.ErrRemoteNotFound {
-			logger.Warnf("remote 'origin' not found, will be created on first push")
-		} else if err == nil {
-			// Verify remote URL matches configuration
-			urls := remote.Config().URLs
-			logger.Infof("existing remote 'origin': %v", urls)
+		if repo != nil {
+			remote, err := repo.Remote("origin")
+			if err == git.ErrRemoteNotFound {
+				logger.Warnf("remote 'origin' not found, will be created on first push")
+			} else if err == nil {
+				// Verify remote URL matches configuration
+				urls := remote.Config().URLs
+				logger.Infof("existing remote 'origin': %v", urls)
+			}
 		}
 
 		// Validate authentication configuration
-		switch Konfig.Repo.RepoGithub.AuthMethod {
+		switch cfg.Repo.Remote.AuthMethod {
 		case "ssh":
-			if Konfig.Repo.RepoGithub.SSHKeyPath == "" {
-				logger.Fatal("authMethod is 'ssh' but sshKeyPath not configured")
+			// Loads the key or connects to the agent, and parses the known_hosts
+			// file and fingerprints
+			if _, err := storage.NewSSHAuth(cfg.Repo.Remote); err != nil {
+				problems = append(problems, fmt.Errorf("invalid SSH configuration: %v", err))
+			}
+			remoteURL, err := storage.RemoteURL(cfg.Repo.Remote)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("invalid SSH configuration: %v", err))
 			}
-			// Check if SSH key file exists
-			sshKeyPath := os.ExpandEnv(Konfig.Repo.RepoGithub.SSHKeyPath)
-			if _, err := os.Stat(sshKeyPath); os.IsNotExist(err) {
-				logger.Fatalf("SSH key not found: %s", sshKeyPath)
+			sshConfig := cfg.Repo.Remote.SSH
+			if sshConfig.KnownHostsFile == "" && len(sshConfig.HostKeyFingerprints) == 0 {
+				logger.Warn("no ssh.knownHostsFile or ssh.hostKeyFingerprints configured, using the default known_hosts files")
+			}
+			if sshConfig.Agent {
+				logger.Infof("using ssh-agent keys for %s", remoteURL)
+			} else {
+				logger.Infof("SSH key loaded: %s", os.ExpandEnv(cfg.Repo.Remote.SSHKeyPath))
 			}
-			logger.Infof("SSH key found: %s", sshKeyPath)
 		case "token":
-			token := os.ExpandEnv(Konfig.Repo.RepoGithub.Token)
+			token := os.ExpandEnv(cfg.Repo.Remote.Token)
 			if token == "" {
-				logger.Fatal("authMethod is 'token' but token not configured or empty")
+				problems = append(problems, errors.New("authMethod is 'token' but token not configured or empty"))
+			}
+			if cfg.Repo.Remote.TokenUsername == "" {
+				switch remoteForge {
+				case forge.TypeGeneric:
+					problems = append(problems, errors.New("authMethod is 'token' with forge 'generic' but tokenUsername not configured"))
+				case forge.TypeBitbucket:
+					logger.Info("using the Bitbucket access token username, set tokenUsername to your account for app passwords")
+				}
 			}
-			logger.Info("GitHub token configured (not showing value for security)")
+			if strings.HasPrefix(cfg.Repo.Remote.RemoteURL, "git@") || strings.HasPrefix(cfg.Repo.Remote.RemoteURL, "ssh://") {
+				problems = append(problems, errors.New("authMethod is 'token' but remoteUrl is an SSH URL, use the HTTPS URL"))
+			}
+			logger.Infof("%s token configured (not showing value for security)", remoteForge)
 		case "default":
 			logger.Info("using default git credentials from system")
 		default:
-			logger.Warnf("unknown authMethod '%s', will use default", Konfig.Repo.RepoGithub.AuthMethod)
+			logger.Warnf("unknown authMethod '%s', will use default", cfg.Repo.Remote.AuthMethod)
 		}
 
-		logger.Infof("GitHub sync validated: remote=%s, branch=%s, auth=%s",
-			Konfig.Repo.RepoGithub.RemoteURL,
-			Konfig.Repo.RepoGithub.Branch,
-			Konfig.Repo.RepoGithub.AuthMethod)
+		if prs := cfg.Repo.Remote.PullRequests; len(prs.Prefixes) > 0 {
+			if remoteForge != forge.TypeGitHub {
+				problems = append(problems, fmt.Errorf("pullRequests are not supported on forge %s", remoteForge))
+			}
+			if _, err := forge.RepositoryPath(cfg.Repo.Remote.RemoteURL); err != nil {
+				problems = append(problems, fmt.Errorf("pullRequests enabled but %v", err))
+			}
+			if os.ExpandEnv(cfg.Repo.Remote.Token) == "" {
+				logger.Warn("pullRequests enabled without a token, the forge API will reject opening pull requests")
+			}
+			logger.Infof("opening pull requests for states under %v", prs.Prefixes)
+		}
+
+		// Mirrors have their own forge, auth and retry settings
+		if err := storage.ValidateMirrors(cfg.Repo.Remote.Mirrors); err != nil {
+			problems = append(problems, fmt.Errorf("invalid repo.remote.mirrors: %v", err))
+		}
+		for _, mirror := range cfg.Repo.Remote.Mirrors {
+			if err := forge.ValidateType(mirror.Forge); err != nil {
+				problems = append(problems, fmt.Errorf("invalid forge of mirror %s: %v", mirror.Name, err))
+			}
+			if mirror.AuthMethod == "token" && os.ExpandEnv(mirror.Token) == "" {
+				problems = append(problems, fmt.Errorf("mirror %s: authMethod is 'token' but token not configured or empty", mirror.Name))
+			}
+			if mirror.AuthMethod == "token" && mirror.Forge == forge.TypeGeneric && mirror.TokenUsername == "" {
+				problems = append(problems, fmt.Errorf("mirror %s: authMethod is 'token' with forge 'generic' but tokenUsername not configured", mirror.Name))
+			}
+			if mirror.AuthMethod == "ssh" {
+				if _, err := storage.NewSSHAuth(mirror.RepoRemote); err != nil {
+					problems = append(problems, fmt.Errorf("invalid SSH configuration of mirror %s: %v", mirror.Name, err))
+				}
+				if _, err := storage.RemoteURL(mirror.RepoRemote); err != nil {
+					problems = append(problems, fmt.Errorf("invalid SSH configuration of mirror %s: %v", mirror.Name, err))
+				}
+			}
+			logger.Infof("mirroring to %s: remote=%s, required=%v", mirror.Name, mirror.RemoteURL, mirror.Required)
+		}
+
+		logger.Infof("git sync validated: forge=%s, remote=%s, branch=%s, auth=%s",
+			remoteForge,
+			cfg.Repo.Remote.RemoteURL,
+			cfg.Repo.Remote.Branch,
+			cfg.Repo.Remote.AuthMethod)
 	} else {
-		logger.Debug("GitHub sync is disabled")
+		logger.Debug("git sync is disabled")
+	}
+
+	if cfg.Server.Admin.Enabled && os.ExpandEnv(cfg.Server.Admin.Token) == "" {
+		problems = append(problems, errors.New("server.admin is enabled but server.admin.token is not configured or empty"))
+	}
+
+	for _, err := range splitErrors(webhook.Validate(cfg.Webhooks)) {
+		problems = append(problems, fmt.Errorf("invalid webhooks: %v", err))
 	}
+	return problems
 }
@@ -1,10 +1,23 @@
 package command
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/kholisrag/terraform-backend-gitops/pkg/app"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
 	"github.com/spf13/cobra"
 )
 
+// shutdownTimeout bounds the time in-flight requests and pending spans get
+// on exit
+const shutdownTimeout = 10 * time.Second
+
 var (
 	serveCmd = &cobra.Command{
 		Use:   "serve",
@@ -16,8 +29,36 @@ var (
 			Konfig.Build.BuildTime = buildTime
 
 			s := app.NewApp(&Konfig)
-			//nolint:errcheck
-			s.Run(Konfig.Server.Address)
+			app.StartMetricsServer(&Konfig)
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			server := &http.Server{
+				Addr:              Konfig.Server.Address,
+				Handler:           s,
+				ReadHeaderTimeout: 30 * time.Second,
+			}
+			// the event streams only end when closed
+			server.RegisterOnShutdown(app.CloseEvents)
+			go func() {
+				logger.Infof("listening and serving HTTP on %s", Konfig.Server.Address)
+				if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					logger.Fatalf("server failed: %v", err)
+				}
+			}()
+
+			<-ctx.Done()
+			logger.Info("shutting down")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				logger.Warnf("failed to shut down the server: %v", err)
+			}
+			// commits the last audit records and flushes their spans
+			if err := app.Shutdown(shutdownCtx); err != nil {
+				logger.Warnf("failed to shut down: %v", err)
+			}
 		},
 	}
 )
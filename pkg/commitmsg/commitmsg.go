@@ -0,0 +1,156 @@
+// Package commitmsg renders the commit messages of state writes from the
+// repo.remote.commitMessage template and trailers
+package commitmsg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/tfstate"
+)
+
+// Default is the commit message when none is configured
+const Default = "chore: update terraform state [automated]"
+
+// maxBodyAddresses caps the addresses listed per kind of change in the
+// commit body, e.g. when importing a large state
+const maxBodyAddresses = 50
+
+// Data is available to the commit message and trailer templates, e.g.
+// {{ .Path }} or {{ .Lock.Who }}
+type Data struct {
+	Path             string
+	Serial           uint64
+	Lineage          string
+	TerraformVersion string
+	Lock             Lock
+	// Principal is the user authenticated by the request, if any
+	Principal string
+	Added     int
+	Changed   int
+	Removed   int
+	// Changes are listed in the commit body, between the message and the
+	// trailers
+	Changes tfstate.Changes
+}
+
+// Lock is the lock held by the writer of the state
+type Lock struct {
+	Who       string
+	Operation string
+	ID        string
+}
+
+type trailer struct {
+	key   string
+	value *template.Template
+}
+
+// Template renders commit messages
+type Template struct {
+	message  *template.Template
+	trailers []trailer
+}
+
+// IsTemplate reports whether message uses template actions. A message
+// without any is a fixed prefix followed by the state path, as before
+// templates were supported.
+func IsTemplate(message string) bool {
+	return strings.Contains(message, "{{")
+}
+
+// New parses a commit message template and its trailers. Unknown fields
+// are reported when rendering, which New checks with empty data.
+func New(message string, trailers []config.CommitTrailer) (*Template, error) {
+	if message == "" {
+		message = Default
+	}
+	if !IsTemplate(message) {
+		message += ": {{ .Path }}"
+	}
+
+	t := &Template{}
+	var err error
+	if t.message, err = parse("commitMessage", message); err != nil {
+		return nil, err
+	}
+	for _, tr := range trailers {
+		if tr.Key == "" || strings.ContainsAny(tr.Key, ": \n") {
+			return nil, fmt.Errorf("invalid commit trailer key '%s'", tr.Key)
+		}
+		value, err := parse("commitTrailers."+tr.Key, tr.Value)
+		if err != nil {
+			return nil, err
+		}
+		t.trailers = append(t.trailers, trailer{key: tr.Key, value: value})
+	}
+
+	if _, err := t.Render(Data{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func parse(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	return t, nil
+}
+
+// Render returns the commit message for data. The summary of the changes
+// and the trailers follow the message after a blank line, trailers
+// rendering to an empty value are left out.
+func (t *Template) Render(data Data) (string, error) {
+	var b bytes.Buffer
+	if err := t.message.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render commit message: %w", err)
+	}
+	message := strings.TrimSpace(b.String())
+	if body := changesBody(data.Changes); body != "" {
+		message += "\n\n" + body
+	}
+
+	var trailers []string
+	for _, tr := range t.trailers {
+		b.Reset()
+		if err := tr.value.Execute(&b, data); err != nil {
+			return "", fmt.Errorf("failed to render commit trailer %s: %w", tr.key, err)
+		}
+		// a trailer is a single line
+		value := strings.Join(strings.Fields(b.String()), " ")
+		if value != "" {
+			trailers = append(trailers, tr.key+": "+value)
+		}
+	}
+	if len(trailers) > 0 {
+		message += "\n\n" + strings.Join(trailers, "\n")
+	}
+	return message, nil
+}
+
+// changesBody lists the changed resource addresses and output names, one per
+// line prefixed with +, ~ or -
+func changesBody(changes tfstate.Changes) string {
+	var lines []string
+	list := func(prefix string, addresses []string) {
+		for i, address := range addresses {
+			if i == maxBodyAddresses {
+				lines = append(lines, fmt.Sprintf("%s ... and %d more", prefix, len(addresses)-i))
+				return
+			}
+			lines = append(lines, prefix+" "+address)
+		}
+	}
+	list("+", changes.Added)
+	list("~", changes.Changed)
+	list("-", changes.Removed)
+	if len(changes.Outputs) > 0 {
+		lines = append(lines, "Outputs changed: "+strings.Join(changes.Outputs, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,115 @@
+package commitmsg
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/tfstate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	data := Data{
+		Path:             "env/prod.tfstate",
+		Serial:           7,
+		Lineage:          "abc",
+		TerraformVersion: "1.9.5",
+		Lock:             Lock{Who: "alice@laptop", Operation: "OperationTypeApply", ID: "lock-123"},
+		Principal:        "ci",
+		Added:            1,
+		Changed:          2,
+		Removed:          3,
+	}
+
+	tests := []struct {
+		name     string
+		message  string
+		trailers []config.CommitTrailer
+		expected string
+	}{
+		{
+			name:     "default",
+			expected: "chore: update terraform state [automated]: env/prod.tfstate",
+		},
+		{
+			name:     "fixed prefix",
+			message:  "state update",
+			expected: "state update: env/prod.tfstate",
+		},
+		{
+			name:     "template",
+			message:  "{{ .Path }}: serial {{ .Serial }} (+{{ .Added }} ~{{ .Changed }} -{{ .Removed }})",
+			expected: "env/prod.tfstate: serial 7 (+1 ~2 -3)",
+		},
+		{
+			name:    "trailers",
+			message: "update {{ .Path }}",
+			trailers: []config.CommitTrailer{
+				{Key: "State-Lineage", Value: "{{ .Lineage }}"},
+				{Key: "Lock-ID", Value: "{{ .Lock.ID }}"},
+				{Key: "Terraform-Principal", Value: "{{ .Principal }}"},
+				{Key: "Skipped-When-Empty", Value: "{{ if .Lock.Who }}{{ else }}never{{ end }}"},
+			},
+			expected: "update env/prod.tfstate\n\nState-Lineage: abc\nLock-ID: lock-123\nTerraform-Principal: ci",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := New(tt.message, tt.trailers)
+			require.NoError(t, err)
+
+			message, err := tmpl.Render(data)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, message)
+		})
+	}
+}
+
+func TestRender_Changes(t *testing.T) {
+	tmpl, err := New("update {{ .Path }}", []config.CommitTrailer{{Key: "State-Lineage", Value: "{{ .Lineage }}"}})
+	require.NoError(t, err)
+
+	message, err := tmpl.Render(Data{
+		Path:    "prod.tfstate",
+		Lineage: "abc",
+		Changes: tfstate.Changes{
+			Added:   []string{"aws_s3_bucket.logs"},
+			Changed: []string{`aws_iam_user.this["alice"]`},
+			Removed: []string{"module.vpc.aws_subnet.private[1]"},
+			Outputs: []string{"bucket_arn", "vpc_id"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "update prod.tfstate\n\n"+
+		"+ aws_s3_bucket.logs\n"+
+		"~ aws_iam_user.this[\"alice\"]\n"+
+		"- module.vpc.aws_subnet.private[1]\n"+
+		"Outputs changed: bucket_arn, vpc_id\n\n"+
+		"State-Lineage: abc", message)
+
+	added := make([]string, maxBodyAddresses+3)
+	for i := range added {
+		added[i] = "null_resource.this[" + strconv.Itoa(i) + "]"
+	}
+	message, err = tmpl.Render(Data{Path: "prod.tfstate", Changes: tfstate.Changes{Added: added}})
+	require.NoError(t, err)
+	assert.Equal(t, maxBodyAddresses+1, strings.Count(message, "\n+ "))
+	assert.True(t, strings.HasSuffix(message, "\n+ ... and 3 more"), message)
+}
+
+func TestNew_Invalid(t *testing.T) {
+	_, err := New("{{ .Path", nil)
+	assert.Error(t, err)
+
+	_, err = New("{{ .Unknown }}", nil)
+	assert.Error(t, err)
+
+	_, err = New("update", []config.CommitTrailer{{Key: "Bad Key", Value: "x"}})
+	assert.Error(t, err)
+
+	_, err = New("update", []config.CommitTrailer{{Key: "Lock-ID", Value: "{{ .Lock.Unknown }}"}})
+	assert.Error(t, err)
+}
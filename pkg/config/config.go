@@ -1,5 +1,7 @@
 package config
 
+import "reflect"
+
 type Config struct {
 	LogLevel    string      `koanf:"logLevel" default:"info"`
 	Repo        Repo        `koanf:"repo"`
@@ -8,30 +10,114 @@ type Config struct {
 	Tracing     Tracing     `koanf:"tracing"`
 	Encryptions Encryptions `koanf:"encryptions"`
 	Redis       Redis       `koanf:"redis"`
+	Audit       Audit       `koanf:"audit"`
+	Webhooks    Webhooks    `koanf:"webhooks"`
 }
 
 type Repo struct {
-	RepoLocal  RepoLocal  `koanf:"local"`
-	RepoGithub RepoGithub `koanf:"github"`
+	RepoLocal RepoLocal  `koanf:"local"`
+	Remote    RepoRemote `koanf:"remote"`
+	// RepoGithub is the former name of Remote, used when remote is not
+	// configured
+	RepoGithub RepoRemote `koanf:"github"`
 }
 
 type RepoLocal struct {
 	Path string `koanf:"path"`
 	Root string `koanf:"root,omitempty"`
+	// BackupDir keeps the previous version of a state until its commit is
+	// confirmed, defaults to .git/state-backups inside the repository
+	BackupDir string `koanf:"backupDir"`
+	// Metadata writes and commits a plaintext <state>.meta.json with the
+	// serial, lineage, writer and resource addresses of every state
+	Metadata bool `koanf:"metadata" default:"false"`
+	// ChangesHistory is the number of writes whose resource-level changes
+	// are kept in <state>.changes.json, defaults to 100
+	ChangesHistory int `koanf:"changesHistory" default:"100"`
+}
+
+// RepoRemote is the git remote the states are pushed to
+type RepoRemote struct {
+	Enabled bool `koanf:"enabled"`
+	// Forge is github, gitlab, gitea, bitbucket or generic, it selects the
+	// token username and the pull request API
+	Forge      string    `koanf:"forge" default:"github"`
+	RemoteURL  string    `koanf:"remoteUrl"`
+	Branch     string    `koanf:"branch" default:"main"`
+	AuthMethod string    `koanf:"authMethod" default:"ssh"`
+	SSHKeyPath string    `koanf:"sshKeyPath"`
+	SSH        RemoteSSH `koanf:"ssh"`
+	Token      string    `koanf:"token"`
+	// TokenUsername overrides the username sent with the token, by default
+	// the one expected by the forge
+	TokenUsername string `koanf:"tokenUsername"`
+	// CommitMessage is a text/template of the commit message, see
+	// pkg/commitmsg for its fields. A message without template actions is
+	// followed by the state path.
+	CommitMessage  string          `koanf:"commitMessage" default:"chore: update terraform state [automated]"`
+	CommitTrailers []CommitTrailer `koanf:"commitTrailers"`
+	AutoPush       bool            `koanf:"autoPush" default:"true"`
+	Author         CommitAuthor    `koanf:"author"`
+	RetryAttempts  int             `koanf:"retryAttempts" default:"3"`
+	RetryDelay     int             `koanf:"retryDelay" default:"5"`
+	Signing        CommitSigning   `koanf:"signing"`
+	PullRequests   PullRequests    `koanf:"pullRequests"`
+	Mirrors        []RemoteMirror  `koanf:"mirrors"`
+}
+
+// RemoteMirror is an additional remote every commit is pushed to after the
+// primary one, with its own URL, auth and retry settings
+type RemoteMirror struct {
+	// Name of the git remote, anything but origin
+	Name string `koanf:"name"`
+	// Required fails the write when the mirror can not be pushed to,
+	// otherwise the failure is only logged and reported in its status
+	Required   bool `koanf:"required" default:"false"`
+	RepoRemote `koanf:",squash"`
+}
+
+// PullRequests commits the states under Prefixes to a branch per state and
+// opens a pull request into Branch instead of pushing to it
+type PullRequests struct {
+	// Prefixes of the state paths, e.g. prod/
+	Prefixes     []string `koanf:"prefixes"`
+	BranchPrefix string   `koanf:"branchPrefix" default:"tfstate/"`
+	// APIURL is the forge API, https://<host>/api/v3 for GitHub Enterprise
+	APIURL string `koanf:"apiUrl" default:"https://api.github.com"`
 }
 
-type RepoGithub struct {
-	Enabled       bool         `koanf:"enabled"`
-	RemoteURL     string       `koanf:"remoteUrl"`
-	Branch        string       `koanf:"branch" default:"main"`
-	AuthMethod    string       `koanf:"authMethod" default:"ssh"`
-	SSHKeyPath    string       `koanf:"sshKeyPath"`
-	Token         string       `koanf:"token"`
-	CommitMessage string       `koanf:"commitMessage" default:"chore: update terraform state [automated]"`
-	AutoPush      bool         `koanf:"autoPush" default:"true"`
-	Author        CommitAuthor `koanf:"author"`
-	RetryAttempts int          `koanf:"retryAttempts" default:"3"`
-	RetryDelay    int          `koanf:"retryDelay" default:"5"`
+// RemoteSSH hardens the SSH transport of the remote
+type RemoteSSH struct {
+	// KeyPassphrase decrypts sshKeyPath, supports ${ENV} expansion
+	KeyPassphrase     string `koanf:"keyPassphrase"`
+	KeyPassphraseFile string `koanf:"keyPassphraseFile"`
+	// Agent authenticates with the keys of the ssh-agent at SSH_AUTH_SOCK
+	// instead of sshKeyPath
+	Agent bool `koanf:"agent" default:"false"`
+	// User and Port override the ones of the remote URL
+	User string `koanf:"user"`
+	Port int    `koanf:"port"`
+	// KnownHostsFile and HostKeyFingerprints (SHA256:... as printed by
+	// ssh-keygen -l) verify the host key, the default known_hosts files are
+	// used when neither is set
+	KnownHostsFile      string   `koanf:"knownHostsFile"`
+	HostKeyFingerprints []string `koanf:"hostKeyFingerprints"`
+}
+
+// CommitSigning signs the commits of the backend with an OpenPGP or SSH key
+type CommitSigning struct {
+	// Format is openpgp or ssh, signing is disabled when empty
+	Format         string `koanf:"format" default:""`
+	KeyPath        string `koanf:"keyPath"`
+	Passphrase     string `koanf:"passphrase"`
+	PassphraseFile string `koanf:"passphraseFile"`
+}
+
+// CommitTrailer is a git trailer appended to the commit messages, its value
+// is a template like the commit message
+type CommitTrailer struct {
+	Key   string `koanf:"key"`
+	Value string `koanf:"value"`
 }
 
 type CommitAuthor struct {
@@ -48,17 +134,87 @@ type Build struct {
 type Server struct {
 	Mode    string `koanf:"mode" default:"release"`
 	Address string `koanf:"address" default:"0.0.0.0:20002"`
+	// MaxBodySize is the maximum request body size in bytes
+	MaxBodySize int64   `koanf:"maxBodySize" default:"104857600"`
+	Admin       Admin   `koanf:"admin"`
+	Metrics     Metrics `koanf:"metrics"`
+	Events      Events  `koanf:"events"`
+	Health      Health  `koanf:"health"`
+}
+
+// Health configures the dependency checks of /readyz and /healthz?verbose
+type Health struct {
+	// Timeout of each check in seconds
+	Timeout int `koanf:"timeout" default:"5"`
+	// Remote also checks that the remote is reachable with the configured
+	// auth, like git ls-remote
+	Remote        bool `koanf:"remote" default:"false"`
+	RemoteTimeout int  `koanf:"remoteTimeout" default:"10"`
+}
+
+// Events streams the lock, state and git sync events on /v1/events, shared
+// by the replicas through redis.addresses
+type Events struct {
+	Enabled bool `koanf:"enabled" default:"false"`
+	// Channel is the Redis pub/sub channel of the events
+	Channel string `koanf:"channel" default:"terraform-backend-gitops:events"`
+	// KeepAlive is the interval in seconds of the comments keeping idle
+	// streams open through proxies
+	KeepAlive int `koanf:"keepAlive" default:"15"`
+}
+
+// Metrics serves the Prometheus metrics on /metrics
+type Metrics struct {
+	Enabled bool `koanf:"enabled" default:"false"`
+	// Address is the listen address of the metrics server, empty serves
+	// /metrics on server.address
+	Address string `koanf:"address"`
+}
+
+type Admin struct {
+	Enabled bool   `koanf:"enabled" default:"false"`
+	Token   string `koanf:"token"`
 }
 
 type Tracing struct {
-	Enabled    bool    `koanf:"enabled" default:"true"`
+	Enabled    bool    `koanf:"enabled" default:"false"`
 	Provider   string  `koanf:"provider" default:"stdout"`
 	SampleRate float64 `koanf:"sampleRate" default:"0.1"`
 	OTLP       OTLP    `koanf:"otlp"`
+	// ServiceName is the service.name resource attribute of the spans
+	ServiceName string `koanf:"serviceName" default:"terraform-backend-gitops"`
+	// Environment is the deployment.environment resource attribute
+	Environment string `koanf:"environment"`
+	// ResourceAttributes are added to the resource of the spans, as a list
+	// since attribute keys contain dots
+	ResourceAttributes []ResourceAttribute `koanf:"resourceAttributes"`
+}
+
+type ResourceAttribute struct {
+	Key   string `koanf:"key"`
+	Value string `koanf:"value"`
 }
 
 type OTLP struct {
 	Endpoint string `koanf:"endpoint" default:"0.0.0.0:4317"`
+	// Headers are sent with every export, e.g. an API key, values support
+	// ${ENV} expansion
+	Headers map[string]string `koanf:"headers"`
+	// Timeout of an export in seconds
+	Timeout int     `koanf:"timeout" default:"10"`
+	TLS     OTLPTLS `koanf:"tls"`
+}
+
+// OTLPTLS secures the connection to the collector, which is plaintext when
+// disabled
+type OTLPTLS struct {
+	Enabled bool `koanf:"enabled" default:"false"`
+	// CAFile verifies the collector certificate instead of the system roots
+	CAFile string `koanf:"caFile"`
+	// CertFile and KeyFile are the client certificate for mutual TLS
+	CertFile           string `koanf:"certFile"`
+	KeyFile            string `koanf:"keyFile"`
+	InsecureSkipVerify bool   `koanf:"insecureSkipVerify" default:"false"`
 }
 
 type Encryptions struct {
@@ -67,14 +223,75 @@ type Encryptions struct {
 }
 
 type Age struct {
-	Recipient         string `koanf:"recipient" default:""`
-	AgePrivateKeyPath string `koanf:"keys" default:""`
+	Recipient         string   `koanf:"recipient" default:""`
+	Recipients        []string `koanf:"recipients"`
+	RecipientsFile    string   `koanf:"recipientsFile" default:""`
+	AgePrivateKeyPath string   `koanf:"keys" default:""`
+	IdentityFiles     []string `koanf:"identityFiles"`
+	IdentityEnv       string   `koanf:"identityEnv" default:""`
+	Passphrase        string   `koanf:"passphrase" default:""`
+	PassphraseFile    string   `koanf:"passphraseFile" default:""`
+	Format            string   `koanf:"format" default:"binary"`
+	SensitiveOnly     bool     `koanf:"sensitiveOnly" default:"false"`
+	Compression       string   `koanf:"compression" default:"none"`
+}
+
+// Audit records every state and lock request and admin action as JSON
+// lines, without any state content
+type Audit struct {
+	Enabled bool   `koanf:"enabled" default:"false"`
+	Path    string `koanf:"path" default:"audit.jsonl"`
+	// MaxSizeMB rotates the file once it reaches the size, keeping
+	// MaxBackups rotated files as path.1 to path.N
+	MaxSizeMB  int `koanf:"maxSizeMB" default:"100"`
+	MaxBackups int `koanf:"maxBackups" default:"10"`
+	// Commit also appends the records to audit/YYYY-MM-DD.jsonl in the state
+	// repository, committed every CommitInterval seconds
+	Commit         bool `koanf:"commit" default:"false"`
+	CommitInterval int  `koanf:"commitInterval" default:"300"`
+}
+
+// Webhooks notify the targets of state and lock events with signed JSON
+// payloads
+type Webhooks struct {
+	Targets []WebhookTarget `koanf:"targets"`
+	// QueuePath persists the undelivered events across restarts
+	QueuePath string `koanf:"queuePath" default:"webhooks-queue.json"`
+	// MaxAttempts of a delivery, retried after InitialBackoff seconds doubled
+	// after every failure up to MaxBackoff
+	MaxAttempts    int `koanf:"maxAttempts" default:"10"`
+	InitialBackoff int `koanf:"initialBackoff" default:"5"`
+	MaxBackoff     int `koanf:"maxBackoff" default:"3600"`
+	// Timeout of a delivery in seconds
+	Timeout int `koanf:"timeout" default:"10"`
+	// LockHeldThreshold is the time in seconds after which a lock still held
+	// sends lock.held_too_long
+	LockHeldThreshold int `koanf:"lockHeldThreshold" default:"3600"`
+	// DeliveryLogSize is the number of deliveries kept for the delivery log
+	DeliveryLogSize int `koanf:"deliveryLogSize" default:"100"`
+}
+
+type WebhookTarget struct {
+	Name string `koanf:"name"`
+	URL  string `koanf:"url"`
+	// Secret signs the payloads with HMAC-SHA256, supports ${ENV} expansion
+	Secret string `koanf:"secret"`
+	// Events are the event types sent to the target, all when empty
+	Events []string `koanf:"events"`
+	// States are glob patterns of the state paths, ** matching any number of
+	// directories, all when empty
+	States  []string          `koanf:"states"`
+	Headers map[string]string `koanf:"headers"`
 }
 
 type Redis struct {
 	Addresses []string `koanf:"addresses"`
 }
 
+// NewDefaultConfig returns the configuration with the default tag of every
+// field applied
 func NewDefaultConfig() *Config {
-	return &Config{}
+	config := &Config{}
+	setDefaults(reflect.ValueOf(config).Elem())
+	return config
 }
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/knadh/koanf/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func load(t *testing.T, content string) *koanf.Koanf {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	k := koanf.New(".")
+	require.NoError(t, k.Load(file.Provider(path), yaml.Parser()))
+	return k
+}
+
+func TestNewDefaultConfig(t *testing.T) {
+	cfg := NewDefaultConfig()
+	assert.Equal(t, "info", cfg.LogLevel)
+	assert.Equal(t, "main", cfg.Repo.Remote.Branch)
+	assert.Equal(t, "ssh", cfg.Repo.Remote.AuthMethod)
+	assert.True(t, cfg.Repo.Remote.AutoPush)
+	assert.Equal(t, "0.0.0.0:20002", cfg.Server.Address)
+	assert.Equal(t, int64(104857600), cfg.Server.MaxBodySize)
+	assert.False(t, cfg.Tracing.Enabled)
+	assert.Equal(t, 0.1, cfg.Tracing.SampleRate)
+	assert.Equal(t, 100, cfg.Audit.MaxSizeMB)
+	assert.Equal(t, "", cfg.Repo.Remote.Signing.Format)
+}
+
+func TestUnmarshal(t *testing.T) {
+	k := load(t, `
+repo:
+  remote:
+    branch: trunk
+    autoPush: false
+    mirrors:
+      - name: gitlab
+        authMethod: token
+        autoPush: false
+tracing:
+  enabled: true
+`)
+	cfg := NewDefaultConfig()
+	unknown, err := Unmarshal(k, cfg)
+	require.NoError(t, err)
+	assert.Empty(t, unknown)
+
+	assert.Equal(t, "trunk", cfg.Repo.Remote.Branch)
+	assert.Equal(t, "ssh", cfg.Repo.Remote.AuthMethod)
+	// set to the zero value explicitly
+	assert.False(t, cfg.Repo.Remote.AutoPush)
+	assert.True(t, cfg.Tracing.Enabled)
+	assert.Equal(t, "stdout", cfg.Tracing.Provider)
+
+	// the items of lists get the defaults of their fields
+	require.Len(t, cfg.Repo.Remote.Mirrors, 1)
+	mirror := cfg.Repo.Remote.Mirrors[0]
+	assert.Equal(t, "token", mirror.AuthMethod)
+	assert.Equal(t, "github", mirror.Forge)
+	assert.Equal(t, 3, mirror.RetryAttempts)
+	assert.False(t, mirror.AutoPush)
+}
+
+func TestUnmarshal_ReportsEveryProblem(t *testing.T) {
+	k := load(t, `
+repo:
+  remote:
+    remoteURL: "https://github.com/a/b.git"
+    tokn: x
+    mirrors:
+      - name: gitlab
+        retries: 3
+server:
+  adress: "0.0.0.0:8080"
+  maxBodySize: lots
+  events:
+    keepAlive: often
+tracing:
+  otlp:
+    headers:
+      X-Api-Key: secret
+`)
+	cfg := NewDefaultConfig()
+	unknown, err := Unmarshal(k, cfg)
+	assert.Equal(t, []string{"repo.remote.mirrors[0].retries", "repo.remote.tokn", "server.adress"}, unknown)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "server.maxBodySize")
+	assert.Contains(t, err.Error(), "server.events.keepAlive")
+	// keys are matched ignoring case
+	assert.Equal(t, "https://github.com/a/b.git", cfg.Repo.Remote.RemoteURL)
+}
+
+func TestEnvOverrides(t *testing.T) {
+	overrides, err := EnvOverrides([]string{
+		"TBG_REPO__GITHUB__TOKEN=secret",
+		"TBG_SERVER__MAX_BODY_SIZE=1024",
+		"TBG_REDIS__ADDRESSES=redis-1:6379, redis-2:6379",
+		"TBG_LOG_LEVEL=debug",
+		// used by ${ENV} expansions
+		"TBG_ADMIN_TOKEN=admin",
+		"HOME=/root",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"repo.remote.token":  "secret",
+		"server.maxBodySize": "1024",
+		"redis.addresses":    []string{"redis-1:6379", "redis-2:6379"},
+		"logLevel":           "debug",
+	}, overrides)
+
+	_, err = EnvOverrides([]string{
+		"TBG_SERVER__ADRESS=0.0.0.0:8080",
+		"TBG_REPO__REMOTE__MIRRORS=gitlab",
+		"TBG_SERVER__ADMIN=true",
+	})
+	require.Error(t, err)
+	assert.Len(t, err.(interface{ Unwrap() []error }).Unwrap(), 3)
+	assert.Contains(t, err.Error(), "TBG_SERVER__ADRESS: unknown key")
+	assert.Contains(t, err.Error(), "repo.remote.mirrors is a list of objects")
+	assert.Contains(t, err.Error(), "server.admin is a section")
+}
+
+func TestFlagOverrides(t *testing.T) {
+	overrides, err := FlagOverrides([]string{
+		"server.address=0.0.0.0:8080",
+		"repo.remote.autopush=false",
+		"tracing.otlp.headers.X-Api-Key=secret",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"server.address":                 "0.0.0.0:8080",
+		"repo.remote.autoPush":           "false",
+		"tracing.otlp.headers.X-Api-Key": "secret",
+	}, overrides)
+
+	_, err = FlagOverrides([]string{"server.address", "server.nope=1"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "--set server.address: expected key=value")
+	assert.Contains(t, err.Error(), "--set server.nope: unknown key")
+}
+
+func TestFlagOverrides_Apply(t *testing.T) {
+	k := load(t, `
+server:
+  address: "0.0.0.0:9000"
+  mode: debug
+`)
+	overrides, err := FlagOverrides([]string{"server.address=127.0.0.1:8080", "server.maxBodySize=10"})
+	require.NoError(t, err)
+	for key, value := range overrides {
+		require.NoError(t, k.Set(key, value))
+	}
+
+	cfg := NewDefaultConfig()
+	_, err = Unmarshal(k, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:8080", cfg.Server.Address)
+	assert.Equal(t, "debug", cfg.Server.Mode)
+	assert.Equal(t, int64(10), cfg.Server.MaxBodySize)
+}
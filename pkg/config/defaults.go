@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// setDefaults sets the zero fields of the struct v to the value of their
+// default tag, the fields of nested structs included
+func setDefaults(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if value.Kind() == reflect.Struct {
+			setDefaults(value)
+			continue
+		}
+		tag, ok := field.Tag.Lookup("default")
+		if !ok || tag == "" || !value.IsZero() {
+			continue
+		}
+		if err := setValue(value, tag); err != nil {
+			// the tags are constants, a test loads all of them
+			panic(fmt.Sprintf("config: invalid default of %s.%s: %v", t.Name(), field.Name, err))
+		}
+	}
+}
+
+func setValue(value reflect.Value, s string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetInt(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported kind %s", value.Kind())
+	}
+	return nil
+}
+
+// defaultsHook sets the defaults of the structs created while decoding, the
+// items of lists like the mirrors, before their keys are decoded
+func defaultsHook(from, to reflect.Value) (any, error) {
+	if to.Kind() == reflect.Struct && to.CanSet() && to.IsZero() {
+		setDefaults(to)
+	}
+	return from.Interface(), nil
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/knadh/koanf/v2"
+)
+
+// Unmarshal decodes the configuration loaded in k over config, usually
+// NewDefaultConfig, the items of lists like the mirrors get the defaults of
+// their fields. It returns the keys matching no field and every value that
+// could not be decoded.
+func Unmarshal(k *koanf.Koanf, config *Config) (unknown []string, err error) {
+	err = k.UnmarshalWithConf("", config, koanf.UnmarshalConf{
+		DecoderConfig: &mapstructure.DecoderConfig{
+			DecodeHook: mapstructure.ComposeDecodeHookFunc(
+				defaultsHook,
+				mapstructure.StringToTimeDurationHookFunc(),
+				mapstructure.TextUnmarshallerHookFunc()),
+			Result:           config,
+			WeaklyTypedInput: true,
+		},
+	})
+	unknown = unknownKeys(k.Raw(), reflect.TypeOf(*config), "")
+	sort.Strings(unknown)
+	return unknown, decodeErrors(err)
+}
+
+// decodeErrors joins the errors of the decoded values, reported together
+func decodeErrors(err error) error {
+	var decodeErr *mapstructure.Error
+	if !errors.As(err, &decodeErr) {
+		return err
+	}
+	errs := make([]error, 0, len(decodeErr.Errors))
+	for _, e := range decodeErr.Errors {
+		errs = append(errs, errors.New(e))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding the
+// configuration, e.g. TBG_REPO__REMOTE__TOKEN for repo.remote.token
+const EnvPrefix = "TBG_"
+
+// envSeparator separates the segments of a key in an environment variable
+const envSeparator = "__"
+
+var errUnknownKey = errors.New("unknown key")
+
+// deprecatedKeys are the former names of the configuration sections
+var deprecatedKeys = map[string]string{
+	"repo.github": "repo.remote",
+}
+
+// EnvOverrides returns the configuration keys and values of the TBG_
+// environment variables in environ. The segments of a key are separated by
+// a double underscore and matched ignoring case and single underscores, so
+// TBG_SERVER__MAX_BODY_SIZE sets server.maxBodySize. Lists are comma
+// separated. The variables without a double underscore matching no top-level
+// key are ignored.
+func EnvOverrides(environ []string) (map[string]any, error) {
+	overrides := map[string]any{}
+	var errs []error
+	for _, env := range environ {
+		name, value, ok := strings.Cut(env, "=")
+		if !ok || !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		path := strings.Split(strings.TrimPrefix(name, EnvPrefix), envSeparator)
+		key, v, err := override(path, value, func(s string) string {
+			return strings.ToLower(strings.ReplaceAll(s, "_", ""))
+		})
+		if err != nil {
+			// without a separator it is likely a variable of a ${ENV}
+			// expansion, like TBG_ADMIN_TOKEN
+			if len(path) > 1 {
+				errs = append(errs, fmt.Errorf("environment variable %s: %w", name, err))
+			}
+			continue
+		}
+		overrides[key] = v
+	}
+	return overrides, errors.Join(errs...)
+}
+
+// FlagOverrides returns the configuration keys and values of key=value
+// pairs, the keys are matched ignoring case. Lists are comma separated.
+func FlagOverrides(pairs []string) (map[string]any, error) {
+	overrides := map[string]any{}
+	var errs []error
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			errs = append(errs, fmt.Errorf("--set %s: expected key=value", pair))
+			continue
+		}
+		key, v, err := override(strings.Split(name, "."), value, strings.ToLower)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("--set %s: %w", name, err))
+			continue
+		}
+		overrides[key] = v
+	}
+	return overrides, errors.Join(errs...)
+}
+
+// override resolves the key of the path and converts the value to the type
+// of its field
+func override(path []string, value string, normalize func(string) string) (string, any, error) {
+	key, t, err := resolveKey(path, normalize)
+	if err != nil {
+		return "", nil, err
+	}
+	if t.Kind() != reflect.Slice {
+		return key, value, nil
+	}
+	if t.Elem().Kind() == reflect.Struct {
+		return "", nil, fmt.Errorf("%s is a list of objects, set it in the configuration file", key)
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return key, items, nil
+}
+
+// resolveKey returns the configuration key of the path and the type of its
+// field. The keys of a map are the rest of the path, kept as is.
+func resolveKey(path []string, normalize func(string) string) (string, reflect.Type, error) {
+	t := reflect.TypeOf(Config{})
+	var resolved []string
+	for i, segment := range path {
+		if t.Kind() == reflect.Map {
+			resolved = append(resolved, strings.Join(path[i:], "."))
+			t = t.Elem()
+			break
+		}
+		if segment == "" || t.Kind() != reflect.Struct {
+			return "", nil, errUnknownKey
+		}
+		name, field, ok := lookupField(t, normalize(segment), normalize)
+		if !ok {
+			return "", nil, errUnknownKey
+		}
+		resolved = append(resolved, name)
+		t = field
+	}
+	key := strings.Join(resolved, ".")
+	if t.Kind() == reflect.Struct || t.Kind() == reflect.Map {
+		return "", nil, fmt.Errorf("%s is a section, set one of its keys", key)
+	}
+	for deprecated, current := range deprecatedKeys {
+		if strings.HasPrefix(key, deprecated+".") {
+			key = current + strings.TrimPrefix(key, deprecated)
+		}
+	}
+	return key, t, nil
+}
+
+// lookupField returns the key and type of the field of the struct t whose
+// normalized key is name, looking into the squashed structs
+func lookupField(t reflect.Type, name string, normalize func(string) string) (string, reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag, opts, _ := strings.Cut(field.Tag.Get("koanf"), ",")
+		if field.Anonymous && strings.Contains(opts, "squash") {
+			if key, ft, ok := lookupField(field.Type, name, normalize); ok {
+				return key, ft, true
+			}
+			continue
+		}
+		if tag == "" {
+			tag = field.Name
+		}
+		if normalize(tag) == name {
+			return tag, field.Type, true
+		}
+	}
+	return "", nil, false
+}
+
+// unknownKeys returns the keys of raw matching no field of the struct t,
+// ignoring case like the decoding. The items of lists are checked too.
+func unknownKeys(raw map[string]any, t reflect.Type, prefix string) []string {
+	var unknown []string
+	for name, value := range raw {
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+		_, field, ok := lookupField(t, strings.ToLower(name), strings.ToLower)
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		switch {
+		case field.Kind() == reflect.Struct:
+			if m, ok := value.(map[string]any); ok {
+				unknown = append(unknown, unknownKeys(m, field, key)...)
+			}
+		case field.Kind() == reflect.Slice && field.Elem().Kind() == reflect.Struct:
+			items, _ := value.([]any)
+			for i, item := range items {
+				if m, ok := item.(map[string]any); ok {
+					unknown = append(unknown, unknownKeys(m, field.Elem(), fmt.Sprintf("%s[%d]", key, i))...)
+				}
+			}
+		}
+	}
+	return unknown
+}
@@ -2,90 +2,265 @@ package encryptions
 
 import (
 	"bufio"
-	"encoding/json"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
-	"strings"
+	"strconv"
 
 	"filippo.io/age"
-	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
-	"go.uber.org/zap"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
 )
 
-func AgeEncrypt(publickey string, plaintext string, dst io.Writer) (err error) {
-	recipient, err := age.ParseX25519Recipient(publickey)
-	if err != nil {
-		logger.Fatalf("failed to parse public key: %v", err)
+const ageHeader = "age-encryption.org/v1\n"
+
+// EncryptOptions selects the format AgeEncrypt writes
+type EncryptOptions struct {
+	// Format is FormatBinary (default) or FormatStructured
+	Format string
+	// SensitiveOnly only encrypts sensitive values in the structured format
+	SensitiveOnly bool
+	// Compression of the plaintext inside the binary format, see
+	// CompressionNone, CompressionGzip and CompressionZstd
+	Compression string
+	// Previous is the current content of the state file, its data key is
+	// reused in the structured format when Identities can decrypt it
+	Previous   []byte
+	Identities []age.Identity
+}
+
+// AgeEncrypt encrypts the plaintext stream to dst. The binary format never
+// holds the whole state in memory, the structured format has to read the
+// document first.
+func AgeEncrypt(recipients []age.Recipient, plaintext io.Reader, dst io.Writer, opts EncryptOptions) error {
+	const op = "encryptions.AgeEncrypt"
+
+	if opts.Format == FormatStructured {
+		document, err := io.ReadAll(plaintext)
+		if err != nil {
+			return errs.E(readErrorKind(err), op, fmt.Errorf("failed to read state: %w", err))
+		}
+		data, err := StructuredEncrypt(recipients, document, opts.SensitiveOnly, opts.Previous, opts.Identities)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(data); err != nil {
+			return errs.E(errs.KindStorage, op, fmt.Errorf("failed to write encrypted file: %w", err))
+		}
+		return nil
 	}
 
-	w, err := age.Encrypt(dst, recipient)
+	if len(recipients) == 0 {
+		return errs.Errorf(errs.KindEncryption, op, "no age recipients configured")
+	}
+	w, err := age.Encrypt(dst, recipients...)
 	if err != nil {
-		logger.Fatalf("failed to create encrypted file: %v", err)
+		return errs.E(errs.KindEncryption, op, fmt.Errorf("failed to create encrypted file: %w", err))
 	}
-	if _, err := io.WriteString(w, plaintext); err != nil {
-		logger.Fatalf("failed to write to encrypted file: %v", err)
+	cw, err := compressWriter(w, opts.Compression)
+	if err != nil {
+		return errs.E(errs.KindEncryption, op, err)
+	}
+	if _, err := io.Copy(cw, plaintext); err != nil {
+		return errs.E(readErrorKind(err), op, fmt.Errorf("failed to write to encrypted file: %w", err))
+	}
+	if err := cw.Close(); err != nil {
+		return errs.E(errs.KindStorage, op, fmt.Errorf("failed to compress state: %w", err))
 	}
 	if err := w.Close(); err != nil {
-		logger.Fatalf("failed to close encrypted file: %v", err)
+		return errs.E(errs.KindStorage, op, fmt.Errorf("failed to close encrypted file: %w", err))
+	}
+	return nil
+}
+
+// readErrorKind keeps the kind of errors returned by the plaintext reader,
+// e.g. a request body that is too large, other copy failures are storage
+// failures
+func readErrorKind(err error) errs.Kind {
+	if kind := errs.KindOf(err); kind != errs.KindInternal {
+		return kind
 	}
-	return err
+	return errs.KindStorage
 }
 
-func AgeDecrypt(privateKeyPath string, filePath string) (result map[string]interface{}, err error) {
-	logger.Debugf("privateKeyPath: %s", privateKeyPath)
-	privateKeyFile, err := os.Open(privateKeyPath)
+// AgeDecrypt returns the plaintext of a state file exactly as it was
+// encrypted, the caller decides whether it needs to be parsed
+func AgeDecrypt(identities []age.Identity, filePath string) ([]byte, error) {
+	const op = "encryptions.AgeDecrypt"
+
+	r, err := OpenState(identities, filePath)
 	if err != nil {
-		logger.Fatalf("failed to read private key: %v", err)
-	}
-	defer privateKeyFile.Close()
-
-	var privateKey string
-	scanner := bufio.NewScanner(privateKeyFile)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "AGE-SECRET-KEY-") {
-			logger.Debug("found private key")
-			privateKey = line // pragma: allowlist secret
-			break
-		}
+		return nil, err
 	}
+	defer r.Close()
 
-	if privateKey != "" {
-		logger.Debugf("age private key found in : %s", privateKeyPath)
-	} else {
-		logger.Fatalf("age private key not found")
-		return result, err
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errs.E(errs.KindEncryption, op, fmt.Errorf("failed to decrypt file: %w", err))
 	}
+	return plaintext, nil
+}
+
+// OpenState opens a state file and returns a reader of its plaintext. Binary
+// files are decrypted while reading, structured files are decrypted at once.
+func OpenState(identities []age.Identity, filePath string) (io.ReadCloser, error) {
+	const op = "encryptions.OpenState"
 
-	identity, err := age.ParseX25519Identity(privateKey)
+	f, err := os.Open(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errs.E(errs.KindNotFound, op, err)
+	}
 	if err != nil {
-		logger.Fatalf("failed to parse private key: %v", err)
-		return result, err
+		return nil, errs.E(errs.KindStorage, op, fmt.Errorf("failed to open file: %w", err))
 	}
 
-	file, err := os.Open(filePath)
+	r, err := DecryptReader(identities, f)
 	if err != nil {
-		// logger.Errorf("failed to open file: %v", err)
-		logger.Error("failed to open file", zap.Error(err))
-		return result, err
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+// DecryptReader returns a reader of the plaintext of src in any of the
+// supported formats. Only the binary format is decrypted while it is read,
+// the others are returned as a *bytes.Reader.
+func DecryptReader(identities []age.Identity, src io.Reader) (io.Reader, error) {
+	const op = "encryptions.DecryptReader"
+
+	if len(identities) == 0 {
+		return nil, errs.Errorf(errs.KindEncryption, op, "no age identities loaded")
+	}
+
+	br := bufio.NewReader(src)
+	header, err := br.Peek(len(ageHeader))
+	if err != nil && err != io.EOF {
+		return nil, errs.E(errs.KindStorage, op, fmt.Errorf("failed to read encrypted file: %w", err))
+	}
+	if string(header) != ageHeader {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, errs.E(errs.KindStorage, op, fmt.Errorf("failed to read encrypted file: %w", err))
+		}
+		plaintext, err := Decrypt(identities, data)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(plaintext), nil
+	}
+
+	r, _, err := openBinary(identities, br)
+	return r, err
+}
+
+// Envelope describes how a state file is stored
+type Envelope struct {
+	Format      string `json:"format"`
+	Compression string `json:"compression"`
+}
+
+// Decrypt decrypts a state file in any of the supported formats
+func Decrypt(identities []age.Identity, data []byte) ([]byte, error) {
+	plaintext, _, err := DecryptEnvelope(identities, data)
+	return plaintext, err
+}
+
+// DecryptEnvelope decrypts a state file and reports its format and
+// compression
+func DecryptEnvelope(identities []age.Identity, data []byte) ([]byte, Envelope, error) {
+	const op = "encryptions.Decrypt"
+
+	if len(identities) == 0 {
+		return nil, Envelope{}, errs.Errorf(errs.KindEncryption, op, "no age identities loaded")
 	}
-	defer file.Close()
 
-	decryptedIOReader, err := age.Decrypt(file, identity)
+	if DetectFormat(data) == FormatStructured {
+		plaintext, err := StructuredDecrypt(identities, data)
+		return plaintext, Envelope{Format: FormatStructured, Compression: CompressionNone}, err
+	}
+
+	r, compression, err := openBinary(identities, bytes.NewReader(data))
+	if err != nil {
+		return nil, Envelope{}, err
+	}
+	plaintext, err := io.ReadAll(r)
 	if err != nil {
-		logger.Fatalf("failed to open encrypted file: %v", err)
-		return result, err
+		return nil, Envelope{}, errs.E(errs.KindEncryption, op, fmt.Errorf("failed to decrypt file: %w", err))
 	}
+	return plaintext, Envelope{Format: FormatBinary, Compression: compression}, nil
+}
 
-	dataByte, err := io.ReadAll(decryptedIOReader)
+// openBinary decrypts a binary age file and decompresses its content
+func openBinary(identities []age.Identity, src io.Reader) (io.Reader, string, error) {
+	const op = "encryptions.openBinary"
+
+	r, err := age.Decrypt(src, identities...)
 	if err != nil {
-		return nil, err
+		return nil, "", errs.E(errs.KindEncryption, op, fmt.Errorf("failed to open encrypted file: %w", err))
+	}
+	plaintext, compression, err := decompressReader(r)
+	if err != nil {
+		return nil, "", errs.E(errs.KindEncryption, op, fmt.Errorf("failed to decompress file: %w", err))
 	}
+	return plaintext, compression, nil
+}
+
+// DetectFormat returns the encryption format of a state file, or an empty
+// string when it is not encrypted by the backend
+func DetectFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte(ageHeader)):
+		return FormatBinary
+	case isStructured(data):
+		return FormatStructured
+	default:
+		return ""
+	}
+}
 
-	dataStringNormalized := strings.ReplaceAll(string(dataByte), "\n", "")
-	err = json.Unmarshal([]byte(dataStringNormalized), &result)
+// The binary format starts with the age header, the structured one ends with
+// its metadata, which has a wrapped data key per recipient
+const (
+	formatHeaderSize  = 512
+	formatTrailerSize = 64 << 10
+)
+
+// DetectFileFormat returns the encryption format of a file like
+// DetectFormat, reading only its first and last bytes
+func DetectFileFormat(path string) (string, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	header := make([]byte, min(info.Size(), formatHeaderSize))
+	if _, err := io.ReadFull(f, header); err != nil {
+		return "", err
+	}
+	if bytes.HasPrefix(header, []byte(ageHeader)) {
+		return FormatBinary, nil
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(header), []byte("{")) {
+		return "", nil
+	}
+
+	offset := max(info.Size()-formatTrailerSize, 0)
+	trailer := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(trailer, offset); err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if bytes.Contains(trailer, []byte(strconv.Quote(structuredMetadataKey))) {
+		return FormatStructured, nil
 	}
-	return result, err
+	return "", nil
 }
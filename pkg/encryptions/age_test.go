@@ -2,12 +2,15 @@ package encryptions
 
 import (
 	"bytes"
-	"encoding/json"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"filippo.io/age"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
 )
 
 func TestAgeEncryptAndDecrypt(t *testing.T) {
@@ -17,7 +20,7 @@ func TestAgeEncryptAndDecrypt(t *testing.T) {
 		t.Fatalf("Failed to generate age key pair: %v", err)
 	}
 
-	publicKey := identity.Recipient().String()
+	recipients := []age.Recipient{identity.Recipient()}
 	privateKey := identity.String()
 
 	// Write the private key to a file
@@ -32,11 +35,12 @@ func TestAgeEncryptAndDecrypt(t *testing.T) {
 		log.Fatalf("failed to write private key to file: %v", err)
 	}
 
-	plaintext := `{"data": "your-text-for-unit-test-here"}`
+	// key order, spacing, large integers and the trailing newline must survive
+	plaintext := "{\n  \"serial\": 18446744073709551615,\n  \"data\": \"your-text-for-unit-test-here\"\n}\n"
 
 	// Test AgeEncrypt
 	var encrypted bytes.Buffer
-	err = AgeEncrypt(publicKey, plaintext, &encrypted)
+	err = AgeEncrypt(recipients, strings.NewReader(plaintext), &encrypted, EncryptOptions{})
 	if err != nil {
 		t.Errorf("AgeEncrypt returned an error: %v", err)
 	}
@@ -54,24 +58,114 @@ func TestAgeEncryptAndDecrypt(t *testing.T) {
 	}
 
 	// Test AgeDecrypt
-	result, err := AgeDecrypt(tmpPrivateKey.Name(), tmpEncryptedData.Name())
+	keyring, err := NewKeyring(config.Age{AgePrivateKeyPath: tmpPrivateKey.Name()})
+	if err != nil {
+		t.Fatalf("NewKeyring returned an error: %v", err)
+	}
+	result, err := AgeDecrypt(keyring.Identities(), tmpEncryptedData.Name())
 	if err != nil {
 		t.Errorf("AgeDecrypt returned an error: %v", err)
 	}
-	resultMarshal, err := json.Marshal(result)
+
+	// Check if the decrypted bytes are exactly the original plaintext
+	if string(result) != plaintext {
+		t.Errorf("decrypted data is not the same as the original plaintext: %q", result)
+	} else {
+		t.Logf("decrypted data is the same as the original plaintext: %s", result)
+	}
+}
+
+func TestDecryptReader(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
 	if err != nil {
-		t.Errorf("failed to marshal decrypted data: %v", err)
+		t.Fatalf("Failed to generate age key pair: %v", err)
+	}
+	recipients := []age.Recipient{identity.Recipient()}
+	identities := []age.Identity{identity}
+
+	// larger than a single age chunk of 64 KiB
+	large := `{"data": "` + strings.Repeat("x", 300<<10) + `"}`
+
+	tests := []struct {
+		name      string
+		plaintext string
+		opts      EncryptOptions
+	}{
+		{"binary", large, EncryptOptions{}},
+		{"structured", testState, EncryptOptions{Format: FormatStructured}},
 	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var encrypted bytes.Buffer
+			if err := AgeEncrypt(recipients, strings.NewReader(tt.plaintext), &encrypted, tt.opts); err != nil {
+				t.Fatalf("AgeEncrypt returned an error: %v", err)
+			}
+
+			r, err := DecryptReader(identities, &encrypted)
+			if err != nil {
+				t.Fatalf("DecryptReader returned an error: %v", err)
+			}
+			result, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("failed to read plaintext: %v", err)
+			}
 
-	// Check if the decrypted text is the same as the original plaintext
-	var decrypted map[string]interface{}
-	err = json.Unmarshal(resultMarshal, &decrypted)
+			expected, err := NormalizePlaintext(tt.opts.Format, []byte(tt.plaintext))
+			if err != nil {
+				t.Fatalf("NormalizePlaintext returned an error: %v", err)
+			}
+			if !bytes.Equal(result, expected) {
+				t.Errorf("decrypted data is not the same as the original plaintext")
+			}
+		})
+	}
+
+	if _, err := DecryptReader(identities, strings.NewReader(`{"serial": 1}`)); err == nil {
+		t.Errorf("DecryptReader accepted a plaintext state")
+	}
+}
+
+func TestDetectFileFormat(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
 	if err != nil {
-		t.Errorf("failed to unmarshal decrypted data: %v", err)
+		t.Fatalf("Failed to generate age key pair: %v", err)
 	}
-	if decrypted["data"] != "your-text-for-unit-test-here" {
-		t.Errorf("decrypted data is not the same as the original plaintext")
-	} else {
-		t.Logf("decrypted data is the same as the original plaintext: %v", decrypted["data"])
+	recipients := []age.Recipient{identity.Recipient()}
+
+	// the structured metadata is beyond the bytes read from the start
+	large := `{"data": "` + strings.Repeat("x", 300<<10) + `"}`
+	encrypt := func(plaintext string, opts EncryptOptions) string {
+		var encrypted bytes.Buffer
+		if err := AgeEncrypt(recipients, strings.NewReader(plaintext), &encrypted, opts); err != nil {
+			t.Fatalf("AgeEncrypt returned an error: %v", err)
+		}
+		return encrypted.String()
+	}
+
+	tests := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"binary", encrypt(large, EncryptOptions{}), FormatBinary},
+		{"structured", encrypt(large, EncryptOptions{Format: FormatStructured}), FormatStructured},
+		{"plaintext", large, ""},
+		{"metadata", `{"state": "prod.tfstate", "serial": 1}`, ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state")
+			if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+				t.Fatalf("failed to write state: %v", err)
+			}
+			format, err := DetectFileFormat(path)
+			if err != nil {
+				t.Fatalf("DetectFileFormat returned an error: %v", err)
+			}
+			if format != tt.expected || format != DetectFormat([]byte(tt.data)) {
+				t.Errorf("DetectFileFormat returned %q, expected %q", format, tt.expected)
+			}
+		})
 	}
 }
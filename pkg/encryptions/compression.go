@@ -0,0 +1,97 @@
+package encryptions
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression of the plaintext inside the binary age envelope. The
+// compressed stream is recognized by its magic bytes, a JSON state never
+// starts with them, so compressed and uncompressed files are read side by
+// side.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ValidateCompression checks a configured compression
+func ValidateCompression(compression string) error {
+	switch compression {
+	case "", CompressionNone, CompressionGzip, CompressionZstd:
+		return nil
+	default:
+		return fmt.Errorf("unsupported compression '%s', use none, gzip or zstd", compression)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressWriter returns a writer compressing to w, closing it flushes the
+// compressed stream but does not close w
+func compressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "", CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, ValidateCompression(compression)
+	}
+}
+
+// decompressReader detects the compression of r by its magic bytes and
+// returns a reader of the uncompressed data
+func decompressReader(r io.Reader) (io.Reader, string, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		d, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, "", err
+		}
+		return &zstdReader{d: d}, CompressionZstd, nil
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, "", err
+		}
+		return gr, CompressionGzip, nil
+	default:
+		return br, CompressionNone, nil
+	}
+}
+
+// zstdReader releases the decoder once the stream is read
+type zstdReader struct {
+	d *zstd.Decoder
+}
+
+func (r *zstdReader) Read(p []byte) (int, error) {
+	n, err := r.d.Read(p)
+	if err != nil {
+		r.d.Close()
+	}
+	return n, err
+}
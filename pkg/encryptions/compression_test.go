@@ -0,0 +1,57 @@
+package encryptions
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	recipients := []age.Recipient{identity.Recipient()}
+	identities := []age.Identity{identity}
+
+	state := `{"resources": [` + strings.Repeat(`{"type": "aws_instance", "name": "web"},`, 2000) + `{}]}`
+
+	sizes := map[string]int{}
+	for _, compression := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			var encrypted bytes.Buffer
+			err := AgeEncrypt(recipients, strings.NewReader(state), &encrypted, EncryptOptions{Compression: compression})
+			require.NoError(t, err)
+			sizes[compression] = encrypted.Len()
+
+			plaintext, envelope, err := DecryptEnvelope(identities, encrypted.Bytes())
+			require.NoError(t, err)
+			assert.Equal(t, state, string(plaintext))
+			assert.Equal(t, Envelope{Format: FormatBinary, Compression: compression}, envelope)
+
+			// compressed and uncompressed files are read transparently
+			r, err := DecryptReader(identities, bytes.NewReader(encrypted.Bytes()))
+			require.NoError(t, err)
+			plaintext, err = io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, state, string(plaintext))
+		})
+	}
+
+	assert.Less(t, sizes[CompressionGzip], sizes[CompressionNone]/10)
+	assert.Less(t, sizes[CompressionZstd], sizes[CompressionNone]/10)
+}
+
+func TestValidateCompression(t *testing.T) {
+	assert.NoError(t, ValidateCompression(""))
+	assert.NoError(t, ValidateCompression(CompressionZstd))
+	assert.Error(t, ValidateCompression("brotli"))
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	err = AgeEncrypt([]age.Recipient{identity.Recipient()}, strings.NewReader(`{}`), &bytes.Buffer{}, EncryptOptions{Compression: "brotli"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,304 @@
+package encryptions
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+const armorHeader = "-----BEGIN AGE ENCRYPTED FILE-----"
+
+// Keyring holds the decryption identities parsed from the configured key
+// files, directories (e.g. mounted secrets) and environment variable. The
+// identities are parsed once and reloaded when one of the files changes.
+type Keyring struct {
+	cfg config.Age
+
+	mu          sync.RWMutex
+	identities  []age.Identity
+	fingerprint string
+}
+
+// NewKeyring loads the identities configured under encryptions.age
+func NewKeyring(cfg config.Age) (*Keyring, error) {
+	k := &Keyring{cfg: cfg}
+
+	fingerprint := k.sourcesFingerprint()
+	identities, err := k.load()
+	if err != nil {
+		return nil, err
+	}
+	k.identities = identities
+	k.fingerprint = fingerprint
+	return k, nil
+}
+
+// Identities returns the identities in the configured order: `keys`,
+// `identityFiles` then `identityEnv`. When the sources changed since the last
+// load they are parsed again; on failure the previous identities are kept.
+func (k *Keyring) Identities() []age.Identity {
+	fingerprint := k.sourcesFingerprint()
+
+	k.mu.RLock()
+	if fingerprint == k.fingerprint {
+		defer k.mu.RUnlock()
+		return k.identities
+	}
+	k.mu.RUnlock()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if fingerprint == k.fingerprint {
+		return k.identities
+	}
+
+	identities, err := k.load()
+	if err != nil {
+		logger.Warnf("failed to reload age identities, keeping the previous ones: %v", err)
+		return k.identities
+	}
+
+	logger.Infof("reloaded %d age identities", len(identities))
+	k.identities = identities
+	k.fingerprint = fingerprint
+	return k.identities
+}
+
+// CheckFiles returns an error when a configured identity file or directory
+// does not exist anymore. The identities are not parsed again.
+func (k *Keyring) CheckFiles() error {
+	for _, path := range k.identityPaths() {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("identity file: %w", err)
+		}
+	}
+	return nil
+}
+
+// identityPaths returns the configured identity files and directories
+func (k *Keyring) identityPaths() []string {
+	var paths []string
+	if k.cfg.AgePrivateKeyPath != "" {
+		paths = append(paths, os.ExpandEnv(k.cfg.AgePrivateKeyPath))
+	}
+	for _, path := range k.cfg.IdentityFiles {
+		if path != "" {
+			paths = append(paths, os.ExpandEnv(path))
+		}
+	}
+	return paths
+}
+
+func (k *Keyring) load() ([]age.Identity, error) {
+	var identities []age.Identity
+	for _, path := range k.identityPaths() {
+		files, err := identityFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read identity file: %w", err)
+			}
+			parsed, err := parseIdentities(data, k.passphrase)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			identities = append(identities, parsed...)
+		}
+	}
+
+	if k.cfg.IdentityEnv != "" {
+		if value := os.Getenv(k.cfg.IdentityEnv); value != "" {
+			parsed, err := parseIdentities([]byte(value), k.passphrase)
+			if err != nil {
+				return nil, fmt.Errorf("$%s: %w", k.cfg.IdentityEnv, err)
+			}
+			identities = append(identities, parsed...)
+		}
+	}
+
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no age identities configured")
+	}
+	logger.Debugf("loaded %d age identities", len(identities))
+	return identities, nil
+}
+
+// passphrase returns the passphrase of scrypt encrypted identity files and
+// encrypted SSH keys
+func (k *Keyring) passphrase() ([]byte, error) {
+	if k.cfg.PassphraseFile != "" {
+		data, err := os.ReadFile(os.ExpandEnv(k.cfg.PassphraseFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase file: %w", err)
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+	if passphrase := os.ExpandEnv(k.cfg.Passphrase); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return nil, fmt.Errorf("identity is passphrase protected but no passphrase configured")
+}
+
+// sourcesFingerprint summarizes size and modification time of every identity
+// source, symlinks are followed so swapped mounted secrets are detected
+func (k *Keyring) sourcesFingerprint() string {
+	var b strings.Builder
+	paths := k.identityPaths()
+	if k.cfg.PassphraseFile != "" {
+		paths = append(paths, os.ExpandEnv(k.cfg.PassphraseFile))
+	}
+	for _, path := range paths {
+		files, err := identityFiles(path)
+		if err != nil {
+			fmt.Fprintf(&b, "%s:error;", path)
+			continue
+		}
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				fmt.Fprintf(&b, "%s:error;", file)
+				continue
+			}
+			fmt.Fprintf(&b, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return b.String()
+}
+
+// identityFiles expands a directory into its regular files, hidden entries
+// such as the ..data links of Kubernetes secret volumes are ignored
+func identityFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity file: %w", err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity directory: %w", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		file := filepath.Join(path, entry.Name())
+		info, err := os.Stat(file)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// parseIdentities parses age identity files (AGE-SECRET-KEY- lines),
+// passphrase protected identity files (`age -p`, binary or armored) and SSH
+// private keys
+func parseIdentities(data []byte, passphrase func() ([]byte, error)) ([]age.Identity, error) {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte(ageHeader)) || bytes.HasPrefix(trimmed, []byte(armorHeader)):
+		return parseEncryptedIdentities(trimmed, passphrase)
+	case bytes.HasPrefix(trimmed, []byte("-----BEGIN")):
+		identity, err := parseSSHIdentity(trimmed, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Identity{identity}, nil
+	}
+
+	var identities []age.Identity
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "AGE-SECRET-KEY-") {
+			continue
+		}
+		identity, err := age.ParseX25519Identity(line)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("age private key not found")
+	}
+	return identities, nil
+}
+
+func parseEncryptedIdentities(data []byte, passphrase func() ([]byte, error)) ([]age.Identity, error) {
+	pass, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+	scrypt, err := age.NewScryptIdentity(string(pass))
+	if err != nil {
+		return nil, err
+	}
+
+	var src io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(data, []byte(armorHeader)) {
+		src = armor.NewReader(src)
+	}
+	r, err := age.Decrypt(src, scrypt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt identity file: %w", err)
+	}
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt identity file: %w", err)
+	}
+	return parseIdentities(plaintext, passphrase)
+}
+
+func parseSSHIdentity(data []byte, passphrase func() ([]byte, error)) (age.Identity, error) {
+	key, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		pass, passErr := passphrase()
+		if passErr != nil {
+			return nil, passErr
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, pass)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH private key: %w", err)
+	}
+
+	switch key := key.(type) {
+	case *ed25519.PrivateKey:
+		return agessh.NewEd25519Identity(*key)
+	case ed25519.PrivateKey:
+		return agessh.NewEd25519Identity(key)
+	case *rsa.PrivateKey:
+		return agessh.NewRSAIdentity(key)
+	}
+	return nil, fmt.Errorf("unsupported SSH identity type: %T", key)
+}
@@ -0,0 +1,152 @@
+package encryptions
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func encryptTo(t *testing.T, plaintext string, recipient age.Recipient) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipient)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, plaintext)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func canDecrypt(identities []age.Identity, ciphertext []byte) bool {
+	_, err := age.Decrypt(bytes.NewReader(ciphertext), identities...)
+	return err == nil
+}
+
+func TestKeyringSources(t *testing.T) {
+	dir := t.TempDir()
+
+	keysFile, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "keys.txt"), []byte("# created\n"+keysFile.String()+"\n"), 0600))
+
+	// mounted secret directory, hidden entries are ignored
+	secretDir := filepath.Join(dir, "secret")
+	require.NoError(t, os.MkdirAll(filepath.Join(secretDir, "..data"), 0700))
+	mounted, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(secretDir, "identity"), []byte(mounted.String()), 0600))
+
+	// passphrase protected identity file, as created by `age -p -a`
+	protected, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	scrypt, err := age.NewScryptRecipient("correct horse")
+	require.NoError(t, err)
+	scrypt.SetWorkFactor(10)
+	var armored bytes.Buffer
+	aw := armor.NewWriter(&armored)
+	w, err := age.Encrypt(aw, scrypt)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, protected.String()+"\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, aw.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "protected.age"), armored.Bytes(), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "passphrase"), []byte("correct horse\n"), 0600))
+
+	// passphrase protected SSH private key
+	_, sshKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(sshKey, "backend", []byte("correct horse"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "id_ed25519"), pem.EncodeToMemory(block), 0600))
+	sshIdentity, err := agessh.NewEd25519Identity(sshKey)
+	require.NoError(t, err)
+
+	fromEnv, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	t.Setenv("TEST_AGE_IDENTITIES", fromEnv.String())
+
+	keyring, err := NewKeyring(config.Age{
+		AgePrivateKeyPath: filepath.Join(dir, "keys.txt"),
+		IdentityFiles: []string{
+			secretDir,
+			filepath.Join(dir, "protected.age"),
+			filepath.Join(dir, "id_ed25519"),
+		},
+		IdentityEnv:    "TEST_AGE_IDENTITIES",
+		PassphraseFile: filepath.Join(dir, "passphrase"),
+	})
+	require.NoError(t, err)
+
+	identities := keyring.Identities()
+	assert.Len(t, identities, 5)
+	for _, recipient := range []age.Recipient{
+		keysFile.Recipient(),
+		mounted.Recipient(),
+		protected.Recipient(),
+		sshIdentity.Recipient(),
+		fromEnv.Recipient(),
+	} {
+		assert.True(t, canDecrypt(identities, encryptTo(t, "state", recipient)))
+	}
+}
+
+func TestKeyringReload(t *testing.T) {
+	keysPath := filepath.Join(t.TempDir(), "keys.txt")
+
+	oldIdentity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keysPath, []byte(oldIdentity.String()), 0600))
+
+	keyring, err := NewKeyring(config.Age{AgePrivateKeyPath: keysPath})
+	require.NoError(t, err)
+	assert.Len(t, keyring.Identities(), 1)
+
+	// rotation: old and new keys work side by side
+	newIdentity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keysPath, []byte(oldIdentity.String()+"\n"+newIdentity.String()+"\n"), 0600))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(keysPath, future, future))
+
+	identities := keyring.Identities()
+	assert.Len(t, identities, 2)
+	assert.True(t, canDecrypt(identities, encryptTo(t, "state", oldIdentity.Recipient())))
+	assert.True(t, canDecrypt(identities, encryptTo(t, "state", newIdentity.Recipient())))
+
+	// a broken file keeps the previously loaded identities
+	require.NoError(t, os.WriteFile(keysPath, []byte("garbage"), 0600))
+	later := future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(keysPath, later, later))
+	assert.Len(t, keyring.Identities(), 2)
+}
+
+func TestKeyringErrors(t *testing.T) {
+	_, err := NewKeyring(config.Age{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no age identities configured")
+
+	dir := t.TempDir()
+	scrypt, err := age.NewScryptRecipient("secret")
+	require.NoError(t, err)
+	scrypt.SetWorkFactor(10)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "protected.age"), encryptTo(t, "AGE-SECRET-KEY-1", scrypt), 0600))
+
+	_, err = NewKeyring(config.Age{AgePrivateKeyPath: filepath.Join(dir, "protected.age")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no passphrase configured")
+}
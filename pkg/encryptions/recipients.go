@@ -0,0 +1,107 @@
+package encryptions
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+)
+
+const recipientsFileSizeLimit = 1 << 24 // 16 MiB, same as the age CLI
+
+// LoadRecipients collects every recipient configured under encryptions.age:
+// the legacy comma/newline separated `recipient` string, the `recipients`
+// list and the `recipientsFile`. Duplicate entries are removed.
+func LoadRecipients(cfg config.Age) ([]age.Recipient, error) {
+	var entries []string
+	entries = append(entries, splitRecipients(cfg.Recipient)...)
+	for _, r := range cfg.Recipients {
+		entries = append(entries, splitRecipients(r)...)
+	}
+
+	if cfg.RecipientsFile != "" {
+		path := os.ExpandEnv(cfg.RecipientsFile)
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open recipients file: %w", err)
+		}
+		defer f.Close()
+
+		lines, err := readRecipientLines(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		entries = append(entries, lines...)
+	}
+
+	seen := make(map[string]bool, len(entries))
+	recipients := make([]age.Recipient, 0, len(entries))
+	for _, entry := range entries {
+		if seen[entry] {
+			continue
+		}
+		seen[entry] = true
+
+		recipient, err := ParseRecipient(entry)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no age recipients configured")
+	}
+	return recipients, nil
+}
+
+// ParseRecipient parses a single X25519 (age1...) or SSH (ssh-ed25519,
+// ssh-rsa) recipient.
+func ParseRecipient(s string) (age.Recipient, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "age1"):
+		return age.ParseX25519Recipient(s)
+	case strings.HasPrefix(s, "ssh-"):
+		return agessh.ParseRecipient(s)
+	default:
+		return nil, fmt.Errorf("unknown recipient type: %q", s)
+	}
+}
+
+// splitRecipients splits a configured recipient string on commas and
+// newlines. Spaces are kept because SSH recipients contain them.
+func splitRecipients(s string) []string {
+	var entries []string
+	for _, line := range strings.Split(s, "\n") {
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" || strings.HasPrefix(entry, "#") {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func readRecipientLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(io.LimitReader(r, recipientsFileSizeLimit))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recipients: %w", err)
+	}
+	return lines, nil
+}
@@ -0,0 +1,83 @@
+package encryptions
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoadRecipients(t *testing.T) {
+	first, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	second, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	third, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	sshPub, sshPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPubKey, err := ssh.NewPublicKey(sshPub)
+	require.NoError(t, err)
+	sshRecipient := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPubKey))) + " oncall@example.com"
+	sshIdentity, err := agessh.NewEd25519Identity(sshPriv)
+	require.NoError(t, err)
+
+	recipientsFile := filepath.Join(t.TempDir(), "recipients.txt")
+	err = os.WriteFile(recipientsFile, []byte("# break-glass\n"+third.Recipient().String()+"\n\n"+sshRecipient+"\n"), 0600)
+	require.NoError(t, err)
+
+	cfg := config.Age{
+		// legacy comma separated form, as in the example configuration
+		Recipient:      first.Recipient().String() + ",\n" + second.Recipient().String() + "\n",
+		Recipients:     []string{first.Recipient().String()},
+		RecipientsFile: recipientsFile,
+	}
+
+	recipients, err := LoadRecipients(cfg)
+	require.NoError(t, err)
+	assert.Len(t, recipients, 4)
+
+	var encrypted bytes.Buffer
+	err = AgeEncrypt(recipients, strings.NewReader(`{"serial": 1}`), &encrypted, EncryptOptions{})
+	require.NoError(t, err)
+
+	// every identity must be able to decrypt independently
+	for _, identity := range []age.Identity{first, second, third, sshIdentity} {
+		r, err := age.Decrypt(bytes.NewReader(encrypted.Bytes()), identity)
+		require.NoError(t, err)
+		plaintext, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, `{"serial": 1}`, string(plaintext))
+	}
+}
+
+func TestLoadRecipients_Invalid(t *testing.T) {
+	_, err := LoadRecipients(config.Age{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no age recipients configured")
+
+	_, err = LoadRecipients(config.Age{Recipient: "not-a-recipient"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown recipient type")
+
+	path := filepath.Join(t.TempDir(), "recipients.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# comment\nage1invalid\n"), 0o600))
+	_, err = LoadRecipients(config.Age{RecipientsFile: path})
+	require.Error(t, err)
+
+	_, err = LoadRecipients(config.Age{RecipientsFile: filepath.Join(t.TempDir(), "missing.txt")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to open recipients file")
+}
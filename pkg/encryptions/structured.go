@@ -0,0 +1,632 @@
+package encryptions
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+)
+
+// Encryption formats of the state files
+const (
+	// FormatBinary encrypts the whole state as a single age file
+	FormatBinary = "binary"
+	// FormatStructured keeps the tfstate JSON structure readable and only
+	// encrypts attribute values, similar to SOPS
+	FormatStructured = "structured"
+)
+
+const (
+	structuredMetadataKey = "tbg_encryption"
+	structuredVersion     = 1
+	structuredCipher      = "AES256_GCM"
+	structuredPrefix      = "ENC[" + structuredCipher + ","
+	dataKeySize           = 32
+)
+
+var errMACMismatch = errors.New("structured state MAC mismatch, the file was modified outside of the backend")
+
+// structuredMetadata is stored next to the state content under
+// structuredMetadataKey
+type structuredMetadata struct {
+	Version       int    `json:"version"`
+	Cipher        string `json:"cipher"`
+	SensitiveOnly bool   `json:"sensitive_only"`
+	DataKey       string `json:"data_key"`
+	MAC           string `json:"mac"`
+}
+
+// StructuredEncrypt encrypts the attribute values, output values and private
+// data of a tfstate document while keeping resource addresses, types, modules,
+// serial and lineage readable. The values are encrypted with a data key that
+// is age encrypted to the recipients, and an HMAC over the whole encrypted
+// document detects tampering with the readable parts.
+//
+// When previous holds the current structured file and its data key can be
+// decrypted with identities, the data key is reused. Value encryption is
+// deterministic for a given key, path and value, so unchanged values keep
+// their ciphertext and git diffs only show what changed. Use rekey to rotate
+// the data key after removing a recipient.
+func StructuredEncrypt(recipients []age.Recipient, plaintext []byte, sensitiveOnly bool, previous []byte, identities []age.Identity) ([]byte, error) {
+	const op = "encryptions.StructuredEncrypt"
+
+	doc, err := parseJSONNode(plaintext)
+	if err != nil {
+		return nil, errs.E(errs.KindBadRequest, op, fmt.Errorf("failed to parse state: %w", err))
+	}
+	if !doc.object {
+		return nil, errs.Errorf(errs.KindBadRequest, op, "failed to parse state: not a JSON object")
+	}
+	if doc.get(structuredMetadataKey) != nil {
+		return nil, errs.Errorf(errs.KindBadRequest, op, "state already contains %s", structuredMetadataKey)
+	}
+	if len(recipients) == 0 {
+		return nil, errs.Errorf(errs.KindEncryption, op, "no age recipients configured")
+	}
+
+	dataKey := previousDataKey(previous, identities)
+	if dataKey == nil {
+		dataKey = make([]byte, dataKeySize)
+		if _, err := rand.Read(dataKey); err != nil {
+			return nil, errs.E(errs.KindEncryption, op, fmt.Errorf("failed to generate data key: %w", err))
+		}
+	}
+
+	wrappedKey, err := wrapDataKey(dataKey, recipients)
+	if err != nil {
+		return nil, errs.E(errs.KindEncryption, op, err)
+	}
+
+	keys, err := newStructuredKeys(dataKey)
+	if err != nil {
+		return nil, errs.E(errs.KindEncryption, op, err)
+	}
+	if err := transformSecrets(doc, sensitiveOnly, keys.encryptValue); err != nil {
+		return nil, errs.E(errs.KindEncryption, op, err)
+	}
+
+	metadata := structuredMetadata{
+		Version:       structuredVersion,
+		Cipher:        structuredCipher,
+		SensitiveOnly: sensitiveOnly,
+		DataKey:       wrappedKey,
+		MAC:           keys.mac(doc, sensitiveOnly),
+	}
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, errs.E(errs.KindEncryption, op, err)
+	}
+	metadataNode, err := parseJSONNode(metadataJSON)
+	if err != nil {
+		return nil, errs.E(errs.KindEncryption, op, err)
+	}
+	doc.keys = append(doc.keys, structuredMetadataKey)
+	doc.children = append(doc.children, metadataNode)
+
+	data, err := doc.indent()
+	if err != nil {
+		return nil, errs.E(errs.KindEncryption, op, err)
+	}
+	return data, nil
+}
+
+// StructuredDecrypt verifies the MAC and decrypts a structured state file
+func StructuredDecrypt(identities []age.Identity, data []byte) ([]byte, error) {
+	const op = "encryptions.StructuredDecrypt"
+
+	doc, metadata, err := parseStructured(data)
+	if err != nil {
+		return nil, errs.E(errs.KindEncryption, op, err)
+	}
+
+	dataKey, err := unwrapDataKey(metadata.DataKey, identities)
+	if err != nil {
+		return nil, errs.E(errs.KindEncryption, op, err)
+	}
+	keys, err := newStructuredKeys(dataKey)
+	if err != nil {
+		return nil, errs.E(errs.KindEncryption, op, err)
+	}
+
+	if !hmac.Equal([]byte(keys.mac(doc, metadata.SensitiveOnly)), []byte(metadata.MAC)) {
+		return nil, errs.E(errs.KindEncryption, op, errMACMismatch)
+	}
+
+	if err := transformSecrets(doc, metadata.SensitiveOnly, keys.decryptValue); err != nil {
+		return nil, errs.E(errs.KindEncryption, op, err)
+	}
+	plaintext, err := doc.indent()
+	if err != nil {
+		return nil, errs.E(errs.KindEncryption, op, err)
+	}
+	return plaintext, nil
+}
+
+// NormalizePlaintext returns the plaintext as it is returned after a round
+// trip through the given format. Structured states are re-indented the way
+// Terraform writes them.
+func NormalizePlaintext(format string, plaintext []byte) ([]byte, error) {
+	if format != FormatStructured {
+		return plaintext, nil
+	}
+	doc, err := parseJSONNode(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return doc.indent()
+}
+
+// isStructured reports whether data is a structured state file
+func isStructured(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	return bytes.HasPrefix(trimmed, []byte("{")) &&
+		bytes.Contains(trimmed, []byte(strconv.Quote(structuredMetadataKey)))
+}
+
+// parseStructured splits a structured file into the state document and its
+// metadata
+func parseStructured(data []byte) (*jsonNode, *structuredMetadata, error) {
+	doc, err := parseJSONNode(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse structured state: %w", err)
+	}
+
+	metadataNode := doc.get(structuredMetadataKey)
+	if !doc.object || metadataNode == nil {
+		return nil, nil, fmt.Errorf("failed to parse structured state: %s not found", structuredMetadataKey)
+	}
+	doc.remove(structuredMetadataKey)
+
+	var metadataJSON bytes.Buffer
+	metadataNode.compact(&metadataJSON)
+	var metadata structuredMetadata
+	if err := json.Unmarshal(metadataJSON.Bytes(), &metadata); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %w", structuredMetadataKey, err)
+	}
+	if metadata.Version != structuredVersion || metadata.Cipher != structuredCipher {
+		return nil, nil, fmt.Errorf("unsupported structured state version %d cipher %s", metadata.Version, metadata.Cipher)
+	}
+	return doc, &metadata, nil
+}
+
+// previousDataKey returns the data key of the previous structured file, nil
+// when it can not be decrypted or its MAC does not match, e.g. when the file
+// was modified outside of the backend
+func previousDataKey(previous []byte, identities []age.Identity) []byte {
+	if len(previous) == 0 || len(identities) == 0 || !isStructured(previous) {
+		return nil
+	}
+	doc, metadata, err := parseStructured(previous)
+	if err != nil {
+		return nil
+	}
+	dataKey, err := unwrapDataKey(metadata.DataKey, identities)
+	if err != nil {
+		return nil
+	}
+	keys, err := newStructuredKeys(dataKey)
+	if err != nil {
+		return nil
+	}
+	if !hmac.Equal([]byte(keys.mac(doc, metadata.SensitiveOnly)), []byte(metadata.MAC)) {
+		return nil
+	}
+	return dataKey
+}
+
+func wrapDataKey(dataKey []byte, recipients []age.Recipient) (string, error) {
+	var buf bytes.Buffer
+	aw := armor.NewWriter(&buf)
+	w, err := age.Encrypt(aw, recipients...)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt data key: %w", err)
+	}
+	if _, err := w.Write(dataKey); err != nil {
+		return "", fmt.Errorf("failed to encrypt data key: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to encrypt data key: %w", err)
+	}
+	if err := aw.Close(); err != nil {
+		return "", fmt.Errorf("failed to encrypt data key: %w", err)
+	}
+	return buf.String(), nil
+}
+
+func unwrapDataKey(wrappedKey string, identities []age.Identity) ([]byte, error) {
+	r, err := age.Decrypt(armor.NewReader(strings.NewReader(wrappedKey)), identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	dataKey, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	if len(dataKey) != dataKeySize {
+		return nil, fmt.Errorf("invalid data key size %d", len(dataKey))
+	}
+	return dataKey, nil
+}
+
+// structuredKeys holds the subkeys derived from the data key
+type structuredKeys struct {
+	aead  cipher.AEAD
+	ivKey []byte
+	mKey  []byte
+}
+
+func newStructuredKeys(dataKey []byte) (*structuredKeys, error) {
+	derive := func(label string) []byte {
+		h := hmac.New(sha256.New, dataKey)
+		h.Write([]byte(label))
+		return h.Sum(nil)
+	}
+
+	block, err := aes.NewCipher(derive("tbg-structured-encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &structuredKeys{
+		aead:  aead,
+		ivKey: derive("tbg-structured-iv"),
+		mKey:  derive("tbg-structured-mac"),
+	}, nil
+}
+
+// mac authenticates the whole encrypted document, readable parts included
+func (k *structuredKeys) mac(doc *jsonNode, sensitiveOnly bool) string {
+	var buf bytes.Buffer
+	doc.compact(&buf)
+	h := hmac.New(sha256.New, k.mKey)
+	h.Write(buf.Bytes())
+	h.Write([]byte(strconv.FormatBool(sensitiveOnly)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// encryptValue encrypts a JSON scalar, the JSON path is authenticated so
+// values can not be moved around. The IV is derived from the path and value.
+func (k *structuredKeys) encryptValue(raw []byte, path string) ([]byte, error) {
+	h := hmac.New(sha256.New, k.ivKey)
+	h.Write([]byte(path))
+	h.Write([]byte{0})
+	h.Write(raw)
+	iv := h.Sum(nil)[:k.aead.NonceSize()]
+
+	sealed := k.aead.Seal(nil, iv, raw, []byte(path))
+	data, tag := sealed[:len(sealed)-k.aead.Overhead()], sealed[len(sealed)-k.aead.Overhead():]
+	value := fmt.Sprintf("%sdata:%s,iv:%s,tag:%s]", structuredPrefix,
+		base64.StdEncoding.EncodeToString(data),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(tag))
+	return json.Marshal(value)
+}
+
+func (k *structuredKeys) decryptValue(raw []byte, path string) ([]byte, error) {
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil || !strings.HasPrefix(value, structuredPrefix) || !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("value at %s is not encrypted", path)
+	}
+
+	fields := map[string][]byte{}
+	for _, field := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(value, structuredPrefix), "]"), ",") {
+		name, encoded, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed encrypted value at %s", path)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("malformed encrypted value at %s: %w", path, err)
+		}
+		fields[name] = decoded
+	}
+	if len(fields["iv"]) != k.aead.NonceSize() || len(fields["tag"]) != k.aead.Overhead() {
+		return nil, fmt.Errorf("malformed encrypted value at %s", path)
+	}
+
+	plaintext, err := k.aead.Open(nil, fields["iv"], append(fields["data"], fields["tag"]...), []byte(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value at %s: %w", path, err)
+	}
+	return plaintext, nil
+}
+
+// transformSecrets applies fn to every secret scalar of a tfstate document:
+// output values, resource instance attributes, identities and private data.
+// With sensitiveOnly, only sensitive outputs, the attribute paths listed in
+// sensitive_attributes and private data are selected. Null values are kept.
+func transformSecrets(doc *jsonNode, sensitiveOnly bool, fn func(raw []byte, path string) ([]byte, error)) error {
+	if outputs := doc.get("outputs"); outputs != nil && outputs.object {
+		for i, name := range outputs.keys {
+			output := outputs.children[i]
+			value := output.get("value")
+			if value == nil {
+				continue
+			}
+			if sensitiveOnly && !output.get("sensitive").isTrue() {
+				continue
+			}
+			if err := transformLeaves(value, []string{"outputs", name, "value"}, nil, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	resources := doc.get("resources")
+	if resources == nil || !resources.array {
+		return nil
+	}
+	for r, resource := range resources.children {
+		instances := resource.get("instances")
+		if instances == nil || !instances.array {
+			continue
+		}
+		for i, instance := range instances.children {
+			base := []string{"resources", strconv.Itoa(r), "instances", strconv.Itoa(i)}
+
+			var sensitivePaths [][]string
+			if sensitiveOnly {
+				sensitivePaths = parseSensitivePaths(instance.get("sensitive_attributes"))
+			}
+
+			for _, key := range []string{"attributes", "attributes_flat", "identity"} {
+				attributes := instance.get(key)
+				if attributes == nil {
+					continue
+				}
+				if sensitiveOnly && len(sensitivePaths) == 0 {
+					continue
+				}
+				if err := transformLeaves(attributes, appendPath(base, key), sensitivePaths, fn); err != nil {
+					return err
+				}
+			}
+
+			if private := instance.get("private"); private != nil {
+				if err := transformLeaves(private, appendPath(base, "private"), nil, fn); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// transformLeaves walks every scalar below node, selected paths are relative
+// to node and select everything when nil
+func transformLeaves(node *jsonNode, path []string, selected [][]string, fn func(raw []byte, path string) ([]byte, error)) error {
+	return walkLeaves(node, path, len(path), selected, fn)
+}
+
+func walkLeaves(node *jsonNode, path []string, base int, selected [][]string, fn func(raw []byte, path string) ([]byte, error)) error {
+	switch {
+	case node.object:
+		for i, key := range node.keys {
+			if err := walkLeaves(node.children[i], appendPath(path, key), base, selected, fn); err != nil {
+				return err
+			}
+		}
+	case node.array:
+		for i, child := range node.children {
+			if err := walkLeaves(child, appendPath(path, strconv.Itoa(i)), base, selected, fn); err != nil {
+				return err
+			}
+		}
+	default:
+		if string(node.raw) == "null" {
+			return nil
+		}
+		if selected != nil && !hasPrefix(path[base:], selected) {
+			return nil
+		}
+		raw, err := fn(node.raw, "/"+strings.Join(path, "/"))
+		if err != nil {
+			return err
+		}
+		node.raw = raw
+	}
+	return nil
+}
+
+// parseSensitivePaths reads Terraform's sensitive_attributes, a list of cty
+// paths such as [{"type":"get_attr","value":"password"}]
+func parseSensitivePaths(node *jsonNode) [][]string {
+	if node == nil || !node.array {
+		return nil
+	}
+
+	var paths [][]string
+	for _, steps := range node.children {
+		if !steps.array {
+			continue
+		}
+		var path []string
+		for _, step := range steps.children {
+			value := step.get("value")
+			if value == nil {
+				break
+			}
+			// index steps may wrap the key as {"value": 0, "type": "number"}
+			if inner := value.get("value"); inner != nil {
+				value = inner
+			}
+			var key interface{}
+			if err := json.Unmarshal(value.raw, &key); err != nil {
+				break
+			}
+			path = append(path, fmt.Sprint(key))
+		}
+		if len(path) > 0 {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func hasPrefix(path []string, prefixes [][]string) bool {
+	for _, prefix := range prefixes {
+		if len(prefix) > len(path) {
+			continue
+		}
+		matched := true
+		for i := range prefix {
+			if prefix[i] != path[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func appendPath(path []string, key string) []string {
+	next := make([]string, len(path), len(path)+1)
+	copy(next, path)
+	return append(next, key)
+}
+
+// jsonNode is a JSON value that keeps the key order of objects
+type jsonNode struct {
+	object   bool
+	array    bool
+	keys     []string
+	children []*jsonNode
+	raw      []byte
+}
+
+func parseJSONNode(data []byte) (*jsonNode, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	node, err := decodeJSONNode(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	return node, nil
+}
+
+func decodeJSONNode(dec *json.Decoder) (*jsonNode, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch value := token.(type) {
+	case json.Delim:
+		node := &jsonNode{object: value == '{', array: value == '['}
+		for dec.More() {
+			if node.object {
+				keyToken, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				node.keys = append(node.keys, keyToken.(string))
+			}
+			child, err := decodeJSONNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			node.children = append(node.children, child)
+		}
+		// closing delimiter
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case json.Number:
+		return &jsonNode{raw: []byte(value)}, nil
+	default:
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{raw: raw}, nil
+	}
+}
+
+func (n *jsonNode) get(key string) *jsonNode {
+	if n == nil || !n.object {
+		return nil
+	}
+	for i, k := range n.keys {
+		if k == key {
+			return n.children[i]
+		}
+	}
+	return nil
+}
+
+func (n *jsonNode) remove(key string) {
+	for i, k := range n.keys {
+		if k == key {
+			n.keys = append(n.keys[:i], n.keys[i+1:]...)
+			n.children = append(n.children[:i], n.children[i+1:]...)
+			return
+		}
+	}
+}
+
+func (n *jsonNode) isTrue() bool {
+	return n != nil && string(n.raw) == "true"
+}
+
+func (n *jsonNode) compact(buf *bytes.Buffer) {
+	switch {
+	case n.object:
+		buf.WriteByte('{')
+		for i, key := range n.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			keyJSON, _ := json.Marshal(key)
+			buf.Write(keyJSON)
+			buf.WriteByte(':')
+			n.children[i].compact(buf)
+		}
+		buf.WriteByte('}')
+	case n.array:
+		buf.WriteByte('[')
+		for i, child := range n.children {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			child.compact(buf)
+		}
+		buf.WriteByte(']')
+	default:
+		buf.Write(n.raw)
+	}
+}
+
+// indent formats the node the way Terraform writes state files
+func (n *jsonNode) indent() ([]byte, error) {
+	var compact, indented bytes.Buffer
+	n.compact(&compact)
+	if err := json.Indent(&indented, compact.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	indented.WriteByte('\n')
+	return indented.Bytes(), nil
+}
@@ -0,0 +1,147 @@
+package encryptions
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testState = `{
+  "version": 4,
+  "terraform_version": "1.9.5",
+  "serial": 7,
+  "lineage": "3f1c6b2e-1d4b-4c55-9a3e-0c7f2d1e8b90",
+  "outputs": {
+    "endpoint": {
+      "value": "db.internal:5432",
+      "type": "string"
+    },
+    "password": {
+      "value": "hunter2",
+      "type": "string",
+      "sensitive": true
+    }
+  },
+  "resources": [
+    {
+      "module": "module.db",
+      "mode": "managed",
+      "type": "aws_db_instance",
+      "name": "main",
+      "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]",
+      "instances": [
+        {
+          "schema_version": 2,
+          "attributes": {
+            "allocated_storage": 20,
+            "id": "db-123",
+            "password": "hunter2",
+            "tags": {
+              "env": "prod"
+            },
+            "replicas": null
+          },
+          "sensitive_attributes": [
+            [
+              {
+                "type": "get_attr",
+                "value": "password"
+              }
+            ]
+          ],
+          "private": "eyJzY2hlbWFfdmVyc2lvbiI6IjIifQ=="
+        }
+      ]
+    }
+  ],
+  "check_results": null
+}
+`
+
+func TestStructuredEncryptAndDecrypt(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	recipients := []age.Recipient{identity.Recipient()}
+	identities := []age.Identity{identity}
+
+	encrypted, err := StructuredEncrypt(recipients, []byte(testState), false, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, FormatStructured, DetectFormat(encrypted))
+
+	// the structure stays reviewable, the values do not leak
+	for _, readable := range []string{`"serial": 7`, `"lineage": "3f1c6b2e`, `"module": "module.db"`, `"type": "aws_db_instance"`, `"password": "ENC[AES256_GCM,`, `"replicas": null`} {
+		assert.Contains(t, string(encrypted), readable)
+	}
+	for _, secret := range []string{"hunter2", "db-123", "db.internal", "eyJzY2hlbWFfdmVyc2lvbiI6IjIifQ=="} {
+		assert.NotContains(t, string(encrypted), secret)
+	}
+
+	decrypted, err := Decrypt(identities, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, testState, string(decrypted))
+
+	// reusing the previous data key keeps unchanged values byte for byte
+	changed := strings.Replace(testState, `"id": "db-123"`, `"id": "db-456"`, 1)
+	reencrypted, err := StructuredEncrypt(recipients, []byte(changed), false, encrypted, identities)
+	require.NoError(t, err)
+	oldLines := strings.Split(string(encrypted), "\n")
+	newLines := strings.Split(string(reencrypted), "\n")
+	require.Len(t, newLines, len(oldLines))
+	var diff []string
+	for i := range oldLines {
+		if oldLines[i] != newLines[i] {
+			diff = append(diff, strings.TrimSpace(newLines[i]))
+		}
+	}
+	require.Len(t, diff, 3)
+	assert.True(t, strings.HasPrefix(diff[0], `"id": "ENC[`))
+	assert.True(t, strings.HasPrefix(diff[1], `"data_key": `))
+	assert.True(t, strings.HasPrefix(diff[2], `"mac": `))
+}
+
+func TestStructuredSensitiveOnly(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	encrypted, err := StructuredEncrypt([]age.Recipient{identity.Recipient()}, []byte(testState), true, nil, nil)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(encrypted), `"id": "db-123"`)
+	assert.Contains(t, string(encrypted), `"value": "db.internal:5432"`)
+	assert.NotContains(t, string(encrypted), "hunter2")
+	assert.NotContains(t, string(encrypted), "eyJzY2hlbWFfdmVyc2lvbiI6IjIifQ==")
+
+	decrypted, err := StructuredDecrypt([]age.Identity{identity}, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, testState, string(decrypted))
+}
+
+func TestStructuredTamperDetection(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	encrypted, err := StructuredEncrypt([]age.Recipient{identity.Recipient()}, []byte(testState), false, nil, nil)
+	require.NoError(t, err)
+
+	tampered := bytes.Replace(encrypted, []byte(`"serial": 7`), []byte(`"serial": 8`), 1)
+	_, err = StructuredDecrypt([]age.Identity{identity}, tampered)
+	require.ErrorIs(t, err, errMACMismatch)
+
+	_, err = StructuredDecrypt([]age.Identity{other}, encrypted)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to decrypt data key")
+
+	_, err = StructuredEncrypt([]age.Recipient{identity.Recipient()}, []byte(`["not", "a", "state"]`), false, nil, nil)
+	require.Error(t, err)
+
+	// the data key of a modified file is not reused
+	identities := []age.Identity{identity}
+	assert.NotNil(t, previousDataKey(encrypted, identities))
+	assert.Nil(t, previousDataKey(tampered, identities))
+}
@@ -0,0 +1,88 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kind classifies an error so it can be mapped to an HTTP status code
+type Kind int
+
+const (
+	KindInternal Kind = iota
+	KindNotFound
+	KindConflict
+	KindLocked
+	KindBadRequest
+	KindTooLarge
+	KindEncryption
+	KindStorage
+	KindGitSync
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindNotFound:
+		return "not_found"
+	case KindConflict:
+		return "conflict"
+	case KindLocked:
+		return "locked"
+	case KindBadRequest:
+		return "bad_request"
+	case KindTooLarge:
+		return "too_large"
+	case KindEncryption:
+		return "encryption_failure"
+	case KindStorage:
+		return "storage_failure"
+	case KindGitSync:
+		return "git_sync_failure"
+	default:
+		return "internal_error"
+	}
+}
+
+// Error is returned by the storage, lock and encryption packages
+type Error struct {
+	Kind Kind
+	// Op is the operation that failed, e.g. "encryptions.Decrypt"
+	Op  string
+	Err error
+}
+
+// E creates an Error of the given kind wrapping err
+func E(kind Kind, op string, err error) error {
+	return &Error{Kind: kind, Op: op, Err: err}
+}
+
+// Errorf creates an Error of the given kind with a formatted message
+func Errorf(kind Kind, op string, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Op: op, Err: fmt.Errorf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	if e.Op == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// KindOf returns the kind of the outermost Error in the chain of err,
+// KindInternal when there is none
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return KindInternal
+}
+
+// Is reports whether err is an Error of the given kind
+func Is(err error, kind Kind) bool {
+	return err != nil && KindOf(err) == kind
+}
@@ -0,0 +1,24 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKindOf(t *testing.T) {
+	err := E(KindNotFound, "encryptions.Decrypt", os.ErrNotExist)
+	wrapped := fmt.Errorf("failed to get state: %w", err)
+
+	assert.Equal(t, KindNotFound, KindOf(wrapped))
+	assert.True(t, Is(wrapped, KindNotFound))
+	assert.True(t, errors.Is(wrapped, os.ErrNotExist))
+	assert.Equal(t, "encryptions.Decrypt: file does not exist", err.Error())
+
+	assert.Equal(t, KindInternal, KindOf(errors.New("plain")))
+	assert.False(t, Is(nil, KindInternal))
+	assert.Equal(t, "git_sync_failure", KindGitSync.String())
+}
@@ -0,0 +1,263 @@
+// Package events broadcasts lock, state and git sync events to the
+// subscribers of every replica, through Redis pub/sub when it is configured
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// Event types
+const (
+	LockAcquired = "lock.acquired"
+	LockReleased = "lock.released"
+	StateWritten = "state.written"
+	StateDeleted = "state.deleted"
+	GitSync      = "git.sync"
+)
+
+const (
+	// DefaultChannel is the Redis channel shared by the replicas
+	DefaultChannel = "terraform-backend-gitops:events"
+
+	subscriptionBuffer = 64
+	publishBuffer      = 256
+	reconnectDelay     = time.Second
+	publishTimeout     = 5 * time.Second
+)
+
+// Event is a change on a replica
+type Event struct {
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// State is the state path of lock and state events
+	State string `json:"state,omitempty"`
+	Data  any    `json:"data,omitempty"`
+	// Origin is the replica that published the event
+	Origin string `json:"origin"`
+}
+
+// Subscription receives the events of the states under a prefix
+type Subscription struct {
+	// C is closed when the subscription or the broker is closed
+	C      <-chan Event
+	c      chan Event
+	prefix string
+	broker *Broker
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.broker.unsubscribe(s)
+}
+
+// Broker fans the events out to the local subscriptions and, with a Redis
+// pool, to the other replicas
+type Broker struct {
+	logger  *zap.Logger
+	origin  string
+	pool    *redis.Pool
+	channel string
+
+	mu            sync.Mutex
+	subscriptions map[*Subscription]bool
+	closed        bool
+
+	outbox chan []byte
+	// ctx is cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New starts the broker, the events stay on this replica when pool is nil
+func New(pool *redis.Pool, channel string, logger *zap.Logger) *Broker {
+	if channel == "" {
+		channel = DefaultChannel
+	}
+	b := &Broker{
+		logger:        logger,
+		origin:        uuid.New().String(),
+		pool:          pool,
+		channel:       channel,
+		subscriptions: map[*Subscription]bool{},
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	if pool != nil {
+		b.outbox = make(chan []byte, publishBuffer)
+		b.wg.Add(2)
+		go b.publishLoop()
+		go b.subscribeLoop()
+	}
+	return b
+}
+
+// Publish sends the event to the subscriptions of every replica
+func (b *Broker) Publish(eventType, state string, data any) {
+	event := Event{
+		ID:     uuid.New().String(),
+		Type:   eventType,
+		Time:   time.Now().UTC(),
+		State:  state,
+		Data:   data,
+		Origin: b.origin,
+	}
+	b.dispatch(event)
+	if b.pool == nil {
+		return
+	}
+
+	message, err := json.Marshal(event)
+	if err != nil {
+		b.logger.Error("failed to encode event", zap.String("type", eventType), zap.Error(err))
+		return
+	}
+	select {
+	case b.outbox <- message:
+	default:
+		b.logger.Warn("event queue full, the event is not sent to the other replicas", zap.String("type", eventType))
+	}
+}
+
+// Subscribe returns a subscription to the events of the states under the
+// prefix directory, events without a state are always received
+func (b *Broker) Subscribe(prefix string) *Subscription {
+	c := make(chan Event, subscriptionBuffer)
+	s := &Subscription{C: c, c: c, prefix: prefix, broker: b}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(c)
+		return s
+	}
+	b.subscriptions[s] = true
+	return s
+}
+
+// Close ends the subscriptions and stops the fan-out
+func (b *Broker) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	for s := range b.subscriptions {
+		close(s.c)
+		delete(b.subscriptions, s)
+	}
+	b.mu.Unlock()
+
+	b.cancel()
+	b.wg.Wait()
+}
+
+func (b *Broker) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscriptions[s] {
+		close(s.c)
+		delete(b.subscriptions, s)
+	}
+}
+
+// dispatch sends the event to the local subscriptions, a subscriber too slow
+// to keep up misses it
+func (b *Broker) dispatch(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscriptions {
+		if event.State != "" && !underPrefix(event.State, s.prefix) {
+			continue
+		}
+		select {
+		case s.c <- event:
+		default:
+			b.logger.Warn("event subscriber too slow, dropping event", zap.String("type", event.Type))
+		}
+	}
+}
+
+// underPrefix reports whether the state is the prefix or under the prefix
+// directory, "prod" matches "prod/app.tfstate" but not "production/app.tfstate"
+func underPrefix(state, prefix string) bool {
+	dir := strings.TrimSuffix(prefix, "/")
+	return dir == "" || state == dir || strings.HasPrefix(state, dir+"/")
+}
+
+func (b *Broker) publishLoop() {
+	defer b.wg.Done()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case message := <-b.outbox:
+			if err := b.publishRedis(message); err != nil {
+				b.logger.Warn("failed to publish event to redis", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (b *Broker) publishRedis(message []byte) error {
+	ctx, cancel := context.WithTimeout(b.ctx, publishTimeout)
+	defer cancel()
+	conn, err := b.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("PUBLISH", b.channel, message)
+	return err
+}
+
+// subscribeLoop receives the events of the other replicas, reconnecting
+// until the broker is closed
+func (b *Broker) subscribeLoop() {
+	defer b.wg.Done()
+	for {
+		err := b.receive()
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+		b.logger.Warn("redis event subscription lost, reconnecting", zap.Error(err))
+	}
+}
+
+func (b *Broker) receive() error {
+	conn := redis.PubSubConn{Conn: b.pool.Get()}
+	defer conn.Close()
+	if err := conn.Subscribe(b.channel); err != nil {
+		return err
+	}
+
+	for {
+		// the connection is closed once the broker is closed
+		switch message := conn.ReceiveContext(b.ctx).(type) {
+		case redis.Message:
+			var event Event
+			if err := json.Unmarshal(message.Data, &event); err != nil {
+				b.logger.Warn("ignoring invalid event", zap.Error(err))
+				continue
+			}
+			// the local subscriptions got it when it was published
+			if event.Origin == b.origin {
+				continue
+			}
+			b.dispatch(event)
+		case error:
+			return message
+		}
+	}
+}
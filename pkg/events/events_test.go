@@ -0,0 +1,102 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func receive(t *testing.T, s *Subscription) Event {
+	t.Helper()
+	select {
+	case event := <-s.C:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return Event{}
+	}
+}
+
+func TestBroker_Subscribe(t *testing.T) {
+	b := New(nil, "", zap.NewNop())
+	defer b.Close()
+
+	prod := b.Subscribe("prod/")
+	all := b.Subscribe("")
+	defer prod.Close()
+
+	b.Publish(LockAcquired, "dev/app.tfstate", map[string]string{"id": "1"})
+	b.Publish(StateWritten, "prod/app.tfstate", nil)
+	b.Publish(GitSync, "", map[string]any{"remote": "origin", "success": true})
+
+	// events without a state are not filtered by prefix
+	assert.Equal(t, StateWritten, receive(t, prod).Type)
+	assert.Equal(t, GitSync, receive(t, prod).Type)
+
+	event := receive(t, all)
+	assert.Equal(t, LockAcquired, event.Type)
+	assert.Equal(t, "dev/app.tfstate", event.State)
+	assert.NotEmpty(t, event.ID)
+	assert.NotEmpty(t, event.Origin)
+	assert.Equal(t, StateWritten, receive(t, all).Type)
+	assert.Equal(t, GitSync, receive(t, all).Type)
+
+	all.Close()
+	_, ok := <-all.C
+	assert.False(t, ok)
+	// closing twice is harmless
+	all.Close()
+}
+
+func TestBroker_SubscribePrefixSegments(t *testing.T) {
+	b := New(nil, "", zap.NewNop())
+	defer b.Close()
+
+	prod := b.Subscribe("prod")
+	defer prod.Close()
+	state := b.Subscribe("prod/app.tfstate")
+	defer state.Close()
+
+	b.Publish(StateWritten, "production/app.tfstate", nil)
+	b.Publish(StateWritten, "prod/app.tfstate.bak", nil)
+	b.Publish(StateWritten, "prod/app.tfstate", nil)
+
+	assert.Equal(t, "prod/app.tfstate.bak", receive(t, prod).State)
+	assert.Equal(t, "prod/app.tfstate", receive(t, prod).State)
+	assert.Equal(t, "prod/app.tfstate", receive(t, state).State)
+	select {
+	case event := <-state.C:
+		t.Fatalf("unexpected event for %s", event.State)
+	default:
+	}
+}
+
+func TestBroker_Close(t *testing.T) {
+	b := New(nil, "", zap.NewNop())
+	s := b.Subscribe("")
+	b.Close()
+
+	_, ok := <-s.C
+	assert.False(t, ok)
+	s.Close()
+
+	// subscriptions after close are ended right away
+	_, ok = <-b.Subscribe("").C
+	assert.False(t, ok)
+	b.Publish(StateWritten, "prod/app.tfstate", nil)
+}
+
+func TestBroker_SlowSubscriber(t *testing.T) {
+	b := New(nil, "", zap.NewNop())
+	defer b.Close()
+	s := b.Subscribe("")
+
+	// a full subscription misses events instead of blocking the publisher
+	for i := 0; i < subscriptionBuffer+10; i++ {
+		b.Publish(StateWritten, "prod/app.tfstate", nil)
+	}
+	require.Len(t, s.C, subscriptionBuffer)
+}
@@ -0,0 +1,143 @@
+package events
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeRedis implements SUBSCRIBE and PUBLISH of the Redis protocol
+type fakeRedis struct {
+	ln          net.Listener
+	mu          sync.Mutex
+	subscribers map[net.Conn]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeRedis{ln: ln, subscribers: map[net.Conn]string{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) pool() *redis.Pool {
+	return &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", f.ln.Addr().String()) }}
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer func() {
+		f.mu.Lock()
+		delete(f.subscribers, conn)
+		f.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "SUBSCRIBE":
+			f.subscribers[conn] = args[1]
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+		case "PUBLISH":
+			count := 0
+			for subscriber, channel := range f.subscribers {
+				if channel == args[1] {
+					fmt.Fprintf(subscriber, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(channel), channel, len(args[2]), args[2])
+					count++
+				}
+			}
+			fmt.Fprintf(conn, ":%d\r\n", count)
+		default:
+			fmt.Fprintf(conn, "+OK\r\n")
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *fakeRedis) subscriberCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subscribers)
+}
+
+// readCommand reads an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestBroker_RedisFanOut(t *testing.T) {
+	server := newFakeRedis(t)
+	a := New(server.pool(), "", zap.NewNop())
+	defer a.Close()
+	b := New(server.pool(), "", zap.NewNop())
+	defer b.Close()
+	require.Eventually(t, func() bool { return server.subscriberCount() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	onA, onB := a.Subscribe(""), b.Subscribe("prod/")
+	a.Publish(LockReleased, "prod/app.tfstate", map[string]string{"id": "1"})
+
+	// both replicas get it once
+	event := receive(t, onB)
+	assert.Equal(t, LockReleased, event.Type)
+	assert.Equal(t, "prod/app.tfstate", event.State)
+	assert.Equal(t, map[string]any{"id": "1"}, event.Data)
+	assert.Equal(t, event.ID, receive(t, onA).ID)
+
+	b.Publish(StateWritten, "dev/app.tfstate", nil)
+	assert.Equal(t, StateWritten, receive(t, onA).Type)
+	select {
+	case event := <-onA.C:
+		t.Fatalf("unexpected event %v", event)
+	case event := <-onB.C:
+		t.Fatalf("unexpected event %v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
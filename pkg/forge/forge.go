@@ -0,0 +1,110 @@
+// Package forge opens pull requests on the git hosting service of the state
+// repository
+package forge
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Forges of repo.remote.forge
+const (
+	TypeGitHub    = "github"
+	TypeGitLab    = "gitlab"
+	TypeGitea     = "gitea"
+	TypeBitbucket = "bitbucket"
+	// TypeGeneric is any other git server, its token username has to be
+	// configured
+	TypeGeneric = "generic"
+)
+
+// ValidateType checks a configured forge, empty is github
+func ValidateType(forge string) error {
+	switch forge {
+	case "", TypeGitHub, TypeGitLab, TypeGitea, TypeBitbucket, TypeGeneric:
+		return nil
+	default:
+		return fmt.Errorf("unsupported forge '%s', use github, gitlab, gitea, bitbucket or generic", forge)
+	}
+}
+
+// hostTypes are the forges of well known hosts
+var hostTypes = map[string]string{
+	"github.com":    TypeGitHub,
+	"gitlab.com":    TypeGitLab,
+	"bitbucket.org": TypeBitbucket,
+	"codeberg.org":  TypeGitea,
+}
+
+// DetectType returns the forge of a remote URL on a well known host, ""
+// for self-hosted servers
+func DetectType(remoteURL string) string {
+	host := remoteURL
+	if u, err := url.Parse(remoteURL); err == nil && u.Host != "" {
+		host = u.Hostname()
+	} else if before, _, ok := strings.Cut(remoteURL, ":"); ok {
+		// scp-like user@host:path
+		_, host, _ = strings.Cut(before, "@")
+		if host == "" {
+			host = before
+		}
+	}
+	return hostTypes[strings.ToLower(host)]
+}
+
+// TokenUsername returns the username a forge expects with an access token
+// over HTTPS, "" for a generic server
+func TokenUsername(forge string) string {
+	switch forge {
+	case "", TypeGitHub:
+		// any non-empty username works with a personal access token
+		return "git"
+	case TypeGitLab, TypeGitea:
+		// accepted with personal, project, group and OAuth tokens
+		return "oauth2"
+	case TypeBitbucket:
+		// repository, project and workspace access tokens, app passwords
+		// need the account username instead
+		return "x-token-auth"
+	default:
+		return ""
+	}
+}
+
+// PullRequest is a pull (or merge) request from Head into Base
+type PullRequest struct {
+	Number int
+	URL    string
+	Head   string
+	Base   string
+	Title  string
+	Body   string
+}
+
+// Client is the API of a forge, implemented for each supported service
+type Client interface {
+	// FindPullRequest returns the open pull request from head into base, nil
+	// when there is none
+	FindPullRequest(ctx context.Context, head, base string) (*PullRequest, error)
+	// CreatePullRequest opens a pull request
+	CreatePullRequest(ctx context.Context, pr PullRequest) (*PullRequest, error)
+}
+
+// RepositoryPath returns the owner/name path of a repository from its SSH
+// (git@host:owner/name.git) or HTTPS remote URL
+func RepositoryPath(remoteURL string) (string, error) {
+	path := remoteURL
+	if u, err := url.Parse(remoteURL); err == nil && u.Scheme != "" {
+		path = u.Path
+	} else if _, after, ok := strings.Cut(remoteURL, ":"); ok {
+		path = after
+	}
+
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if !strings.Contains(path, "/") {
+		return "", fmt.Errorf("can not find the repository in remote URL %q", remoteURL)
+	}
+	return path, nil
+}
@@ -0,0 +1,37 @@
+package forge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateType(t *testing.T) {
+	for _, forge := range []string{"", TypeGitHub, TypeGitLab, TypeGitea, TypeBitbucket, TypeGeneric} {
+		assert.NoError(t, ValidateType(forge), forge)
+	}
+	assert.Error(t, ValidateType("sourcehut"))
+}
+
+func TestTokenUsername(t *testing.T) {
+	assert.Equal(t, "git", TokenUsername(""))
+	assert.Equal(t, "git", TokenUsername(TypeGitHub))
+	assert.Equal(t, "oauth2", TokenUsername(TypeGitLab))
+	assert.Equal(t, "oauth2", TokenUsername(TypeGitea))
+	assert.Equal(t, "x-token-auth", TokenUsername(TypeBitbucket))
+	assert.Empty(t, TokenUsername(TypeGeneric))
+}
+
+func TestDetectType(t *testing.T) {
+	tests := map[string]string{
+		"git@github.com:kholisrag/labirin-tfstate.git": TypeGitHub,
+		"https://gitlab.com/infra/states.git":          TypeGitLab,
+		"https://user@bitbucket.org/infra/states.git":  TypeBitbucket,
+		"ssh://git@codeberg.org/infra/states.git":      TypeGitea,
+		"https://gitlab.example.com/infra/states.git":  "",
+		"git@git.example.com:infra/states.git":         "",
+	}
+	for remoteURL, expected := range tests {
+		assert.Equal(t, expected, DetectType(remoteURL), remoteURL)
+	}
+}
@@ -0,0 +1,141 @@
+package forge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultGitHubAPIURL is the API of github.com
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// GitHub is the REST API of GitHub or GitHub Enterprise
+type GitHub struct {
+	apiURL     string
+	owner      string
+	repository string
+	token      string
+	httpClient *http.Client
+}
+
+// NewGitHub returns a client of the repository at remoteURL. An empty apiURL
+// is github.com, GitHub Enterprise uses https://<host>/api/v3.
+func NewGitHub(apiURL, remoteURL, token string) (*GitHub, error) {
+	if apiURL == "" {
+		apiURL = DefaultGitHubAPIURL
+	}
+	path, err := RepositoryPath(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+	owner, repository, _ := strings.Cut(path, "/")
+
+	return &GitHub{
+		apiURL:     strings.TrimSuffix(apiURL, "/"),
+		owner:      owner,
+		repository: repository,
+		token:      token,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+type githubPullRequest struct {
+	Number  int    `json:"number"`
+	HTMLURL string `json:"html_url"`
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+	Head    struct {
+		Ref string `json:"ref"`
+	} `json:"head"`
+	Base struct {
+		Ref string `json:"ref"`
+	} `json:"base"`
+}
+
+func (pr githubPullRequest) pullRequest() *PullRequest {
+	return &PullRequest{
+		Number: pr.Number,
+		URL:    pr.HTMLURL,
+		Head:   pr.Head.Ref,
+		Base:   pr.Base.Ref,
+		Title:  pr.Title,
+		Body:   pr.Body,
+	}
+}
+
+func (g *GitHub) FindPullRequest(ctx context.Context, head, base string) (*PullRequest, error) {
+	query := url.Values{
+		"state": {"open"},
+		"head":  {g.owner + ":" + head},
+		"base":  {base},
+	}
+	var prs []githubPullRequest
+	if err := g.do(ctx, http.MethodGet, "/pulls?"+query.Encode(), nil, &prs); err != nil {
+		return nil, err
+	}
+	if len(prs) == 0 {
+		return nil, nil
+	}
+	return prs[0].pullRequest(), nil
+}
+
+func (g *GitHub) CreatePullRequest(ctx context.Context, pr PullRequest) (*PullRequest, error) {
+	request := map[string]string{
+		"title": pr.Title,
+		"body":  pr.Body,
+		"head":  pr.Head,
+		"base":  pr.Base,
+	}
+	var created githubPullRequest
+	if err := g.do(ctx, http.MethodPost, "/pulls", request, &created); err != nil {
+		return nil, err
+	}
+	return created.pullRequest(), nil
+}
+
+// do calls an endpoint of the repository and decodes its JSON response
+func (g *GitHub) do(ctx context.Context, method, path string, body, response interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	endpoint := fmt.Sprintf("%s/repos/%s/%s%s", g.apiURL, url.PathEscape(g.owner), url.PathEscape(g.repository), path)
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("github %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("github %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("github %s %s: failed to decode response: %w", method, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package forge
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepositoryPath(t *testing.T) {
+	tests := map[string]string{
+		"git@github.com:kholisrag/labirin-tfstate.git":            "kholisrag/labirin-tfstate",
+		"https://github.com/kholisrag/labirin-tfstate.git":        "kholisrag/labirin-tfstate",
+		"https://github.com/kholisrag/labirin-tfstate":            "kholisrag/labirin-tfstate",
+		"ssh://git@gitlab.example.com:2222/infra/states/prod.git": "infra/states/prod",
+	}
+	for remoteURL, expected := range tests {
+		path, err := RepositoryPath(remoteURL)
+		require.NoError(t, err, remoteURL)
+		assert.Equal(t, expected, path, remoteURL)
+	}
+
+	_, err := RepositoryPath("states.git")
+	assert.Error(t, err)
+}
+
+func TestGitHub(t *testing.T) {
+	var created map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/kholisrag/states/pulls":
+			assert.Equal(t, "open", r.URL.Query().Get("state"))
+			assert.Equal(t, "main", r.URL.Query().Get("base"))
+			if r.URL.Query().Get("head") == "kholisrag:tfstate/prod.tfstate" && created != nil {
+				w.Write([]byte(`[{"number": 7, "html_url": "https://github.com/kholisrag/states/pull/7", "head": {"ref": "tfstate/prod.tfstate"}, "base": {"ref": "main"}}]`))
+				return
+			}
+			w.Write([]byte(`[]`))
+		case r.Method == http.MethodPost && r.URL.Path == "/repos/kholisrag/states/pulls":
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&created))
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"number": 7, "html_url": "https://github.com/kholisrag/states/pull/7", "title": "update prod", "head": {"ref": "tfstate/prod.tfstate"}, "base": {"ref": "main"}}`))
+		default:
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewGitHub(server.URL, "git@github.com:kholisrag/states.git", "secret")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	pr, err := client.FindPullRequest(ctx, "tfstate/prod.tfstate", "main")
+	require.NoError(t, err)
+	assert.Nil(t, pr)
+
+	pr, err = client.CreatePullRequest(ctx, PullRequest{Head: "tfstate/prod.tfstate", Base: "main", Title: "update prod", Body: "details"})
+	require.NoError(t, err)
+	assert.Equal(t, 7, pr.Number)
+	assert.Equal(t, "https://github.com/kholisrag/states/pull/7", pr.URL)
+	assert.Equal(t, map[string]string{"head": "tfstate/prod.tfstate", "base": "main", "title": "update prod", "body": "details"}, created)
+
+	pr, err = client.FindPullRequest(ctx, "tfstate/prod.tfstate", "main")
+	require.NoError(t, err)
+	require.NotNil(t, pr)
+	assert.Equal(t, 7, pr.Number)
+	assert.Equal(t, "tfstate/prod.tfstate", pr.Head)
+
+	client, err = NewGitHub(server.URL, "git@github.com:kholisrag/missing.git", "secret")
+	require.NoError(t, err)
+	_, err = client.FindPullRequest(ctx, "tfstate/prod.tfstate", "main")
+	assert.ErrorContains(t, err, "404")
+}
@@ -0,0 +1,103 @@
+// Package health runs the dependency checks of the readiness endpoint, each
+// with its own timeout and status
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Statuses of a check and of a report
+const (
+	StatusOK          = "ok"
+	StatusFailed      = "failed"
+	StatusTimeout     = "timeout"
+	StatusUnavailable = "unavailable"
+)
+
+const defaultTimeout = 5 * time.Second
+
+// Check is a dependency check, Run must return once ctx is done
+type Check struct {
+	Name    string
+	Timeout time.Duration
+	Run     func(ctx context.Context) error
+}
+
+// Result is the outcome of a check
+type Result struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is ok when every check is
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+// OK reports whether every check passed
+func (r Report) OK() bool {
+	return r.Status == StatusOK
+}
+
+// Run runs the checks concurrently, a check still running after its timeout
+// is reported as timed out without being waited for
+func Run(ctx context.Context, checks []Check) Report {
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = run(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: results}
+	for _, result := range results {
+		if result.Status != StatusOK {
+			report.Status = StatusUnavailable
+		}
+	}
+	return report
+}
+
+func run(ctx context.Context, check Check) Result {
+	timeout := check.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check.Run(ctx)
+	}()
+
+	result := Result{Name: check.Name, Status: StatusOK}
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	result.Duration = time.Since(start).Round(time.Millisecond).String()
+	switch {
+	case err == nil:
+	case errors.Is(err, context.DeadlineExceeded):
+		result.Status = StatusTimeout
+		result.Error = "timed out after " + timeout.String()
+	default:
+		result.Status = StatusFailed
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,39 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	report := Run(context.Background(), []Check{
+		{Name: "ok", Run: func(context.Context) error { return nil }},
+		{Name: "failed", Run: func(context.Context) error { return errors.New("connection refused") }},
+		{Name: "slow", Timeout: 10 * time.Millisecond, Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+		// a check ignoring its context is not waited for
+		{Name: "stuck", Timeout: 10 * time.Millisecond, Run: func(context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		}},
+	})
+
+	assert.False(t, report.OK())
+	assert.Equal(t, StatusUnavailable, report.Status)
+	assert.Equal(t, []string{"ok", "failed", "slow", "stuck"}, []string{report.Checks[0].Name, report.Checks[1].Name, report.Checks[2].Name, report.Checks[3].Name})
+	assert.Equal(t, StatusOK, report.Checks[0].Status)
+	assert.Empty(t, report.Checks[0].Error)
+	assert.Equal(t, StatusFailed, report.Checks[1].Status)
+	assert.Equal(t, "connection refused", report.Checks[1].Error)
+	assert.Equal(t, StatusTimeout, report.Checks[2].Status)
+	assert.Equal(t, StatusTimeout, report.Checks[3].Status)
+	assert.Equal(t, "timed out after 10ms", report.Checks[3].Error)
+
+	assert.True(t, Run(context.Background(), nil).OK())
+}
@@ -0,0 +1,27 @@
+package lock
+
+import (
+	"fmt"
+	"time"
+)
+
+// LockInfo is the lock payload Terraform sends with LOCK and UNLOCK requests
+type LockInfo struct {
+	ID        string    `json:"ID"`
+	Operation string    `json:"Operation"`
+	Info      string    `json:"Info"`
+	Who       string    `json:"Who"`
+	Version   string    `json:"Version"`
+	Created   time.Time `json:"Created"`
+	Path      string    `json:"Path"`
+}
+
+// LockedError is returned when a state is already locked, Info holds the
+// current lock so it can be reported back to Terraform
+type LockedError struct {
+	Info *LockInfo
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("state is locked by %s (lock ID %s, operation %s)", e.Info.Who, e.Info.ID, e.Info.Operation)
+}
@@ -3,6 +3,7 @@ package redis
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -11,13 +12,22 @@ import (
 	"github.com/gomodule/redigo/redis"
 	"github.com/google/uuid"
 	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/lock"
 	"github.com/kholisrag/terraform-backend-gitops/pkg/logger"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	redisLockKey = "terraform-backend-gitops"
 )
 
+var tracer = otel.Tracer("terraform-backend-gitops/lock")
+
 type RedisLocker struct {
 	pool     *redis.Pool
 	rsClient *redsync.Redsync
@@ -35,6 +45,15 @@ func redigoNewPool(config *config.Config) *redis.Pool {
 func NewRedisLock(config *config.Config) *RedisLocker {
 	pool := redigoNewPool(config)
 	rsPool := redigo.NewPool(pool)
+	metrics.SetRedisPool(func() metrics.PoolStats {
+		stats := pool.Stats()
+		return metrics.PoolStats{
+			ActiveCount:  stats.ActiveCount,
+			IdleCount:    stats.IdleCount,
+			WaitCount:    stats.WaitCount,
+			WaitDuration: stats.WaitDuration,
+		}
+	})
 
 	return &RedisLocker{
 		pool:     pool,
@@ -42,173 +61,263 @@ func NewRedisLock(config *config.Config) *RedisLocker {
 	}
 }
 
-func (l *RedisLocker) Unlock(path string) (unlocked bool, err error) {
-	mutex := l.rsClient.NewMutex(
+// Pool returns the connection pool of the lock server, shared with the
+// event fan-out
+func (l *RedisLocker) Pool() *redis.Pool {
+	return l.pool
+}
+
+// Ping checks that the lock server is reachable
+func (l *RedisLocker) Ping(ctx context.Context) error {
+	conn, err := l.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = redis.DoContext(conn, ctx, "PING")
+	return err
+}
+
+// newMutex guards the read-modify-write sequences on the lock keys
+func (l *RedisLocker) newMutex() *redsync.Mutex {
+	return l.rsClient.NewMutex(
 		redisLockKey,
 		redsync.WithExpiry(24*time.Hour),
 		redsync.WithTries(1),
 		redsync.WithGenValueFunc(func() (string, error) {
 			return uuid.New().String(), nil
 		}))
-	if err := mutex.Lock(); err != nil {
+}
+
+// Unlock releases the lock of path. When info carries a lock ID it must match
+// the current lock, an empty info (terraform force-unlock) always releases it.
+// Unlocking a state that is not locked is not an error.
+func (l *RedisLocker) Unlock(ctx context.Context, path string, info *lock.LockInfo) (err error) {
+	const op = "redis.Unlock"
+	ctx, span := tracer.Start(ctx, op, trace.WithAttributes(lockAttributes(path, info)...))
+	defer func() {
+		metrics.ObserveLock("unlock", lockResult(err))
+		endSpan(span, err)
+	}()
+
+	mutex := l.newMutex()
+	if err := mutex.LockContext(ctx); err != nil {
 		logger.Errorf("failed to lock redsync mutex: %v", err)
-		return false, err
+		return errs.E(errs.KindStorage, op, err)
 	}
 
 	defer func() {
 		if _, mutexErr := mutex.Unlock(); mutexErr != nil {
 			logger.Errorf("failed to unlock redsync mutex: %v", mutexErr)
-			if err != nil {
-				err = mutexErr
+			if err == nil {
+				err = errs.E(errs.KindStorage, op, mutexErr)
 			}
 		}
 	}()
 
-	lock, err := l.getLock(path)
+	current, err := l.getLock(ctx, path)
+	if errs.Is(err, errs.KindNotFound) {
+		logger.Debugf("state %s is not locked", path)
+		return nil
+	}
 	if err != nil {
-		logger.Debugf("redis unlocked status false: %v", lock)
-		logger.Errorf("failed to get lock: %v", err)
-		return false, nil
+		return err
 	}
 
-	if lock != path {
-		return false, nil
+	if info != nil && info.ID != "" && info.ID != current.ID {
+		return errs.E(errs.KindConflict, op, fmt.Errorf("lock ID %s does not match the current lock: %w", info.ID, &lock.LockedError{Info: current}))
 	}
 
-	if err := l.deleteLock(path); err != nil {
-		logger.Errorf("failed to delete lock: %v", err)
-		return false, err
+	if err := l.deleteLock(ctx, path); err != nil {
+		return err
 	}
-
-	return true, nil
+	if !current.Created.IsZero() {
+		metrics.ObserveLockHeld(time.Since(current.Created))
+	}
+	return nil
 }
 
-func (l *RedisLocker) Lock(path string, unlock bool) (redisKeyLocked bool, err error) {
-	mutex := l.rsClient.NewMutex(
-		redisLockKey,
-		redsync.WithExpiry(24*time.Hour),
-		redsync.WithTries(1),
-		redsync.WithGenValueFunc(func() (string, error) {
-			return uuid.New().String(), nil
-		}))
-	if err := mutex.Lock(); err != nil {
+// Lock locks path with info, it returns a KindLocked error wrapping a
+// lock.LockedError when the state is locked by another lock ID
+func (l *RedisLocker) Lock(ctx context.Context, path string, info *lock.LockInfo) (err error) {
+	const op = "redis.Lock"
+	ctx, span := tracer.Start(ctx, op, trace.WithAttributes(lockAttributes(path, info)...))
+	defer func() {
+		metrics.ObserveLock("lock", lockResult(err))
+		endSpan(span, err)
+	}()
+
+	mutex := l.newMutex()
+	if err := mutex.LockContext(ctx); err != nil {
 		logger.Errorf("failed to lock redsync mutex: %v", err)
-		return false, err
+		return errs.E(errs.KindStorage, op, err)
 	}
 
 	defer func() {
 		if _, mutexErr := mutex.Unlock(); mutexErr != nil {
 			logger.Errorf("failed to unlock redsync mutex: %v", mutexErr)
-			if err != nil {
-				err = mutexErr
+			if err == nil {
+				err = errs.E(errs.KindStorage, op, mutexErr)
 			}
 		}
 	}()
 
-	lock, err := l.getLock(path)
-	if lock == "not_found" {
-		logger.Warnf("lock not found: %v", path)
-
-		if err := l.setLock(path, lock); err != nil {
-			return false, err
+	current, err := l.getLock(ctx, path)
+	if err == nil {
+		if current.ID != "" && current.ID == info.ID {
+			return nil
 		}
+		return errs.E(errs.KindLocked, op, &lock.LockedError{Info: current})
+	}
+	if !errs.Is(err, errs.KindNotFound) {
+		return err
+	}
 
-		return true, err
+	return l.setLock(ctx, path, info)
+}
+
+// lockAttributes describe the state and lock of a span
+func lockAttributes(path string, info *lock.LockInfo) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{attribute.String("state.path", path)}
+	if info != nil {
+		attrs = append(attrs,
+			attribute.String("lock.id", info.ID),
+			attribute.String("lock.operation", info.Operation))
 	}
+	return attrs
+}
 
-	if lock == path {
-		return true, nil
+// endSpan records err on the span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
+	span.End()
+}
 
-	return false, err
+// lockResult classifies the result of a lock operation for the metrics
+func lockResult(err error) string {
+	switch {
+	case err == nil:
+		return metrics.ResultSuccess
+	case errs.Is(err, errs.KindLocked), errs.Is(err, errs.KindConflict):
+		return metrics.ResultConflict
+	default:
+		return metrics.ResultError
+	}
 }
 
-func (l *RedisLocker) GetLock(path string) (lock string, err error) {
-	mutex := l.rsClient.NewMutex(
-		redisLockKey,
-		redsync.WithExpiry(24*time.Hour),
-		redsync.WithTries(1),
-		redsync.WithGenValueFunc(func() (string, error) {
-			return uuid.New().String(), nil
-		}))
-	if err := mutex.Lock(); err != nil {
+// GetLock returns the current lock of path, a KindNotFound error when the
+// state is not locked
+func (l *RedisLocker) GetLock(ctx context.Context, path string) (info *lock.LockInfo, err error) {
+	const op = "redis.GetLock"
+	ctx, span := tracer.Start(ctx, op, trace.WithAttributes(lockAttributes(path, nil)...))
+	defer func() {
+		if errs.Is(err, errs.KindNotFound) {
+			span.End()
+			return
+		}
+		endSpan(span, err)
+	}()
+
+	mutex := l.newMutex()
+	if err := mutex.LockContext(ctx); err != nil {
 		logger.Errorf("failed to lock: %v", err)
-		return "", err
+		return nil, errs.E(errs.KindStorage, op, err)
 	}
 
 	defer func() {
 		if _, mutexErr := mutex.Unlock(); mutexErr != nil {
 			logger.Errorf("failed to unlock: %v", mutexErr)
-			if err != nil {
-				err = mutexErr
+			if err == nil {
+				err = errs.E(errs.KindStorage, op, mutexErr)
 			}
 		}
 	}()
 
-	return l.getLock(path)
+	return l.getLock(ctx, path)
 }
 
-func (l *RedisLocker) getLock(path string) (string, error) {
-	ctx := context.Background()
+func (l *RedisLocker) getLock(ctx context.Context, path string) (*lock.LockInfo, error) {
+	const op = "redis.getLock"
 
 	conn, err := l.pool.GetContext(ctx)
 	if err != nil {
 		logger.Errorf("failed to get redis connection: %v", err)
-		return "", err
+		return nil, errs.E(errs.KindStorage, op, err)
 	}
 	defer conn.Close()
 
 	value, err := redis.String(conn.Do("GET", path))
+	if err == redis.ErrNil {
+		return nil, errs.Errorf(errs.KindNotFound, op, "lock of %s not found", path)
+	}
 	if err != nil {
-		logger.Debugf("failed to get redis key: %v", err)
-		return "not_found", nil
+		logger.Errorf("failed to get redis key: %v", err)
+		return nil, errs.E(errs.KindStorage, op, err)
+	}
+
+	info := &lock.LockInfo{}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || json.Unmarshal(decoded, info) != nil {
+		// a lock written by an older version, keep the state locked
+		logger.Warnf("failed to decode lock of %s", path)
+		info.Info = "unreadable lock, use force-unlock to release it"
 	}
-	return value, nil
+	return info, nil
 }
 
-func (l *RedisLocker) deleteLock(path string) error {
-	ctx := context.Background()
+func (l *RedisLocker) deleteLock(ctx context.Context, path string) error {
+	const op = "redis.deleteLock"
 
 	conn, err := l.pool.GetContext(ctx)
 	if err != nil {
 		logger.Errorf("failed to get redis connection: %v", err)
-		return err
+		return errs.E(errs.KindStorage, op, err)
 	}
 	defer conn.Close()
 
 	count, err := redis.Int(conn.Do("DEL", path))
 	if err != nil {
 		logger.Errorf("failed to delete redis key: %v", err)
-		return err
+		return errs.E(errs.KindStorage, op, err)
 	}
 
 	if count != 1 {
-		return fmt.Errorf("delete %v redis key while unlocking id %v", count, path)
+		return errs.Errorf(errs.KindStorage, op, "delete %v redis key while unlocking id %v", count, path)
 	}
 
 	return nil
 }
 
-func (l *RedisLocker) setLock(path, lock string) error {
-	ctx := context.Background()
+func (l *RedisLocker) setLock(ctx context.Context, path string, info *lock.LockInfo) error {
+	const op = "redis.setLock"
 
 	conn, err := l.pool.GetContext(ctx)
 	if err != nil {
 		logger.Errorf("failed to get redis connection: %v", err)
-		return err
+		return errs.E(errs.KindStorage, op, err)
 	}
 	defer conn.Close()
 
-	lockValue := base64.StdEncoding.EncodeToString([]byte(lock))
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return errs.E(errs.KindBadRequest, op, err)
+	}
+	lockValue := base64.StdEncoding.EncodeToString(infoJSON)
 
 	resp, err := redis.String(conn.Do("SET", path, lockValue, "NX", "PX", int(24*time.Hour/time.Millisecond)))
+	if err == redis.ErrNil {
+		return errs.Errorf(errs.KindLocked, op, "state %s was locked concurrently", path)
+	}
 	if err != nil {
 		logger.Errorf("failed to set redis key: %v", err)
-		return err
+		return errs.E(errs.KindStorage, op, err)
 	}
 
 	if resp != "OK" {
-		return fmt.Errorf("failed to set redis key: %v", resp)
+		return errs.Errorf(errs.KindStorage, op, "failed to set redis key: %v", resp)
 	}
 
 	return nil
@@ -68,27 +68,29 @@ func GetZapLogger() *zap.Logger {
 }
 
 func Infof(msg string, args ...interface{}) {
-	log.Sugar().Infof(msg, args)
+	log.Sugar().Infof(msg, args...)
 }
 
 func Errorf(msg string, args ...interface{}) {
-	log.Sugar().Errorf(msg, args)
+	log.Sugar().Errorf(msg, args...)
 }
 
+// Fatalf logs and exits, only use it while starting up, library code returns
+// errors instead
 func Fatalf(msg string, args ...interface{}) {
-	log.Sugar().Errorf(msg, args)
+	log.Sugar().Fatalf(msg, args...)
 }
 
 func Debugf(msg string, args ...interface{}) {
-	log.Sugar().Debugf(msg, args)
+	log.Sugar().Debugf(msg, args...)
 }
 
 func Warnf(msg string, args ...interface{}) {
-	log.Sugar().Warnf(msg, args)
+	log.Sugar().Warnf(msg, args...)
 }
 
 func Panicf(msg string, args ...interface{}) {
-	log.Sugar().Panicf(msg, args)
+	log.Sugar().Panicf(msg, args...)
 }
 
 func Info(msg string, fields ...zap.Field) {
@@ -0,0 +1,206 @@
+// Package metrics holds the Prometheus metrics of the backend, served by
+// Handler on server.metrics.address
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "tbg"
+
+// Results of lock operations
+const (
+	ResultSuccess  = "success"
+	ResultConflict = "conflict"
+	ResultError    = "error"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latencies by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	lockOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lock_operations_total",
+		Help:      "State lock and unlock operations by result (success, conflict or error).",
+	}, []string{"operation", "result"})
+	lockHoldDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "lock_hold_duration_seconds",
+		Help:      "Time a state lock was held until it was released.",
+		// 1s to ~9h
+		Buckets: prometheus.ExponentialBuckets(1, 3, 11),
+	})
+
+	gitCommitDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "git_commit_duration_seconds",
+		Help:      "Duration of git commits.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	gitPushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "git_push_duration_seconds",
+		Help:      "Duration of git push attempts by remote.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"remote"})
+	gitFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "git_failures_total",
+		Help:      "Failed git commits and pushes, a push counts once after its retries.",
+	}, []string{"operation", "remote"})
+	gitRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "git_retries_total",
+		Help:      "Retried git push attempts by remote.",
+	}, []string{"remote"})
+
+	cryptoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "encryption_duration_seconds",
+		Help:      "Duration of state encryptions and decryptions.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+	stateSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "state_size_bytes",
+		Help:      "Plaintext size of the states written and read.",
+		// 1 KiB to 256 MiB
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"operation"})
+
+	redisPoolMu sync.Mutex
+	redisPool   func() PoolStats
+)
+
+// PoolStats are the connection pool statistics of the Redis locker
+type PoolStats struct {
+	ActiveCount  int
+	IdleCount    int
+	WaitCount    int64
+	WaitDuration time.Duration
+}
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpRequestDuration,
+		lockOperations, lockHoldDuration,
+		gitCommitDuration, gitPushDuration, gitFailures, gitRetries,
+		cryptoDuration, stateSize,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "redis_pool_active_connections",
+			Help:      "Connections of the Redis pool, in use or idle.",
+		}, func() float64 { return float64(redisPoolStats().ActiveCount) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "redis_pool_idle_connections",
+			Help:      "Idle connections of the Redis pool.",
+		}, func() float64 { return float64(redisPoolStats().IdleCount) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "redis_pool_waits_total",
+			Help:      "Times a Redis connection was waited for.",
+		}, func() float64 { return float64(redisPoolStats().WaitCount) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "redis_pool_wait_duration_seconds_total",
+			Help:      "Time spent waiting for a Redis connection.",
+		}, func() float64 { return redisPoolStats().WaitDuration.Seconds() }),
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
+
+// ObserveRequest records a served HTTP request, route is the route pattern
+// so paths with parameters share their series
+func ObserveRequest(route, method, status string, duration time.Duration) {
+	httpRequests.WithLabelValues(route, method, status).Inc()
+	httpRequestDuration.WithLabelValues(route, method, status).Observe(duration.Seconds())
+}
+
+// ObserveLock records a lock or unlock operation
+func ObserveLock(operation, result string) {
+	lockOperations.WithLabelValues(operation, result).Inc()
+}
+
+// ObserveLockHeld records how long a released lock was held
+func ObserveLockHeld(duration time.Duration) {
+	lockHoldDuration.Observe(duration.Seconds())
+}
+
+// ObserveCommit records a git commit
+func ObserveCommit(duration time.Duration, err error) {
+	gitCommitDuration.Observe(duration.Seconds())
+	if err != nil {
+		gitFailures.WithLabelValues("commit", "").Inc()
+	}
+}
+
+// ObservePushAttempt records a single push attempt to a remote
+func ObservePushAttempt(remote string, duration time.Duration) {
+	gitPushDuration.WithLabelValues(remote).Observe(duration.Seconds())
+}
+
+// ObservePush records the result of a push to a remote after its retries
+func ObservePush(remote string, err error) {
+	if err != nil {
+		gitFailures.WithLabelValues("push", remote).Inc()
+	}
+}
+
+// ObserveRetry records a retried push attempt
+func ObserveRetry(remote string) {
+	gitRetries.WithLabelValues(remote).Inc()
+}
+
+// ObserveEncrypt records the encryption of a written state
+func ObserveEncrypt(duration time.Duration, size int64) {
+	cryptoDuration.WithLabelValues("encrypt").Observe(duration.Seconds())
+	stateSize.WithLabelValues("write").Observe(float64(size))
+}
+
+// ObserveDecrypt records the decryption of a read state
+func ObserveDecrypt(duration time.Duration, size int64) {
+	cryptoDuration.WithLabelValues("decrypt").Observe(duration.Seconds())
+	stateSize.WithLabelValues("read").Observe(float64(size))
+}
+
+// SetRedisPool sets the source of the Redis pool statistics
+func SetRedisPool(stats func() PoolStats) {
+	redisPoolMu.Lock()
+	defer redisPoolMu.Unlock()
+	redisPool = stats
+}
+
+func redisPoolStats() PoolStats {
+	redisPoolMu.Lock()
+	stats := redisPool
+	redisPoolMu.Unlock()
+	if stats == nil {
+		return PoolStats{}
+	}
+	return stats()
+}
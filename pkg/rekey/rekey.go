@@ -0,0 +1,503 @@
+package rekey
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"filippo.io/age"
+	"github.com/google/uuid"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/commitmsg"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/encryptions"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/lock"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/sidecar"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// lockOwner is the Who of the locks taken while rekeying
+const lockOwner = "terraform-backend-gitops rekey"
+
+// Policies for states that are locked while rekeying
+const (
+	OnLockedSkip  = "skip"
+	OnLockedAbort = "abort"
+)
+
+// Locker holds the locks of the states while they are rewritten. GetLock
+// returns a KindNotFound error when the state is not locked and Lock a
+// KindLocked error when another lock holds it.
+type Locker interface {
+	GetLock(ctx context.Context, path string) (*lock.LockInfo, error)
+	Lock(ctx context.Context, path string, info *lock.LockInfo) error
+	Unlock(ctx context.Context, path string, info *lock.LockInfo) error
+}
+
+// Committer commits several files as one git commit
+type Committer interface {
+	CommitAndPushFiles(ctx context.Context, filePaths []string, commitMessage string) error
+}
+
+type Options struct {
+	DryRun   bool
+	OnLocked string
+	// Migrate only re-encrypts the states whose format or compression differs
+	// from the configuration, e.g. to compress the existing states once
+	Migrate bool
+}
+
+type Skipped struct {
+	State  string `json:"state"`
+	Reason string `json:"reason"`
+}
+
+type Result struct {
+	DryRun    bool      `json:"dryRun"`
+	Rekeyed   []string  `json:"rekeyed"`
+	Skipped   []Skipped `json:"skipped,omitempty"`
+	Committed bool      `json:"committed"`
+}
+
+// Rekeyer re-encrypts every state of the repository to the configured
+// recipients
+type Rekeyer struct {
+	root          string
+	backupDir     string
+	commitMessage string
+	format        string
+	sensitiveOnly bool
+	compression   string
+	recipients    []age.Recipient
+	identities    []age.Identity
+	locker        Locker
+	git           Committer
+	logger        *zap.Logger
+}
+
+type pendingState struct {
+	path      string
+	statePath string
+	mode      fs.FileMode
+	// previous is the ciphertext that was re-encrypted, the state is only
+	// replaced when it still holds it
+	previous   []byte
+	ciphertext []byte
+	// checksum is the digest of the plaintext served from the new ciphertext
+	checksum sidecar.Digest
+}
+
+// writtenFile is a file replaced by writeStates, its previous version is kept
+// until the commit
+type writtenFile struct {
+	path   string
+	backup *storage.Backup
+}
+
+// New creates a Rekeyer, locker and git are optional
+func New(cfg *config.Config, locker Locker, git Committer, logger *zap.Logger) (*Rekeyer, error) {
+	recipients, err := encryptions.LoadRecipients(cfg.Encryptions.Age)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load recipients: %w", err)
+	}
+
+	keyring, err := encryptions.NewKeyring(cfg.Encryptions.Age)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identities: %w", err)
+	}
+
+	return &Rekeyer{
+		root:          cfg.Repo.RepoLocal.Path,
+		backupDir:     storage.BackupDir(cfg),
+		commitMessage: commitPrefix(cfg.Repo.Remote.CommitMessage),
+		format:        cfg.Encryptions.Age.Format,
+		sensitiveOnly: cfg.Encryptions.Age.SensitiveOnly,
+		compression:   cfg.Encryptions.Age.Compression,
+		recipients:    recipients,
+		identities:    keyring.Identities(),
+		locker:        locker,
+		git:           git,
+		logger:        logger,
+	}, nil
+}
+
+// Run decrypts every encrypted state, re-encrypts it to the configured
+// recipients in the configured format and verifies the round trip. Unless it is a dry run, all states
+// are then written and committed together, each one locked from the moment it
+// is read until it is committed. Nothing is written when any state fails to
+// re-encrypt, and the previous versions are restored when the commit fails.
+func (r *Rekeyer) Run(ctx context.Context, opts Options) (*Result, error) {
+	if opts.OnLocked == "" {
+		opts.OnLocked = OnLockedAbort
+	}
+	if opts.OnLocked != OnLockedSkip && opts.OnLocked != OnLockedAbort {
+		return nil, errs.Errorf(errs.KindBadRequest, "rekey.Run", "unsupported locked state policy: %s", opts.OnLocked)
+	}
+
+	states, err := r.findStates()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{DryRun: opts.DryRun, Rekeyed: []string{}}
+	var pending []pendingState
+
+	// a concurrent write of a locked state can not be overwritten by its
+	// re-encrypted previous version
+	lockInfo := &lock.LockInfo{
+		ID:        uuid.New().String(),
+		Operation: "rekey",
+		Who:       lockOwner,
+		Created:   time.Now().UTC(),
+	}
+	var locked []string
+	defer func() {
+		r.unlock(ctx, locked, lockInfo)
+	}()
+	for _, path := range states {
+		relativePath, err := filepath.Rel(r.root, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get relative state path: %w", err)
+		}
+		relativePath = filepath.ToSlash(relativePath)
+
+		acquired, err := r.lock(ctx, relativePath, lockInfo, opts.DryRun)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock %s: %w", relativePath, err)
+		}
+		if acquired && r.locker != nil && !opts.DryRun {
+			locked = append(locked, relativePath)
+		}
+		if !acquired {
+			if opts.OnLocked == OnLockedAbort {
+				return nil, errs.Errorf(errs.KindLocked, "rekey.Run", "state %s is locked, aborting rekey", relativePath)
+			}
+			r.logger.Warn("skipping locked state", zap.String("state", relativePath))
+			result.Skipped = append(result.Skipped, Skipped{State: relativePath, Reason: "locked"})
+			continue
+		}
+
+		state, err := r.reencrypt(path, opts.Migrate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rekey %s: %w", relativePath, err)
+		}
+		if state == nil {
+			result.Skipped = append(result.Skipped, Skipped{State: relativePath, Reason: "up to date"})
+			continue
+		}
+		state.statePath = relativePath
+		pending = append(pending, *state)
+		result.Rekeyed = append(result.Rekeyed, relativePath)
+	}
+
+	if opts.DryRun || len(pending) == 0 {
+		return result, nil
+	}
+
+	writer := sidecar.Writer{
+		Who:       lockOwner,
+		Operation: lockInfo.Operation,
+		LockID:    lockInfo.ID,
+		Time:      time.Now().UTC(),
+	}
+	written, err := r.writeStates(pending, writer)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.git == nil {
+		r.discardBackups(written)
+		r.logger.Warn("git sync disabled, re-encrypted states are not committed")
+		return result, nil
+	}
+
+	commitMessage := fmt.Sprintf("%s: rekey %d states", r.commitMessage, len(pending))
+	if opts.Migrate {
+		commitMessage = fmt.Sprintf("%s: migrate %d states to %s", r.commitMessage, len(pending), r.envelope())
+	}
+	paths := make([]string, 0, len(written))
+	for _, file := range written {
+		paths = append(paths, file.path)
+	}
+	if err := r.git.CommitAndPushFiles(ctx, paths, commitMessage); err != nil {
+		// the states are committed locally, only the push failed
+		if errs.Is(err, errs.KindGitSync) {
+			r.discardBackups(written)
+			result.Committed = true
+			return result, fmt.Errorf("states re-encrypted but git sync failed: %w", err)
+		}
+		r.restoreStates(written)
+		return nil, fmt.Errorf("failed to commit the re-encrypted states, the previous versions are restored: %w", err)
+	}
+	r.discardBackups(written)
+	result.Committed = true
+
+	return result, nil
+}
+
+// findStates walks the repository and returns every encrypted state file
+func (r *Rekeyer) findStates() ([]string, error) {
+	var states []string
+	err := filepath.WalkDir(r.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" || path == r.backupDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		format, err := encryptions.DetectFileFormat(path)
+		if err != nil {
+			return err
+		}
+		if format != "" {
+			states = append(states, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk repository: %w", err)
+	}
+
+	sort.Strings(states)
+	return states, nil
+}
+
+// lock takes the lock of a state, it returns false when another lock holds
+// it. A dry run only checks the state is not locked.
+func (r *Rekeyer) lock(ctx context.Context, statePath string, info *lock.LockInfo, dryRun bool) (bool, error) {
+	if r.locker == nil {
+		return true, nil
+	}
+	if dryRun {
+		_, err := r.locker.GetLock(ctx, statePath)
+		if errs.Is(err, errs.KindNotFound) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	err := r.locker.Lock(ctx, statePath, info)
+	if errs.Is(err, errs.KindLocked) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unlock releases the locks taken by Run, even when its context is done
+func (r *Rekeyer) unlock(ctx context.Context, statePaths []string, info *lock.LockInfo) {
+	ctx = context.WithoutCancel(ctx)
+	for _, statePath := range statePaths {
+		if err := r.locker.Unlock(ctx, statePath, info); err != nil {
+			r.logger.Error("failed to unlock state", zap.String("state", statePath), zap.Error(err))
+		}
+	}
+}
+
+// envelope returns the configured format and compression
+func (r *Rekeyer) envelope() encryptions.Envelope {
+	envelope := encryptions.Envelope{Format: r.format, Compression: r.compression}
+	if envelope.Format == "" {
+		envelope.Format = encryptions.FormatBinary
+	}
+	if envelope.Compression == "" || envelope.Format == encryptions.FormatStructured {
+		envelope.Compression = encryptions.CompressionNone
+	}
+	return envelope
+}
+
+// reencrypt decrypts a state, encrypts it to the recipients and checks the
+// new ciphertext decrypts to the same plaintext with the loaded identities.
+// When migrating, states already stored in the configured envelope return nil.
+func (r *Rekeyer) reencrypt(path string, migrate bool) (*pendingState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	oldCiphertext, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, envelope, err := encryptions.DecryptEnvelope(r.identities, oldCiphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	if migrate && envelope == r.envelope() {
+		return nil, nil
+	}
+
+	// no previous file is passed, structured states get a fresh data key
+	var ciphertext bytes.Buffer
+	err = encryptions.AgeEncrypt(r.recipients, bytes.NewReader(plaintext), &ciphertext, encryptions.EncryptOptions{
+		Format:        r.format,
+		SensitiveOnly: r.sensitiveOnly,
+		Compression:   r.compression,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt: %w", err)
+	}
+
+	roundTrip, err := encryptions.Decrypt(r.identities, ciphertext.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("round trip verification failed, none of the identities matches the new recipients: %w", err)
+	}
+	expected, err := encryptions.NormalizePlaintext(r.format, plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize plaintext: %w", err)
+	}
+	if !bytes.Equal(expected, roundTrip) {
+		return nil, fmt.Errorf("round trip verification failed, plaintext mismatch")
+	}
+
+	checksum := sidecar.NewDigest(roundTrip)
+	checksum.EncryptedSize = int64(ciphertext.Len())
+	return &pendingState{
+		path:       path,
+		mode:       info.Mode().Perm(),
+		previous:   oldCiphertext,
+		ciphertext: ciphertext.Bytes(),
+		checksum:   checksum,
+	}, nil
+}
+
+// writeStates replaces every state through a temporary file and rename,
+// keeping the previous versions in the backup directory until they are
+// committed. The checksum and metadata sidecars a state has are rewritten
+// for the new ciphertext and writer. A state that changed since it was
+// re-encrypted is not replaced, and the already replaced files are restored
+// when one of them fails.
+func (r *Rekeyer) writeStates(states []pendingState, writer sidecar.Writer) ([]writtenFile, error) {
+	var written []writtenFile
+	for _, state := range states {
+		current, err := os.ReadFile(state.path)
+		if err != nil {
+			r.restoreStates(written)
+			return nil, fmt.Errorf("failed to read %s: %w", state.statePath, err)
+		}
+		if !bytes.Equal(current, state.previous) {
+			r.restoreStates(written)
+			return nil, errs.Errorf(errs.KindConflict, "rekey.writeStates", "state %s changed while rekeying", state.statePath)
+		}
+
+		files, err := r.sidecars(state, writer)
+		if err != nil {
+			r.restoreStates(written)
+			return nil, fmt.Errorf("failed to update the sidecars of %s: %w", state.statePath, err)
+		}
+		// the state is written first, its checksum is not older than it
+		files = append([]pendingFile{{path: state.path, data: state.ciphertext, mode: state.mode}}, files...)
+		for _, file := range files {
+			relativePath, err := filepath.Rel(r.root, file.path)
+			if err != nil {
+				r.restoreStates(written)
+				return nil, err
+			}
+			relativePath = filepath.ToSlash(relativePath)
+
+			backup, err := storage.BackupFile(file.path, filepath.Join(r.backupDir, filepath.FromSlash(relativePath)))
+			if err != nil {
+				r.restoreStates(written)
+				return nil, err
+			}
+			if err := replaceFile(file.path, file.data, file.mode); err != nil {
+				if discardErr := backup.Discard(); discardErr != nil {
+					r.logger.Warn("failed to remove backup", zap.String("file", relativePath), zap.Error(discardErr))
+				}
+				r.restoreStates(written)
+				return nil, fmt.Errorf("failed to write %s: %w", relativePath, err)
+			}
+			written = append(written, writtenFile{path: relativePath, backup: backup})
+		}
+	}
+	return written, nil
+}
+
+// pendingFile is the new content of a file written by writeStates
+type pendingFile struct {
+	path string
+	data []byte
+	mode fs.FileMode
+}
+
+// sidecars returns the new checksum and metadata of a state, a state without
+// them does not get them
+func (r *Rekeyer) sidecars(state pendingState, writer sidecar.Writer) ([]pendingFile, error) {
+	var files []pendingFile
+	checksumInfo, err := os.Stat(sidecar.ChecksumPath(state.path))
+	switch {
+	case err == nil:
+		var data bytes.Buffer
+		if err := sidecar.WriteChecksum(&data, state.path, state.checksum); err != nil {
+			return nil, err
+		}
+		files = append(files, pendingFile{path: sidecar.ChecksumPath(state.path), data: data.Bytes(), mode: checksumInfo.Mode().Perm()})
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	metadata, err := sidecar.ReadMetadata(state.path)
+	if err != nil || metadata == nil {
+		return files, err
+	}
+	metadata.LastWriter = writer
+	metadataInfo, err := os.Stat(sidecar.MetadataPath(state.path))
+	if err != nil {
+		return nil, err
+	}
+	var data bytes.Buffer
+	if err := sidecar.WriteMetadata(&data, *metadata); err != nil {
+		return nil, err
+	}
+	return append(files, pendingFile{path: sidecar.MetadataPath(state.path), data: data.Bytes(), mode: metadataInfo.Mode().Perm()}), nil
+}
+
+// restoreStates puts the previous versions of the written files back
+func (r *Rekeyer) restoreStates(written []writtenFile) {
+	for _, file := range written {
+		if err := file.backup.Restore(); err != nil {
+			r.logger.Error("failed to restore the previous version", zap.String("file", file.path), zap.Error(err))
+		}
+	}
+}
+
+// discardBackups drops the previous versions once the files are committed
+func (r *Rekeyer) discardBackups(written []writtenFile) {
+	for _, file := range written {
+		if err := file.backup.Discard(); err != nil {
+			r.logger.Warn("failed to remove backup", zap.String("file", file.path), zap.Error(err))
+		}
+	}
+}
+
+func replaceFile(path string, data []byte, mode fs.FileMode) error {
+	return storage.WriteFileAtomic(path, mode, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// commitPrefix returns the prefix of the rekey commit messages. A templated
+// commit message describes a single state write, the default prefix is used
+// instead.
+func commitPrefix(message string) string {
+	if message == "" || commitmsg.IsTemplate(message) {
+		return commitmsg.Default
+	}
+	return message
+}
@@ -0,0 +1,416 @@
+package rekey
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/encryptions"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/lock"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/sidecar"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/storage"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/tfstate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeLocker map[string]*lock.LockInfo
+
+func (f fakeLocker) GetLock(ctx context.Context, path string) (*lock.LockInfo, error) {
+	if info, ok := f[path]; ok {
+		return info, nil
+	}
+	return nil, errs.Errorf(errs.KindNotFound, "fakeLocker.GetLock", "lock of %s not found", path)
+}
+
+func (f fakeLocker) Lock(ctx context.Context, path string, info *lock.LockInfo) error {
+	if current, ok := f[path]; ok && current.ID != info.ID {
+		return errs.E(errs.KindLocked, "fakeLocker.Lock", &lock.LockedError{Info: current})
+	}
+	f[path] = info
+	return nil
+}
+
+func (f fakeLocker) Unlock(ctx context.Context, path string, info *lock.LockInfo) error {
+	delete(f, path)
+	return nil
+}
+
+// hookLocker calls onLock before locking a state
+type hookLocker struct {
+	fakeLocker
+	onLock func(path string)
+}
+
+func (h hookLocker) Lock(ctx context.Context, path string, info *lock.LockInfo) error {
+	h.onLock(path)
+	return h.fakeLocker.Lock(ctx, path, info)
+}
+
+// fakeCommitter checks the states are still locked when they are committed
+type fakeCommitter struct {
+	t      *testing.T
+	locker fakeLocker
+	err    error
+}
+
+func (f fakeCommitter) CommitAndPushFiles(ctx context.Context, filePaths []string, commitMessage string) error {
+	for _, path := range filePaths {
+		path = strings.TrimSuffix(strings.TrimSuffix(path, sidecar.ChecksumSuffix), sidecar.MetadataSuffix)
+		assert.Contains(f.t, f.locker, path)
+	}
+	return f.err
+}
+
+func encryptState(t *testing.T, path string, plaintext string, recipient age.Recipient) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0750))
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	w, err := age.Encrypt(f, recipient)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, plaintext)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+}
+
+func decryptState(t *testing.T, path string, identity age.Identity) (string, error) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	r, err := age.Decrypt(bytes.NewReader(data), identity)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := io.ReadAll(r)
+	return string(plaintext), err
+}
+
+// writeSidecars writes the metadata of a state and a checksum without the
+// encrypted size, as the backend did before storing it
+func writeSidecars(t *testing.T, path string, plaintext string) {
+	t.Helper()
+	sums := sidecar.NewDigest([]byte(plaintext))
+	checksum := fmt.Sprintf("%x  %s\n# size %d md5 %x\n", sums.SHA256, filepath.Base(path), sums.Size, sums.MD5)
+	require.NoError(t, os.WriteFile(sidecar.ChecksumPath(path), []byte(checksum), 0644))
+
+	var data bytes.Buffer
+	state, err := tfstate.Parse(strings.NewReader(plaintext))
+	require.NoError(t, err)
+	metadata := sidecar.NewMetadata(filepath.Base(path), state, sidecar.Writer{Who: "alice", Operation: "OperationTypeApply"})
+	require.NoError(t, sidecar.WriteMetadata(&data, metadata))
+	require.NoError(t, os.WriteFile(sidecar.MetadataPath(path), data.Bytes(), 0644))
+}
+
+func setupRepo(t *testing.T) (string, *git.Repository, *age.X25519Identity, *config.Config) {
+	t.Helper()
+	tempDir := t.TempDir()
+
+	repo, err := git.PlainInit(tempDir, false)
+	require.NoError(t, err)
+
+	oldIdentity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	newIdentity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	encryptState(t, filepath.Join(tempDir, "prod", "network.tfstate"), `{"serial": 1}`, oldIdentity.Recipient())
+	encryptState(t, filepath.Join(tempDir, "dev.tfstate"), `{"serial": 2}`, oldIdentity.Recipient())
+	writeSidecars(t, filepath.Join(tempDir, "dev.tfstate"), `{"serial": 2}`)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "README.md"), []byte("plaintext"), 0644))
+
+	worktree, err := repo.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, worktree.AddGlob("."))
+	_, err = worktree.Commit("initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com"},
+	})
+	require.NoError(t, err)
+
+	// the server keeps both keys while rotating to the new recipient
+	keysPath := filepath.Join(t.TempDir(), "keys.txt")
+	keys := "# old\n" + oldIdentity.String() + "\n# new\n" + newIdentity.String() + "\n"
+	require.NoError(t, os.WriteFile(keysPath, []byte(keys), 0600))
+
+	cfg := &config.Config{
+		Repo: config.Repo{
+			RepoLocal: config.RepoLocal{Path: tempDir},
+			Remote: config.RepoRemote{
+				Enabled:       true,
+				RemoteURL:     "https://github.com/test/repo.git",
+				Branch:        "main",
+				AuthMethod:    "default",
+				CommitMessage: "test commit",
+				Author:        config.CommitAuthor{Name: "Test User", Email: "test@example.com"},
+			},
+		},
+		Encryptions: config.Encryptions{
+			Age: config.Age{
+				Recipient:         newIdentity.Recipient().String(),
+				AgePrivateKeyPath: keysPath,
+			},
+		},
+	}
+
+	return tempDir, repo, newIdentity, cfg
+}
+
+func TestRekeyRun(t *testing.T) {
+	tempDir, repo, newIdentity, cfg := setupRepo(t)
+	logger, _ := zap.NewDevelopment()
+
+	gitOps, err := storage.NewGitOperations(cfg, logger)
+	require.NoError(t, err)
+
+	rekeyer, err := New(cfg, fakeLocker{}, gitOps, logger)
+	require.NoError(t, err)
+
+	// dry run must not touch anything
+	result, err := rekeyer.Run(context.Background(), Options{DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dev.tfstate", "prod/network.tfstate"}, result.Rekeyed)
+	assert.False(t, result.Committed)
+	_, err = decryptState(t, filepath.Join(tempDir, "dev.tfstate"), newIdentity)
+	require.Error(t, err)
+
+	result, err = rekeyer.Run(context.Background(), Options{})
+	require.NoError(t, err)
+	assert.True(t, result.Committed)
+
+	plaintext, err := decryptState(t, filepath.Join(tempDir, "prod", "network.tfstate"), newIdentity)
+	require.NoError(t, err)
+	assert.Equal(t, `{"serial": 1}`, plaintext)
+
+	// every state is part of a single commit
+	head, err := repo.Head()
+	require.NoError(t, err)
+	commit, err := repo.CommitObject(head.Hash())
+	require.NoError(t, err)
+	assert.Equal(t, "test commit: rekey 2 states", commit.Message)
+	parent, err := commit.Parent(0)
+	require.NoError(t, err)
+	parentTree, err := parent.Tree()
+	require.NoError(t, err)
+	tree, err := commit.Tree()
+	require.NoError(t, err)
+	changes, err := object.DiffTree(parentTree, tree)
+	require.NoError(t, err)
+	assert.Len(t, changes, 4)
+
+	// the sidecars of dev.tfstate describe the new ciphertext and writer
+	devPath := filepath.Join(tempDir, "dev.tfstate")
+	info, err := os.Stat(devPath)
+	require.NoError(t, err)
+	checksum, err := sidecar.ReadChecksum(devPath)
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), checksum.EncryptedSize)
+	expected := sidecar.NewDigest([]byte(`{"serial": 2}`))
+	assert.True(t, expected.Matches(*checksum))
+	metadata, err := sidecar.ReadMetadata(devPath)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), metadata.Serial)
+	assert.Equal(t, lockOwner, metadata.LastWriter.Who)
+	assert.Equal(t, "rekey", metadata.LastWriter.Operation)
+	status, err := mustWorktree(t, repo).Status()
+	require.NoError(t, err)
+	assert.True(t, status.IsClean(), status.String())
+}
+
+func TestRekeyRun_Locked(t *testing.T) {
+	tempDir, _, newIdentity, cfg := setupRepo(t)
+	logger, _ := zap.NewDevelopment()
+	locker := fakeLocker{"dev.tfstate": &lock.LockInfo{ID: "f1e2d3", Who: "alice@laptop"}}
+
+	rekeyer, err := New(cfg, locker, nil, logger)
+	require.NoError(t, err)
+
+	_, err = rekeyer.Run(context.Background(), Options{OnLocked: OnLockedAbort})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "state dev.tfstate is locked")
+	assert.True(t, errs.Is(err, errs.KindLocked))
+
+	result, err := rekeyer.Run(context.Background(), Options{OnLocked: OnLockedSkip})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"prod/network.tfstate"}, result.Rekeyed)
+	assert.Equal(t, []Skipped{{State: "dev.tfstate", Reason: "locked"}}, result.Skipped)
+
+	_, err = decryptState(t, filepath.Join(tempDir, "dev.tfstate"), newIdentity)
+	require.Error(t, err)
+}
+
+func TestRekeyRun_UnverifiableRecipients(t *testing.T) {
+	tempDir, _, _, cfg := setupRepo(t)
+	logger, _ := zap.NewDevelopment()
+
+	// none of the loaded identities matches this recipient
+	foreign, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	cfg.Encryptions.Age.Recipient = foreign.Recipient().String()
+
+	before, err := os.ReadFile(filepath.Join(tempDir, "dev.tfstate"))
+	require.NoError(t, err)
+
+	rekeyer, err := New(cfg, nil, nil, logger)
+	require.NoError(t, err)
+	_, err = rekeyer.Run(context.Background(), Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "round trip verification failed")
+
+	after, err := os.ReadFile(filepath.Join(tempDir, "dev.tfstate"))
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestRekeyRun_StructuredFormat(t *testing.T) {
+	tempDir, _, newIdentity, cfg := setupRepo(t)
+	logger, _ := zap.NewDevelopment()
+	cfg.Encryptions.Age.Format = encryptions.FormatStructured
+
+	rekeyer, err := New(cfg, nil, nil, logger)
+	require.NoError(t, err)
+	result, err := rekeyer.Run(context.Background(), Options{})
+	require.NoError(t, err)
+	assert.Len(t, result.Rekeyed, 2)
+
+	data, err := os.ReadFile(filepath.Join(tempDir, "dev.tfstate"))
+	require.NoError(t, err)
+	assert.Equal(t, encryptions.FormatStructured, encryptions.DetectFormat(data))
+
+	plaintext, err := encryptions.Decrypt([]age.Identity{newIdentity}, data)
+	require.NoError(t, err)
+	assert.Equal(t, "{\n  \"serial\": 2\n}\n", string(plaintext))
+
+	// structured states are picked up again by the next rotation
+	result, err = rekeyer.Run(context.Background(), Options{DryRun: true})
+	require.NoError(t, err)
+	assert.Len(t, result.Rekeyed, 2)
+}
+
+func TestRekeyRun_MigrateCompression(t *testing.T) {
+	tempDir, _, newIdentity, cfg := setupRepo(t)
+	logger, _ := zap.NewDevelopment()
+	cfg.Encryptions.Age.Compression = encryptions.CompressionZstd
+
+	rekeyer, err := New(cfg, nil, nil, logger)
+	require.NoError(t, err)
+	result, err := rekeyer.Run(context.Background(), Options{Migrate: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dev.tfstate", "prod/network.tfstate"}, result.Rekeyed)
+
+	data, err := os.ReadFile(filepath.Join(tempDir, "dev.tfstate"))
+	require.NoError(t, err)
+	plaintext, envelope, err := encryptions.DecryptEnvelope([]age.Identity{newIdentity}, data)
+	require.NoError(t, err)
+	assert.Equal(t, `{"serial": 2}`, string(plaintext))
+	assert.Equal(t, encryptions.Envelope{Format: encryptions.FormatBinary, Compression: encryptions.CompressionZstd}, envelope)
+
+	// migrated states are left alone by the next migration
+	result, err = rekeyer.Run(context.Background(), Options{Migrate: true})
+	require.NoError(t, err)
+	assert.Empty(t, result.Rekeyed)
+	assert.Len(t, result.Skipped, 2)
+	assert.Equal(t, "up to date", result.Skipped[0].Reason)
+}
+
+func TestRekeyRun_LocksUntilCommitted(t *testing.T) {
+	_, _, _, cfg := setupRepo(t)
+	logger, _ := zap.NewDevelopment()
+	locker := fakeLocker{}
+
+	rekeyer, err := New(cfg, locker, fakeCommitter{t: t, locker: locker}, logger)
+	require.NoError(t, err)
+	result, err := rekeyer.Run(context.Background(), Options{})
+	require.NoError(t, err)
+	assert.True(t, result.Committed)
+	assert.Empty(t, locker)
+}
+
+func TestRekeyRun_StateChangedWhileRekeying(t *testing.T) {
+	tempDir, _, _, cfg := setupRepo(t)
+	logger, _ := zap.NewDevelopment()
+
+	devPath := filepath.Join(tempDir, "dev.tfstate")
+	networkPath := filepath.Join(tempDir, "prod", "network.tfstate")
+	networkBefore, err := os.ReadFile(networkPath)
+	require.NoError(t, err)
+	// an apply writes dev.tfstate after it was re-encrypted
+	applied := []byte("age-encryption.org/v1 applied")
+	locker := hookLocker{fakeLocker: fakeLocker{}, onLock: func(path string) {
+		if path == "prod/network.tfstate" {
+			require.NoError(t, os.WriteFile(devPath, applied, 0644))
+		}
+	}}
+
+	rekeyer, err := New(cfg, locker, nil, logger)
+	require.NoError(t, err)
+	_, err = rekeyer.Run(context.Background(), Options{})
+	require.Error(t, err)
+	assert.True(t, errs.Is(err, errs.KindConflict))
+
+	data, err := os.ReadFile(devPath)
+	require.NoError(t, err)
+	assert.Equal(t, applied, data)
+	data, err = os.ReadFile(networkPath)
+	require.NoError(t, err)
+	assert.Equal(t, networkBefore, data)
+	assert.Empty(t, locker.fakeLocker)
+}
+
+func TestRekeyRun_CommitFailureRestores(t *testing.T) {
+	tempDir, _, _, cfg := setupRepo(t)
+	logger, _ := zap.NewDevelopment()
+
+	before, err := os.ReadFile(filepath.Join(tempDir, "dev.tfstate"))
+	require.NoError(t, err)
+	checksumBefore, err := os.ReadFile(filepath.Join(tempDir, "dev.tfstate.sha256"))
+	require.NoError(t, err)
+
+	committer := fakeCommitter{t: t, locker: fakeLocker{}, err: errs.Errorf(errs.KindStorage, "test", "commit failed")}
+	rekeyer, err := New(cfg, committer.locker, committer, logger)
+	require.NoError(t, err)
+	_, err = rekeyer.Run(context.Background(), Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the previous versions are restored")
+
+	after, err := os.ReadFile(filepath.Join(tempDir, "dev.tfstate"))
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+	checksumAfter, err := os.ReadFile(filepath.Join(tempDir, "dev.tfstate.sha256"))
+	require.NoError(t, err)
+	assert.Equal(t, checksumBefore, checksumAfter)
+	entries, err := os.ReadDir(storage.BackupDir(cfg))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.True(t, entry.IsDir(), "backup %s left behind", entry.Name())
+	}
+
+	// a failed push keeps the local commit
+	committer.err = errs.Errorf(errs.KindGitSync, "test", "push failed")
+	rekeyer, err = New(cfg, committer.locker, committer, logger)
+	require.NoError(t, err)
+	result, err := rekeyer.Run(context.Background(), Options{})
+	require.Error(t, err)
+	assert.True(t, result.Committed)
+	after, err = os.ReadFile(filepath.Join(tempDir, "dev.tfstate"))
+	require.NoError(t, err)
+	assert.NotEqual(t, before, after)
+}
+
+func mustWorktree(t *testing.T, repo *git.Repository) *git.Worktree {
+	t.Helper()
+	worktree, err := repo.Worktree()
+	require.NoError(t, err)
+	return worktree
+}
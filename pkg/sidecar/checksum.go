@@ -0,0 +1,109 @@
+// Package sidecar reads and writes the plaintext files committed next to an
+// encrypted state, shared by the backend and rekey
+package sidecar
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+)
+
+// ChecksumSuffix names the sidecar holding the plaintext SHA-256 of a state,
+// in the sha256sum format. The size, the MD5 and the size of the encrypted
+// state follow on a comment line, which sha256sum --check skips.
+const ChecksumSuffix = ".sha256"
+
+func ChecksumPath(statePath string) string {
+	return statePath + ChecksumSuffix
+}
+
+// Digest is the size and sums of a plaintext state
+type Digest struct {
+	Size   int64
+	MD5    []byte
+	SHA256 []byte
+	// EncryptedSize is the size of the state file, 0 when unknown
+	EncryptedSize int64
+}
+
+// Matches reports whether two digests are of the same state file
+func (d *Digest) Matches(other Digest) bool {
+	return d.Size == other.Size && bytes.Equal(d.MD5, other.MD5) && bytes.Equal(d.SHA256, other.SHA256) &&
+		(d.EncryptedSize == 0 || d.EncryptedSize == other.EncryptedSize)
+}
+
+// ReadChecksum returns the stored plaintext digest of a state, nil when the
+// state was written before checksums were stored. The MD5 is nil when only
+// the SHA-256 is stored.
+func ReadChecksum(statePath string) (*Digest, error) {
+	const op = "sidecar.ReadChecksum"
+
+	data, err := os.ReadFile(ChecksumPath(statePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errs.E(errs.KindStorage, op, fmt.Errorf("failed to read checksum: %w", err))
+	}
+	first, rest, _ := strings.Cut(string(data), "\n")
+	line, _, _ := strings.Cut(first, " ")
+	sum, err := hex.DecodeString(line)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errs.Errorf(errs.KindStorage, op, "malformed checksum file %s", ChecksumPath(statePath))
+	}
+	stored := &Digest{SHA256: sum}
+	var md5Hex string
+	// checksums stored before the encrypted size have the first two fields
+	if n, _ := fmt.Sscanf(rest, "# size %d md5 %s encrypted %d", &stored.Size, &md5Hex, &stored.EncryptedSize); n >= 2 {
+		if sum, err := hex.DecodeString(md5Hex); err == nil && len(sum) == md5.Size && stored.Size >= 0 {
+			stored.MD5 = sum
+		}
+	}
+	return stored, nil
+}
+
+func WriteChecksum(w io.Writer, statePath string, sums Digest) error {
+	_, err := fmt.Fprintf(w, "%x  %s\n# size %d md5 %x encrypted %d\n",
+		sums.SHA256, filepath.Base(statePath), sums.Size, sums.MD5, sums.EncryptedSize)
+	return err
+}
+
+// DigestWriter measures the plaintext written to it
+type DigestWriter struct {
+	size   int64
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func NewDigestWriter() *DigestWriter {
+	return &DigestWriter{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (d *DigestWriter) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	d.md5.Write(p)
+	d.sha256.Write(p)
+	return len(p), nil
+}
+
+func (d *DigestWriter) Digest() Digest {
+	return Digest{Size: d.size, MD5: d.md5.Sum(nil), SHA256: d.sha256.Sum(nil)}
+}
+
+// NewDigest returns the size and sums of a plaintext held in memory
+func NewDigest(plaintext []byte) Digest {
+	w := NewDigestWriter()
+	w.Write(plaintext)
+	return w.Digest()
+}
@@ -0,0 +1,82 @@
+package sidecar
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/tfstate"
+)
+
+// MetadataSuffix names the plaintext sidecar describing a state, written when
+// repo.local.metadata is enabled
+const MetadataSuffix = ".meta.json"
+
+func MetadataPath(statePath string) string {
+	return statePath + MetadataSuffix
+}
+
+// Metadata is committed next to a state so the git history shows what
+// changed without decrypting it. It never contains attribute or output values.
+type Metadata struct {
+	State            string   `json:"state"`
+	Serial           uint64   `json:"serial"`
+	Lineage          string   `json:"lineage"`
+	TerraformVersion string   `json:"terraform_version"`
+	LastWriter       Writer   `json:"last_writer"`
+	ResourceCount    int      `json:"resource_count"`
+	Resources        []string `json:"resources"`
+}
+
+// Writer describes who wrote a state, from the lock held while writing
+type Writer struct {
+	Who       string    `json:"who,omitempty"`
+	Operation string    `json:"operation,omitempty"`
+	LockID    string    `json:"lock_id,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+func NewMetadata(relativeStatePath string, state *tfstate.State, writer Writer) Metadata {
+	return Metadata{
+		State:            relativeStatePath,
+		Serial:           state.Serial,
+		Lineage:          state.Lineage,
+		TerraformVersion: state.TerraformVersion,
+		LastWriter:       writer,
+		ResourceCount:    len(state.Resources),
+		Resources:        state.Resources,
+	}
+}
+
+// ReadMetadata returns the metadata of a state, nil when it has none
+func ReadMetadata(statePath string) (*Metadata, error) {
+	const op = "sidecar.ReadMetadata"
+
+	data, err := os.ReadFile(MetadataPath(statePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errs.E(errs.KindStorage, op, fmt.Errorf("failed to read metadata: %w", err))
+	}
+	var metadata Metadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, errs.Errorf(errs.KindStorage, op, "malformed metadata file %s: %v", MetadataPath(statePath), err)
+	}
+	return &metadata, nil
+}
+
+func WriteMetadata(w io.Writer, metadata Metadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -1,20 +1,29 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
-	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	appconfig "github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/forge"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/metrics"
 )
 
 // GitOperations handles git commit and push operations for state files
@@ -22,6 +31,23 @@ type GitOperations struct {
 	config *appconfig.Config
 	repo   *git.Repository
 	logger *zap.Logger
+	// signer signs the commits, nil when signing is disabled
+	signer CommitSigner
+	// forge opens the pull requests of repo.remote.pullRequests
+	forge forge.Client
+	// mirrors are pushed to after origin
+	mirrors []appconfig.RemoteMirror
+	// mu serializes worktree changes, commits and pushes
+	mu sync.Mutex
+
+	statusMu sync.Mutex
+	status   map[string]*RemoteStatus
+	// worktreeCheck is the running CheckWorktree, shared by the callers
+	// arriving meanwhile
+	worktreeCheckMu sync.Mutex
+	worktreeCheck   *worktreeCheck
+	// pushObservers are notified of the outcome of every push
+	pushObservers []func(remote string, err error)
 }
 
 // NewGitOperations creates a new GitOperations instance
@@ -29,94 +55,199 @@ func NewGitOperations(cfg *appconfig.Config, logger *zap.Logger) (*GitOperations
 	// Open the repository
 	repo, err := git.PlainOpen(cfg.Repo.RepoLocal.Path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open git repository: %w", err)
+		return nil, errs.E(errs.KindStorage, "storage.NewGitOperations", fmt.Errorf("failed to open git repository: %w", err))
 	}
 
 	// Ensure remote is configured
-	if err := ensureRemote(repo, cfg.Repo.RepoGithub.RemoteURL); err != nil {
-		return nil, fmt.Errorf("failed to ensure remote: %w", err)
+	remoteURL, err := RemoteURL(cfg.Repo.Remote)
+	if err != nil {
+		return nil, errs.E(errs.KindStorage, "storage.NewGitOperations", fmt.Errorf("invalid remote URL: %w", err))
+	}
+	if err := ensureRemote(repo, originRemote, remoteURL); err != nil {
+		return nil, errs.E(errs.KindStorage, "storage.NewGitOperations", fmt.Errorf("failed to ensure remote: %w", err))
+	}
+	if err := ensureMirrors(repo, cfg.Repo.Remote.Mirrors); err != nil {
+		return nil, errs.E(errs.KindStorage, "storage.NewGitOperations", err)
+	}
+
+	signer, err := NewCommitSigner(cfg.Repo.Remote.Signing)
+	if err != nil {
+		return nil, errs.E(errs.KindStorage, "storage.NewGitOperations", fmt.Errorf("failed to load signing key: %w", err))
+	}
+
+	var forgeClient forge.Client
+	if len(cfg.Repo.Remote.PullRequests.Prefixes) > 0 {
+		if cfg.Repo.Remote.Forge != "" && cfg.Repo.Remote.Forge != forge.TypeGitHub {
+			return nil, errs.Errorf(errs.KindStorage, "storage.NewGitOperations", "pull requests are not supported on forge %s", cfg.Repo.Remote.Forge)
+		}
+		forgeClient, err = forge.NewGitHub(cfg.Repo.Remote.PullRequests.APIURL, cfg.Repo.Remote.RemoteURL, os.ExpandEnv(cfg.Repo.Remote.Token))
+		if err != nil {
+			return nil, errs.E(errs.KindStorage, "storage.NewGitOperations", fmt.Errorf("failed to configure pull requests: %w", err))
+		}
 	}
 
 	return &GitOperations{
-		config: cfg,
-		repo:   repo,
-		logger: logger,
+		config:  cfg,
+		repo:    repo,
+		logger:  logger,
+		signer:  signer,
+		forge:   forgeClient,
+		mirrors: cfg.Repo.Remote.Mirrors,
+		status:  map[string]*RemoteStatus{},
 	}, nil
 }
 
 // CommitAndPush commits a file and pushes to the remote repository
-func (g *GitOperations) CommitAndPush(filePath, commitMessage string) error {
-	// Commit the file
-	commitHash, err := g.commitFile(filePath, commitMessage)
+func (g *GitOperations) CommitAndPush(ctx context.Context, filePath, commitMessage string) error {
+	return g.CommitAndPushFiles(ctx, []string{filePath}, commitMessage)
+}
+
+// CommitAndPushFiles commits several files as one atomic commit and pushes
+// to the remote repository
+func (g *GitOperations) CommitAndPushFiles(ctx context.Context, filePaths []string, commitMessage string) (err error) {
+	ctx, span := tracer.Start(ctx, "git.CommitAndPush", trace.WithAttributes(stateAttributes(filePaths)...))
+	defer func() { endSpan(span, err) }()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	branch := g.pullRequestBranch(filePaths)
+	if g.config.Repo.Remote.AutoPush || branch != "" {
+		// pull requests merged on the forge move the state branch, the
+		// commit is built on top of it
+		if err := g.syncBase(ctx); err != nil {
+			g.logger.Warn("failed to sync the state branch with origin", zap.Error(err))
+		}
+	}
+	if branch != "" {
+		return g.commitToPullRequest(ctx, branch, filePaths, commitMessage)
+	}
+
+	// Commit the files
+	commitHash, err := g.traceCommit(ctx, func() (string, error) {
+		return g.commitFiles(filePaths, commitMessage)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to commit file: %w", err)
+		return errs.E(errs.KindStorage, "storage.CommitAndPush", fmt.Errorf("failed to commit files: %w", err))
 	}
 
-	g.logger.Info("committed file to git",
-		zap.String("file", filePath),
+	g.logger.Info("committed files to git",
+		zap.Strings("files", filePaths),
 		zap.String("commit", commitHash))
 
-	// Push to remote with retry
-	if g.config.Repo.RepoGithub.AutoPush {
-		if err := g.retryOperation(g.pushToRemote); err != nil {
-			return fmt.Errorf("failed to push to remote: %w", err)
-		}
+	if !g.config.Repo.Remote.AutoPush {
+		return nil
+	}
 
+	// Push to remote with retry, the mirrors get the commit even when
+	// origin is unreachable
+	var originErr error
+	if err := g.recordPush(originRemote, g.config.Repo.Remote.RemoteURL, g.pushWithRetry(ctx, originRemote, g.config.Repo.Remote, g.branchRefSpec())); err != nil {
+		originErr = errs.E(errs.KindGitSync, "storage.CommitAndPush", fmt.Errorf("failed to push to remote: %w", err))
+	} else {
 		g.logger.Info("pushed to remote successfully",
-			zap.String("remote", g.config.Repo.RepoGithub.RemoteURL),
-			zap.String("branch", g.config.Repo.RepoGithub.Branch))
+			zap.String("remote", g.config.Repo.Remote.RemoteURL),
+			zap.String("branch", g.config.Repo.Remote.Branch))
 	}
 
-	return nil
+	return errors.Join(originErr, g.pushMirrors(ctx, g.branchRefSpec()))
 }
 
-// commitFile stages and commits a specific file
-func (g *GitOperations) commitFile(filePath, commitMessage string) (string, error) {
+// commitFiles stages the given files and commits them together
+func (g *GitOperations) commitFiles(filePaths []string, commitMessage string) (string, error) {
 	worktree, err := g.repo.Worktree()
 	if err != nil {
 		return "", fmt.Errorf("failed to get worktree: %w", err)
 	}
 
-	// Stage the specific file
-	_, err = worktree.Add(filePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to stage file %s: %w", filePath, err)
+	// Stage the specific files
+	for _, filePath := range filePaths {
+		if _, err := worktree.Add(filePath); err != nil {
+			return "", g.unstageFiles(worktree, filePaths, fmt.Errorf("failed to stage file %s: %w", filePath, err))
+		}
 	}
 
 	// Create commit
 	author := &object.Signature{
-		Name:  g.config.Repo.RepoGithub.Author.Name,
-		Email: g.config.Repo.RepoGithub.Author.Email,
+		Name:  g.config.Repo.Remote.Author.Name,
+		Email: g.config.Repo.Remote.Author.Email,
 		When:  time.Now(),
 	}
 
-	commit, err := worktree.Commit(commitMessage, &git.CommitOptions{
+	opts := &git.CommitOptions{
 		Author: author,
-	})
+	}
+	if g.signer != nil {
+		opts.Signer = g.signer
+	}
+	commit, err := worktree.Commit(commitMessage, opts)
 	if err != nil {
-		return "", fmt.Errorf("failed to create commit: %w", err)
+		return "", g.unstageFiles(worktree, filePaths, fmt.Errorf("failed to create commit: %w", err))
 	}
 
 	return commit.String(), nil
 }
 
-// pushToRemote pushes to the configured remote repository
-func (g *GitOperations) pushToRemote() error {
-	auth, err := g.getAuth()
+// unstageFiles resets the index entries of the files to HEAD after a failed
+// commit, so the next commit does not pick them up, and returns the cause
+func (g *GitOperations) unstageFiles(worktree *git.Worktree, filePaths []string, cause error) error {
+	err := worktree.Restore(&git.RestoreOptions{Staged: true, Files: filePaths})
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// without a commit the files were not in the index before
+		err = g.removeFromIndex(filePaths)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to get authentication: %w", err)
+		g.logger.Error("failed to unstage files", zap.Strings("files", filePaths), zap.Error(err))
 	}
+	return cause
+}
 
-	// Create refspec for the configured branch
-	refSpec := config.RefSpec(fmt.Sprintf("refs/heads/%s:refs/heads/%s",
-		g.config.Repo.RepoGithub.Branch,
-		g.config.Repo.RepoGithub.Branch))
+func (g *GitOperations) removeFromIndex(filePaths []string) error {
+	idx, err := g.repo.Storer.Index()
+	if err != nil {
+		return err
+	}
+	for _, filePath := range filePaths {
+		if _, err := idx.Remove(filePath); err != nil && !errors.Is(err, index.ErrEntryNotFound) {
+			return err
+		}
+	}
+	return g.repo.Storer.SetIndex(idx)
+}
+
+// branchRefSpec is the refspec of the configured branch
+func (g *GitOperations) branchRefSpec() config.RefSpec {
+	return config.RefSpec(fmt.Sprintf("refs/heads/%s:refs/heads/%s",
+		g.config.Repo.Remote.Branch,
+		g.config.Repo.Remote.Branch))
+}
+
+// pushWithRetry pushes a refspec to a named remote with its retry settings
+func (g *GitOperations) pushWithRetry(ctx context.Context, remoteName string, remote appconfig.RepoRemote, refSpec config.RefSpec) (err error) {
+	ctx, span := tracer.Start(ctx, "git.push", trace.WithAttributes(
+		attribute.String("git.remote", remoteName),
+		attribute.String("git.refspec", refSpec.String())))
+	defer func() { endSpan(span, err) }()
+
+	return g.retry(ctx, remoteName, remote, func(ctx context.Context) error {
+		return g.pushTo(ctx, remoteName, remote, refSpec)
+	})
+}
+
+// pushTo pushes a refspec to a named remote with its auth settings
+func (g *GitOperations) pushTo(ctx context.Context, remoteName string, remote appconfig.RepoRemote, refSpec config.RefSpec) error {
+	auth, err := remoteAuth(remote)
+	if err != nil {
+		return fmt.Errorf("failed to get authentication: %w", err)
+	}
 
-	err = g.repo.Push(&git.PushOptions{
-		RemoteName: "origin",
+	start := time.Now()
+	err = g.repo.PushContext(ctx, &git.PushOptions{
+		RemoteName: remoteName,
 		RefSpecs:   []config.RefSpec{refSpec},
 		Auth:       auth,
 	})
+	metrics.ObservePushAttempt(remoteName, time.Since(start))
 
 	if err != nil {
 		// git.NoErrAlreadyUpToDate is not an error
@@ -130,47 +261,24 @@ func (g *GitOperations) pushToRemote() error {
 	return nil
 }
 
-// getAuth returns the appropriate authentication method based on configuration
-func (g *GitOperations) getAuth() (transport.AuthMethod, error) {
-	switch g.config.Repo.RepoGithub.AuthMethod {
+// remoteAuth returns the authentication method of a remote
+func remoteAuth(remote appconfig.RepoRemote) (transport.AuthMethod, error) {
+	switch remote.AuthMethod {
 	case "ssh":
-		return g.getSSHAuth()
+		return NewSSHAuth(remote)
 	case "token":
-		return g.getPATAuth()
+		return patAuth(remote)
 	case "default":
 		// Use system git credentials (nil auth)
 		return nil, nil
 	default:
-		return nil, fmt.Errorf("unsupported auth method: %s", g.config.Repo.RepoGithub.AuthMethod)
+		return nil, fmt.Errorf("unsupported auth method: %s", remote.AuthMethod)
 	}
 }
 
-// getSSHAuth creates SSH authentication
-func (g *GitOperations) getSSHAuth() (transport.AuthMethod, error) {
-	sshKeyPath := g.config.Repo.RepoGithub.SSHKeyPath
-
-	// Expand environment variables and home directory
-	sshKeyPath = os.ExpandEnv(sshKeyPath)
-	if strings.HasPrefix(sshKeyPath, "~/") {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get home directory: %w", err)
-		}
-		sshKeyPath = strings.Replace(sshKeyPath, "~", homeDir, 1)
-	}
-
-	// Create SSH public keys auth
-	publicKeys, err := ssh.NewPublicKeysFromFile("git", sshKeyPath, "")
-	if err != nil {
-		return nil, fmt.Errorf("failed to load SSH key from %s: %w", sshKeyPath, err)
-	}
-
-	return publicKeys, nil
-}
-
-// getPATAuth creates Personal Access Token authentication
-func (g *GitOperations) getPATAuth() (transport.AuthMethod, error) {
-	token := g.config.Repo.RepoGithub.Token
+// patAuth creates Personal Access Token authentication
+func patAuth(remote appconfig.RepoRemote) (transport.AuthMethod, error) {
+	token := remote.Token
 
 	// Expand environment variables
 	token = os.ExpandEnv(token)
@@ -179,28 +287,41 @@ func (g *GitOperations) getPATAuth() (transport.AuthMethod, error) {
 		return nil, fmt.Errorf("token is empty")
 	}
 
-	// GitHub expects username "git" for PAT auth
+	username := remote.TokenUsername
+	if username == "" {
+		username = forge.TokenUsername(remote.Forge)
+	}
+	if username == "" {
+		return nil, fmt.Errorf("tokenUsername is required with forge %s", remote.Forge)
+	}
+
 	return &http.BasicAuth{
-		Username: "git",
+		Username: username,
 		Password: token,
 	}, nil
 }
 
-// retryOperation retries an operation with exponential backoff
-func (g *GitOperations) retryOperation(operation func() error) error {
-	maxAttempts := g.config.Repo.RepoGithub.RetryAttempts
+// retry retries an operation with exponential backoff, using the retry
+// settings of a named remote. Every attempt has its own span. The caller
+// holds g.mu.
+func (g *GitOperations) retry(ctx context.Context, name string, remote appconfig.RepoRemote, operation func(context.Context) error) error {
+	maxAttempts := remote.RetryAttempts
 	if maxAttempts <= 0 {
 		maxAttempts = 1
 	}
 
-	baseDelay := time.Duration(g.config.Repo.RepoGithub.RetryDelay) * time.Second
+	baseDelay := time.Duration(remote.RetryDelay) * time.Second
 	if baseDelay <= 0 {
 		baseDelay = 5 * time.Second
 	}
 
 	var lastErr error
 	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		err := operation()
+		attemptCtx, span := tracer.Start(ctx, "git.attempt", trace.WithAttributes(
+			attribute.String("git.remote", name),
+			attribute.Int("git.attempt", attempt)))
+		err := operation(attemptCtx)
+		endSpan(span, err)
 		if err == nil {
 			return nil
 		}
@@ -224,13 +345,30 @@ func (g *GitOperations) retryOperation(operation func() error) error {
 				zap.Int("attempt", attempt),
 				zap.Int("maxAttempts", maxAttempts),
 				zap.Duration("retryAfter", delay))
-			time.Sleep(delay)
+			metrics.ObserveRetry(name)
+			if !g.backoff(ctx, delay) {
+				return fmt.Errorf("operation canceled after %d attempts: %w", attempt, lastErr)
+			}
 		}
 	}
 
 	return fmt.Errorf("operation failed after %d attempts: %w", maxAttempts, lastErr)
 }
 
+// backoff waits for delay, false when ctx is done first. The caller holds
+// g.mu, it is released meanwhile so an unreachable remote does not hold up
+// the commits of the other requests.
+func (g *GitOperations) backoff(ctx context.Context, delay time.Duration) bool {
+	g.mu.Unlock()
+	defer g.mu.Lock()
+	select {
+	case <-time.After(delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 // isRetryableError determines if an error should be retried
 func isRetryableError(err error) bool {
 	if err == nil {
@@ -274,13 +412,13 @@ func isRetryableError(err error) bool {
 	return true
 }
 
-// ensureRemote ensures the remote "origin" exists and matches the configured URL
-func ensureRemote(repo *git.Repository, remoteURL string) error {
-	remote, err := repo.Remote("origin")
+// ensureRemote ensures the named remote exists and matches the configured URL
+func ensureRemote(repo *git.Repository, name, remoteURL string) error {
+	remote, err := repo.Remote(name)
 	if err == git.ErrRemoteNotFound {
 		// Create the remote
 		_, err = repo.CreateRemote(&config.RemoteConfig{
-			Name: "origin",
+			Name: name,
 			URLs: []string{remoteURL},
 		})
 		if err != nil {
@@ -295,13 +433,13 @@ func ensureRemote(repo *git.Repository, remoteURL string) error {
 	urls := remote.Config().URLs
 	if len(urls) == 0 || urls[0] != remoteURL {
 		// Update remote URL
-		err = repo.DeleteRemote("origin")
+		err = repo.DeleteRemote(name)
 		if err != nil {
 			return fmt.Errorf("failed to delete old remote: %w", err)
 		}
 
 		_, err = repo.CreateRemote(&config.RemoteConfig{
-			Name: "origin",
+			Name: name,
 			URLs: []string{remoteURL},
 		})
 		if err != nil {
@@ -1,12 +1,16 @@
 package storage
 
 import (
+	"context"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -45,7 +49,7 @@ func TestNewGitOperations(t *testing.T) {
 			RepoLocal: config.RepoLocal{
 				Path: tempDir,
 			},
-			RepoGithub: config.RepoGithub{
+			Remote: config.RepoRemote{
 				Enabled:       true,
 				RemoteURL:     "https://github.com/test/repo.git",
 				Branch:        "main",
@@ -72,7 +76,7 @@ func TestNewGitOperations(t *testing.T) {
 	assert.NotNil(t, gitOps.logger)
 }
 
-func TestCommitFile(t *testing.T) {
+func TestCommitFiles(t *testing.T) {
 	// Create a temporary directory for testing
 	tempDir := t.TempDir()
 
@@ -104,7 +108,7 @@ func TestCommitFile(t *testing.T) {
 			RepoLocal: config.RepoLocal{
 				Path: tempDir,
 			},
-			RepoGithub: config.RepoGithub{
+			Remote: config.RepoRemote{
 				Enabled:       true,
 				RemoteURL:     "https://github.com/test/repo.git",
 				Branch:        "main",
@@ -136,7 +140,7 @@ func TestCommitFile(t *testing.T) {
 	require.NoError(t, err)
 
 	// Commit the file
-	commitHash, err := gitOps.commitFile(testFile, "test: commit state file")
+	commitHash, err := gitOps.commitFiles([]string{testFile}, "test: commit state file")
 	require.NoError(t, err)
 	assert.NotEmpty(t, commitHash)
 
@@ -152,6 +156,48 @@ func TestCommitFile(t *testing.T) {
 	assert.Equal(t, "test@example.com", commitObj.Author.Email)
 }
 
+type failingSigner struct{}
+
+func (failingSigner) Sign(io.Reader) ([]byte, error) {
+	return nil, errors.New("no signing key")
+}
+
+func (failingSigner) Verify(*object.Commit) error {
+	return ErrUnsigned
+}
+
+func TestCommitFiles_UnstagesOnFailure(t *testing.T) {
+	tempDir := t.TempDir()
+	repo, err := git.PlainInit(tempDir, false)
+	require.NoError(t, err)
+	worktree, err := repo.Worktree()
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "prod.tfstate"), []byte("v1"), 0644))
+	_, err = worktree.Add("prod.tfstate")
+	require.NoError(t, err)
+	_, err = worktree.Commit("initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com"},
+	})
+	require.NoError(t, err)
+
+	cfg := &config.Config{}
+	cfg.Repo.RepoLocal.Path = tempDir
+	gitOps := &GitOperations{config: cfg, repo: repo, logger: zap.NewNop(), signer: failingSigner{}}
+
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "prod.tfstate"), []byte("v2"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "dev.tfstate"), []byte("v1"), 0644))
+	_, err = gitOps.commitFiles([]string{"prod.tfstate", "dev.tfstate"}, "test: commit states")
+	require.ErrorContains(t, err, "failed to create commit")
+
+	// the index is back at HEAD, the files are only changed in the worktree
+	status, err := worktree.Status()
+	require.NoError(t, err)
+	assert.Equal(t, git.Unmodified, status.File("prod.tfstate").Staging)
+	assert.Equal(t, git.Modified, status.File("prod.tfstate").Worktree)
+	assert.Equal(t, git.Untracked, status.File("dev.tfstate").Staging)
+}
+
 func TestIsRetryableError(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -183,6 +229,35 @@ func TestIsRetryableError(t *testing.T) {
 	}
 }
 
+func TestRetry_ReleasesLockDuringBackoff(t *testing.T) {
+	g := &GitOperations{logger: zap.NewNop()}
+	remote := config.RepoRemote{RetryAttempts: 2, RetryDelay: 1}
+	locked := make(chan struct{})
+
+	g.mu.Lock()
+	attempts := 0
+	err := g.retry(context.Background(), "origin", remote, func(context.Context) error {
+		attempts++
+		if attempts == 1 {
+			go func() {
+				g.mu.Lock()
+				close(locked)
+				g.mu.Unlock()
+			}()
+			return errors.New("connection refused")
+		}
+		select {
+		case <-locked:
+		default:
+			t.Error("the lock was held during the backoff")
+		}
+		return nil
+	})
+	g.mu.Unlock()
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+}
+
 func TestEnsureRemote(t *testing.T) {
 	// Create a temporary directory for testing
 	tempDir := t.TempDir()
@@ -194,7 +269,7 @@ func TestEnsureRemote(t *testing.T) {
 	remoteURL := "https://github.com/test/repo.git"
 
 	// Test creating a new remote
-	err = ensureRemote(repo, remoteURL)
+	err = ensureRemote(repo, "origin", remoteURL)
 	require.NoError(t, err)
 
 	// Verify remote was created
@@ -203,12 +278,12 @@ func TestEnsureRemote(t *testing.T) {
 	assert.Equal(t, []string{remoteURL}, remote.Config().URLs)
 
 	// Test ensuring remote with same URL (should not error)
-	err = ensureRemote(repo, remoteURL)
+	err = ensureRemote(repo, "origin", remoteURL)
 	require.NoError(t, err)
 
 	// Test updating remote with different URL
 	newRemoteURL := "https://github.com/test/new-repo.git"
-	err = ensureRemote(repo, newRemoteURL)
+	err = ensureRemote(repo, "origin", newRemoteURL)
 	require.NoError(t, err)
 
 	// Verify remote was updated
@@ -217,99 +292,69 @@ func TestEnsureRemote(t *testing.T) {
 	assert.Equal(t, []string{newRemoteURL}, remote.Config().URLs)
 }
 
-func TestGetAuth_Default(t *testing.T) {
-	cfg := &config.Config{
-		Repo: config.Repo{
-			RepoGithub: config.RepoGithub{
-				AuthMethod: "default",
-			},
-		},
-	}
-
-	logger, _ := zap.NewDevelopment()
-
-	gitOps := &GitOperations{
-		config: cfg,
-		logger: logger,
-	}
-
-	auth, err := gitOps.getAuth()
+func TestRemoteAuth_Default(t *testing.T) {
+	auth, err := remoteAuth(config.RepoRemote{AuthMethod: "default"})
 	require.NoError(t, err)
 	assert.Nil(t, auth) // default auth should return nil
 }
 
-func TestGetAuth_UnsupportedMethod(t *testing.T) {
-	cfg := &config.Config{
-		Repo: config.Repo{
-			RepoGithub: config.RepoGithub{
-				AuthMethod: "unsupported",
-			},
-		},
-	}
-
-	logger, _ := zap.NewDevelopment()
-
-	gitOps := &GitOperations{
-		config: cfg,
-		logger: logger,
-	}
-
-	auth, err := gitOps.getAuth()
+func TestRemoteAuth_UnsupportedMethod(t *testing.T) {
+	auth, err := remoteAuth(config.RepoRemote{AuthMethod: "unsupported"})
 	require.Error(t, err)
 	assert.Nil(t, auth)
 	assert.Contains(t, err.Error(), "unsupported auth method")
 }
 
-func TestGetPATAuth(t *testing.T) {
+func TestPATAuth(t *testing.T) {
 	// Test with direct token
-	cfg := &config.Config{
-		Repo: config.Repo{
-			RepoGithub: config.RepoGithub{
-				Token: "ghp_test_token_123",
-			},
-		},
-	}
-
-	logger, _ := zap.NewDevelopment()
-
-	gitOps := &GitOperations{
-		config: cfg,
-		logger: logger,
-	}
-
-	auth, err := gitOps.getPATAuth()
+	remote := config.RepoRemote{Token: "ghp_test_token_123"}
+	auth, err := patAuth(remote)
 	require.NoError(t, err)
 	assert.NotNil(t, auth)
 
 	// Test with empty token
-	cfg.Repo.RepoGithub.Token = ""
-	auth, err = gitOps.getPATAuth()
+	remote.Token = ""
+	auth, err = patAuth(remote)
 	require.Error(t, err)
 	assert.Nil(t, auth)
 	assert.Contains(t, err.Error(), "token is empty")
 }
 
-func TestGetPATAuth_EnvVar(t *testing.T) {
+func TestPATAuth_EnvVar(t *testing.T) {
 	// Set environment variable
 	os.Setenv("TEST_GITHUB_TOKEN", "ghp_env_token_456")
 	defer os.Unsetenv("TEST_GITHUB_TOKEN")
 
-	cfg := &config.Config{
-		Repo: config.Repo{
-			RepoGithub: config.RepoGithub{
-				Token: "${TEST_GITHUB_TOKEN}",
-			},
-		},
-	}
-
-	logger, _ := zap.NewDevelopment()
+	auth, err := patAuth(config.RepoRemote{Token: "${TEST_GITHUB_TOKEN}"})
+	require.NoError(t, err)
+	assert.NotNil(t, auth)
+}
 
-	gitOps := &GitOperations{
-		config: cfg,
-		logger: logger,
+func TestPATAuth_Forge(t *testing.T) {
+	tests := []struct {
+		forge         string
+		tokenUsername string
+		expected      string
+	}{
+		{forge: "", expected: "git"},
+		{forge: "github", expected: "git"},
+		{forge: "gitlab", expected: "oauth2"},
+		{forge: "gitea", expected: "oauth2"},
+		{forge: "bitbucket", expected: "x-token-auth"},
+		{forge: "bitbucket", tokenUsername: "alice", expected: "alice"},
+		{forge: "generic", tokenUsername: "deploy", expected: "deploy"},
+	}
+	for _, tt := range tests {
+		auth, err := patAuth(config.RepoRemote{
+			Forge:         tt.forge,
+			Token:         "secret",
+			TokenUsername: tt.tokenUsername,
+		})
+		require.NoError(t, err, tt.forge)
+		assert.Equal(t, tt.expected, auth.(*http.BasicAuth).Username, tt.forge)
 	}
 
-	auth, err := gitOps.getPATAuth()
-	require.NoError(t, err)
-	assert.NotNil(t, auth)
+	// a generic server has no default token username
+	_, err := patAuth(config.RepoRemote{Forge: "generic", Token: "secret"})
+	assert.Error(t, err)
 }
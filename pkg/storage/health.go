@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+type worktreeCheck struct {
+	done chan struct{}
+	err  error
+}
+
+// CheckWorktree opens the repository from disk and checks that the worktree
+// is clean or recoverable: untracked files are states and audit records not
+// committed yet, a modified file needs a backup in backupDir to be rolled
+// back. Files under ignoredDirs, slash separated, are not checked, nor are
+// the files under a pull request prefix: they are committed to their pull
+// request branch and stay changed against HEAD until it is merged.
+//
+// The worktree status can not be cancelled, so only one check runs at a
+// time: callers arriving meanwhile wait for its result, or for ctx.
+func (g *GitOperations) CheckWorktree(ctx context.Context, backupDir string, ignoredDirs ...string) error {
+	g.worktreeCheckMu.Lock()
+	check := g.worktreeCheck
+	if check == nil {
+		check = &worktreeCheck{done: make(chan struct{})}
+		g.worktreeCheck = check
+		go func() {
+			check.err = g.checkWorktree(backupDir, ignoredDirs...)
+			g.worktreeCheckMu.Lock()
+			g.worktreeCheck = nil
+			g.worktreeCheckMu.Unlock()
+			close(check.done)
+		}()
+	}
+	g.worktreeCheckMu.Unlock()
+
+	select {
+	case <-check.done:
+		return check.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *GitOperations) checkWorktree(backupDir string, ignoredDirs ...string) error {
+	repo, err := git.PlainOpen(g.config.Repo.RepoLocal.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open git repository: %w", err)
+	}
+	if _, err := repo.Head(); err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return fmt.Errorf("failed to get HEAD: %w", err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree status: %w", err)
+	}
+
+	var unrecoverable []string
+	for file, fileStatus := range status {
+		if fileStatus.Worktree == git.Untracked || ignored(file, ignoredDirs) || g.pullRequestBranch([]string{file}) != "" {
+			continue
+		}
+		if fileStatus.Worktree == git.Unmodified && fileStatus.Staging == git.Unmodified {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(backupDir, filepath.FromSlash(file))); err == nil {
+			continue
+		}
+		unrecoverable = append(unrecoverable, file)
+	}
+	if len(unrecoverable) > 0 {
+		sort.Strings(unrecoverable)
+		return fmt.Errorf("%d files changed without a backup: %s", len(unrecoverable), strings.Join(unrecoverable, ", "))
+	}
+	return nil
+}
+
+func ignored(file string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(file, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckRemote lists the references of origin, like git ls-remote, to check
+// that it is reachable with the configured authentication
+func (g *GitOperations) CheckRemote(ctx context.Context) error {
+	remote, err := g.repo.Remote(originRemote)
+	if err != nil {
+		return fmt.Errorf("failed to get remote %s: %w", originRemote, err)
+	}
+	auth, err := remoteAuth(g.config.Repo.Remote)
+	if err != nil {
+		return fmt.Errorf("failed to get authentication: %w", err)
+	}
+	if _, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth}); err != nil && !errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return fmt.Errorf("failed to list %s: %w", g.config.Repo.Remote.RemoteURL, err)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+)
+
+func TestCheckWorktree(t *testing.T) {
+	tempDir := t.TempDir()
+	repo, err := git.PlainInit(tempDir, false)
+	require.NoError(t, err)
+	worktree, err := repo.Worktree()
+	require.NoError(t, err)
+	for _, name := range []string{"prod.tfstate", "audit/2026-03-01.jsonl"} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(tempDir, name)), 0750))
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, name), []byte("initial"), 0644))
+		_, err = worktree.Add(name)
+		require.NoError(t, err)
+	}
+	_, err = worktree.Commit("initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com"},
+	})
+	require.NoError(t, err)
+
+	cfg := &config.Config{}
+	cfg.Repo.RepoLocal.Path = tempDir
+	cfg.Repo.Remote = config.RepoRemote{Enabled: true, RemoteURL: t.TempDir(), AuthMethod: "default"}
+	gitOps, err := NewGitOperations(cfg, zap.NewNop())
+	require.NoError(t, err)
+	backupDir := BackupDir(cfg)
+
+	require.NoError(t, gitOps.CheckWorktree(context.Background(), backupDir))
+
+	// states not committed yet
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "dev.tfstate"), []byte("new"), 0644))
+	require.NoError(t, gitOps.CheckWorktree(context.Background(), backupDir))
+
+	// audit records appended since the last commit
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "audit", "2026-03-01.jsonl"), []byte("appended"), 0644))
+	require.NoError(t, gitOps.CheckWorktree(context.Background(), backupDir, "audit"))
+	assert.EqualError(t, gitOps.CheckWorktree(context.Background(), backupDir), "1 files changed without a backup: audit/2026-03-01.jsonl")
+
+	// a replaced state is rolled back to its backup
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "prod.tfstate"), []byte("replaced"), 0644))
+	assert.EqualError(t, gitOps.CheckWorktree(context.Background(), backupDir, "audit"), "1 files changed without a backup: prod.tfstate")
+	require.NoError(t, os.MkdirAll(backupDir, 0750))
+	require.NoError(t, os.WriteFile(filepath.Join(backupDir, "prod.tfstate"), []byte("initial"), 0644))
+	require.NoError(t, gitOps.CheckWorktree(context.Background(), backupDir, "audit"))
+
+	// states under a pull request prefix are committed to their branch
+	require.NoError(t, os.MkdirAll(filepath.Join(tempDir, "prod"), 0750))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "prod", "app.tfstate"), []byte("initial"), 0644))
+	_, err = worktree.Add("prod/app.tfstate")
+	require.NoError(t, err)
+	_, err = worktree.Commit("prod state", &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "prod", "app.tfstate"), []byte("pending review"), 0644))
+	assert.EqualError(t, gitOps.CheckWorktree(context.Background(), backupDir, "audit"), "1 files changed without a backup: prod/app.tfstate")
+	cfg.Repo.Remote.PullRequests.Prefixes = []string{"prod/"}
+	require.NoError(t, gitOps.CheckWorktree(context.Background(), backupDir, "audit"))
+
+	require.NoError(t, os.RemoveAll(filepath.Join(tempDir, ".git")))
+	assert.ErrorContains(t, gitOps.CheckWorktree(context.Background(), backupDir), "failed to open git repository")
+}
+
+func TestCheckWorktree_Shared(t *testing.T) {
+	gitOps := &GitOperations{}
+	// a check still running is shared instead of starting another one
+	running := &worktreeCheck{done: make(chan struct{})}
+	gitOps.worktreeCheck = running
+
+	backupDir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, gitOps.CheckWorktree(ctx, backupDir), context.Canceled)
+
+	result := make(chan error, 1)
+	go func() { result <- gitOps.CheckWorktree(context.Background(), backupDir) }()
+	running.err = errors.New("1 files changed without a backup: prod.tfstate")
+	close(running.done)
+	assert.Equal(t, running.err, <-result)
+}
+
+func TestCheckRemote(t *testing.T) {
+	tempDir := t.TempDir()
+	_, err := git.PlainInit(tempDir, false)
+	require.NoError(t, err)
+	remoteDir := t.TempDir()
+	_, err = git.PlainInit(remoteDir, true)
+	require.NoError(t, err)
+
+	cfg := &config.Config{}
+	cfg.Repo.RepoLocal.Path = tempDir
+	cfg.Repo.Remote = config.RepoRemote{Enabled: true, RemoteURL: remoteDir, AuthMethod: "default"}
+	gitOps, err := NewGitOperations(cfg, zap.NewNop())
+	require.NoError(t, err)
+	// an empty remote is reachable
+	require.NoError(t, gitOps.CheckRemote(context.Background()))
+
+	cfg.Repo.Remote.AuthMethod = "token"
+	assert.ErrorContains(t, gitOps.CheckRemote(context.Background()), "token is empty")
+
+	cfg.Repo.Remote.AuthMethod = "default"
+	require.NoError(t, os.RemoveAll(remoteDir))
+	assert.ErrorContains(t, gitOps.CheckRemote(context.Background()), "failed to list")
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"go.uber.org/zap"
+
+	appconfig "github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/metrics"
+)
+
+// originRemote is the name of the primary remote, repo.remote
+const originRemote = "origin"
+
+// ErrRequiredMirror is wrapped by the error of a push to a required mirror
+// that failed, whether or not the commit reached origin
+var ErrRequiredMirror = errors.New("failed to push to required mirror")
+
+// RemoteStatus is the sync status of origin or a mirror
+type RemoteStatus struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	Required    bool      `json:"required"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// ValidateMirrors checks the names of repo.remote.mirrors, they become git
+// remotes next to origin
+func ValidateMirrors(mirrors []appconfig.RemoteMirror) error {
+	names := map[string]bool{}
+	for i, mirror := range mirrors {
+		if mirror.Name == "" {
+			return fmt.Errorf("mirror %d has no name", i)
+		}
+		if mirror.Name == originRemote {
+			return fmt.Errorf("mirror name %q is reserved for repo.remote", originRemote)
+		}
+		if names[mirror.Name] {
+			return fmt.Errorf("duplicate mirror name %q", mirror.Name)
+		}
+		names[mirror.Name] = true
+		if mirror.RemoteURL == "" {
+			return fmt.Errorf("mirror %q has no remoteUrl", mirror.Name)
+		}
+	}
+	return nil
+}
+
+// ensureMirrors ensures a git remote exists for every mirror
+func ensureMirrors(repo *git.Repository, mirrors []appconfig.RemoteMirror) error {
+	if err := ValidateMirrors(mirrors); err != nil {
+		return err
+	}
+	for _, mirror := range mirrors {
+		remoteURL, err := RemoteURL(mirror.RepoRemote)
+		if err != nil {
+			return fmt.Errorf("mirror %s: %w", mirror.Name, err)
+		}
+		if err := ensureRemote(repo, mirror.Name, remoteURL); err != nil {
+			return fmt.Errorf("failed to ensure mirror %s: %w", mirror.Name, err)
+		}
+	}
+	return nil
+}
+
+// pushMirrors pushes a refspec to every mirror with its own auth and retry
+// settings, after the push to origin whatever its result. A failing mirror is a warning
+// unless it is required.
+func (g *GitOperations) pushMirrors(ctx context.Context, refSpec config.RefSpec) error {
+	var requiredErrs []error
+	for _, mirror := range g.mirrors {
+		err := g.pushWithRetry(ctx, mirror.Name, mirror.RepoRemote, refSpec)
+		g.recordMirrorPush(mirror, err)
+		if err == nil {
+			g.logger.Info("pushed to mirror successfully",
+				zap.String("mirror", mirror.Name),
+				zap.String("refspec", refSpec.String()))
+			continue
+		}
+		if mirror.Required {
+			requiredErrs = append(requiredErrs, fmt.Errorf("%w %s: %w", ErrRequiredMirror, mirror.Name, err))
+			continue
+		}
+		g.logger.Warn("failed to push to mirror",
+			zap.String("mirror", mirror.Name),
+			zap.Error(err))
+	}
+	if len(requiredErrs) > 0 {
+		return errs.E(errs.KindGitSync, "storage.PushMirrors", errors.Join(requiredErrs...))
+	}
+	return nil
+}
+
+// recordPush records the result of a push to origin and returns err
+func (g *GitOperations) recordPush(name, url string, err error) error {
+	g.setStatus(name, url, true, err)
+	return err
+}
+
+func (g *GitOperations) recordMirrorPush(mirror appconfig.RemoteMirror, err error) {
+	g.setStatus(mirror.Name, mirror.RemoteURL, mirror.Required, err)
+}
+
+func (g *GitOperations) setStatus(name, url string, required bool, err error) {
+	metrics.ObservePush(name, err)
+
+	g.statusMu.Lock()
+	defer g.statusMu.Unlock()
+	for _, observer := range g.pushObservers {
+		observer(name, err)
+	}
+
+	status, ok := g.status[name]
+	if !ok {
+		status = &RemoteStatus{Name: name}
+		g.status[name] = status
+	}
+	status.URL = url
+	status.Required = required
+	status.LastAttempt = time.Now()
+	if err != nil {
+		status.LastError = err.Error()
+		return
+	}
+	status.LastSuccess = status.LastAttempt
+	status.LastError = ""
+}
+
+// OnPush registers fn to be called after every push to a remote, with the
+// error of its last attempt. fn must not block.
+func (g *GitOperations) OnPush(fn func(remote string, err error)) {
+	g.statusMu.Lock()
+	defer g.statusMu.Unlock()
+	g.pushObservers = append(g.pushObservers, fn)
+}
+
+// RemoteStatus returns the sync status of origin and of every mirror, a
+// remote that was never pushed to has no attempt
+func (g *GitOperations) RemoteStatus() []RemoteStatus {
+	g.statusMu.Lock()
+	defer g.statusMu.Unlock()
+
+	statuses := []RemoteStatus{g.statusOf(originRemote, g.config.Repo.Remote.RemoteURL, true)}
+	for _, mirror := range g.mirrors {
+		statuses = append(statuses, g.statusOf(mirror.Name, mirror.RemoteURL, mirror.Required))
+	}
+	return statuses
+}
+
+func (g *GitOperations) statusOf(name, url string, required bool) RemoteStatus {
+	if status, ok := g.status[name]; ok {
+		return *status
+	}
+	return RemoteStatus{Name: name, URL: url, Required: required}
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+)
+
+func TestValidateMirrors(t *testing.T) {
+	mirror := func(name string) config.RemoteMirror {
+		return config.RemoteMirror{Name: name, RepoRemote: config.RepoRemote{RemoteURL: "/srv/git/" + name}}
+	}
+
+	assert.NoError(t, ValidateMirrors(nil))
+	assert.NoError(t, ValidateMirrors([]config.RemoteMirror{mirror("gitlab"), mirror("onprem")}))
+	assert.Error(t, ValidateMirrors([]config.RemoteMirror{mirror("")}))
+	assert.Error(t, ValidateMirrors([]config.RemoteMirror{mirror("origin")}))
+	assert.Error(t, ValidateMirrors([]config.RemoteMirror{mirror("gitlab"), mirror("gitlab")}))
+	assert.Error(t, ValidateMirrors([]config.RemoteMirror{{Name: "gitlab"}}))
+}
+
+func TestCommitAndPush_Mirrors(t *testing.T) {
+	newRemote := func() string {
+		dir := t.TempDir()
+		_, err := git.PlainInit(dir, true)
+		require.NoError(t, err)
+		return dir
+	}
+	// not a repository, every push to it fails
+	brokenDir := t.TempDir()
+
+	setup := func(t *testing.T, brokenRequired bool) (*GitOperations, string, string, string) {
+		originDir, mirrorDir := newRemote(), newRemote()
+		tempDir := t.TempDir()
+		repo, err := git.PlainInit(tempDir, false)
+		require.NoError(t, err)
+		worktree, err := repo.Worktree()
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, "initial.txt"), []byte("initial"), 0644))
+		_, err = worktree.Add("initial.txt")
+		require.NoError(t, err)
+		_, err = worktree.Commit("initial commit", &git.CommitOptions{
+			Author: &object.Signature{Name: "Test", Email: "test@example.com"},
+		})
+		require.NoError(t, err)
+
+		cfg := &config.Config{}
+		cfg.Repo.RepoLocal.Path = tempDir
+		cfg.Repo.Remote = config.RepoRemote{
+			Enabled:       true,
+			RemoteURL:     originDir,
+			Branch:        "master",
+			AuthMethod:    "default",
+			AutoPush:      true,
+			Author:        config.CommitAuthor{Name: "Test User", Email: "test@example.com"},
+			RetryAttempts: 1,
+			Mirrors: []config.RemoteMirror{
+				{Name: "backup", RepoRemote: config.RepoRemote{RemoteURL: mirrorDir, AuthMethod: "default"}},
+				{Name: "broken", Required: brokenRequired, RepoRemote: config.RepoRemote{RemoteURL: brokenDir, AuthMethod: "default"}},
+			},
+		}
+		gitOps, err := NewGitOperations(cfg, zap.NewNop())
+		require.NoError(t, err)
+
+		remotes, err := repo.Remotes()
+		require.NoError(t, err)
+		assert.Len(t, remotes, 3)
+		return gitOps, tempDir, originDir, mirrorDir
+	}
+
+	assertPushed := func(t *testing.T, dir string, local string) {
+		localRepo, err := git.PlainOpen(local)
+		require.NoError(t, err)
+		head, err := localRepo.Head()
+		require.NoError(t, err)
+		remote, err := git.PlainOpen(dir)
+		require.NoError(t, err)
+		ref, err := remote.Reference(plumbing.NewBranchReferenceName("master"), true)
+		require.NoError(t, err)
+		assert.Equal(t, head.Hash(), ref.Hash())
+	}
+
+	t.Run("optional mirror failure is a warning", func(t *testing.T) {
+		gitOps, tempDir, originDir, mirrorDir := setup(t, false)
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, "app.tfstate"), []byte("{}"), 0644))
+		require.NoError(t, gitOps.CommitAndPush(context.Background(), "app.tfstate", "update app.tfstate"))
+		assertPushed(t, originDir, tempDir)
+		assertPushed(t, mirrorDir, tempDir)
+
+		statuses := gitOps.RemoteStatus()
+		require.Len(t, statuses, 3)
+		assert.Equal(t, "origin", statuses[0].Name)
+		assert.Empty(t, statuses[0].LastError)
+		assert.False(t, statuses[0].LastSuccess.IsZero())
+		assert.Equal(t, "backup", statuses[1].Name)
+		assert.Empty(t, statuses[1].LastError)
+		assert.False(t, statuses[1].LastSuccess.IsZero())
+		assert.Equal(t, "broken", statuses[2].Name)
+		assert.NotEmpty(t, statuses[2].LastError)
+		assert.True(t, statuses[2].LastSuccess.IsZero())
+		assert.False(t, statuses[2].LastAttempt.IsZero())
+	})
+
+	t.Run("required mirror failure is an error", func(t *testing.T) {
+		gitOps, tempDir, originDir, mirrorDir := setup(t, true)
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, "app.tfstate"), []byte(`{"serial":2}`), 0644))
+		err := gitOps.CommitAndPush(context.Background(), "app.tfstate", "update app.tfstate")
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrRequiredMirror))
+		assert.True(t, errs.Is(err, errs.KindGitSync))
+		// origin and the other mirrors are pushed anyway
+		assertPushed(t, originDir, tempDir)
+		assertPushed(t, mirrorDir, tempDir)
+	})
+
+	t.Run("origin failure still pushes the mirrors", func(t *testing.T) {
+		gitOps, tempDir, originDir, mirrorDir := setup(t, false)
+		require.NoError(t, os.RemoveAll(originDir))
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, "app.tfstate"), []byte(`{"serial":3}`), 0644))
+		err := gitOps.CommitAndPush(context.Background(), "app.tfstate", "update app.tfstate")
+		require.Error(t, err)
+		assert.True(t, errs.Is(err, errs.KindGitSync))
+		assert.False(t, errors.Is(err, ErrRequiredMirror))
+		assertPushed(t, mirrorDir, tempDir)
+
+		statuses := gitOps.RemoteStatus()
+		require.Len(t, statuses, 3)
+		assert.NotEmpty(t, statuses[0].LastError)
+		assert.Empty(t, statuses[1].LastError)
+		assert.False(t, statuses[1].LastSuccess.IsZero())
+	})
+
+	t.Run("origin and required mirror failures are both returned", func(t *testing.T) {
+		gitOps, tempDir, originDir, mirrorDir := setup(t, true)
+		require.NoError(t, os.RemoveAll(originDir))
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, "app.tfstate"), []byte(`{"serial":4}`), 0644))
+		err := gitOps.CommitAndPush(context.Background(), "app.tfstate", "update app.tfstate")
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrRequiredMirror))
+		assert.Contains(t, err.Error(), "failed to push to remote")
+		assertPushed(t, mirrorDir, tempDir)
+	})
+
+	t.Run("status before any push", func(t *testing.T) {
+		gitOps, _, _, _ := setup(t, false)
+		statuses := gitOps.RemoteStatus()
+		require.Len(t, statuses, 3)
+		for _, status := range statuses {
+			assert.True(t, status.LastAttempt.IsZero())
+		}
+		assert.True(t, statuses[0].Required)
+	})
+}
+
+func TestCommitAndPush_Spans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	tempDir := t.TempDir()
+	remoteDir := t.TempDir()
+	_, err := git.PlainInit(remoteDir, true)
+	require.NoError(t, err)
+	_, err = git.PlainInit(tempDir, false)
+	require.NoError(t, err)
+
+	cfg := &config.Config{}
+	cfg.Repo.RepoLocal.Path = tempDir
+	cfg.Repo.Remote = config.RepoRemote{
+		Enabled:       true,
+		RemoteURL:     remoteDir,
+		Branch:        "master",
+		AuthMethod:    "default",
+		AutoPush:      true,
+		Author:        config.CommitAuthor{Name: "Test User", Email: "test@example.com"},
+		RetryAttempts: 1,
+	}
+	gitOps, err := NewGitOperations(cfg, zap.NewNop())
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "app.tfstate"), []byte("{}"), 0644))
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+	require.NoError(t, gitOps.CommitAndPush(ctx, "app.tfstate", "update app.tfstate"))
+	parent.End()
+
+	names := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		names[span.Name()] = span
+	}
+	require.Contains(t, names, "git.CommitAndPush")
+	require.Contains(t, names, "git.commit")
+	require.Contains(t, names, "git.push")
+	require.Contains(t, names, "git.attempt")
+	assert.Equal(t, parent.SpanContext().SpanID(), names["git.CommitAndPush"].Parent().SpanID())
+	assert.Equal(t, names["git.CommitAndPush"].SpanContext().SpanID(), names["git.push"].Parent().SpanID())
+	assert.Equal(t, names["git.push"].SpanContext().SpanID(), names["git.attempt"].Parent().SpanID())
+	assert.Contains(t, names["git.CommitAndPush"].Attributes(), attribute.String("state.path", "app.tfstate"))
+}
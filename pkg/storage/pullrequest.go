@@ -0,0 +1,291 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/forge"
+)
+
+const (
+	defaultPullRequestBranchPrefix = "tfstate/"
+	pullRequestTimeout             = time.Minute
+)
+
+// emptyTreeHash is the hash of the tree without entries
+var emptyTreeHash = plumbing.NewHash("4b825dc642cb6eb9a060e54bf8d69288fbee4904")
+
+// pullRequestBranch returns the branch a commit of filePaths goes to when
+// any of them is under a pull request prefix, "" otherwise. The branch is
+// named after the first file, the state, so the writes of a state are
+// batched on one branch until its pull request is merged or closed.
+func (g *GitOperations) pullRequestBranch(filePaths []string) string {
+	cfg := g.config.Repo.Remote.PullRequests
+	if len(filePaths) == 0 {
+		return ""
+	}
+	for _, filePath := range filePaths {
+		for _, prefix := range cfg.Prefixes {
+			if prefix != "" && strings.HasPrefix(filepath.ToSlash(filePath), prefix) {
+				branchPrefix := cfg.BranchPrefix
+				if branchPrefix == "" {
+					branchPrefix = defaultPullRequestBranchPrefix
+				}
+				return branchPrefix + filepath.ToSlash(filePaths[0])
+			}
+		}
+	}
+	return ""
+}
+
+// commitToPullRequest commits the files to branch without touching the
+// worktree, which keeps serving the written states, pushes the branch and
+// opens a pull request into the state branch unless one is open already.
+// Without an open pull request the branch restarts from the state branch.
+func (g *GitOperations) commitToPullRequest(ctx context.Context, branch string, filePaths []string, commitMessage string) error {
+	const op = "storage.CommitToPullRequest"
+	base := g.config.Repo.Remote.Branch
+	forgeCtx, cancel := context.WithTimeout(ctx, pullRequestTimeout)
+	defer cancel()
+
+	branchRef := plumbing.NewBranchReferenceName(branch)
+	parent, err := g.branchHash(plumbing.NewBranchReferenceName(base))
+	if err != nil {
+		return errs.E(errs.KindStorage, op, err)
+	}
+	// a failing forge keeps batching on the local branch
+	open, findErr := g.forge.FindPullRequest(forgeCtx, branch, base)
+	if open != nil || findErr != nil {
+		if hash, err := g.branchHash(branchRef); err == nil && !hash.IsZero() {
+			parent = hash
+		}
+	}
+
+	commitHash, err := g.traceCommit(ctx, func() (string, error) {
+		hash, err := g.commitTree(branchRef, parent, filePaths, commitMessage)
+		return hash.String(), err
+	})
+	if err != nil {
+		return errs.E(errs.KindStorage, op, fmt.Errorf("failed to commit files: %w", err))
+	}
+	g.logger.Info("committed files to pull request branch",
+		zap.Strings("files", filePaths),
+		zap.String("branch", branch),
+		zap.String("commit", commitHash))
+
+	// the branch only has the commits of the backend, it is rewritten when it
+	// restarts from the state branch
+	refSpec := config.RefSpec(fmt.Sprintf("+%s:%s", branchRef, branchRef))
+	// the mirrors get the branch even when origin is unreachable
+	var originErr error
+	if err := g.recordPush(originRemote, g.config.Repo.Remote.RemoteURL, g.pushWithRetry(ctx, originRemote, g.config.Repo.Remote, refSpec)); err != nil {
+		originErr = errs.E(errs.KindGitSync, op, fmt.Errorf("failed to push %s: %w", branch, err))
+	}
+	if err := errors.Join(originErr, g.pushMirrors(ctx, refSpec)); err != nil {
+		return err
+	}
+	if findErr != nil {
+		return errs.E(errs.KindGitSync, op, fmt.Errorf("failed to find pull request of %s: %w", branch, findErr))
+	}
+
+	if open == nil {
+		title, body, _ := strings.Cut(commitMessage, "\n")
+		open, err = g.forge.CreatePullRequest(forgeCtx, forge.PullRequest{
+			Head:  branch,
+			Base:  base,
+			Title: title,
+			Body:  strings.TrimSpace(body),
+		})
+		if err != nil {
+			return errs.E(errs.KindGitSync, op, fmt.Errorf("failed to open pull request of %s: %w", branch, err))
+		}
+		g.logger.Info("opened pull request", zap.String("branch", branch), zap.String("url", open.URL))
+	} else {
+		g.logger.Info("updated pull request", zap.String("branch", branch), zap.String("url", open.URL))
+	}
+	return nil
+}
+
+// branchHash returns the commit of a branch, the zero hash when the
+// repository has no commit yet
+func (g *GitOperations) branchHash(name plumbing.ReferenceName) (plumbing.Hash, error) {
+	ref, err := g.repo.Reference(name, true)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return plumbing.ZeroHash, nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to resolve %s: %w", name, err)
+	}
+	return ref.Hash(), nil
+}
+
+// commitTree commits the worktree version of the files on top of parent and
+// points branch to the new commit, files missing in the worktree are removed
+func (g *GitOperations) commitTree(branch plumbing.ReferenceName, parent plumbing.Hash, filePaths []string, commitMessage string) (plumbing.Hash, error) {
+	var tree *object.Tree
+	var parents []plumbing.Hash
+	if !parent.IsZero() {
+		commit, err := g.repo.CommitObject(parent)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if tree, err = commit.Tree(); err != nil {
+			return plumbing.ZeroHash, err
+		}
+		parents = []plumbing.Hash{parent}
+	}
+
+	blobs := map[string]plumbing.Hash{}
+	for _, filePath := range filePaths {
+		data, err := os.ReadFile(filepath.Join(g.config.Repo.RepoLocal.Path, filePath))
+		if errors.Is(err, fs.ErrNotExist) {
+			// a removed file is removed from the tree
+			blobs[filepath.ToSlash(filePath)] = plumbing.ZeroHash
+			continue
+		}
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		hash, err := g.storeObject(plumbing.BlobObject, func(obj plumbing.EncodedObject) error {
+			w, err := obj.Writer()
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			return w.Close()
+		})
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		blobs[filepath.ToSlash(filePath)] = hash
+	}
+
+	treeHash, err := g.writeTree(tree, blobs)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	hash, err := g.storeCommit(treeHash, parents, commitMessage)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err := g.repo.Storer.SetReference(plumbing.NewHashReference(branch, hash)); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return hash, nil
+}
+
+// storeCommit stores a commit of the tree by the configured author, signed
+// when signing is enabled
+func (g *GitOperations) storeCommit(treeHash plumbing.Hash, parents []plumbing.Hash, commitMessage string) (plumbing.Hash, error) {
+	author := object.Signature{
+		Name:  g.config.Repo.Remote.Author.Name,
+		Email: g.config.Repo.Remote.Author.Email,
+		When:  time.Now(),
+	}
+	commit := &object.Commit{
+		Author:       author,
+		Committer:    author,
+		Message:      commitMessage,
+		TreeHash:     treeHash,
+		ParentHashes: parents,
+	}
+	if g.signer != nil {
+		message, err := encodeWithoutSignature(commit)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		signature, err := g.signer.Sign(message)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("failed to sign commit: %w", err)
+		}
+		commit.PGPSignature = string(signature)
+	}
+
+	return g.storeObject(plumbing.CommitObject, commit.Encode)
+}
+
+// writeTree stores a copy of tree with the files, given by slash separated
+// path, replaced. A zero hash removes the file, and its directory once empty.
+func (g *GitOperations) writeTree(tree *object.Tree, files map[string]plumbing.Hash) (plumbing.Hash, error) {
+	entries := map[string]object.TreeEntry{}
+	if tree != nil {
+		for _, entry := range tree.Entries {
+			entries[entry.Name] = entry
+		}
+	}
+
+	subdirs := map[string]map[string]plumbing.Hash{}
+	for filePath, hash := range files {
+		dir, rest, nested := strings.Cut(filePath, "/")
+		if !nested {
+			if hash.IsZero() {
+				delete(entries, filePath)
+				continue
+			}
+			entries[filePath] = object.TreeEntry{Name: filePath, Mode: filemode.Regular, Hash: hash}
+			continue
+		}
+		if subdirs[dir] == nil {
+			subdirs[dir] = map[string]plumbing.Hash{}
+		}
+		subdirs[dir][rest] = hash
+	}
+	for dir, subfiles := range subdirs {
+		var subtree *object.Tree
+		if entry, ok := entries[dir]; ok && entry.Mode == filemode.Dir {
+			var err error
+			if subtree, err = object.GetTree(g.repo.Storer, entry.Hash); err != nil {
+				return plumbing.ZeroHash, err
+			}
+		}
+		hash, err := g.writeTree(subtree, subfiles)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if hash == emptyTreeHash {
+			delete(entries, dir)
+			continue
+		}
+		entries[dir] = object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: hash}
+	}
+
+	// git orders the entries by name, directories as if they ended with a slash
+	sorted := make([]object.TreeEntry, 0, len(entries))
+	for _, entry := range entries {
+		sorted = append(sorted, entry)
+	}
+	sortKey := func(entry object.TreeEntry) string {
+		if entry.Mode == filemode.Dir {
+			return entry.Name + "/"
+		}
+		return entry.Name
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sortKey(sorted[i]) < sortKey(sorted[j]) })
+
+	return g.storeObject(plumbing.TreeObject, (&object.Tree{Entries: sorted}).Encode)
+}
+
+func (g *GitOperations) storeObject(objectType plumbing.ObjectType, encode func(plumbing.EncodedObject) error) (plumbing.Hash, error) {
+	obj := g.repo.Storer.NewEncodedObject()
+	obj.SetType(objectType)
+	if err := encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return g.repo.Storer.SetEncodedObject(obj)
+}
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/forge"
+)
+
+// stubForge keeps the pull requests in memory
+type stubForge struct {
+	open    map[string]*forge.PullRequest
+	created []forge.PullRequest
+}
+
+func (f *stubForge) FindPullRequest(ctx context.Context, head, base string) (*forge.PullRequest, error) {
+	return f.open[head+":"+base], nil
+}
+
+func (f *stubForge) CreatePullRequest(ctx context.Context, pr forge.PullRequest) (*forge.PullRequest, error) {
+	pr.Number = len(f.created) + 1
+	pr.URL = "https://github.com/test/repo/pull/" + pr.Head
+	f.created = append(f.created, pr)
+	f.open[pr.Head+":"+pr.Base] = &pr
+	return &pr, nil
+}
+
+// newPullRequestRepo returns a repository with one commit, pushing to a
+// bare origin and opening pull requests for the states under prod/
+func newPullRequestRepo(t *testing.T) (string, *git.Repository, *GitOperations, *stubForge, plumbing.Hash) {
+	tempDir := t.TempDir()
+	remoteDir := t.TempDir()
+	_, err := git.PlainInit(remoteDir, true)
+	require.NoError(t, err)
+
+	repo, err := git.PlainInit(tempDir, false)
+	require.NoError(t, err)
+	worktree, err := repo.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "initial.txt"), []byte("initial"), 0644))
+	_, err = worktree.Add("initial.txt")
+	require.NoError(t, err)
+	initial, err := worktree.Commit("initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com"},
+	})
+	require.NoError(t, err)
+
+	cfg := &config.Config{}
+	cfg.Repo.RepoLocal.Path = tempDir
+	cfg.Repo.Remote = config.RepoRemote{
+		Enabled:       true,
+		RemoteURL:     remoteDir,
+		Branch:        "master",
+		AuthMethod:    "default",
+		AutoPush:      true,
+		Author:        config.CommitAuthor{Name: "Test User", Email: "test@example.com"},
+		RetryAttempts: 1,
+		PullRequests:  config.PullRequests{Prefixes: []string{"prod/"}},
+	}
+	gitOps, err := NewGitOperations(cfg, zap.NewNop())
+	require.NoError(t, err)
+	stub := &stubForge{open: map[string]*forge.PullRequest{}}
+	gitOps.forge = stub
+
+	remote, err := git.PlainOpen(remoteDir)
+	require.NoError(t, err)
+	return tempDir, remote, gitOps, stub, initial
+}
+
+// mergeUpstream merges branch into master of the remote like the forge does
+func mergeUpstream(t *testing.T, remote *git.Repository, branch string) plumbing.Hash {
+	master, err := remote.Reference(plumbing.NewBranchReferenceName("master"), true)
+	require.NoError(t, err)
+	head, err := remote.Reference(plumbing.NewBranchReferenceName(branch), true)
+	require.NoError(t, err)
+	merged, err := remote.CommitObject(head.Hash())
+	require.NoError(t, err)
+
+	merge := &object.Commit{
+		Author:       object.Signature{Name: "Forge", Email: "forge@example.com"},
+		Committer:    object.Signature{Name: "Forge", Email: "forge@example.com"},
+		Message:      "Merge pull request from " + branch,
+		TreeHash:     merged.TreeHash,
+		ParentHashes: []plumbing.Hash{master.Hash(), head.Hash()},
+	}
+	obj := remote.Storer.NewEncodedObject()
+	require.NoError(t, merge.Encode(obj))
+	hash, err := remote.Storer.SetEncodedObject(obj)
+	require.NoError(t, err)
+	require.NoError(t, remote.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("master"), hash)))
+	return hash
+}
+
+func TestCommitToPullRequest(t *testing.T) {
+	tempDir, remote, gitOps, stub, initial := newPullRequestRepo(t)
+	repo := gitOps.repo
+	const branch = "tfstate/prod/app.tfstate"
+	write := func(path, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(tempDir, filepath.Dir(path)), 0750))
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, path), []byte(content), 0644))
+		require.NoError(t, gitOps.CommitAndPush(context.Background(), path, "update "+path+"\n\nserial "+content))
+	}
+	remoteCommit := func() *object.Commit {
+		ref, err := remote.Reference(plumbing.NewBranchReferenceName(branch), true)
+		require.NoError(t, err)
+		commit, err := remote.CommitObject(ref.Hash())
+		require.NoError(t, err)
+		return commit
+	}
+	fileContent := func(commit *object.Commit, path string) string {
+		file, err := commit.File(path)
+		require.NoError(t, err)
+		content, err := file.Contents()
+		require.NoError(t, err)
+		return content
+	}
+
+	// the first write opens a pull request from a new branch
+	write("prod/app.tfstate", "1")
+	require.Len(t, stub.created, 1)
+	assert.Equal(t, forge.PullRequest{Number: 1, URL: "https://github.com/test/repo/pull/" + branch, Head: branch, Base: "master", Title: "update prod/app.tfstate", Body: "serial 1"}, stub.created[0])
+	first := remoteCommit()
+	assert.Equal(t, []plumbing.Hash{initial}, first.ParentHashes)
+	assert.Equal(t, "1", fileContent(first, "prod/app.tfstate"))
+	assert.Equal(t, "initial", fileContent(first, "initial.txt"))
+
+	// the state branch is untouched, the worktree serves the written state
+	head, err := repo.Head()
+	require.NoError(t, err)
+	assert.Equal(t, initial, head.Hash())
+	data, err := os.ReadFile(filepath.Join(tempDir, "prod/app.tfstate"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(data))
+
+	// writes are batched on the open pull request
+	write("prod/app.tfstate", "2")
+	assert.Len(t, stub.created, 1)
+	second := remoteCommit()
+	assert.Equal(t, []plumbing.Hash{first.Hash}, second.ParentHashes)
+	assert.Equal(t, "2", fileContent(second, "prod/app.tfstate"))
+
+	// other states are pushed to the state branch
+	write("dev/app.tfstate", "1")
+	head, err = repo.Head()
+	require.NoError(t, err)
+	assert.NotEqual(t, initial, head.Hash())
+	_, err = remote.Reference(plumbing.NewBranchReferenceName("master"), true)
+	require.NoError(t, err)
+
+	// once the pull request is closed the branch restarts from the state branch
+	delete(stub.open, branch+":master")
+	write("prod/app.tfstate", "3")
+	assert.Len(t, stub.created, 2)
+	third := remoteCommit()
+	assert.Equal(t, []plumbing.Hash{head.Hash()}, third.ParentHashes)
+	assert.Equal(t, "3", fileContent(third, "prod/app.tfstate"))
+	assert.Equal(t, "1", fileContent(third, "dev/app.tfstate"))
+}
+
+func TestCommitToPullRequest_MergedUpstream(t *testing.T) {
+	tempDir, remote, gitOps, stub, _ := newPullRequestRepo(t)
+	repo := gitOps.repo
+	const branch = "tfstate/prod/app.tfstate"
+	write := func(path, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(tempDir, filepath.Dir(path)), 0750))
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, path), []byte(content), 0644))
+		require.NoError(t, gitOps.CommitAndPush(context.Background(), path, "update "+path))
+	}
+	commitOf := func(r *git.Repository, name string) *object.Commit {
+		ref, err := r.Reference(plumbing.NewBranchReferenceName(name), true)
+		require.NoError(t, err)
+		commit, err := r.CommitObject(ref.Hash())
+		require.NoError(t, err)
+		return commit
+	}
+	fileContent := func(commit *object.Commit, path string) string {
+		file, err := commit.File(path)
+		require.NoError(t, err)
+		content, err := file.Contents()
+		require.NoError(t, err)
+		return content
+	}
+
+	write("dev/app.tfstate", "0")
+	write("prod/app.tfstate", "1")
+	merged := mergeUpstream(t, remote, branch)
+	delete(stub.open, branch+":master")
+
+	// the state branch is fast-forwarded to the merge before the next push
+	write("dev/app.tfstate", "1")
+	head := commitOf(repo, "master")
+	assert.Equal(t, []plumbing.Hash{merged}, head.ParentHashes)
+	assert.Equal(t, head.Hash, commitOf(remote, "master").Hash)
+	assert.Equal(t, "1", fileContent(head, "prod/app.tfstate"))
+
+	// the next pull request starts from the merged content
+	write("prod/app.tfstate", "2")
+	assert.Len(t, stub.created, 2)
+	second := commitOf(remote, branch)
+	assert.Equal(t, []plumbing.Hash{head.Hash}, second.ParentHashes)
+	assert.Equal(t, "1", fileContent(second, "dev/app.tfstate"))
+
+	// a local commit not pushed yet is merged with the one of origin
+	merged = mergeUpstream(t, remote, branch)
+	delete(stub.open, branch+":master")
+	gitOps.config.Repo.Remote.AutoPush = false
+	write("dev/app.tfstate", "2")
+	gitOps.config.Repo.Remote.AutoPush = true
+	write("staging/app.tfstate", "1")
+
+	pushed := commitOf(remote, "master")
+	assert.Equal(t, commitOf(repo, "master").Hash, pushed.Hash)
+	require.Len(t, pushed.ParentHashes, 1)
+	merge, err := repo.CommitObject(pushed.ParentHashes[0])
+	require.NoError(t, err)
+	assert.Contains(t, merge.ParentHashes, merged)
+	assert.Equal(t, "2", fileContent(pushed, "prod/app.tfstate"))
+	assert.Equal(t, "2", fileContent(pushed, "dev/app.tfstate"))
+	assert.Equal(t, "1", fileContent(pushed, "staging/app.tfstate"))
+
+	// the worktree keeps serving the written states
+	data, err := os.ReadFile(filepath.Join(tempDir, "prod/app.tfstate"))
+	require.NoError(t, err)
+	assert.Equal(t, "2", string(data))
+	status, err := mustWorktree(t, repo).Status()
+	require.NoError(t, err)
+	assert.True(t, status.IsClean(), status.String())
+}
+
+func mustWorktree(t *testing.T, repo *git.Repository) *git.Worktree {
+	worktree, err := repo.Worktree()
+	require.NoError(t, err)
+	return worktree
+}
@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/ssh"
+
+	appconfig "github.com/kholisrag/terraform-backend-gitops/pkg/config"
+)
+
+// Commit signing formats of repo.remote.signing.format
+const (
+	SigningOpenPGP = "openpgp"
+	SigningSSH     = "ssh"
+)
+
+// CommitSigner signs the commits of the backend and verifies that a commit
+// was signed by the same key
+type CommitSigner interface {
+	// Sign returns the armored signature of a commit encoded without its
+	// signature
+	Sign(message io.Reader) ([]byte, error)
+	Verify(commit *object.Commit) error
+}
+
+// ErrUnsigned is returned by CommitSigner.Verify for a commit without a
+// signature
+var ErrUnsigned = errors.New("commit is not signed")
+
+// NewCommitSigner loads the signing key configured in repo.remote.signing,
+// it returns nil when signing is disabled
+func NewCommitSigner(cfg appconfig.CommitSigning) (CommitSigner, error) {
+	if cfg.Format == "" {
+		return nil, nil
+	}
+	if cfg.KeyPath == "" {
+		return nil, fmt.Errorf("signing format '%s' requires a keyPath", cfg.Format)
+	}
+	key, err := os.ReadFile(os.ExpandEnv(cfg.KeyPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	passphrase, err := signingPassphrase(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Format {
+	case SigningOpenPGP:
+		return newOpenPGPSigner(key, passphrase)
+	case SigningSSH:
+		return newSSHSigner(key, passphrase)
+	default:
+		return nil, fmt.Errorf("unsupported signing format '%s', use openpgp or ssh", cfg.Format)
+	}
+}
+
+func signingPassphrase(cfg appconfig.CommitSigning) ([]byte, error) {
+	if cfg.PassphraseFile != "" {
+		data, err := os.ReadFile(os.ExpandEnv(cfg.PassphraseFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing key passphrase: %w", err)
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+	return []byte(os.ExpandEnv(cfg.Passphrase)), nil
+}
+
+// encodeWithoutSignature returns the commit as it was signed
+func encodeWithoutSignature(commit *object.Commit) (io.Reader, error) {
+	encoded := &plumbing.MemoryObject{}
+	if err := commit.EncodeWithoutSignature(encoded); err != nil {
+		return nil, err
+	}
+	return encoded.Reader()
+}
+
+type openPGPSigner struct {
+	entity *openpgp.Entity
+}
+
+// newOpenPGPSigner reads an armored or binary private key, decrypting it with
+// the passphrase when it is protected
+func newOpenPGPSigner(key, passphrase []byte) (*openPGPSigner, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+	if err != nil {
+		if entities, err = openpgp.ReadKeyRing(bytes.NewReader(key)); err != nil {
+			return nil, fmt.Errorf("failed to parse OpenPGP key: %w", err)
+		}
+	}
+
+	for _, entity := range entities {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if entity.PrivateKey.Encrypted {
+			if len(passphrase) == 0 {
+				return nil, errors.New("OpenPGP key is encrypted but no passphrase is configured")
+			}
+			if err := entity.DecryptPrivateKeys(passphrase); err != nil {
+				return nil, fmt.Errorf("failed to decrypt OpenPGP key: %w", err)
+			}
+		}
+		return &openPGPSigner{entity: entity}, nil
+	}
+	return nil, errors.New("no OpenPGP private key found")
+}
+
+func (s *openPGPSigner) Sign(message io.Reader) ([]byte, error) {
+	var b bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&b, s.entity, message, nil); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (s *openPGPSigner) Verify(commit *object.Commit) error {
+	if commit.PGPSignature == "" {
+		return ErrUnsigned
+	}
+	if !strings.HasPrefix(commit.PGPSignature, "-----BEGIN PGP SIGNATURE-----") {
+		return errors.New("commit is not signed with OpenPGP")
+	}
+	message, err := encodeWithoutSignature(commit)
+	if err != nil {
+		return err
+	}
+	_, err = openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{s.entity}, message, strings.NewReader(commit.PGPSignature), nil)
+	return err
+}
+
+// SSH signatures follow the sshsig format of OpenSSH (ssh-keygen -Y sign),
+// git verifies them with gpg.format=ssh
+const (
+	sshsigMagic     = "SSHSIG"
+	sshsigVersion   = 1
+	sshsigNamespace = "git"
+	sshsigHash      = "sha512"
+	sshsigPEMType   = "SSH SIGNATURE"
+)
+
+type sshSigner struct {
+	signer ssh.Signer
+}
+
+func newSSHSigner(key, passphrase []byte) (*sshSigner, error) {
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if len(passphrase) == 0 {
+			return nil, errors.New("SSH key is encrypted but no passphrase is configured")
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key: %w", err)
+	}
+	return &sshSigner{signer: signer}, nil
+}
+
+// sshsigSignedData is the blob actually signed by the key
+func sshsigSignedData(message io.Reader) ([]byte, error) {
+	h := sha512.New()
+	if _, err := io.Copy(h, message); err != nil {
+		return nil, err
+	}
+	return append([]byte(sshsigMagic), ssh.Marshal(struct {
+		Namespace string
+		Reserved  string
+		Hash      string
+		Digest    []byte
+	}{sshsigNamespace, "", sshsigHash, h.Sum(nil)})...), nil
+}
+
+// sshsigBlob is the signature after the magic preamble
+type sshsigBlob struct {
+	Version   uint32
+	PublicKey []byte
+	Namespace string
+	Reserved  string
+	Hash      string
+	Signature []byte
+}
+
+func (s *sshSigner) Sign(message io.Reader) ([]byte, error) {
+	data, err := sshsigSignedData(message)
+	if err != nil {
+		return nil, err
+	}
+
+	// RSA keys must not sign with SHA-1
+	var signature *ssh.Signature
+	if algorithmSigner, ok := s.signer.(ssh.AlgorithmSigner); ok && s.signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		signature, err = algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+	} else {
+		signature, err = s.signer.Sign(rand.Reader, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	blob := append([]byte(sshsigMagic), ssh.Marshal(sshsigBlob{
+		Version:   sshsigVersion,
+		PublicKey: s.signer.PublicKey().Marshal(),
+		Namespace: sshsigNamespace,
+		Hash:      sshsigHash,
+		Signature: ssh.Marshal(signature),
+	})...)
+	return pem.EncodeToMemory(&pem.Block{Type: sshsigPEMType, Bytes: blob}), nil
+}
+
+func (s *sshSigner) Verify(commit *object.Commit) error {
+	if commit.PGPSignature == "" {
+		return ErrUnsigned
+	}
+	block, _ := pem.Decode([]byte(commit.PGPSignature))
+	if block == nil || block.Type != sshsigPEMType {
+		return errors.New("commit is not signed with SSH")
+	}
+	if !bytes.HasPrefix(block.Bytes, []byte(sshsigMagic)) {
+		return errors.New("invalid SSH signature")
+	}
+
+	var blob sshsigBlob
+	if err := ssh.Unmarshal(block.Bytes[len(sshsigMagic):], &blob); err != nil {
+		return fmt.Errorf("invalid SSH signature: %w", err)
+	}
+	if blob.Version != sshsigVersion || blob.Namespace != sshsigNamespace || blob.Hash != sshsigHash {
+		return errors.New("unsupported SSH signature")
+	}
+	if !bytes.Equal(blob.PublicKey, s.signer.PublicKey().Marshal()) {
+		return errors.New("commit is signed by another SSH key")
+	}
+
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(blob.Signature, &signature); err != nil {
+		return fmt.Errorf("invalid SSH signature: %w", err)
+	}
+	message, err := encodeWithoutSignature(commit)
+	if err != nil {
+		return err
+	}
+	data, err := sshsigSignedData(message)
+	if err != nil {
+		return err
+	}
+	return s.signer.PublicKey().Verify(data, &signature)
+}
+
+// CommitVerification is the signature check of a single commit
+type CommitVerification struct {
+	Hash    string
+	Subject string
+	// Err is nil when the commit is signed by the backend's key
+	Err error
+}
+
+// VerifyCommits checks the signature of every commit of the state branch.
+// Commits reachable from since, e.g. the history before signing was
+// enabled, are not checked.
+func (g *GitOperations) VerifyCommits(since string) ([]CommitVerification, error) {
+	if g.signer == nil {
+		return nil, errors.New("commit signing is not configured")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ref, err := g.repo.Reference(plumbing.NewBranchReferenceName(g.config.Repo.Remote.Branch), true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve branch %s: %w", g.config.Repo.Remote.Branch, err)
+	}
+
+	excluded := map[plumbing.Hash]bool{}
+	if since != "" {
+		hash, err := g.repo.ResolveRevision(plumbing.Revision(since))
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", since, err)
+		}
+		iter, err := g.repo.Log(&git.LogOptions{From: *hash})
+		if err != nil {
+			return nil, err
+		}
+		err = iter.ForEach(func(c *object.Commit) error {
+			excluded[c.Hash] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	iter, err := g.repo.Log(&git.LogOptions{From: ref.Hash()})
+	if err != nil {
+		return nil, err
+	}
+	var results []CommitVerification
+	err = iter.ForEach(func(c *object.Commit) error {
+		if excluded[c.Hash] {
+			return nil
+		}
+		subject, _, _ := strings.Cut(c.Message, "\n")
+		results = append(results, CommitVerification{
+			Hash:    c.Hash.String(),
+			Subject: subject,
+			Err:     g.signer.Verify(c),
+		})
+		return nil
+	})
+	return results, err
+}
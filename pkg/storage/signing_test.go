@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+)
+
+func writeSSHKey(t *testing.T, passphrase string) string {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	var block *pem.Block
+	if passphrase != "" {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(key, "")
+	}
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0600))
+	return path
+}
+
+func writeOpenPGPKey(t *testing.T, passphrase string) string {
+	entity, err := openpgp.NewEntity("Terraform Backend GitOps", "", "terraform-backend@gitops.local", nil)
+	require.NoError(t, err)
+	if passphrase != "" {
+		require.NoError(t, entity.EncryptPrivateKeys([]byte(passphrase), nil))
+	}
+
+	var b bytes.Buffer
+	w, err := armor.Encode(&b, openpgp.PrivateKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.SerializePrivateWithoutSigning(w, nil))
+	require.NoError(t, w.Close())
+
+	path := filepath.Join(t.TempDir(), "signing.asc")
+	require.NoError(t, os.WriteFile(path, b.Bytes(), 0600))
+	return path
+}
+
+func TestNewCommitSigner(t *testing.T) {
+	signer, err := NewCommitSigner(config.CommitSigning{})
+	require.NoError(t, err)
+	assert.Nil(t, signer)
+
+	_, err = NewCommitSigner(config.CommitSigning{Format: SigningSSH})
+	assert.Error(t, err, "missing key path")
+
+	_, err = NewCommitSigner(config.CommitSigning{Format: "x509", KeyPath: writeSSHKey(t, "")})
+	assert.Error(t, err, "unsupported format")
+
+	_, err = NewCommitSigner(config.CommitSigning{Format: SigningSSH, KeyPath: writeSSHKey(t, "secret")})
+	assert.Error(t, err, "missing passphrase")
+
+	_, err = NewCommitSigner(config.CommitSigning{Format: SigningOpenPGP, KeyPath: writeOpenPGPKey(t, "secret"), Passphrase: "wrong"})
+	assert.Error(t, err, "wrong passphrase")
+}
+
+func TestVerifyCommits(t *testing.T) {
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	require.NoError(t, os.WriteFile(passphraseFile, []byte("secret\n"), 0600))
+
+	tests := []struct {
+		name    string
+		signing config.CommitSigning
+	}{
+		{"openpgp", config.CommitSigning{Format: SigningOpenPGP, KeyPath: writeOpenPGPKey(t, "")}},
+		{"openpgp with passphrase", config.CommitSigning{Format: SigningOpenPGP, KeyPath: writeOpenPGPKey(t, "secret"), Passphrase: "secret"}},
+		{"ssh", config.CommitSigning{Format: SigningSSH, KeyPath: writeSSHKey(t, "")}},
+		{"ssh with passphrase", config.CommitSigning{Format: SigningSSH, KeyPath: writeSSHKey(t, "secret"), PassphraseFile: passphraseFile}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			repo, err := git.PlainInit(tempDir, false)
+			require.NoError(t, err)
+
+			worktree, err := repo.Worktree()
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(filepath.Join(tempDir, "initial.txt"), []byte("initial"), 0644))
+			_, err = worktree.Add("initial.txt")
+			require.NoError(t, err)
+			unsigned, err := worktree.Commit("initial commit", &git.CommitOptions{
+				Author: &object.Signature{Name: "Test", Email: "test@example.com"},
+			})
+			require.NoError(t, err)
+
+			cfg := &config.Config{}
+			cfg.Repo.RepoLocal.Path = tempDir
+			cfg.Repo.Remote.Branch = "master"
+			cfg.Repo.Remote.Signing = tt.signing
+			gitOps, err := NewGitOperations(cfg, zap.NewNop())
+			require.NoError(t, err)
+
+			require.NoError(t, os.WriteFile(filepath.Join(tempDir, "test.tfstate"), []byte("state"), 0644))
+			signed, err := gitOps.commitFiles([]string{"test.tfstate"}, "test: commit state file")
+			require.NoError(t, err)
+
+			results, err := gitOps.VerifyCommits("")
+			require.NoError(t, err)
+			require.Len(t, results, 2)
+			assert.Equal(t, signed, results[0].Hash)
+			assert.NoError(t, results[0].Err)
+			assert.Equal(t, unsigned.String(), results[1].Hash)
+			assert.ErrorIs(t, results[1].Err, ErrUnsigned)
+
+			results, err = gitOps.VerifyCommits(unsigned.String())
+			require.NoError(t, err)
+			require.Len(t, results, 1)
+			assert.NoError(t, results[0].Err)
+
+			// a commit signed by another key is rejected
+			other := tt.signing
+			if other.Format == SigningSSH {
+				other = config.CommitSigning{Format: SigningSSH, KeyPath: writeSSHKey(t, "")}
+			} else {
+				other = config.CommitSigning{Format: SigningOpenPGP, KeyPath: writeOpenPGPKey(t, "")}
+			}
+			gitOps.signer, err = NewCommitSigner(other)
+			require.NoError(t, err)
+			results, err = gitOps.VerifyCommits(unsigned.String())
+			require.NoError(t, err)
+			assert.Error(t, results[0].Err)
+		})
+	}
+}
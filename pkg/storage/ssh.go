@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+
+	appconfig "github.com/kholisrag/terraform-backend-gitops/pkg/config"
+)
+
+const defaultSSHUser = "git"
+
+// RemoteURL returns the URL of the remote with the configured SSH port,
+// an scp-like URL (git@host:owner/repo.git) is rewritten as
+// ssh://git@host:port/owner/repo.git
+func RemoteURL(cfg appconfig.RepoRemote) (string, error) {
+	if cfg.SSH.Port == 0 || cfg.AuthMethod != "ssh" {
+		return cfg.RemoteURL, nil
+	}
+	if cfg.SSH.Port < 0 || cfg.SSH.Port > 65535 {
+		return "", fmt.Errorf("invalid SSH port %d", cfg.SSH.Port)
+	}
+
+	u, err := parseSSHURL(cfg.RemoteURL)
+	if err != nil {
+		return "", err
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(cfg.SSH.Port))
+	return u.String(), nil
+}
+
+// parseSSHURL parses an ssh:// or scp-like URL
+func parseSSHURL(remoteURL string) (*url.URL, error) {
+	if strings.Contains(remoteURL, "://") {
+		u, err := url.Parse(remoteURL)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "ssh" {
+			return nil, fmt.Errorf("remote URL %q is not an SSH URL", remoteURL)
+		}
+		return u, nil
+	}
+
+	host, path, ok := strings.Cut(remoteURL, ":")
+	if !ok || host == "" || strings.Contains(host, "/") {
+		return nil, fmt.Errorf("remote URL %q is not an SSH URL", remoteURL)
+	}
+	u := &url.URL{Scheme: "ssh", Path: "/" + strings.TrimPrefix(path, "/")}
+	if user, hostname, ok := strings.Cut(host, "@"); ok {
+		u.User = url.User(user)
+		u.Host = hostname
+	} else {
+		u.Host = host
+	}
+	return u, nil
+}
+
+// sshUser returns the configured SSH user, the one of the remote URL or git
+func sshUser(cfg appconfig.RepoRemote) string {
+	if cfg.SSH.User != "" {
+		return cfg.SSH.User
+	}
+	if u, err := parseSSHURL(cfg.RemoteURL); err == nil && u.User != nil && u.User.Username() != "" {
+		return u.User.Username()
+	}
+	return defaultSSHUser
+}
+
+// NewSSHAuth returns the SSH authentication of the remote, with the keys of
+// the ssh-agent or the key file decrypted with its passphrase, verifying the
+// host key
+func NewSSHAuth(cfg appconfig.RepoRemote) (transport.AuthMethod, error) {
+	hostKeyCallback, err := sshHostKeyCallback(cfg.SSH)
+	if err != nil {
+		return nil, err
+	}
+	user := sshUser(cfg)
+
+	if cfg.SSH.Agent {
+		if os.Getenv("SSH_AUTH_SOCK") == "" {
+			return nil, errors.New("ssh agent enabled but SSH_AUTH_SOCK is not set")
+		}
+		auth, err := gitssh.NewSSHAgentAuth(user)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to ssh agent: %w", err)
+		}
+		auth.HostKeyCallback = hostKeyCallback
+		return auth, nil
+	}
+
+	sshKeyPath, err := expandPath(cfg.SSHKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if sshKeyPath == "" {
+		return nil, errors.New("sshKeyPath is not configured")
+	}
+	key, err := os.ReadFile(sshKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key: %w", err)
+	}
+	passphrase, err := sshKeyPassphrase(cfg.SSH)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("SSH key %s is encrypted but no passphrase is configured", sshKeyPath)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SSH key from %s: %w", sshKeyPath, err)
+	}
+
+	auth := &gitssh.PublicKeys{User: user, Signer: signer}
+	auth.HostKeyCallback = hostKeyCallback
+	return auth, nil
+}
+
+func sshKeyPassphrase(cfg appconfig.RemoteSSH) (string, error) {
+	if cfg.KeyPassphraseFile != "" {
+		path, err := expandPath(cfg.KeyPassphraseFile)
+		if err != nil {
+			return "", err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read SSH key passphrase: %w", err)
+		}
+		return string(bytes.TrimRight(data, "\r\n")), nil
+	}
+	return os.ExpandEnv(cfg.KeyPassphrase), nil
+}
+
+// sshHostKeyCallback verifies the host key against the configured
+// known_hosts file and pinned fingerprints, both when both are set. It
+// returns nil to use the default known_hosts files.
+func sshHostKeyCallback(cfg appconfig.RemoteSSH) (ssh.HostKeyCallback, error) {
+	var knownHosts ssh.HostKeyCallback
+	if cfg.KnownHostsFile != "" {
+		path, err := expandPath(cfg.KnownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("known_hosts file: %w", err)
+		}
+		if knownHosts, err = gitssh.NewKnownHostsCallback(path); err != nil {
+			return nil, fmt.Errorf("failed to load known_hosts file %s: %w", path, err)
+		}
+	}
+
+	fingerprints := map[string]bool{}
+	for _, fingerprint := range cfg.HostKeyFingerprints {
+		if !strings.HasPrefix(fingerprint, "SHA256:") {
+			return nil, fmt.Errorf("invalid host key fingerprint %q, use the SHA256:... form of ssh-keygen -l", fingerprint)
+		}
+		fingerprints[fingerprint] = true
+	}
+
+	if len(fingerprints) == 0 {
+		return knownHosts, nil
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if knownHosts != nil {
+			if err := knownHosts(hostname, remote, key); err != nil {
+				return err
+			}
+		}
+		if fingerprint := ssh.FingerprintSHA256(key); !fingerprints[fingerprint] {
+			return fmt.Errorf("host key %s of %s is not pinned in hostKeyFingerprints", fingerprint, hostname)
+		}
+		return nil
+	}, nil
+}
+
+// expandPath expands environment variables and a leading ~/
+func expandPath(path string) (string, error) {
+	path = os.ExpandEnv(path)
+	if strings.HasPrefix(path, "~/") {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get home directory: %w", err)
+		}
+		path = strings.Replace(path, "~", homeDir, 1)
+	}
+	return path, nil
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+)
+
+func TestRemoteURL(t *testing.T) {
+	tests := []struct {
+		remoteURL string
+		port      int
+		expected  string
+	}{
+		{"git@github.com:kholisrag/states.git", 0, "git@github.com:kholisrag/states.git"},
+		{"git@github.com:kholisrag/states.git", 443, "ssh://git@github.com:443/kholisrag/states.git"},
+		{"gitlab.example.com:infra/states.git", 2222, "ssh://gitlab.example.com:2222/infra/states.git"},
+		{"ssh://git@gitlab.example.com:22/infra/states.git", 2222, "ssh://git@gitlab.example.com:2222/infra/states.git"},
+	}
+	for _, tt := range tests {
+		remoteURL, err := RemoteURL(config.RepoRemote{RemoteURL: tt.remoteURL, AuthMethod: "ssh", SSH: config.RemoteSSH{Port: tt.port}})
+		require.NoError(t, err, tt.remoteURL)
+		assert.Equal(t, tt.expected, remoteURL)
+	}
+
+	_, err := RemoteURL(config.RepoRemote{RemoteURL: "https://github.com/kholisrag/states.git", AuthMethod: "ssh", SSH: config.RemoteSSH{Port: 2222}})
+	assert.Error(t, err)
+}
+
+func TestNewSSHAuth(t *testing.T) {
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	require.NoError(t, os.WriteFile(passphraseFile, []byte("secret\n"), 0600))
+	encryptedKey := writeSSHKey(t, "secret")
+
+	auth, err := NewSSHAuth(config.RepoRemote{
+		RemoteURL:  "deploy@git.example.com:infra/states.git",
+		SSHKeyPath: encryptedKey,
+		SSH:        config.RemoteSSH{KeyPassphraseFile: passphraseFile},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "deploy", auth.(*gitssh.PublicKeys).User)
+
+	t.Setenv("TEST_SSH_PASSPHRASE", "secret")
+	auth, err = NewSSHAuth(config.RepoRemote{
+		RemoteURL:  "git@github.com:kholisrag/states.git",
+		SSHKeyPath: encryptedKey,
+		SSH:        config.RemoteSSH{KeyPassphrase: "${TEST_SSH_PASSPHRASE}", User: "robot"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "robot", auth.(*gitssh.PublicKeys).User)
+
+	_, err = NewSSHAuth(config.RepoRemote{SSHKeyPath: encryptedKey})
+	assert.ErrorContains(t, err, "no passphrase")
+
+	_, err = NewSSHAuth(config.RepoRemote{SSHKeyPath: encryptedKey, SSH: config.RemoteSSH{KeyPassphrase: "wrong"}})
+	assert.Error(t, err)
+
+	_, err = NewSSHAuth(config.RepoRemote{SSHKeyPath: writeSSHKey(t, ""), SSH: config.RemoteSSH{KnownHostsFile: filepath.Join(t.TempDir(), "missing")}})
+	assert.ErrorContains(t, err, "known_hosts")
+
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, err = NewSSHAuth(config.RepoRemote{SSH: config.RemoteSSH{Agent: true}})
+	assert.ErrorContains(t, err, "SSH_AUTH_SOCK")
+}
+
+func TestSSHHostKeyCallback(t *testing.T) {
+	newHostKey := func() ssh.PublicKey {
+		public, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		key, err := ssh.NewPublicKey(public)
+		require.NoError(t, err)
+		return key
+	}
+	hostKey, otherKey := newHostKey(), newHostKey()
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{"git.example.com"}, hostKey)
+	require.NoError(t, os.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+
+	callback, err := sshHostKeyCallback(config.RemoteSSH{})
+	require.NoError(t, err)
+	assert.Nil(t, callback, "default known_hosts files")
+
+	callback, err = sshHostKeyCallback(config.RemoteSSH{KnownHostsFile: knownHostsFile})
+	require.NoError(t, err)
+	assert.NoError(t, callback("git.example.com:22", remote, hostKey))
+	assert.Error(t, callback("git.example.com:22", remote, otherKey))
+	assert.Error(t, callback("other.example.com:22", remote, hostKey))
+
+	callback, err = sshHostKeyCallback(config.RemoteSSH{HostKeyFingerprints: []string{ssh.FingerprintSHA256(hostKey)}})
+	require.NoError(t, err)
+	assert.NoError(t, callback("git.example.com:22", remote, hostKey))
+	assert.ErrorContains(t, callback("git.example.com:22", remote, otherKey), "not pinned")
+
+	// both the known_hosts file and the fingerprints have to match
+	callback, err = sshHostKeyCallback(config.RemoteSSH{KnownHostsFile: knownHostsFile, HostKeyFingerprints: []string{ssh.FingerprintSHA256(otherKey)}})
+	require.NoError(t, err)
+	assert.Error(t, callback("git.example.com:22", remote, hostKey))
+
+	_, err = sshHostKeyCallback(config.RemoteSSH{HostKeyFingerprints: []string{"aa:bb:cc"}})
+	assert.Error(t, err)
+}
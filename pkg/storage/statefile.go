@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+
+	appconfig "github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/errs"
+)
+
+// tempSuffix marks the temporary files of WriteFileAtomic, leftovers of a
+// crash are removed by RemoveTempFiles
+const tempSuffix = ".tmp"
+
+// BackupDir returns the directory keeping the previous version of the states
+// until their commit is confirmed, by default inside .git so it is never
+// committed
+func BackupDir(cfg *appconfig.Config) string {
+	if cfg.Repo.RepoLocal.BackupDir != "" {
+		return os.ExpandEnv(cfg.Repo.RepoLocal.BackupDir)
+	}
+	return filepath.Join(cfg.Repo.RepoLocal.Path, ".git", "state-backups")
+}
+
+// WriteFileAtomic writes a file through a temporary file in the same
+// directory. The temporary file is fsynced and renamed into place only when
+// write succeeds, so a crash, a full disk or a failed write never leaves a
+// truncated file behind.
+func WriteFileAtomic(path string, perm fs.FileMode, write func(w io.Writer) error) error {
+	const op = "storage.WriteFileAtomic"
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*"+tempSuffix)
+	if err != nil {
+		return errs.E(errs.KindStorage, op, fmt.Errorf("failed to create temporary file: %w", err))
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return errs.E(errs.KindStorage, op, fmt.Errorf("failed to set file mode: %w", err))
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errs.E(errs.KindStorage, op, fmt.Errorf("failed to sync file: %w", err))
+	}
+	if err := tmp.Close(); err != nil {
+		return errs.E(errs.KindStorage, op, fmt.Errorf("failed to close file: %w", err))
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errs.E(errs.KindStorage, op, fmt.Errorf("failed to replace file: %w", err))
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return errs.E(errs.KindStorage, op, fmt.Errorf("failed to sync directory: %w", err))
+	}
+	return nil
+}
+
+// syncDir persists a rename in the directory
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Backup is the previous version of a state, kept until the new version is
+// committed
+type Backup struct {
+	statePath  string
+	backupPath string
+}
+
+// BackupFile keeps the current version of statePath at backupPath. The backup
+// is a hard link when possible since the state is replaced by a rename, a
+// copy otherwise. It returns nil when the state does not exist yet.
+func BackupFile(statePath, backupPath string) (*Backup, error) {
+	const op = "storage.BackupFile"
+
+	if _, err := os.Stat(statePath); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errs.E(errs.KindStorage, op, fmt.Errorf("failed to stat state: %w", err))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(backupPath), 0750); err != nil {
+		return nil, errs.E(errs.KindStorage, op, fmt.Errorf("failed to create backup directory: %w", err))
+	}
+	if err := os.Remove(backupPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, errs.E(errs.KindStorage, op, fmt.Errorf("failed to remove stale backup: %w", err))
+	}
+	if err := os.Link(statePath, backupPath); err != nil {
+		if err := copyFile(statePath, backupPath); err != nil {
+			return nil, errs.E(errs.KindStorage, op, fmt.Errorf("failed to back up state: %w", err))
+		}
+	}
+	return &Backup{statePath: statePath, backupPath: backupPath}, nil
+}
+
+// Restore puts the previous version back in place, e.g. when committing the
+// new version failed
+func (b *Backup) Restore() error {
+	if b == nil {
+		return nil
+	}
+	src, err := os.Open(b.backupPath)
+	if err != nil {
+		return errs.E(errs.KindStorage, "storage.Backup.Restore", fmt.Errorf("failed to open backup: %w", err))
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return errs.E(errs.KindStorage, "storage.Backup.Restore", fmt.Errorf("failed to stat backup: %w", err))
+	}
+	err = WriteFileAtomic(b.statePath, info.Mode().Perm(), func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return b.Discard()
+}
+
+// Discard removes the backup once the new version is committed
+func (b *Backup) Discard() error {
+	if b == nil {
+		return nil
+	}
+	if err := os.Remove(b.backupPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return errs.E(errs.KindStorage, "storage.Backup.Discard", fmt.Errorf("failed to remove backup: %w", err))
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(dst, info.Mode().Perm(), func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
+
+// RemoveTempFiles removes the temporary files a crash left in the
+// repository
+func RemoveTempFiles(root string, logger *zap.Logger) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") && strings.HasSuffix(d.Name(), tempSuffix) {
+			logger.Warn("removing leftover temporary file", zap.String("path", path))
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// RecoverBackups handles the backups left by a crash between writing a state
+// and committing it. A state matching the last commit was committed (or never
+// replaced) and its backup is dropped, otherwise the uncommitted state is
+// replaced by its backup. The files under a pull request prefix are
+// committed to the branch of their pull request instead.
+func (g *GitOperations) RecoverBackups(backupDir string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// without any commit yet every backed up state is uncommitted
+	var tree *object.Tree
+	head, err := g.repo.Head()
+	if err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return fmt.Errorf("failed to get HEAD: %w", err)
+	}
+	if head != nil {
+		commit, err := g.repo.CommitObject(head.Hash())
+		if err != nil {
+			return fmt.Errorf("failed to get HEAD commit: %w", err)
+		}
+		if tree, err = commit.Tree(); err != nil {
+			return fmt.Errorf("failed to get HEAD tree: %w", err)
+		}
+	}
+	pullRequestTrees, err := g.pullRequestTrees()
+	if err != nil {
+		return err
+	}
+
+	err = filepath.WalkDir(backupDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(backupDir, path)
+		if err != nil {
+			return err
+		}
+		backup := &Backup{
+			statePath:  filepath.Join(g.config.Repo.RepoLocal.Path, relativePath),
+			backupPath: path,
+		}
+
+		name := filepath.ToSlash(relativePath)
+		trees := []*object.Tree{tree}
+		if g.pullRequestBranch([]string{name}) != "" {
+			// the branch is named after the state, the sidecars start with it
+			var branchState string
+			for state, prTree := range pullRequestTrees {
+				if strings.HasPrefix(name, state) && len(state) > len(branchState) {
+					branchState = state
+					trees = append(trees, prTree)
+				}
+			}
+		}
+		data, err := os.ReadFile(backup.statePath)
+		if err == nil && committedIn(trees, name, data) {
+			g.logger.Info("state was committed, dropping its backup", zap.String("state", relativePath))
+			return backup.Discard()
+		}
+		// a removed state is committed once the last commit of its branch
+		// does not have it
+		if errors.Is(err, fs.ErrNotExist) && removedIn(trees[len(trees)-1], name) {
+			g.logger.Info("state removal was committed, dropping its backup", zap.String("state", relativePath))
+			return backup.Discard()
+		}
+
+		g.logger.Warn("state was not committed, restoring its backup", zap.String("state", relativePath))
+		return backup.Restore()
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// pullRequestTrees returns the trees of the tips of the local pull request
+// branches by the state they are named after
+func (g *GitOperations) pullRequestTrees() (map[string]*object.Tree, error) {
+	trees := map[string]*object.Tree{}
+	if len(g.config.Repo.Remote.PullRequests.Prefixes) == 0 {
+		return trees, nil
+	}
+	branchPrefix := g.config.Repo.Remote.PullRequests.BranchPrefix
+	if branchPrefix == "" {
+		branchPrefix = defaultPullRequestBranchPrefix
+	}
+	branches, err := g.repo.Branches()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list branches: %w", err)
+	}
+	err = branches.ForEach(func(ref *plumbing.Reference) error {
+		state, ok := strings.CutPrefix(ref.Name().Short(), branchPrefix)
+		if !ok || state == "" {
+			return nil
+		}
+		commit, err := g.repo.CommitObject(ref.Hash())
+		if err != nil {
+			return fmt.Errorf("failed to get the commit of %s: %w", ref.Name().Short(), err)
+		}
+		tree, err := commit.Tree()
+		if err != nil {
+			return fmt.Errorf("failed to get the tree of %s: %w", ref.Name().Short(), err)
+		}
+		trees[state] = tree
+		return nil
+	})
+	return trees, err
+}
+
+func removedIn(tree *object.Tree, name string) bool {
+	if tree == nil {
+		return false
+	}
+	_, err := tree.File(name)
+	return errors.Is(err, object.ErrFileNotFound)
+}
+
+// committedIn reports whether one of the trees has the file with data
+func committedIn(trees []*object.Tree, name string, data []byte) bool {
+	hash := plumbing.ComputeHash(plumbing.BlobObject, data)
+	for _, tree := range trees {
+		if tree == nil {
+			continue
+		}
+		if entry, err := tree.File(name); err == nil && entry.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
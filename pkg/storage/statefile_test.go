@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "prod.tfstate")
+	require.NoError(t, os.WriteFile(path, []byte("previous"), 0644))
+
+	// a failing write leaves the previous content and no temporary file
+	err := WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		_, err := w.Write([]byte("trunc"))
+		require.NoError(t, err)
+		return errors.New("encryption failed")
+	})
+	assert.EqualError(t, err, "encryption failed")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "previous", string(data))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	err = WriteFileAtomic(path, 0640, func(w io.Writer) error {
+		_, err := w.Write([]byte("next"))
+		return err
+	})
+	require.NoError(t, err)
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "next", string(data))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+}
+
+func TestBackupFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "prod.tfstate")
+	backupPath := filepath.Join(dir, ".git", "state-backups", "prod.tfstate")
+
+	backup, err := BackupFile(path, backupPath)
+	require.NoError(t, err)
+	assert.Nil(t, backup, "nothing to back up for a new state")
+	assert.NoError(t, backup.Restore())
+	assert.NoError(t, backup.Discard())
+
+	require.NoError(t, os.WriteFile(path, []byte("v1"), 0644))
+	backup, err = BackupFile(path, backupPath)
+	require.NoError(t, err)
+	require.NoError(t, WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		_, err := w.Write([]byte("v2"))
+		return err
+	}))
+
+	// the hard link still points to the previous version after the rename
+	data, err := os.ReadFile(backupPath)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(data))
+
+	require.NoError(t, backup.Restore())
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(data))
+	assert.NoFileExists(t, backupPath)
+}
+
+func TestRecoverBackups(t *testing.T) {
+	tempDir := t.TempDir()
+	repo, err := git.PlainInit(tempDir, false)
+	require.NoError(t, err)
+
+	for _, name := range []string{"committed.tfstate", "uncommitted.tfstate"} {
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, name), []byte("v1"), 0644))
+	}
+	worktree, err := repo.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, worktree.AddGlob("*.tfstate"))
+	_, err = worktree.Commit("initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com"},
+	})
+	require.NoError(t, err)
+
+	cfg := &config.Config{
+		Repo: config.Repo{
+			RepoLocal: config.RepoLocal{Path: tempDir},
+			Remote: config.RepoRemote{
+				Enabled:   true,
+				RemoteURL: "https://github.com/test/repo.git",
+				Branch:    "main",
+				Author:    config.CommitAuthor{Name: "Test User", Email: "test@example.com"},
+			},
+		},
+	}
+	logger, _ := zap.NewDevelopment()
+	gitOps, err := NewGitOperations(cfg, logger)
+	require.NoError(t, err)
+
+	// crash after committing committed.tfstate v2, and before committing uncommitted.tfstate v2
+	backupDir := BackupDir(cfg)
+	for _, name := range []string{"committed.tfstate", "uncommitted.tfstate"} {
+		path := filepath.Join(tempDir, name)
+		_, err := BackupFile(path, filepath.Join(backupDir, name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path+".new", []byte("v2"), 0644))
+		require.NoError(t, os.Rename(path+".new", path))
+	}
+	require.NoError(t, gitOps.CommitAndPush(context.Background(), "committed.tfstate", "test: committed.tfstate"))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, ".uncommitted.tfstate.123.tmp"), []byte("v3"), 0600))
+
+	require.NoError(t, RemoveTempFiles(tempDir, logger))
+	require.NoError(t, gitOps.RecoverBackups(backupDir))
+
+	data, err := os.ReadFile(filepath.Join(tempDir, "committed.tfstate"))
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(data))
+	data, err = os.ReadFile(filepath.Join(tempDir, "uncommitted.tfstate"))
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(data))
+
+	assert.NoFileExists(t, filepath.Join(tempDir, ".uncommitted.tfstate.123.tmp"))
+	assert.NoFileExists(t, filepath.Join(backupDir, "committed.tfstate"))
+	assert.NoFileExists(t, filepath.Join(backupDir, "uncommitted.tfstate"))
+
+	status, err := worktree.Status()
+	require.NoError(t, err)
+	assert.True(t, status.IsClean(), status.String())
+
+	// nothing to recover without backups
+	require.NoError(t, gitOps.RecoverBackups(filepath.Join(t.TempDir(), "missing")))
+}
+
+func TestRecoverBackups_PullRequest(t *testing.T) {
+	tempDir, _, gitOps, _, _ := newPullRequestRepo(t)
+	backupDir := BackupDir(gitOps.config)
+	files := []string{"prod/app.tfstate", "prod/app.tfstate.sha256"}
+	write := func(name, content string) {
+		path := filepath.Join(tempDir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0750))
+		_, err := BackupFile(path, filepath.Join(backupDir, name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path+".new", []byte(content), 0644))
+		require.NoError(t, os.Rename(path+".new", path))
+	}
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(tempDir, name))
+		require.NoError(t, err)
+		return string(data)
+	}
+	for _, name := range files {
+		write(name, "1")
+	}
+	require.NoError(t, gitOps.CommitAndPushFiles(context.Background(), files, "test: v1"))
+
+	// crash after committing v2 to the pull request branch, HEAD still has no state
+	for _, name := range files {
+		write(name, "2")
+	}
+	require.NoError(t, gitOps.CommitAndPushFiles(context.Background(), files, "test: v2"))
+	require.NoError(t, gitOps.RecoverBackups(backupDir))
+	for _, name := range files {
+		assert.Equal(t, "2", read(name))
+		assert.NoFileExists(t, filepath.Join(backupDir, name))
+	}
+
+	// crash before committing v3
+	write("prod/app.tfstate", "3")
+	require.NoError(t, gitOps.RecoverBackups(backupDir))
+	assert.Equal(t, "2", read("prod/app.tfstate"))
+
+	// a removal is restored until it is committed
+	remove := func() {
+		for _, name := range files {
+			_, err := BackupFile(filepath.Join(tempDir, name), filepath.Join(backupDir, name))
+			require.NoError(t, err)
+			require.NoError(t, os.Remove(filepath.Join(tempDir, name)))
+		}
+	}
+	remove()
+	require.NoError(t, gitOps.RecoverBackups(backupDir))
+	assert.Equal(t, "2", read("prod/app.tfstate"))
+	remove()
+	require.NoError(t, gitOps.CommitAndPushFiles(context.Background(), files, "test: remove"))
+	require.NoError(t, gitOps.RecoverBackups(backupDir))
+	for _, name := range files {
+		assert.NoFileExists(t, filepath.Join(tempDir, name))
+		assert.NoFileExists(t, filepath.Join(backupDir, name))
+	}
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"go.uber.org/zap"
+)
+
+// syncBase fetches the state branch from origin and brings the local branch
+// up to date, e.g. after a pull request was merged on the forge. A branch
+// behind origin is fast-forwarded; commits not pushed yet are merged with
+// the ones of origin, the local version of a file changed on both sides
+// wins. Files changed in the worktree but not committed are kept.
+func (g *GitOperations) syncBase(ctx context.Context) error {
+	branch := g.config.Repo.Remote.Branch
+	remoteRef := plumbing.NewRemoteReferenceName(originRemote, branch)
+
+	auth, err := remoteAuth(g.config.Repo.Remote)
+	if err != nil {
+		return fmt.Errorf("failed to get authentication: %w", err)
+	}
+	err = g.repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: originRemote,
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("+refs/heads/%s:%s", branch, remoteRef))},
+		Auth:       auth,
+	})
+	var noMatch git.NoMatchingRefSpecError
+	switch {
+	case errors.Is(err, transport.ErrEmptyRemoteRepository), errors.As(err, &noMatch):
+		// the branch is created by the first push
+		return nil
+	case err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate):
+		return fmt.Errorf("failed to fetch %s: %w", branch, err)
+	}
+
+	remoteHash, err := g.branchHash(remoteRef)
+	if err != nil || remoteHash.IsZero() {
+		return err
+	}
+	localHash, err := g.branchHash(plumbing.NewBranchReferenceName(branch))
+	if err != nil {
+		return err
+	}
+	if localHash == remoteHash {
+		return nil
+	}
+
+	remoteCommit, err := g.repo.CommitObject(remoteHash)
+	if err != nil {
+		return err
+	}
+	target := remoteHash
+	var localCommit *object.Commit
+	if !localHash.IsZero() {
+		if localCommit, err = g.repo.CommitObject(localHash); err != nil {
+			return err
+		}
+		if ahead, err := remoteCommit.IsAncestor(localCommit); err != nil || ahead {
+			return err
+		}
+		behind, err := localCommit.IsAncestor(remoteCommit)
+		if err != nil {
+			return err
+		}
+		if !behind {
+			if target, err = g.mergeCommits(localCommit, remoteCommit); err != nil {
+				return fmt.Errorf("failed to merge %s: %w", remoteRef, err)
+			}
+		}
+	}
+
+	if err := g.checkoutKeepingChanges(localCommit, target); err != nil {
+		return fmt.Errorf("failed to update %s: %w", branch, err)
+	}
+	g.logger.Info("updated the state branch from origin",
+		zap.String("branch", branch),
+		zap.String("from", localHash.String()),
+		zap.String("to", target.String()))
+	return nil
+}
+
+// mergeCommits commits the merge of local into remote, the files changed by
+// the local commits since their merge base replace the ones of remote
+func (g *GitOperations) mergeCommits(local, remote *object.Commit) (plumbing.Hash, error) {
+	bases, err := local.MergeBase(remote)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	var baseTree *object.Tree
+	if len(bases) > 0 {
+		if baseTree, err = bases[0].Tree(); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	localTree, err := local.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	remoteTree, err := remote.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	changes, err := object.DiffTree(baseTree, localTree)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	files := map[string]plumbing.Hash{}
+	for _, change := range changes {
+		if change.From.Name != "" {
+			files[change.From.Name] = plumbing.ZeroHash
+		}
+		if change.To.Name != "" {
+			files[change.To.Name] = change.To.TreeEntry.Hash
+		}
+	}
+	treeHash, err := g.writeTree(remoteTree, files)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	message := fmt.Sprintf("Merge remote-tracking branch '%s/%s'", originRemote, g.config.Repo.Remote.Branch)
+	return g.storeCommit(treeHash, []plumbing.Hash{local.Hash, remote.Hash}, message)
+}
+
+// checkoutKeepingChanges points the current branch and the index to target.
+// Files the worktree still has in their version of from are updated to
+// target, files changed in the worktree are left as they are.
+func (g *GitOperations) checkoutKeepingChanges(from *object.Commit, target plumbing.Hash) error {
+	targetCommit, err := g.repo.CommitObject(target)
+	if err != nil {
+		return err
+	}
+	targetTree, err := targetCommit.Tree()
+	if err != nil {
+		return err
+	}
+	var fromTree *object.Tree
+	if from != nil {
+		if fromTree, err = from.Tree(); err != nil {
+			return err
+		}
+	}
+	changes, err := object.DiffTree(fromTree, targetTree)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		name := change.To.Name
+		if name == "" {
+			name = change.From.Name
+		}
+		current, err := g.worktreeHash(name)
+		if err != nil {
+			return err
+		}
+		if current != change.From.TreeEntry.Hash {
+			// changed locally, or already at the target version
+			continue
+		}
+		if err := g.writeWorktreeFile(name, targetTree); err != nil {
+			return err
+		}
+	}
+
+	worktree, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	return worktree.Reset(&git.ResetOptions{Commit: target, Mode: git.MixedReset})
+}
+
+// worktreeHash returns the blob hash of a worktree file, the zero hash when
+// it does not exist
+func (g *GitOperations) worktreeHash(name string) (plumbing.Hash, error) {
+	data, err := os.ReadFile(filepath.Join(g.config.Repo.RepoLocal.Path, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return plumbing.ZeroHash, nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return plumbing.ComputeHash(plumbing.BlobObject, data), nil
+}
+
+// writeWorktreeFile writes the version of tree of a file to the worktree,
+// removes it when tree does not have it
+func (g *GitOperations) writeWorktreeFile(name string, tree *object.Tree) error {
+	path := filepath.Join(g.config.Repo.RepoLocal.Path, filepath.FromSlash(name))
+	file, err := tree.File(name)
+	if errors.Is(err, object.ErrFileNotFound) {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	reader, err := file.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		_, err := io.Copy(w, reader)
+		return err
+	})
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/metrics"
+)
+
+var tracer = otel.Tracer("terraform-backend-gitops/storage")
+
+// stateAttributes describe the committed files, the first one is the state
+func stateAttributes(filePaths []string) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{attribute.StringSlice("git.files", filePaths)}
+	if len(filePaths) > 0 {
+		attrs = append(attrs, attribute.String("state.path", filePaths[0]))
+	}
+	return attrs
+}
+
+// endSpan records err on the span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceCommit runs a commit in its own span and records its metrics
+func (g *GitOperations) traceCommit(ctx context.Context, commit func() (string, error)) (string, error) {
+	_, span := tracer.Start(ctx, "git.commit")
+	start := time.Now()
+	hash, err := commit()
+	metrics.ObserveCommit(time.Since(start), err)
+	if err == nil {
+		span.SetAttributes(attribute.String("git.commit", hash))
+	}
+	endSpan(span, err)
+	return hash, err
+}
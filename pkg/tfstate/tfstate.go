@@ -0,0 +1,285 @@
+// Package tfstate reads the metadata of Terraform states (serial, lineage,
+// resource addresses) from a stream without keeping attribute values
+package tfstate
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// State is the metadata of a Terraform state
+type State struct {
+	Version          int    `json:"version"`
+	TerraformVersion string `json:"terraform_version"`
+	Serial           uint64 `json:"serial"`
+	Lineage          string `json:"lineage"`
+	// Resources are the resource instance addresses, as listed by
+	// `terraform state list`
+	Resources []string `json:"resources"`
+	// instances maps the resource instance addresses to a hash of their
+	// content, to tell changed instances apart without keeping the values
+	instances map[string][sha256.Size]byte
+	// outputs maps the output names to a hash of their content
+	outputs map[string][sha256.Size]byte
+}
+
+// Changes are the resource instances added, changed and removed between two
+// versions of a state
+type Changes struct {
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+	// Outputs are the names of the outputs added, changed or removed
+	Outputs []string `json:"outputs"`
+}
+
+// Diff compares the resource instances and outputs of two versions of a
+// state, a nil previous version is an empty state
+func Diff(previous, current *State) Changes {
+	changes := Changes{Added: []string{}, Changed: []string{}, Removed: []string{}, Outputs: []string{}}
+	if previous == nil {
+		previous = &State{}
+	}
+	for name, sum := range current.outputs {
+		if previousSum, ok := previous.outputs[name]; !ok || previousSum != sum {
+			changes.Outputs = append(changes.Outputs, name)
+		}
+	}
+	for name := range previous.outputs {
+		if _, ok := current.outputs[name]; !ok {
+			changes.Outputs = append(changes.Outputs, name)
+		}
+	}
+	sort.Strings(changes.Outputs)
+
+	for _, address := range current.Resources {
+		sum, ok := previous.instances[address]
+		if !ok {
+			changes.Added = append(changes.Added, address)
+		} else if sum != current.instances[address] {
+			changes.Changed = append(changes.Changed, address)
+		}
+	}
+	for _, address := range previous.Resources {
+		if _, ok := current.instances[address]; !ok {
+			changes.Removed = append(changes.Removed, address)
+		}
+	}
+	return changes
+}
+
+type resource struct {
+	Module    string            `json:"module"`
+	Mode      string            `json:"mode"`
+	Type      string            `json:"type"`
+	Name      string            `json:"name"`
+	Instances []json.RawMessage `json:"instances"`
+}
+
+type instance struct {
+	IndexKey json.RawMessage `json:"index_key"`
+}
+
+// Parse reads a single JSON value from r and returns its state metadata. The
+// resources are decoded one at a time, so memory use is bounded by the
+// largest resource instead of the whole state. Any valid JSON value is
+// accepted, values other than a state object return empty metadata. Data
+// after the value is an error.
+func Parse(r io.Reader) (*State, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	state := &State{
+		Resources: []string{},
+		instances: map[string][sha256.Size]byte{},
+		outputs:   map[string][sha256.Size]byte{},
+	}
+
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token == json.Delim('{') {
+		if err := parseObject(dec, state); err != nil {
+			return nil, err
+		}
+	} else if err := skipValue(dec, token); err != nil {
+		return nil, err
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after the state")
+		}
+		return nil, err
+	}
+	return state, nil
+}
+
+func parseObject(dec *json.Decoder, state *State) error {
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := token.(string)
+
+		switch key {
+		case "version":
+			err = decodeField(dec, &state.Version)
+		case "terraform_version":
+			err = decodeField(dec, &state.TerraformVersion)
+		case "serial":
+			err = decodeField(dec, &state.Serial)
+		case "lineage":
+			err = decodeField(dec, &state.Lineage)
+		case "resources":
+			err = parseResources(dec, state)
+		case "outputs":
+			err = parseOutputs(dec, state)
+		default:
+			var raw json.RawMessage
+			err = dec.Decode(&raw)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	// closing brace
+	_, err := dec.Token()
+	return err
+}
+
+func parseResources(dec *json.Decoder, state *State) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != json.Delim('[') {
+		return skipValue(dec, token)
+	}
+
+	for dec.More() {
+		var r resource
+		if err := decodeField(dec, &r); err != nil {
+			return err
+		}
+		if r.Type != "" {
+			r.add(state)
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
+
+// parseOutputs hashes the outputs one at a time, their values are not kept
+func parseOutputs(dec *json.Decoder, state *State) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != json.Delim('{') {
+		return skipValue(dec, token)
+	}
+
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name, _ := token.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		state.outputs[name] = sha256.Sum256(raw)
+	}
+	_, err = dec.Token()
+	return err
+}
+
+// decodeField decodes the next value into v, a value of an unexpected type
+// is skipped since only syntax errors make the document invalid
+func decodeField(dec *json.Decoder, v interface{}) error {
+	err := dec.Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return nil
+	}
+	return err
+}
+
+// skipValue reads the rest of a value whose first token was already read
+func skipValue(dec *json.Decoder, token json.Token) error {
+	depth := 0
+	for {
+		if delim, ok := token.(json.Delim); ok {
+			switch delim {
+			case '{', '[':
+				depth++
+			default:
+				depth--
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+
+		var err error
+		if token, err = dec.Token(); err != nil {
+			return err
+		}
+	}
+}
+
+// address returns the address of the resource, e.g.
+// module.vpc.data.aws_region.current
+func (r resource) address() string {
+	var b strings.Builder
+	if r.Module != "" {
+		b.WriteString(r.Module)
+		b.WriteByte('.')
+	}
+	if r.Mode == "data" {
+		b.WriteString("data.")
+	}
+	b.WriteString(r.Type)
+	b.WriteByte('.')
+	b.WriteString(r.Name)
+	return b.String()
+}
+
+// add adds every instance of the resource to the state
+func (r resource) add(state *State) {
+	address := r.address()
+	if len(r.Instances) == 0 {
+		state.Resources = append(state.Resources, address)
+		state.instances[address] = sha256.Sum256(nil)
+		return
+	}
+
+	for _, raw := range r.Instances {
+		var i instance
+		// the instance was already decoded as part of the resource
+		_ = json.Unmarshal(raw, &i)
+		state.Resources = append(state.Resources, address+i.key())
+		state.instances[address+i.key()] = sha256.Sum256(raw)
+	}
+}
+
+// key formats the index key of count ([0]) and for_each (["a"]) instances
+func (i instance) key() string {
+	if len(i.IndexKey) == 0 || string(i.IndexKey) == "null" {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(i.IndexKey, &s); err == nil {
+		return "[" + strconv.Quote(s) + "]"
+	}
+	return "[" + string(i.IndexKey) + "]"
+}
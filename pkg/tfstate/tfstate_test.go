@@ -0,0 +1,106 @@
+package tfstate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testState = `{
+  "version": 4,
+  "terraform_version": "1.9.5",
+  "serial": 42,
+  "lineage": "0c7d5f0e-1111-2222-3333-444455556666",
+  "outputs": {"password": {"value": "hunter2", "type": "string", "sensitive": true}},
+  "resources": [
+    {
+      "mode": "data",
+      "type": "aws_region",
+      "name": "current",
+      "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]",
+      "instances": [{"schema_version": 0, "attributes": {"name": "eu-west-1"}}]
+    },
+    {
+      "module": "module.vpc",
+      "mode": "managed",
+      "type": "aws_subnet",
+      "name": "private",
+      "instances": [
+        {"index_key": 0, "attributes": {"id": "subnet-1"}},
+        {"index_key": 1, "attributes": {"id": "subnet-2"}}
+      ]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_iam_user",
+      "name": "this",
+      "instances": [{"index_key": "alice", "attributes": {"name": "alice"}}]
+    }
+  ],
+  "check_results": null
+}`
+
+func TestParse(t *testing.T) {
+	state, err := Parse(strings.NewReader(testState))
+	require.NoError(t, err)
+
+	assert.Equal(t, 4, state.Version)
+	assert.Equal(t, "1.9.5", state.TerraformVersion)
+	assert.Equal(t, uint64(42), state.Serial)
+	assert.Equal(t, "0c7d5f0e-1111-2222-3333-444455556666", state.Lineage)
+	assert.Equal(t, []string{
+		"data.aws_region.current",
+		"module.vpc.aws_subnet.private[0]",
+		"module.vpc.aws_subnet.private[1]",
+		`aws_iam_user.this["alice"]`,
+	}, state.Resources)
+}
+
+func TestParse_AnyJSON(t *testing.T) {
+	for _, doc := range []string{`[]`, `"state"`, `{"serial": "not a number", "resources": {}}`, `{}`} {
+		state, err := Parse(strings.NewReader(doc))
+		require.NoError(t, err, doc)
+		assert.Empty(t, state.Resources, doc)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, doc := range []string{``, `{"serial": 1`, `{"resources": [{"type": }]}`, `{} {}`, `{"serial" 1}`} {
+		_, err := Parse(strings.NewReader(doc))
+		assert.Error(t, err, doc)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	previous, err := Parse(strings.NewReader(testState))
+	require.NoError(t, err)
+
+	current, err := Parse(strings.NewReader(strings.NewReplacer(
+		`"subnet-2"`, `"subnet-3"`,
+		`"alice"`, `"bob"`,
+		`"hunter2"`, `"hunter3"`,
+	).Replace(testState)))
+	require.NoError(t, err)
+
+	changes := Diff(previous, current)
+	assert.Equal(t, []string{`aws_iam_user.this["bob"]`}, changes.Added)
+	assert.Equal(t, []string{"module.vpc.aws_subnet.private[1]"}, changes.Changed)
+	assert.Equal(t, []string{`aws_iam_user.this["alice"]`}, changes.Removed)
+	assert.Equal(t, []string{"password"}, changes.Outputs)
+
+	changes = Diff(previous, previous)
+	assert.Empty(t, changes.Added)
+	assert.Empty(t, changes.Outputs)
+
+	withoutOutputs, err := Parse(strings.NewReader(strings.Replace(testState, `"outputs"`, `"removed_outputs"`, 1)))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"password"}, Diff(previous, withoutOutputs).Outputs)
+
+	changes = Diff(nil, current)
+	assert.Len(t, changes.Added, 4)
+	assert.Empty(t, changes.Changed)
+	assert.Empty(t, changes.Removed)
+	assert.Equal(t, []string{"password"}, changes.Outputs)
+}
@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// loadQueue reads the deliveries persisted by saveQueue, none when path is
+// empty or the file does not exist
+func loadQueue(path string) ([]*delivery, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook queue: %w", err)
+	}
+	var queue []*delivery
+	if err := json.Unmarshal(data, &queue); err != nil {
+		return nil, fmt.Errorf("failed to parse webhook queue %s: %w", path, err)
+	}
+	return queue, nil
+}
+
+// saveQueue replaces the queue file, the previous one stays intact until the
+// new one is complete
+func saveQueue(path string, queue []*delivery) error {
+	if path == "" {
+		return nil
+	}
+	if queue == nil {
+		queue = []*delivery{}
+	}
+	data, err := json.Marshal(queue)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,528 @@
+// Package webhook delivers state and lock events to the configured targets
+// as JSON payloads signed with HMAC-SHA256, retrying failed deliveries with
+// exponential backoff from a queue persisted across restarts
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+)
+
+// Event types
+const (
+	EventStateChanged    = "state.changed"
+	EventLockAcquired    = "lock.acquired"
+	EventLockHeldTooLong = "lock.held_too_long"
+	EventGitPushFailed   = "git.push_failed"
+)
+
+// EventTypes are the event types a target can filter on
+var EventTypes = []string{EventStateChanged, EventLockAcquired, EventLockHeldTooLong, EventGitPushFailed}
+
+// Headers of a delivery
+const (
+	HeaderEvent     = "X-TBG-Event"
+	HeaderDelivery  = "X-TBG-Delivery"
+	HeaderSignature = "X-TBG-Signature-256"
+)
+
+const (
+	defaultMaxAttempts    = 10
+	defaultInitialBackoff = 5 * time.Second
+	defaultMaxBackoff     = time.Hour
+	defaultTimeout        = 10 * time.Second
+	defaultLogSize        = 100
+	userAgent             = "terraform-backend-gitops"
+	// saveInterval is the least time between two writes of the queue file
+	saveInterval = 100 * time.Millisecond
+)
+
+// Event is the payload of a delivery
+type Event struct {
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// State is the state path of state and lock events
+	State string `json:"state,omitempty"`
+	Data  any    `json:"data,omitempty"`
+}
+
+// Delivery is an attempt to deliver an event, listed by the delivery log
+type Delivery struct {
+	ID      string    `json:"id"`
+	EventID string    `json:"eventId"`
+	Type    string    `json:"type"`
+	Target  string    `json:"target"`
+	State   string    `json:"state,omitempty"`
+	Attempt int       `json:"attempt"`
+	Time    time.Time `json:"time"`
+	// Status is the response status, 0 when no response was received
+	Status    int    `json:"status"`
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+	// NextAttempt is set when the delivery is retried
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+}
+
+// delivery is a queued event of a target
+type delivery struct {
+	ID          string          `json:"id"`
+	EventID     string          `json:"eventId"`
+	Type        string          `json:"type"`
+	Target      string          `json:"target"`
+	State       string          `json:"state,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+}
+
+type target struct {
+	config.WebhookTarget
+	secret string
+	events map[string]bool
+	// wake signals the worker of the target a delivery was queued
+	wake chan struct{}
+}
+
+// matches reports whether the target receives the event
+func (t *target) matches(eventType, state string) bool {
+	if len(t.events) > 0 && !t.events[eventType] {
+		return false
+	}
+	if len(t.States) == 0 {
+		return true
+	}
+	// events without a state, e.g. failed pushes, are not filtered by path
+	if state == "" {
+		return true
+	}
+	for _, pattern := range t.States {
+		if matchGlob(pattern, state) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dispatcher queues the events of the matching targets and delivers them in
+// the background, every target on its own worker so a slow one does not hold
+// up the others. The queue file is written in the background too.
+type Dispatcher struct {
+	targets        map[string]*target
+	client         *http.Client
+	logger         *zap.Logger
+	queuePath      string
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	logSize        int
+
+	mu    sync.Mutex
+	queue []*delivery
+	log   []Delivery
+
+	// changed signals the queue file is to be written
+	changed chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// Validate checks the webhook targets
+func Validate(cfg config.Webhooks) error {
+	var errList []error
+	names := map[string]bool{}
+	known := map[string]bool{}
+	for _, eventType := range EventTypes {
+		known[eventType] = true
+	}
+	for i, t := range cfg.Targets {
+		if t.Name == "" {
+			errList = append(errList, fmt.Errorf("webhook target %d: name is required", i))
+		} else if names[t.Name] {
+			errList = append(errList, fmt.Errorf("webhook target %s: duplicate name", t.Name))
+		}
+		names[t.Name] = true
+
+		if u, err := url.Parse(t.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errList = append(errList, fmt.Errorf("webhook target %s: url must be an http(s) URL", t.Name))
+		}
+		for _, eventType := range t.Events {
+			if !known[eventType] {
+				errList = append(errList, fmt.Errorf("webhook target %s: unknown event %q", t.Name, eventType))
+			}
+		}
+		for _, pattern := range t.States {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errList = append(errList, fmt.Errorf("webhook target %s: invalid state pattern %q", t.Name, pattern))
+			}
+		}
+	}
+	return errors.Join(errList...)
+}
+
+// New starts delivering the events of the persisted queue, it returns nil
+// when no target is configured
+func New(cfg config.Webhooks, logger *zap.Logger) (*Dispatcher, error) {
+	if len(cfg.Targets) == 0 {
+		return nil, nil
+	}
+	if err := Validate(cfg); err != nil {
+		return nil, err
+	}
+
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	d := &Dispatcher{
+		targets:        map[string]*target{},
+		client:         &http.Client{Timeout: timeout},
+		logger:         logger,
+		queuePath:      cfg.QueuePath,
+		maxAttempts:    cfg.MaxAttempts,
+		initialBackoff: time.Duration(cfg.InitialBackoff) * time.Second,
+		maxBackoff:     time.Duration(cfg.MaxBackoff) * time.Second,
+		logSize:        cfg.DeliveryLogSize,
+		changed:        make(chan struct{}, 1),
+	}
+	if d.maxAttempts <= 0 {
+		d.maxAttempts = defaultMaxAttempts
+	}
+	if d.initialBackoff <= 0 {
+		d.initialBackoff = defaultInitialBackoff
+	}
+	if d.maxBackoff <= 0 {
+		d.maxBackoff = defaultMaxBackoff
+	}
+	if d.logSize <= 0 {
+		d.logSize = defaultLogSize
+	}
+
+	for _, t := range cfg.Targets {
+		compiled := &target{WebhookTarget: t, secret: os.ExpandEnv(t.Secret), events: map[string]bool{}, wake: make(chan struct{}, 1)}
+		if compiled.secret == "" {
+			logger.Warn("webhook target without secret, payloads are not signed", zap.String("target", t.Name))
+		}
+		for _, eventType := range t.Events {
+			compiled.events[eventType] = true
+		}
+		d.targets[t.Name] = compiled
+	}
+
+	queue, err := loadQueue(d.queuePath)
+	if err != nil {
+		return nil, err
+	}
+	// deliveries of removed targets are dropped
+	for _, del := range queue {
+		if d.targets[del.Target] != nil {
+			d.queue = append(d.queue, del)
+		}
+	}
+	if len(d.queue) > 0 {
+		logger.Info("resuming webhook deliveries", zap.Int("pending", len(d.queue)))
+	}
+
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.wg.Add(len(d.targets) + 1)
+	for _, t := range d.targets {
+		go d.run(t)
+	}
+	go d.persist()
+	return d, nil
+}
+
+// Publish queues the event for every matching target
+func (d *Dispatcher) Publish(eventType, state string, data any) {
+	event := Event{ID: uuid.New().String(), Type: eventType, Time: time.Now().UTC(), State: state, Data: data}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		d.logger.Error("failed to encode webhook event", zap.String("type", eventType), zap.Error(err))
+		return
+	}
+
+	var queued []*target
+	d.mu.Lock()
+	for _, t := range d.targets {
+		if !t.matches(eventType, state) {
+			continue
+		}
+		d.queue = append(d.queue, &delivery{
+			ID:          uuid.New().String(),
+			EventID:     event.ID,
+			Type:        eventType,
+			Target:      t.Name,
+			State:       state,
+			Payload:     payload,
+			NextAttempt: event.Time,
+		})
+		queued = append(queued, t)
+	}
+	d.mu.Unlock()
+
+	if len(queued) > 0 {
+		signal(d.changed)
+	}
+	for _, t := range queued {
+		signal(t.wake)
+	}
+}
+
+// signal notifies a worker without waiting, a pending notification covers
+// the new one
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Deliveries returns the delivery log, newest first, of a target or of all
+// of them when target is empty
+func (d *Dispatcher) Deliveries(target string) []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	deliveries := []Delivery{}
+	for i := len(d.log) - 1; i >= 0; i-- {
+		if target == "" || d.log[i].Target == target {
+			deliveries = append(deliveries, d.log[i])
+		}
+	}
+	return deliveries
+}
+
+// Pending returns the number of queued deliveries
+func (d *Dispatcher) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.queue)
+}
+
+// Close stops delivering and writes the queue file, the pending deliveries
+// stay queued for the next start
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.cancel()
+	stopped := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return d.save()
+}
+
+// run delivers the deliveries of a target one at a time, in the order they
+// were queued once they are due
+func (d *Dispatcher) run(t *target) {
+	defer d.wg.Done()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		del, next := d.due(t.Name)
+		if del != nil {
+			d.deliver(d.ctx, t, del)
+			if d.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-t.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// due returns the first delivery of a target to attempt now, or the time of
+// its next one
+func (d *Dispatcher) due(target string) (*delivery, time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	var next time.Time
+	for _, del := range d.queue {
+		if del.Target != target {
+			continue
+		}
+		if !del.NextAttempt.After(now) {
+			return del, time.Time{}
+		}
+		if next.IsZero() || del.NextAttempt.Before(next) {
+			next = del.NextAttempt
+		}
+	}
+	return nil, next
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, t *target, del *delivery) {
+	status, err := d.send(ctx, t, del)
+	// a delivery interrupted by Close is attempted again on the next start
+	if ctx.Err() != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	del.Attempts++
+	record := Delivery{
+		ID:        del.ID,
+		EventID:   del.EventID,
+		Type:      del.Type,
+		Target:    del.Target,
+		State:     del.State,
+		Attempt:   del.Attempts,
+		Time:      time.Now().UTC(),
+		Status:    status,
+		Delivered: err == nil,
+	}
+	if err != nil {
+		record.Error = err.Error()
+		if del.Attempts < d.maxAttempts {
+			del.NextAttempt = time.Now().Add(d.backoff(del.Attempts))
+			next := del.NextAttempt.UTC()
+			record.NextAttempt = &next
+			d.logger.Warn("webhook delivery failed, retrying",
+				zap.String("target", del.Target), zap.String("type", del.Type),
+				zap.Int("attempt", del.Attempts), zap.Time("next_attempt", next), zap.Error(err))
+		} else {
+			d.logger.Error("webhook delivery failed, giving up",
+				zap.String("target", del.Target), zap.String("type", del.Type),
+				zap.Int("attempts", del.Attempts), zap.Error(err))
+			d.removeLocked(del)
+		}
+	} else {
+		d.removeLocked(del)
+	}
+
+	d.log = append(d.log, record)
+	if len(d.log) > d.logSize {
+		d.log = d.log[len(d.log)-d.logSize:]
+	}
+	signal(d.changed)
+}
+
+// send posts the payload, a response other than 2xx is an error
+func (d *Dispatcher) send(ctx context.Context, t *target, del *delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(del.Payload))
+	if err != nil {
+		return 0, err
+	}
+	for name, value := range t.Headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(HeaderEvent, del.Type)
+	req.Header.Set(HeaderDelivery, del.ID)
+	if t.secret != "" {
+		req.Header.Set(HeaderSignature, Sign(t.secret, del.Payload))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff returns the delay after the given number of failed attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.initialBackoff
+	for i := 1; i < attempts && delay < d.maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, d.maxBackoff)
+}
+
+func (d *Dispatcher) removeLocked(del *delivery) {
+	for i, queued := range d.queue {
+		if queued == del {
+			d.queue = append(d.queue[:i], d.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// persist writes the queue file after it changed, at most every
+// saveInterval, so publishing and delivering do not wait for the disk
+func (d *Dispatcher) persist() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-d.changed:
+		}
+		d.save()
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(saveInterval):
+		}
+	}
+}
+
+// save writes a copy of the queue, taken under d.mu, to the queue file
+func (d *Dispatcher) save() error {
+	d.mu.Lock()
+	queue := make([]*delivery, 0, len(d.queue))
+	for _, del := range d.queue {
+		copied := *del
+		queue = append(queue, &copied)
+	}
+	d.mu.Unlock()
+
+	if err := saveQueue(d.queuePath, queue); err != nil {
+		d.logger.Error("failed to persist webhook queue", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// Sign returns the signature header value of a payload, the receiver
+// compares it to the HMAC-SHA256 of the raw body with the shared secret
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,232 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/kholisrag/terraform-backend-gitops/pkg/config"
+)
+
+type receiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	// fail is the number of requests answered with 503
+	fail int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	if r.fail > 0 {
+		r.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"env/*.tfstate", "env/prod.tfstate", true},
+		{"env/*.tfstate", "env/eu/prod.tfstate", false},
+		{"env/**", "env/eu/prod.tfstate", true},
+		{"**/prod.tfstate", "prod.tfstate", true},
+		{"**/prod.tfstate", "env/eu/prod.tfstate", true},
+		{"env/**/prod.tfstate", "env/prod.tfstate", true},
+		{"env/**/prod.tfstate", "other/prod.tfstate", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, matchGlob(tt.pattern, tt.name), "%s %s", tt.pattern, tt.name)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	err := Validate(config.Webhooks{Targets: []config.WebhookTarget{
+		{Name: "chat", URL: "https://chat.example.com/hook"},
+		{Name: "chat", URL: "ftp://example.com", Events: []string{"state.deleted"}, States: []string{"["}},
+		{URL: "https://example.com"},
+	}})
+	require.Error(t, err)
+	for _, want := range []string{"duplicate name", "url must be an http(s) URL", `unknown event "state.deleted"`, `invalid state pattern "["`, "name is required"} {
+		assert.Contains(t, err.Error(), want)
+	}
+}
+
+func TestDispatcher_Deliver(t *testing.T) {
+	prod, all := &receiver{}, &receiver{}
+	prodServer, allServer := httptest.NewServer(prod), httptest.NewServer(all)
+	defer prodServer.Close()
+	defer allServer.Close()
+
+	d, err := New(config.Webhooks{
+		QueuePath: filepath.Join(t.TempDir(), "queue.json"),
+		Targets: []config.WebhookTarget{
+			{Name: "prod", URL: prodServer.URL, Secret: "s3cret", Events: []string{EventStateChanged}, States: []string{"prod/**"}, Headers: map[string]string{"X-Team": "infra"}},
+			{Name: "all", URL: allServer.URL},
+		},
+	}, zap.NewNop())
+	require.NoError(t, err)
+	defer d.Close(context.Background())
+
+	d.Publish(EventStateChanged, "prod/eu/app.tfstate", map[string]int{"serial": 2})
+	d.Publish(EventStateChanged, "dev/app.tfstate", nil)
+	d.Publish(EventLockAcquired, "prod/eu/app.tfstate", nil)
+
+	require.Eventually(t, func() bool { return prod.count() == 1 && all.count() == 3 }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return d.Pending() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	req, body := prod.requests[0], prod.bodies[0]
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, EventStateChanged, req.Header.Get(HeaderEvent))
+	assert.Equal(t, "infra", req.Header.Get("X-Team"))
+	assert.Equal(t, Sign("s3cret", body), req.Header.Get(HeaderSignature))
+	// an unsigned target gets no signature
+	assert.Empty(t, all.requests[0].Header.Get(HeaderSignature))
+
+	var event Event
+	require.NoError(t, json.Unmarshal(body, &event))
+	assert.Equal(t, EventStateChanged, event.Type)
+	assert.Equal(t, "prod/eu/app.tfstate", event.State)
+	assert.Equal(t, map[string]any{"serial": float64(2)}, event.Data)
+
+	deliveries := d.Deliveries("prod")
+	require.Len(t, deliveries, 1)
+	assert.True(t, deliveries[0].Delivered)
+	assert.Equal(t, http.StatusNoContent, deliveries[0].Status)
+	assert.Len(t, d.Deliveries(""), 4)
+}
+
+func TestDispatcher_Retry(t *testing.T) {
+	r := &receiver{fail: 2}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	d, err := New(config.Webhooks{
+		Targets:        []config.WebhookTarget{{Name: "flaky", URL: server.URL}},
+		InitialBackoff: 1,
+		MaxAttempts:    3,
+	}, zap.NewNop())
+	require.NoError(t, err)
+	defer d.Close(context.Background())
+	// backoff in milliseconds for the test
+	d.initialBackoff = 10 * time.Millisecond
+
+	d.Publish(EventGitPushFailed, "", map[string]string{"remote": "origin"})
+	require.Eventually(t, func() bool { return r.count() == 3 && d.Pending() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	deliveries := d.Deliveries("")
+	require.Len(t, deliveries, 3)
+	assert.True(t, deliveries[0].Delivered)
+	assert.Equal(t, 3, deliveries[0].Attempt)
+	assert.False(t, deliveries[1].Delivered)
+	assert.Equal(t, http.StatusServiceUnavailable, deliveries[1].Status)
+	assert.NotNil(t, deliveries[1].NextAttempt)
+	// every attempt sends the same delivery
+	assert.Equal(t, r.requests[0].Header.Get(HeaderDelivery), r.requests[2].Header.Get(HeaderDelivery))
+}
+
+func TestDispatcher_SlowTarget(t *testing.T) {
+	release := make(chan struct{})
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer slowServer.Close()
+	defer close(release)
+	fast := &receiver{}
+	fastServer := httptest.NewServer(fast)
+	defer fastServer.Close()
+
+	queuePath := filepath.Join(t.TempDir(), "queue.json")
+	d, err := New(config.Webhooks{
+		QueuePath: queuePath,
+		Targets: []config.WebhookTarget{
+			{Name: "slow", URL: slowServer.URL},
+			{Name: "fast", URL: fastServer.URL},
+		},
+	}, zap.NewNop())
+	require.NoError(t, err)
+
+	// the fast target gets both events while the slow one hangs on the first
+	d.Publish(EventStateChanged, "prod/app.tfstate", nil)
+	d.Publish(EventLockAcquired, "prod/app.tfstate", nil)
+	require.Eventually(t, func() bool { return fast.count() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// the queue file is written in the background
+	require.Eventually(t, func() bool {
+		queue, err := loadQueue(queuePath)
+		return err == nil && len(queue) == 2 && queue[0].Target == "slow" && queue[1].Target == "slow"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, d.Close(ctx))
+	queue, err := loadQueue(queuePath)
+	require.NoError(t, err)
+	assert.Len(t, queue, 2)
+}
+
+func TestDispatcher_Backoff(t *testing.T) {
+	d := &Dispatcher{initialBackoff: 5 * time.Second, maxBackoff: time.Minute}
+	assert.Equal(t, 5*time.Second, d.backoff(1))
+	assert.Equal(t, 10*time.Second, d.backoff(2))
+	assert.Equal(t, 40*time.Second, d.backoff(4))
+	assert.Equal(t, time.Minute, d.backoff(5))
+	assert.Equal(t, time.Minute, d.backoff(50))
+}
+
+func TestDispatcher_PersistentQueue(t *testing.T) {
+	r := &receiver{fail: 1}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	cfg := config.Webhooks{
+		QueuePath:      filepath.Join(t.TempDir(), "queue.json"),
+		Targets:        []config.WebhookTarget{{Name: "chat", URL: server.URL}},
+		InitialBackoff: 3600,
+	}
+	d, err := New(cfg, zap.NewNop())
+	require.NoError(t, err)
+	d.Publish(EventLockHeldTooLong, "prod/app.tfstate", nil)
+	require.Eventually(t, func() bool { return r.count() == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return len(d.Deliveries("")) == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, d.Close(context.Background()))
+
+	queue, err := loadQueue(cfg.QueuePath)
+	require.NoError(t, err)
+	require.Len(t, queue, 1)
+	assert.Equal(t, 1, queue[0].Attempts)
+
+	// the retry survives the restart, due now
+	queue[0].NextAttempt = time.Now()
+	require.NoError(t, saveQueue(cfg.QueuePath, queue))
+	d, err = New(cfg, zap.NewNop())
+	require.NoError(t, err)
+	defer d.Close(context.Background())
+	require.Eventually(t, func() bool { return r.count() == 2 && d.Pending() == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, r.bodies[0], r.bodies[1])
+}